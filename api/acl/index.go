@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/workspace"
+)
+
+// EntryRequest is the body of POST /api/acl. Exactly one of FileID and
+// FolderID is set.
+//
+//	{"folderId":"1712345678901","userId":"<uuid>","access":"read"}
+type EntryRequest struct {
+	FileID   string `json:"fileId,omitempty"`
+	FolderID string `json:"folderId,omitempty"`
+	UserID   string `json:"userId"`
+	Access   string `json:"access"`
+}
+
+// EntryInfo is one access list entry.
+type EntryInfo struct {
+	UserID    string `json:"userId"`
+	Access    string `json:"access"`
+	CreatedAt string `json:"createdAt,omitempty"`
+}
+
+// Handler shows and changes the access list of a file or folder, named by
+// ?fileId= or ?folderId=. Anyone who can read the item sees what they may
+// do with it; only owners see and change the entries.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+
+	var req EntryRequest
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		req.FileID, req.FolderID, req.UserID = q.Get("fileId"), q.Get("folderId"), q.Get("userId")
+	}
+	if (req.FileID == "") == (req.FolderID == "") {
+		http.Error(w, "Exactly one of fileId and folderId is required", http.StatusBadRequest)
+		return
+	}
+	table, id := "files", req.FileID
+	if req.FolderID != "" {
+		table, id = "folders", req.FolderID
+	}
+	if r.Method != "GET" && !access.Can(workspace.Owner) {
+		writeError(w, workspace.ErrForbidden)
+		return
+	}
+	if err := workspace.Owns(access.Client, table, id); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		listEntries(w, access, table, id)
+	case "POST":
+		e, err := acl.Set(access.Client, table, id, req.UserID, req.Access)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("[ACL] %s %s: %s has %s\n", table, id, e.UserID, e.Access)
+		writeJSON(w, EntryInfo{UserID: e.UserID, Access: e.Access, CreatedAt: e.CreatedAt})
+	case "DELETE":
+		if err := acl.Remove(access.Client, table, id, req.UserID); err != nil {
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("[ACL] %s %s: removed %s\n", table, id, req.UserID)
+		writeJSON(w, map[string]interface{}{"ok": true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listEntries answers with the caller's own access to the item, and the
+// entries when the caller is an owner.
+func listEntries(w http.ResponseWriter, access *workspace.Access, table, id string) {
+	k, err := acl.New(access)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	level, err := k.Level(table, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if level == acl.Deny {
+		writeError(w, meta.ErrNotFound)
+		return
+	}
+	out := []EntryInfo{}
+	if access.Can(workspace.Owner) {
+		rows, err := acl.List(access.Client, table, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for _, e := range rows {
+			out = append(out, EntryInfo{UserID: e.UserID, Access: e.Access, CreatedAt: e.CreatedAt})
+		}
+	}
+	enabled, err := acl.Installed(access.Client)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"access": level, "entries": out, "enabled": enabled})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, acl.ErrAccess):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, acl.ErrDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		workspace.WriteError(w, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,135 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/workspace"
+)
+
+// maxItems caps the IDs one request names. Folders bring everything below
+// them, so this only bounds the lookups.
+const maxItems = 1000
+
+// ArchiveRequest is the body of POST /api/archive. Format is "zip", the
+// default, or "tar.gz". Name is the archive's file name without its
+// extension; it defaults to the one item's name, or the folder the items
+// have in common.
+//
+//	{"fileIds":["1712345678901"],"folderIds":["1712345678902"],"format":"tar.gz"}
+type ArchiveRequest struct {
+	FileIDs   []string `json:"fileIds"`
+	FolderIDs []string `json:"folderIds"`
+	Format    string   `json:"format,omitempty"`
+	Name      string   `json:"name,omitempty"`
+}
+
+// Handler streams files and folders as one archive, decrypting one chunk
+// at a time, so memory stays at about a chunk whatever the total size.
+// Paths inside follow the folders; reading everything needs read access.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ArchiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	n := len(req.FileIDs) + len(req.FolderIDs)
+	if n == 0 {
+		http.Error(w, "fileIds or folderIds required", http.StatusBadRequest)
+		return
+	}
+	if n > maxItems {
+		http.Error(w, fmt.Sprintf("At most %d files and folders at a time", maxItems), http.StatusBadRequest)
+		return
+	}
+	var write func(io.Writer, *meta.Client, *meta.Tree) error
+	var ext, mimeType string
+	switch req.Format {
+	case "", "zip":
+		write, ext, mimeType = content.WriteZip, ".zip", "application/zip"
+	case "tar.gz", "tgz":
+		write, ext, mimeType = content.WriteTarGz, ".tar.gz", "application/gzip"
+	default:
+		http.Error(w, "format must be zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	checker, err := acl.New(access)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	for _, id := range req.FileIDs {
+		if err := checker.Require("files", id, acl.Read); err != nil {
+			workspace.WriteError(w, err)
+			return
+		}
+	}
+	for _, id := range req.FolderIDs {
+		if err := checker.RequireTree(id, acl.Read); err != nil {
+			workspace.WriteError(w, err)
+			return
+		}
+	}
+
+	t, err := access.Client.GetSelection(req.FileIDs, req.FolderIDs)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	switch {
+	case name != "":
+	case len(req.FolderIDs) == 1 && len(req.FileIDs) == 0:
+		name = t.Root.Name
+	case len(req.FileIDs) == 1 && len(req.FolderIDs) == 0 && len(t.Files) == 1:
+		name = t.Files[0].File.Name
+	case t.Root.Name != "":
+		name = t.Root.Name
+	default:
+		name = "TEDDRIVE"
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ext}))
+	w.Header().Set("Cache-Control", "no-store")
+
+	fmt.Printf("[ARCHIVE] %s%s: %d files, %d folders, %d bytes\n", name, ext, len(t.Files), len(t.Folders), t.Size())
+	if err := write(w, access.Client, t); err != nil {
+		// The status line is already sent; drop the connection so the
+		// browser reports a failed download instead of a truncated archive.
+		fmt.Printf("[ARCHIVE] %s%s failed: %v\n", name, ext, err)
+		panic(http.ErrAbortHandler)
+	}
+}
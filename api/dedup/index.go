@@ -0,0 +1,98 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/dedup"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/workspace"
+)
+
+type UploadResponse struct {
+	Link  string      `json:"link"`
+	Stats dedup.Stats `json:"stats"`
+}
+
+// Handler stores one upload window as content-defined chunks, uploading only
+// the chunks the index doesn't already have. The returned link is the chunk
+// group that /api/download reassembles.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers first
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Println("[DEDUP] Upload handler started")
+
+	if !dedup.Enabled() {
+		http.Error(w, "Dedup not configured - missing DEDUP_SECRET", http.StatusServiceUnavailable)
+		return
+	}
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	err = r.ParseMultipartForm(25 << 20)
+	if err != nil {
+		fmt.Printf("[ERROR] Parse form failed: %v\n", err)
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// Chunks are keyed, stored and counted per workspace.
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err == nil {
+		err = acl.Require(access, "folders", r.FormValue("folderId"), acl.Write)
+	}
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	client = access.Client
+
+	fileName := r.FormValue("fileName")
+	if fileName == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("chunkData")
+	if err != nil {
+		fmt.Printf("[ERROR] Get file failed: %v\n", err)
+		http.Error(w, "No file provided", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	group, stats, err := dedup.Store(client, fileName, file)
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		quota.WriteError(w, err)
+		return
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Upload failed: %v\n", err)
+		http.Error(w, fmt.Sprintf("Dedup upload failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadResponse{Link: group.String(), Stats: stats})
+}
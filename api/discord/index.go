@@ -1,20 +1,20 @@
 package handler
 
 import (
-    "bytes"
-    "crypto/aes"
-    "crypto/cipher"
-    "crypto/rand"
     "encoding/base64"
     "encoding/json"
     "fmt"
     "io"
-    "mime/multipart"
     "net/http"
     "os"
-    "regexp"
     "strings"
-    "time"
+
+    "teddrive-web/lib/acl"
+    "teddrive-web/lib/messages"
+    "teddrive-web/lib/meta"
+    "teddrive-web/lib/quota"
+    "teddrive-web/lib/storage"
+    "teddrive-web/lib/workspace"
 )
 
 type UploadResponse struct {
@@ -25,7 +25,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
     // Set CORS headers first
     w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-    w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+    w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
     
     if r.Method == "OPTIONS" {
         w.WriteHeader(http.StatusOK)
@@ -40,9 +40,41 @@ func Handler(w http.ResponseWriter, r *http.Request) {
     // Immediate logging
     fmt.Println("[DISCORD] Upload handler started")
 
+    // Parse form - Discord supports up to 25MB
+    err := r.ParseMultipartForm(25 << 20) // 25MB limit for Discord
+    if err != nil {
+        fmt.Printf("[ERROR] Parse form failed: %v\n", err)
+        http.Error(w, "Parse form failed", http.StatusBadRequest)
+        return
+    }
+    defer r.MultipartForm.RemoveAll()
+
+    fmt.Println("[PARSE] Form parsed successfully")
+
+    // The caller's workspace decides where the chunk goes and whose quota
+    // it counts against. Without Supabase there are no workspaces, and
+    // nothing is counted.
+    client, _ := meta.FromEnv()
+    if client != nil {
+        // Uploads need write access to the folder they go into; the
+        // access list can allow that beyond the caller's role.
+        access, err := workspace.Resolve(client, r, workspace.Guest)
+        if err == nil {
+            err = acl.Require(access, "folders", r.FormValue("folderId"), acl.Write)
+        }
+        if err != nil {
+            workspace.WriteError(w, err)
+            return
+        }
+        client = access.Client
+    }
+
     // Check Discord environment variables
     token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
-    channelID := strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    channelID := client.Target("discord")
+    if channelID == "" {
+        channelID = strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+    }
     
     fmt.Printf("[DEBUG] Token length: %d\n", len(token))
     fmt.Printf("[DEBUG] Channel ID: %s\n", channelID)
@@ -57,17 +89,6 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
     fmt.Println("[ENV] Discord credentials OK")
 
-    // Parse form - Discord supports up to 25MB
-    err := r.ParseMultipartForm(25 << 20) // 25MB limit for Discord
-    if err != nil {
-        fmt.Printf("[ERROR] Parse form failed: %v\n", err)
-        http.Error(w, "Parse form failed", http.StatusBadRequest)
-        return
-    }
-    defer r.MultipartForm.RemoveAll()
-
-    fmt.Println("[PARSE] Form parsed successfully")
-
     // Get form values
     keyBase64 := r.FormValue("keyBase64")
     fileName := r.FormValue("fileName")
@@ -110,117 +131,51 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
     fmt.Println("[CRYPTO] Key decoded")
 
-    // Encrypt
-    block, err := aes.NewCipher(key)
+    // Encrypt (nonce + ciphertext), compressing first when asked to
+    var encryptedData []byte
+    if r.FormValue("compress") == "1" {
+        encryptedData, err = storage.SealCompressed(key, fileData, fileName)
+    } else {
+        encryptedData, err = storage.SealChunk(key, fileData)
+    }
     if err != nil {
         http.Error(w, "Cipher error", http.StatusInternalServerError)
         return
     }
 
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        http.Error(w, "GCM error", http.StatusInternalServerError)
+    fmt.Printf("[ENCRYPT] Encrypted to %d bytes\n", len(encryptedData))
+
+    // Book the bytes against the storage quota
+    stored := int64(len(encryptedData))
+    if err := quota.Reserve(client, quota.Tenant(client), "discord", stored); err != nil {
+        quota.WriteError(w, err)
         return
     }
 
-    nonce := make([]byte, gcm.NonceSize())
-    rand.Read(nonce)
-
-    ciphertext := gcm.Seal(nil, nonce, fileData, nil)
-    
-    // Combine nonce + ciphertext
-    encryptedData := append(nonce, ciphertext...)
-
-    fmt.Printf("[ENCRYPT] Encrypted to %d bytes\n", len(encryptedData))
-
     // Upload to Discord
-    link, err := uploadToDiscord(fileName, encryptedData, token, channelID)
+    loc, err := storage.NewDiscord(token, channelID).Upload(fileName, encryptedData)
     if err != nil {
         fmt.Printf("[ERROR] Upload failed: %v\n", err)
+        if err := quota.Release(client, quota.Tenant(client), "discord", stored); err != nil {
+            fmt.Printf("[WARN] Releasing quota failed: %v\n", err)
+        }
         // Return more detailed error to frontend
         errorMsg := fmt.Sprintf("Discord upload failed: %v", err)
         http.Error(w, errorMsg, http.StatusInternalServerError)
         return
     }
 
-    fmt.Printf("[SUCCESS] Uploaded: %s\n", link)
-
-    // Send response
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(UploadResponse{Link: link})
-}
-
-func uploadToDiscord(fileName string, data []byte, token, channelID string) (string, error) {
-    fmt.Printf("[DISCORD] Starting upload: %d bytes\n", len(data))
-
-    url := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages", channelID)
-    
-    // Create multipart
-    body := &bytes.Buffer{}
-    writer := multipart.NewWriter(body)
-    
-    // Clean filename
-    cleanName := regexp.MustCompile(`[^\w\.\-]+`).ReplaceAllString(fileName, "_")
-    
-    part, err := writer.CreateFormFile("files[0]", cleanName+".bin")
-    if err != nil {
-        return "", err
-    }
-    
-    part.Write(data)
-    writer.Close()
-
-    // Create request
-    req, err := http.NewRequest("POST", url, body)
-    if err != nil {
-        return "", err
-    }
-    
-    req.Header.Set("Authorization", "Bot "+token)
-    req.Header.Set("Content-Type", writer.FormDataContentType())
+    fmt.Printf("[SUCCESS] Uploaded: %s\n", loc.Ref)
 
-    // Make request with longer timeout for large files
-    client := &http.Client{Timeout: 60 * time.Second}
-    resp, err := client.Do(req)
-    if err != nil {
-        return "", fmt.Errorf("HTTP request failed: %v", err)
-    }
-    defer resp.Body.Close()
-
-    respBody, _ := io.ReadAll(resp.Body)
-    fmt.Printf("[DISCORD] Response Status: %d\n", resp.StatusCode)
-    fmt.Printf("[DISCORD] Response Body: %s\n", string(respBody))
-
-    if resp.StatusCode == 401 {
-        return "", fmt.Errorf("Discord bot token invalid or expired. Please check DISCORD_BOT_TOKEN")
-    }
-    
-    if resp.StatusCode == 403 {
-        return "", fmt.Errorf("Discord bot lacks permissions. Check bot permissions in channel %s", channelID)
-    }
-    
-    if resp.StatusCode == 429 {
-        return "", fmt.Errorf("Discord rate limit exceeded. Please wait and try again")
-    }
-
-    if resp.StatusCode != 200 {
-        return "", fmt.Errorf("Discord API error %d: %s", resp.StatusCode, string(respBody))
-    }
-
-    // Parse response
-    var result map[string]interface{}
-    if err := json.Unmarshal(respBody, &result); err != nil {
-        return "", fmt.Errorf("Failed to parse Discord response: %v", err)
-    }
-
-    // Get attachment URL
-    if attachments, ok := result["attachments"].([]interface{}); ok && len(attachments) > 0 {
-        if att, ok := attachments[0].(map[string]interface{}); ok {
-            if url, ok := att["url"].(string); ok {
-                return url, nil
-            }
+    // Remember the message so the chunk can be deleted when its file is
+    // purged from the trash.
+    if client != nil {
+        if err := messages.Record(client, []storage.Locator{loc}); err != nil {
+            fmt.Printf("[WARN] Recording message failed: %v\n", err)
         }
     }
 
-    return "", fmt.Errorf("No attachment URL in Discord response")
-}
\ No newline at end of file
+    // Send response
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(UploadResponse{Link: loc.Ref})
+}
@@ -5,9 +5,15 @@ import (
     "fmt"
     "io"
     "net/http"
-    "os"
     "strconv"
-    "time"
+    "strings"
+
+    "teddrive-web/lib/acl"
+    "teddrive-web/lib/dedup"
+    "teddrive-web/lib/meta"
+    "teddrive-web/lib/share"
+    "teddrive-web/lib/storage"
+    "teddrive-web/lib/workspace"
 )
 
 // Download request hanya butuh URL & Provider
@@ -15,14 +21,20 @@ type DownloadRequest struct {
     URL      string `json:"url"`
     Provider string `json:"provider"`
     Range    string `json:"range,omitempty"` // For chunked downloads
+    FileID   string `json:"fileId"`             // The file the link is from
+    ShareID  string `json:"shareId,omitempty"`  // Share pages: the link that gives access to the file
+    Password string `json:"password,omitempty"` // The share link's password
 }
 
+// Vercel limit is 4.5MB, use 4MB to be safe
+const MAX_SIZE = 4 * 1024 * 1024 // 4MB
+
 func Handler(w http.ResponseWriter, r *http.Request) {
     // Handle CORS preflight
     if r.Method == "OPTIONS" {
         w.Header().Set("Access-Control-Allow-Origin", "*")
         w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
         w.WriteHeader(http.StatusOK)
         return
     }
@@ -38,77 +50,76 @@ func Handler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var targetURL string
+    // Only chunks of a file the caller may read are fetched: the app names
+    // the file and the access list decides, share pages name it and the
+    // share link. The link must be one of the file's own.
+    if req.FileID == "" {
+        http.Error(w, "fileId is required", http.StatusBadRequest)
+        return
+    }
+    client, err := checkFile(r, &req)
+    if err != nil {
+        writeError(w, err)
+        return
+    }
 
-    // --- TELEGRAM: Get file path first ---
-    if req.Provider == "telegram" {
-        token := os.Getenv("TELEGRAM_BOT_TOKEN")
-        if token == "" {
-            http.Error(w, "TELEGRAM_BOT_TOKEN missing in Env", http.StatusInternalServerError)
+    // --- ERASURE: Rebuild the chunk from its shards ---
+    if req.Provider == storage.ErasureProvider {
+        stripe, err := storage.ParseStripe(req.URL)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
-        
-        apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/getFile?file_id=%s", token, req.URL)
-        resp, err := http.Get(apiURL)
+        data, err := storage.ReadStripe(stripe)
         if err != nil {
-            fmt.Println("[DOWNLOAD TG] GetFile Error:", err)
-            http.Error(w, "Telegram GetFile Error", http.StatusInternalServerError)
+            fmt.Println("[DOWNLOAD] Reconstruct Error:", err)
+            http.Error(w, "Reconstruct failed: "+err.Error(), http.StatusBadGateway)
             return
         }
-        defer resp.Body.Close()
-
-        var tgResp map[string]interface{}
-        json.NewDecoder(resp.Body).Decode(&tgResp)
+        serveBytes(w, data, req.Range)
+        return
+    }
 
-        if ok, exists := tgResp["ok"].(bool); !exists || !ok {
-            fmt.Println("[DOWNLOAD TG] API Error:", tgResp["description"])
-            http.Error(w, "Telegram API Error", http.StatusInternalServerError)
+    // --- DEDUP: Reassemble the window from shared chunks ---
+    // The chunks are decrypted here, so the response is plaintext.
+    if req.Provider == storage.DedupProvider {
+        group, err := dedup.ParseGroup(req.URL)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
-
-        result := tgResp["result"].(map[string]interface{})
-        filePath := result["file_path"].(string)
-        targetURL = fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", token, filePath)
-
-    } else {
-        // DISCORD: Use direct URL
-        targetURL = req.URL
+        data, err := dedup.Load(client, group)
+        if err != nil {
+            fmt.Println("[DOWNLOAD] Dedup Error:", err)
+            http.Error(w, "Reassemble failed: "+err.Error(), http.StatusBadGateway)
+            return
+        }
+        serveBytes(w, data, req.Range)
+        return
     }
 
     // Create HTTP request
-    fmt.Printf("[DOWNLOAD] Fetching from: %s\n", targetURL)
-    client := &http.Client{Timeout: 120 * time.Second}
-    httpReq, _ := http.NewRequest("GET", targetURL, nil)
-    httpReq.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
-    httpReq.Header.Set("Accept", "*/*")
-
-    // Add range header if specified (for chunked downloads)
+    fmt.Printf("[DOWNLOAD] Fetching %s object\n", req.Provider)
     if req.Range != "" {
-        httpReq.Header.Set("Range", req.Range)
         fmt.Printf("[DOWNLOAD] Using range: %s\n", req.Range)
     }
 
-    resp, err := client.Do(httpReq)
+    resp, err := storage.Open(req.Provider, req.URL, req.Range)
     if err != nil {
-        fmt.Println("[DOWNLOAD] Connection Error:", err)
-        http.Error(w, "Connection Failed", http.StatusInternalServerError)
+        fmt.Println("[DOWNLOAD] Fetch Error:", err)
+        if remoteErr, ok := err.(*storage.RemoteError); ok {
+            http.Error(w, remoteErr.Error(), remoteErr.StatusCode)
+            return
+        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
     defer resp.Body.Close()
 
-    if resp.StatusCode != 200 && resp.StatusCode != 206 {
-        fmt.Printf("[DOWNLOAD] Remote Status: %d\n", resp.StatusCode)
-        http.Error(w, fmt.Sprintf("Remote server error: %d", resp.StatusCode), resp.StatusCode)
-        return
-    }
-
     // Get content length
     contentLength := resp.Header.Get("Content-Length")
     fileSize, _ := strconv.ParseInt(contentLength, 10, 64)
     
-    // Vercel limit is 4.5MB, use 4MB to be safe
-    const MAX_SIZE = 4 * 1024 * 1024 // 4MB
-    
     // If file is too large and no range specified, return metadata for chunked download
     if fileSize > MAX_SIZE && req.Range == "" {
         fmt.Printf("[DOWNLOAD] File too large (%d bytes), returning chunked metadata\n", fileSize)
@@ -144,4 +155,109 @@ func Handler(w http.ResponseWriter, r *http.Request) {
     } else {
         fmt.Printf("[DOWNLOAD] Stream Success. Bytes written: %d\n", bytesWritten)
     }
-}
\ No newline at end of file
+}
+
+// checkFile makes sure the caller may read req.FileID, through the access
+// list or req.ShareID, and that req.URL is one of its chunks. It returns
+// the client to read the file's chunks with.
+func checkFile(r *http.Request, req *DownloadRequest) (*meta.Client, error) {
+    client, err := meta.FromEnv()
+    if err != nil {
+        return nil, err
+    }
+    var f *meta.File
+    if req.ShareID != "" {
+        s, err := share.Get(client, req.ShareID)
+        if err != nil {
+            return nil, err
+        }
+        if f, err = share.File(client, s, req.Password, req.FileID); err != nil {
+            return nil, err
+        }
+    } else {
+        access, err := workspace.Resolve(client, r, workspace.Guest)
+        if err != nil {
+            return nil, err
+        }
+        if err := acl.Require(access, "files", req.FileID, acl.Read); err != nil {
+            return nil, err
+        }
+        if f, err = access.Client.GetFile(req.FileID); err != nil {
+            return nil, err
+        }
+        client = access.Client
+    }
+    if f.MetaProvider != req.Provider {
+        return nil, meta.ErrNotFound
+    }
+    links, err := f.Links()
+    if err != nil {
+        return nil, err
+    }
+    for _, link := range links {
+        if link == req.URL {
+            return client, nil
+        }
+    }
+    return nil, meta.ErrNotFound
+}
+
+func writeError(w http.ResponseWriter, err error) {
+    switch err {
+    case share.ErrGone:
+        http.Error(w, err.Error(), http.StatusGone)
+    case share.ErrPassword:
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+    default:
+        workspace.WriteError(w, err)
+    }
+}
+
+// serveBytes answers from an in-memory chunk with the same protocol as the
+// streaming path: chunked metadata when it is too large and no range was
+// asked for, otherwise the requested slice.
+func serveBytes(w http.ResponseWriter, data []byte, rangeHeader string) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+    w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+    fileSize := int64(len(data))
+    if fileSize > MAX_SIZE && rangeHeader == "" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "chunked": true,
+            "fileSize": fileSize,
+            "maxChunkSize": MAX_SIZE,
+            "totalChunks": (fileSize + MAX_SIZE - 1) / MAX_SIZE,
+        })
+        return
+    }
+
+    start, end := int64(0), fileSize-1
+    if rangeHeader != "" {
+        spec := strings.TrimPrefix(rangeHeader, "bytes=")
+        parts := strings.SplitN(spec, "-", 2)
+        if len(parts) != 2 {
+            http.Error(w, "Invalid range", http.StatusRequestedRangeNotSatisfiable)
+            return
+        }
+        start, _ = strconv.ParseInt(parts[0], 10, 64)
+        if parts[1] != "" {
+            end, _ = strconv.ParseInt(parts[1], 10, 64)
+        }
+        if end >= fileSize {
+            end = fileSize - 1
+        }
+        if start < 0 || start > end {
+            http.Error(w, "Invalid range", http.StatusRequestedRangeNotSatisfiable)
+            return
+        }
+    }
+    if end-start+1 > MAX_SIZE {
+        end = start + MAX_SIZE - 1
+    }
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    w.Write(data[start : end+1])
+    fmt.Printf("[DOWNLOAD] Served %d bytes from rebuilt chunk\n", end-start+1)
+}
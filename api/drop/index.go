@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/drop"
+	"teddrive-web/lib/messages"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+	"teddrive-web/lib/workspace"
+)
+
+// CreateRequest is the body of POST /api/drop.
+type CreateRequest struct {
+	FolderID  string `json:"folderId"`
+	Provider  string `json:"provider,omitempty"`
+	Password  string `json:"password,omitempty"`
+	ExpiresAt string `json:"expiresAt,omitempty"` // RFC 3339
+	MaxBytes  *int64 `json:"maxBytes,omitempty"`
+}
+
+// FinishRequest is the body of POST /api/drop/{id}: the uploaded chunks of
+// one file, each with the receipt returned by the chunk upload.
+type FinishRequest struct {
+	Password string      `json:"password,omitempty"`
+	Name     string      `json:"name"`
+	Mime     string      `json:"mime"`
+	Key      string      `json:"key"`
+	Parts    []drop.Part `json:"parts"`
+}
+
+// DropInfo describes a link to its owner.
+type DropInfo struct {
+	ID          string  `json:"id"`
+	FolderID    string  `json:"folderId"`
+	Provider    string  `json:"provider"`
+	HasPassword bool    `json:"hasPassword"`
+	ExpiresAt   *string `json:"expiresAt"`
+	MaxBytes    *int64  `json:"maxBytes"`
+	BytesUsed   int64   `json:"bytesUsed"`
+	FileCount   int     `json:"fileCount"`
+	Revoked     bool    `json:"revoked"`
+	Active      bool    `json:"active"`
+	CreatedAt   string  `json:"createdAt,omitempty"`
+}
+
+// PublicInfo is what the uploader sees. It says nothing about the folder.
+type PublicInfo struct {
+	PasswordRequired bool    `json:"passwordRequired"`
+	ExpiresAt        *string `json:"expiresAt"`
+	BytesLeft        *int64  `json:"bytesLeft"`
+	ChunkSize        int     `json:"chunkSize"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	switch {
+	case id == "" && r.Method == "GET":
+		listDrops(w, r, client, r.URL.Query().Get("folderId"))
+	case id == "" && r.Method == "POST":
+		createDrop(w, r, client)
+	case id != "" && r.Method == "GET":
+		describeDrop(w, client, id)
+	case id != "" && r.Method == "POST" && r.URL.Query().Get("chunk") != "":
+		uploadChunk(w, r, client, id)
+	case id != "" && r.Method == "POST":
+		finishFile(w, r, client, id)
+	case id != "" && r.Method == "DELETE":
+		revokeDrop(w, r, client, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createDrop(w http.ResponseWriter, r *http.Request, client *meta.Client) {
+	var req CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.FolderID == "" {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	opts := drop.Options{Provider: req.Provider, Password: req.Password, MaxBytes: req.MaxBytes}
+	if req.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			http.Error(w, "Invalid expiresAt", http.StatusBadRequest)
+			return
+		}
+		opts.ExpiresAt = &t
+	}
+	if req.MaxBytes != nil && *req.MaxBytes <= 0 {
+		http.Error(w, "maxBytes must be positive", http.StatusBadRequest)
+		return
+	}
+
+	scoped, ok := authorize(w, r, client, req.FolderID, acl.Write)
+	if !ok {
+		return
+	}
+	d, err := drop.Create(scoped, req.FolderID, opts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[DROP] Created %s into folder %s\n", d.ID, d.FolderID)
+	writeJSON(w, info(d))
+}
+
+func listDrops(w http.ResponseWriter, r *http.Request, client *meta.Client, folderID string) {
+	if folderID == "" {
+		http.Error(w, "folderId is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorize(w, r, client, folderID, acl.Read); !ok {
+		return
+	}
+	rows, err := drop.List(client, folderID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	out := make([]DropInfo, 0, len(rows))
+	for i := range rows {
+		out = append(out, info(&rows[i]))
+	}
+	writeJSON(w, map[string]interface{}{"drops": out})
+}
+
+func describeDrop(w http.ResponseWriter, client *meta.Client, id string) {
+	d, err := drop.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !d.Active() {
+		writeError(w, drop.ErrGone)
+		return
+	}
+	writeJSON(w, PublicInfo{
+		PasswordRequired: d.NeedsPassword(),
+		ExpiresAt:        d.ExpiresAt,
+		BytesLeft:        d.BytesLeft(),
+		ChunkSize:        storage.ChunkSize(d.Provider),
+	})
+}
+
+// uploadChunk takes the same form fields as /api/discord and /api/telegram,
+// plus the link password, and stores the chunk with the link's provider.
+func uploadChunk(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	d, err := drop.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	if err := r.ParseMultipartForm(50 << 20); err != nil {
+		fmt.Printf("[ERROR] Parse form failed: %v\n", err)
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	if err := drop.Check(d, r.FormValue("password")); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	fileName := r.FormValue("fileName")
+	chunkIndex, _ := strconv.Atoi(r.FormValue("chunkIndex"))
+	key, err := base64.StdEncoding.DecodeString(r.FormValue("keyBase64"))
+	if err != nil || len(key) != 32 || fileName == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("chunkData")
+	if err != nil {
+		http.Error(w, "No file provided", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Read file failed", http.StatusInternalServerError)
+		return
+	}
+	if len(data) > storage.ChunkSize(d.Provider) {
+		http.Error(w, "Invalid chunk size", http.StatusBadRequest)
+		return
+	}
+
+	// The chunk goes to the channel of the folder's workspace and counts
+	// against its quota.
+	into, err := workspace.Of(client, "folders", d.FolderID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	size := int64(len(data))
+	if err := drop.Reserve(client, d, size); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sealed, err := storage.SealChunk(key, data)
+	if err == nil {
+		var link string
+		var locs []storage.Locator
+		link, locs, err = quota.Put(into, d.Provider, "", fileName, sealed, chunkIndex)
+		if err == nil {
+			if rerr := messages.Record(client, locs); rerr != nil {
+				fmt.Printf("[DROP] %s: recording messages failed: %v\n", d.ID, rerr)
+			}
+			fmt.Printf("[DROP] %s: stored chunk %d of %s (%d bytes)\n", d.ID, chunkIndex, fileName, size)
+			writeJSON(w, drop.Part{Link: link, Size: size, Receipt: d.Receipt(chunkIndex, link, size)})
+			return
+		}
+	}
+
+	fmt.Printf("[DROP] %s: chunk %d failed: %v\n", d.ID, chunkIndex, err)
+	if rerr := drop.Reserve(client, d, -size); rerr != nil {
+		fmt.Printf("[DROP] %s: releasing %d bytes failed: %v\n", d.ID, size, rerr)
+	}
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		quota.WriteError(w, err)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Upload failed: %v", err), http.StatusBadGateway)
+}
+
+func finishFile(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	var req FinishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if key, err := base64.StdEncoding.DecodeString(req.Key); err != nil || len(key) != 32 {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+
+	d, err := drop.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := drop.Check(d, req.Password); err != nil {
+		writeError(w, err)
+		return
+	}
+	f, err := drop.Finish(client, d, req.Name, req.Mime, req.Key, req.Parts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[DROP] %s: received %s (%d bytes)\n", d.ID, f.Name, f.Size)
+	writeJSON(w, map[string]interface{}{"name": f.Name, "size": f.Size})
+}
+
+func revokeDrop(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	d, err := drop.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if _, ok := authorize(w, r, client, d.FolderID, acl.Write); !ok {
+		return
+	}
+	if err := drop.Revoke(client, d); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[DROP] Revoked %s\n", id)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+func info(d *drop.Drop) DropInfo {
+	return DropInfo{
+		ID:          d.ID,
+		FolderID:    d.FolderID,
+		Provider:    d.Provider,
+		HasPassword: d.NeedsPassword(),
+		ExpiresAt:   d.ExpiresAt,
+		MaxBytes:    d.MaxBytes,
+		BytesUsed:   d.BytesUsed,
+		FileCount:   d.FileCount,
+		Revoked:     d.RevokedAt != nil,
+		Active:      d.Active(),
+		CreatedAt:   d.CreatedAt,
+	}
+}
+
+// authorize checks the link owner's requests: the folder must be in their
+// workspace, and they need level on it. The uploader's requests are
+// allowed by the link itself.
+func authorize(w http.ResponseWriter, r *http.Request, client *meta.Client, folderID, level string) (*meta.Client, bool) {
+	a, err := workspace.Resolve(client, r, workspace.Guest)
+	if err == nil {
+		err = workspace.Owns(a.Client, "folders", folderID)
+	}
+	if err == nil {
+		err = acl.Require(a, "folders", folderID, level)
+	}
+	if err != nil {
+		workspace.WriteError(w, err)
+		return nil, false
+	}
+	return a.Client, true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case meta.ErrNotFound:
+		http.Error(w, "Drop link not found", http.StatusNotFound)
+	case drop.ErrGone:
+		http.Error(w, err.Error(), http.StatusGone)
+	case drop.ErrPassword:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case drop.ErrFull:
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	case drop.ErrReused:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case drop.ErrProvider, drop.ErrReceipt:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		fmt.Printf("[DROP] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
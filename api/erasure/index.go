@@ -0,0 +1,142 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+	"teddrive-web/lib/workspace"
+)
+
+type UploadResponse struct {
+	Link string `json:"link"`
+}
+
+// Handler encrypts one chunk and stores it erasure-coded across every
+// configured Discord channel and Telegram chat. The returned link is the
+// JSON stripe that /api/download uses to rebuild the chunk. A workspace
+// with its own channel or chat uses that instead of the deployment's.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	// Set CORS headers first
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fmt.Println("[ERASURE] Upload handler started")
+
+	err := r.ParseMultipartForm(25 << 20)
+	if err != nil {
+		fmt.Printf("[ERROR] Parse form failed: %v\n", err)
+		http.Error(w, "Parse form failed", http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	// Without Supabase there are no workspaces, and nothing is counted.
+	client, _ := meta.FromEnv()
+	if client != nil {
+		access, err := workspace.Resolve(client, r, workspace.Guest)
+		if err == nil {
+			err = acl.Require(access, "folders", r.FormValue("folderId"), acl.Write)
+		}
+		if err != nil {
+			workspace.WriteError(w, err)
+			return
+		}
+		client = access.Client
+	}
+
+	backends := storage.BackendsFor(map[string]string{
+		"discord":  client.Target("discord"),
+		"telegram": client.Target("telegram"),
+	})
+	if len(backends) == 0 {
+		fmt.Println("[ERROR] No Discord channel or Telegram chat configured")
+		http.Error(w, "Erasure coding not configured - missing environment variables", http.StatusServiceUnavailable)
+		return
+	}
+	k, m := storage.ErasureConfig()
+	fmt.Printf("[ENV] %d targets, %d data + %d parity shards\n", len(backends), k, m)
+
+	keyBase64 := r.FormValue("keyBase64")
+	fileName := r.FormValue("fileName")
+	chunkIndex, _ := strconv.Atoi(r.FormValue("chunkIndex"))
+
+	if keyBase64 == "" || fileName == "" {
+		http.Error(w, "Missing required fields", http.StatusBadRequest)
+		return
+	}
+
+	file, _, err := r.FormFile("chunkData")
+	if err != nil {
+		fmt.Printf("[ERROR] Get file failed: %v\n", err)
+		http.Error(w, "No file provided", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	fileData, err := io.ReadAll(file)
+	if err != nil {
+		fmt.Printf("[ERROR] Read file failed: %v\n", err)
+		http.Error(w, "Read file failed", http.StatusInternalServerError)
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(keyBase64)
+	if err != nil || len(key) != 32 {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return
+	}
+
+	var encryptedData []byte
+	if r.FormValue("compress") == "1" {
+		encryptedData, err = storage.SealCompressed(key, fileData, fileName)
+	} else {
+		encryptedData, err = storage.SealChunk(key, fileData)
+	}
+	if err != nil {
+		http.Error(w, "Cipher error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[ENCRYPT] Encrypted to %d bytes\n", len(encryptedData))
+
+	// Every shard counts against the storage quota.
+	stored := storage.StoredSize(storage.ErasureProvider, len(encryptedData))
+	if err := quota.Reserve(client, quota.Tenant(client), storage.ErasureProvider, stored); err != nil {
+		quota.WriteError(w, err)
+		return
+	}
+
+	stripe, err := storage.UploadStripe(backends, fileName, encryptedData, k, m, chunkIndex)
+	if err != nil {
+		fmt.Printf("[ERROR] Upload failed: %v\n", err)
+		if err := quota.Release(client, quota.Tenant(client), storage.ErasureProvider, stored); err != nil {
+			fmt.Printf("[WARN] Releasing quota failed: %v\n", err)
+		}
+		http.Error(w, fmt.Sprintf("Erasure upload failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("[SUCCESS] Uploaded chunk %d as %d shards\n", chunkIndex, len(stripe.Shards))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(UploadResponse{Link: stripe.String()})
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/preview"
+	"teddrive-web/lib/stream"
+	"teddrive-web/lib/workspace"
+)
+
+// StreamInfo is the answer to POST /api/files/{id}/stream: a URL to give
+// a <video> or <audio> element, working until Expires.
+type StreamInfo struct {
+	URL     string `json:"url"`
+	Expires string `json:"expires"`
+}
+
+// Handler serves what is derived from one file (?id=):
+//
+//	GET  /api/files/{id}/thumbnail   a JPEG thumbnail of an image or PDF,
+//	                                 or the waveform of audio as JSON
+//	POST /api/files/{id}/stream      a signed URL to play the file from
+//	GET  /api/files/{id}/stream?token=
+//	                                 the file's content, with Range support
+//
+// The preview is made the first time it is asked for; files without one
+// get 404 and keep their type icon.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace, Range")
+	w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "File ID required", http.StatusBadRequest)
+		return
+	}
+	view := r.URL.Query().Get("view")
+	switch {
+	case view == "thumbnail" && r.Method == "GET":
+	case view == "stream" && (r.Method == "GET" || r.Method == "HEAD" || r.Method == "POST"):
+	case view == "thumbnail" || view == "stream":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	var access *workspace.Access
+	if view == "stream" && r.Method != "POST" {
+		// Players cannot send headers; the token carries the caller.
+		token, err := stream.Verify(r.URL.Query().Get("token"), id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		access, err = workspace.Open(client, token.Workspace, token.UserID, token.Admin)
+		if err != nil {
+			workspace.WriteError(w, err)
+			return
+		}
+	} else {
+		access, err = workspace.Resolve(client, r, workspace.Guest)
+		if err != nil {
+			workspace.WriteError(w, err)
+			return
+		}
+	}
+	if err := acl.Require(access, "files", id, acl.Read); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch {
+	case view == "thumbnail":
+		thumbnail(w, access.Client, id)
+	case r.Method == "POST":
+		expires := time.Now().Add(stream.TTL)
+		token, err := stream.Sign(stream.Token{
+			FileID:    id,
+			Workspace: access.Workspace.ID,
+			UserID:    access.UserID,
+			Admin:     auth.IsAdmin(r),
+			Expires:   expires.Unix(),
+		})
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, StreamInfo{
+			URL:     "/api/files/" + url.PathEscape(id) + "/stream?token=" + url.QueryEscape(token),
+			Expires: expires.UTC().Format(time.RFC3339),
+		})
+	default:
+		f, err := access.Client.GetFile(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("[FILES] Streaming %s (%s)\n", id, r.Header.Get("Range"))
+		if err := stream.Serve(w, r, access.Client, f); err != nil {
+			writeError(w, err)
+		}
+	}
+}
+
+func thumbnail(w http.ResponseWriter, c *meta.Client, id string) {
+	f, err := c.GetFile(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	data, mime, err := preview.Open(c, f)
+	if err != nil {
+		if !errors.Is(err, preview.ErrNone) {
+			fmt.Printf("[FILES] Thumbnail of %s failed: %v\n", id, err)
+		}
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	// The URL stays the same when the file changes, so not for long.
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	w.Write(data)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, preview.ErrNone):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, stream.ErrToken):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, preview.ErrDisabled), errors.Is(err, stream.ErrDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		workspace.WriteError(w, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
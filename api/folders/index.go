@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/folders"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/trash"
+	"teddrive-web/lib/workspace"
+)
+
+// FolderRequest is the body of POST /api/folders/{id}.
+//
+//	{"action":"rename","name":"Photos"}
+//	{"action":"move","parentId":"1712345678901"}   // null for the top level
+//	{"action":"copy","parentId":null,"name":"Photos 2024"}
+//
+// Move keeps the folder's name unless one is given. Copy names the copy
+// after the folder, with " (copy)" added when it stays in the same place.
+type FolderRequest struct {
+	Action   string  `json:"action"`
+	Name     string  `json:"name,omitempty"`
+	ParentID *string `json:"parentId"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "Folder ID required", http.StatusBadRequest)
+		return
+	}
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	checker, err := acl.New(access)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	client = access.Client
+
+	switch r.Method {
+	case "POST":
+		changeFolder(w, r, client, checker, id)
+	case "DELETE":
+		if err := checker.RequireTree(id, acl.Write); err != nil {
+			workspace.WriteError(w, err)
+			return
+		}
+		// ?permanent=true skips the trash and deletes the chunks right away.
+		permanent := r.URL.Query().Get("permanent") == "true"
+		if err := folders.Delete(client, id, permanent); err != nil {
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("[FOLDERS] Deleted %s (permanent: %v)\n", id, permanent)
+		writeJSON(w, map[string]interface{}{"ok": true})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// changeFolder needs write access to the folder for a rename or move,
+// read access to all of it for a copy, and write access to where it is
+// moved or copied to.
+func changeFolder(w http.ResponseWriter, r *http.Request, client *meta.Client, checker *acl.Checker, id string) {
+	var req FolderRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if req.Action == "copy" {
+		err = checker.RequireTree(id, acl.Read)
+	} else {
+		err = checker.Require("folders", id, acl.Write)
+	}
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	if req.Action == "move" || req.Action == "copy" {
+		parent := ""
+		if req.ParentID != nil {
+			parent = *req.ParentID
+		}
+		if err := checker.Require("folders", parent, acl.Write); err != nil {
+			workspace.WriteError(w, err)
+			return
+		}
+	}
+
+	switch req.Action {
+	case "rename":
+		if err := folders.Rename(client, id, req.Name); err != nil {
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("[FOLDERS] Renamed %s to %q\n", id, req.Name)
+		writeJSON(w, map[string]interface{}{"ok": true})
+
+	case "move":
+		folder, err := client.GetFolder(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		name := req.Name
+		if name == "" {
+			name = folder.Name
+		}
+		if err := folders.Move(client, id, req.ParentID, name); err != nil {
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("[FOLDERS] Moved %s into %s\n", id, parentName(req.ParentID))
+		writeJSON(w, map[string]interface{}{"ok": true})
+
+	case "copy":
+		folder, err := client.GetFolder(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		name := req.Name
+		if name == "" {
+			name = folder.Name
+			if sameParent(folder.ParentID, req.ParentID) {
+				name += " (copy)"
+			}
+		}
+		newID, err := folders.Copy(client, id, req.ParentID, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		fmt.Printf("[FOLDERS] Copied %s to %s in %s\n", id, newID, parentName(req.ParentID))
+		writeJSON(w, map[string]interface{}{"id": newID, "name": name})
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+func sameParent(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func parentName(p *string) string {
+	if p == nil {
+		return "the top level"
+	}
+	return *p
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, meta.ErrNotFound):
+		http.Error(w, "Folder not found", http.StatusNotFound)
+	case errors.Is(err, folders.ErrExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, folders.ErrCycle), errors.Is(err, folders.ErrBadName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, folders.ErrDisabled), errors.Is(err, trash.ErrDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		fmt.Printf("[FOLDERS] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,212 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/imports"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/storage"
+	"teddrive-web/lib/workspace"
+)
+
+// ImportRequest is the body of POST /api/imports. Name and folderId are
+// optional; provider defaults to discord.
+//
+//	{"url":"https://example.com/data.tar","folderId":"1712345678902","provider":"telegram"}
+type ImportRequest struct {
+	URL      string `json:"url"`
+	Name     string `json:"name,omitempty"`
+	FolderID string `json:"folderId,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// ImportInfo is one import as the browser sees it. Size is null until the
+// server at the URL says.
+type ImportInfo struct {
+	ID        string  `json:"id"`
+	URL       string  `json:"url"`
+	Name      string  `json:"name"`
+	FolderID  *string `json:"folderId"`
+	Provider  string  `json:"provider"`
+	Status    string  `json:"status"`
+	Size      *int64  `json:"size"`
+	DoneBytes int64   `json:"doneBytes"`
+	FileID    *string `json:"fileId"`
+	Error     string  `json:"error,omitempty"`
+	CreatedAt string  `json:"createdAt,omitempty"`
+	UpdatedAt string  `json:"updatedAt,omitempty"`
+}
+
+// runBytes is about how much one call fetches and stores, so it stays well
+// inside the function timeout. Telegram's 50 MB chunks go one at a time.
+const runBytes = 16 << 20
+
+// Handler manages imports from URLs:
+//
+//	GET    /api/imports        the caller's imports, newest first
+//	POST   /api/imports        start one and fetch its first chunks
+//	GET    /api/imports/{id}   one import
+//	POST   /api/imports/{id}   fetch the next chunks, retrying a failed one
+//	DELETE /api/imports/{id}   cancel it, deleting what it stored
+//
+// Each POST works for a few seconds only; the browser, or `teddrive
+// import`, calls again until the status is done or failed.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	switch {
+	case id == "" && r.Method == "GET":
+		jobs, err := imports.List(access.Client, access.UserID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		out := make([]ImportInfo, 0, len(jobs))
+		for i := range jobs {
+			out = append(out, info(&jobs[i]))
+		}
+		writeJSON(w, map[string]interface{}{"imports": out})
+	case id == "" && r.Method == "POST":
+		start(w, r, access)
+	case id != "" && (r.Method == "GET" || r.Method == "POST" || r.Method == "DELETE"):
+		job, err := imports.Get(access.Client, id)
+		if err == nil && job.UserID != access.UserID && !access.Can(workspace.Owner) {
+			err = meta.ErrNotFound
+		}
+		if err == nil && r.Method != "GET" {
+			err = acl.Require(access, "folders", folderOf(job), acl.Write)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		switch r.Method {
+		case "POST":
+			if err := imports.Retry(access.Client, job); err != nil {
+				writeError(w, err)
+				return
+			}
+			run(w, access.Client, job)
+		case "DELETE":
+			if err := imports.Delete(access.Client, job); err != nil {
+				writeError(w, err)
+				return
+			}
+			fmt.Printf("[IMPORT] %s cancelled\n", job.ID)
+			writeJSON(w, map[string]interface{}{"ok": true})
+		default:
+			writeJSON(w, info(job))
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func start(w http.ResponseWriter, r *http.Request, access *workspace.Access) {
+	var req ImportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.URL == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+	if err := acl.Require(access, "folders", req.FolderID, acl.Write); err != nil {
+		writeError(w, err)
+		return
+	}
+	job, err := imports.Enqueue(access.Client, access.UserID, imports.Request{
+		URL:      req.URL,
+		Name:     req.Name,
+		FolderID: req.FolderID,
+		Provider: req.Provider,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[IMPORT] %s: %s into %s\n", job.ID, job.URL, job.Provider)
+	run(w, access.Client, job)
+}
+
+// run works on job for one call and answers with where it got to. A
+// failed job is an answer too: its error says why.
+func run(w http.ResponseWriter, c *meta.Client, job *imports.Job) {
+	budget := max(1, runBytes/storage.ChunkSize(job.Provider))
+	if _, err := imports.Step(c, job, budget); err != nil {
+		fmt.Printf("[IMPORT] %s: %v\n", job.ID, err)
+		if job.Status != imports.StatusFailed {
+			writeError(w, err)
+			return
+		}
+	}
+	writeJSON(w, info(job))
+}
+
+func folderOf(job *imports.Job) string {
+	if job.FolderID == nil {
+		return ""
+	}
+	return *job.FolderID
+}
+
+func info(job *imports.Job) ImportInfo {
+	return ImportInfo{
+		ID:        job.ID,
+		URL:       job.URL,
+		Name:      job.Name,
+		FolderID:  job.FolderID,
+		Provider:  job.Provider,
+		Status:    job.Status,
+		Size:      job.Size,
+		DoneBytes: job.DoneBytes,
+		FileID:    job.FileID,
+		Error:     job.Error,
+		CreatedAt: job.CreatedAt,
+		UpdatedAt: job.UpdatedAt,
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *meta.APIError
+	switch {
+	case errors.Is(err, imports.ErrURL), errors.Is(err, imports.ErrProvider):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, imports.ErrBusy):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound:
+		// PostgREST answers 404 for a table it does not know.
+		http.Error(w, "Imports need supabase/migrations/017_imports.sql", http.StatusServiceUnavailable)
+	default:
+		workspace.WriteError(w, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/migrate"
+)
+
+// MigrateRequest drives the migration worker.
+//
+//	{"action": "enqueue", "fileId": "...", "toProvider": "telegram"}
+//	{"action": "enqueue", "fromProvider": "discord", "fromTarget": "<channel>", "toProvider": "discord", "toTarget": "<new channel>"}
+//	{"action": "run", "maxChunks": 5}
+//	{"action": "retry", "id": "mig_..."}
+type MigrateRequest struct {
+	Action       string `json:"action"`
+	ID           string `json:"id,omitempty"`
+	FileID       string `json:"fileId,omitempty"`
+	FromProvider string `json:"fromProvider,omitempty"`
+	FromTarget   string `json:"fromTarget,omitempty"`
+	ToProvider   string `json:"toProvider,omitempty"`
+	ToTarget     string `json:"toTarget,omitempty"`
+	MaxChunks    int    `json:"maxChunks,omitempty"`
+}
+
+// Chunks copied per "run" call when maxChunks is not given. Keeps one call
+// well inside the function timeout.
+const defaultRunChunks = 3
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !auth.AdminEnabled() {
+		http.Error(w, "Admin API disabled - set TEDDRIVE_ADMIN_TOKEN", http.StatusServiceUnavailable)
+		return
+	}
+	if !auth.IsAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		jobs, err := migrate.List(client, r.URL.Query().Get("id"), r.URL.Query().Get("status"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"jobs": jobs})
+
+	case "POST":
+		var req MigrateRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		handleAction(w, client, req)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func handleAction(w http.ResponseWriter, client *meta.Client, req MigrateRequest) {
+	switch req.Action {
+	case "enqueue":
+		if req.ToProvider == "" {
+			http.Error(w, "toProvider is required", http.StatusBadRequest)
+			return
+		}
+		jobs, err := migrate.Enqueue(client,
+			migrate.Selector{FileID: req.FileID, FromProvider: req.FromProvider, FromTarget: req.FromTarget},
+			migrate.Destination{Provider: req.ToProvider, Target: req.ToTarget})
+		if err != nil {
+			fmt.Printf("[MIGRATE] Enqueue failed: %v\n", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"jobs": jobs})
+
+	case "run":
+		maxChunks := req.MaxChunks
+		if maxChunks <= 0 {
+			maxChunks = defaultRunChunks
+		}
+		copied, err := migrate.Run(client, maxChunks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"copied": copied, "more": copied >= maxChunks})
+
+	case "retry":
+		if err := migrate.Retry(client, req.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, map[string]interface{}{"ok": true})
+
+	default:
+		http.Error(w, "Unknown action", http.StatusBadRequest)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/search"
+	"teddrive-web/lib/tags"
+	"teddrive-web/lib/workspace"
+)
+
+// ResultInfo is one match of GET /api/search.
+type ResultInfo struct {
+	Kind      string            `json:"kind"`
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	Path      string            `json:"path"`
+	ParentID  *string           `json:"parentId"`
+	Size      int64             `json:"size,omitempty"`
+	Mime      string            `json:"mime,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	UpdatedAt string            `json:"updatedAt,omitempty"`
+	Tags      []string          `json:"tags"`
+	Metadata  map[string]string `json:"metadata"`
+}
+
+// Handler searches the workspace. Every parameter is optional:
+//
+//	q          words or part of a name
+//	fuzzy=1    also match names spelled a little differently
+//	folderId   only below this folder, or path=/Projects/2024
+//	mime       MIME type prefix, such as image/ or application/pdf
+//	type       video, image, audio or other
+//	minSize    smallest file size in bytes, and maxSize the largest
+//	after      modified on or after, as 2024-01-31 or RFC 3339, and before
+//	tag        has this tag; repeat for several
+//	meta.KEY   has metadata KEY with this value, as in meta.project=apollo
+//	limit      matches per page, at most 200; offset skips matches
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+
+	q, err := parseQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if p := r.URL.Query().Get("path"); p != "" && q.Folder == "" {
+		if q.Folder, err = search.FolderAt(access.Client, p); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	page, err := search.Run(access, q)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	out := make([]ResultInfo, 0, len(page.Results))
+	for _, m := range page.Results {
+		out = append(out, ResultInfo{
+			Kind:      m.Kind,
+			ID:        m.ID,
+			Name:      m.Name,
+			Path:      m.Path,
+			ParentID:  m.ParentID,
+			Size:      m.Size,
+			Mime:      m.Mime,
+			Type:      m.Type,
+			UpdatedAt: m.UpdatedAt,
+			Tags:      m.Tags,
+			Metadata:  m.Metadata,
+		})
+	}
+	fmt.Printf("[SEARCH] %q: %d of %d\n", q.Text, len(out), page.Total)
+	writeJSON(w, map[string]interface{}{"results": out, "total": page.Total})
+}
+
+func parseQuery(r *http.Request) (search.Query, error) {
+	v := r.URL.Query()
+	q := search.Query{
+		Text:   v.Get("q"),
+		Fuzzy:  v.Get("fuzzy") == "1" || v.Get("fuzzy") == "true",
+		Folder: v.Get("folderId"),
+		Mime:   v.Get("mime"),
+		Type:   v.Get("type"),
+	}
+	var err error
+	number := func(name string) int64 {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return 0
+		}
+		n, e := strconv.ParseInt(s, 10, 64)
+		if e != nil || n < 0 {
+			err = fmt.Errorf("%s must be a whole number of at least 0", name)
+		}
+		return n
+	}
+	date := func(name string, end bool) time.Time {
+		s := v.Get(name)
+		if s == "" || err != nil {
+			return time.Time{}
+		}
+		if t, e := time.Parse(time.RFC3339, s); e == nil {
+			return t
+		}
+		t, e := time.Parse("2006-01-02", s)
+		if e != nil {
+			err = fmt.Errorf("%s must be a date like 2024-01-31", name)
+		}
+		if end {
+			// The whole day counts.
+			t = t.Add(24*time.Hour - time.Second)
+		}
+		return t
+	}
+	q.MinSize = number("minSize")
+	q.MaxSize = number("maxSize")
+	q.Limit = int(number("limit"))
+	q.Offset = int(number("offset"))
+	q.After = date("after", false)
+	q.Before = date("before", true)
+	if err != nil {
+		return q, err
+	}
+
+	if q.Tags, err = tags.Normalize(v["tag"]); err != nil {
+		return q, err
+	}
+	for key, values := range v {
+		if name := strings.TrimPrefix(key, "meta."); name != key && name != "" {
+			if q.Metadata == nil {
+				q.Metadata = make(map[string]string)
+			}
+			q.Metadata[name] = values[0]
+		}
+	}
+	return q, nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, search.ErrPath) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	workspace.WriteError(w, err)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
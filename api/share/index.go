@@ -0,0 +1,463 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/share"
+	"teddrive-web/lib/workspace"
+)
+
+// CreateRequest is the body of POST /api/share. Exactly one of FileID and
+// FolderID is set.
+type CreateRequest struct {
+	FileID       string `json:"fileId,omitempty"`
+	FolderID     string `json:"folderId,omitempty"`
+	Password     string `json:"password,omitempty"`
+	ExpiresAt    string `json:"expiresAt,omitempty"` // RFC 3339
+	MaxDownloads *int   `json:"maxDownloads,omitempty"`
+	WrappedKey   string `json:"wrappedKey,omitempty"` // file key sealed under the fragment key
+}
+
+// OpenRequest is the body of POST /api/share/{id}. For folder links,
+// FileID picks one file from the subtree; without it the listing is
+// returned.
+type OpenRequest struct {
+	Password string `json:"password,omitempty"`
+	FileID   string `json:"fileId,omitempty"`
+}
+
+// ShareInfo describes a link to its owner. It never includes the password
+// hash.
+type ShareInfo struct {
+	ID            string  `json:"id"`
+	FileID        string  `json:"fileId,omitempty"`
+	FolderID      string  `json:"folderId,omitempty"`
+	HasPassword   bool    `json:"hasPassword"`
+	KeyInLink     bool    `json:"keyInLink"`
+	ExpiresAt     *string `json:"expiresAt"`
+	MaxDownloads  *int    `json:"maxDownloads"`
+	DownloadCount int     `json:"downloadCount"`
+	Revoked       bool    `json:"revoked"`
+	Active        bool    `json:"active"`
+	CreatedAt     string  `json:"createdAt,omitempty"`
+}
+
+// PublicInfo is what anyone holding the link sees before downloading. For
+// folder links Size is the total of the subtree and Files its file count.
+type PublicInfo struct {
+	Name             string  `json:"name"`
+	Size             int64   `json:"size"`
+	Type             string  `json:"type"`
+	Mime             string  `json:"mime,omitempty"`
+	Provider         string  `json:"provider,omitempty"`
+	Folder           bool    `json:"folder"`
+	Files            int     `json:"files,omitempty"`
+	PasswordRequired bool    `json:"passwordRequired"`
+	KeyInLink        bool    `json:"keyInLink"`
+	ExpiresAt        *string `json:"expiresAt"`
+	DownloadsLeft    *int    `json:"downloadsLeft"`
+}
+
+// Manifest is returned once the link has been opened; it is everything the
+// browser needs to fetch and decrypt the chunks. Links that keep the key in
+// their fragment get WrappedKey instead of Key.
+type Manifest struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Size       int64    `json:"size"`
+	Type       string   `json:"type"`
+	Mime       string   `json:"mime"`
+	Provider   string   `json:"provider"`
+	Key        string   `json:"key,omitempty"`
+	WrappedKey string   `json:"wrappedKey,omitempty"`
+	Links      []string `json:"links"`
+}
+
+// Listing is the recursive content of a folder link.
+type Listing struct {
+	Name    string         `json:"name"`
+	Size    int64          `json:"size"`
+	Folders []string       `json:"folders"` // paths
+	Files   []ListingEntry `json:"files"`
+}
+
+// ListingEntry is one file of a Listing.
+type ListingEntry struct {
+	ID       string `json:"id"`
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Type     string `json:"type"`
+	Mime     string `json:"mime"`
+	Provider string `json:"provider"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	switch {
+	case id != "" && r.URL.Query().Get("zip") != "" && (r.Method == "GET" || r.Method == "POST"):
+		zipShare(w, r, client, id)
+	case id == "" && r.Method == "GET":
+		listShares(w, r, client, r.URL.Query().Get("fileId"), r.URL.Query().Get("folderId"))
+	case id == "" && r.Method == "POST":
+		createShare(w, r, client)
+	case id != "" && r.Method == "GET":
+		describeShare(w, client, id)
+	case id != "" && r.Method == "POST":
+		openShare(w, r, client, id)
+	case id != "" && r.Method == "DELETE":
+		revokeShare(w, r, client, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createShare(w http.ResponseWriter, r *http.Request, client *meta.Client) {
+	var req CreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (req.FileID == "") == (req.FolderID == "") {
+		http.Error(w, "Exactly one of fileId and folderId is required", http.StatusBadRequest)
+		return
+	}
+
+	opts := share.Options{Password: req.Password, MaxDownloads: req.MaxDownloads, WrappedKey: req.WrappedKey}
+	if req.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		if err != nil {
+			http.Error(w, "Invalid expiresAt", http.StatusBadRequest)
+			return
+		}
+		opts.ExpiresAt = &t
+	}
+	if req.MaxDownloads != nil && *req.MaxDownloads <= 0 {
+		http.Error(w, "maxDownloads must be positive", http.StatusBadRequest)
+		return
+	}
+
+	table, id := "files", req.FileID
+	if req.FolderID != "" {
+		table, id = "folders", req.FolderID
+	}
+	scoped, ok := authorize(w, r, client, table, id, acl.Write, true)
+	if !ok {
+		return
+	}
+	var s *share.Share
+	var err error
+	if req.FolderID != "" {
+		s, err = share.CreateFolder(scoped, req.FolderID, opts)
+	} else {
+		s, err = share.Create(scoped, req.FileID, opts)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[SHARE] Created %s for file %s folder %s\n", s.ID, s.FileID, s.FolderID)
+	writeJSON(w, info(s))
+}
+
+func listShares(w http.ResponseWriter, r *http.Request, client *meta.Client, fileID, folderID string) {
+	table, id := "files", fileID
+	if fileID == "" {
+		table, id = "folders", folderID
+	}
+	if id == "" {
+		http.Error(w, "fileId or folderId is required", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorize(w, r, client, table, id, acl.Read, false); !ok {
+		return
+	}
+	var rows []share.Share
+	var err error
+	if fileID != "" {
+		rows, err = share.List(client, fileID)
+	} else {
+		rows, err = share.ListFolder(client, folderID)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	out := make([]ShareInfo, 0, len(rows))
+	for i := range rows {
+		out = append(out, info(&rows[i]))
+	}
+	writeJSON(w, map[string]interface{}{"shares": out})
+}
+
+func describeShare(w http.ResponseWriter, client *meta.Client, id string) {
+	s, err := share.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.Legacy && !s.Active() {
+		writeError(w, share.ErrGone)
+		return
+	}
+	if s.IsFolder() {
+		t, err := client.GetTree(s.FolderID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, PublicInfo{
+			Name:             t.Root.Name,
+			Size:             t.Size(),
+			Type:             "folder",
+			Folder:           true,
+			Files:            len(t.Files),
+			PasswordRequired: s.NeedsPassword(),
+			ExpiresAt:        s.ExpiresAt,
+			DownloadsLeft:    s.DownloadsLeft(),
+		})
+		return
+	}
+	f, err := client.GetFile(s.FileID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, PublicInfo{
+		Name:             f.Name,
+		Size:             f.Size,
+		Type:             f.Type,
+		Mime:             f.Mime,
+		Provider:         f.MetaProvider,
+		PasswordRequired: s.NeedsPassword(),
+		KeyInLink:        s.KeyInLink(),
+		ExpiresAt:        s.ExpiresAt,
+		DownloadsLeft:    s.DownloadsLeft(),
+	})
+}
+
+func openShare(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	var req OpenRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	s, err := share.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var f *meta.File
+	if s.IsFolder() {
+		t, err := share.Tree(client, s, req.Password)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if req.FileID == "" {
+			writeJSON(w, listing(t))
+			return
+		}
+		tf := t.Find(req.FileID)
+		if tf == nil {
+			writeError(w, meta.ErrNotFound)
+			return
+		}
+		if err := share.Use(client, s, req.Password); err != nil {
+			writeError(w, err)
+			return
+		}
+		f = &tf.File
+	} else if f, err = share.Open(client, s, req.Password); err != nil {
+		writeError(w, err)
+		return
+	}
+	links, err := f.Links()
+	if err != nil {
+		http.Error(w, "File metadata is corrupted", http.StatusInternalServerError)
+		return
+	}
+	fmt.Printf("[SHARE] Opened %s (%d downloads)\n", s.ID, s.DownloadCount)
+	m := Manifest{
+		ID:       f.ID,
+		Name:     f.Name,
+		Size:     f.Size,
+		Type:     f.Type,
+		Mime:     f.Mime,
+		Provider: f.MetaProvider,
+		Links:    links,
+	}
+	if s.KeyInLink() {
+		m.WrappedKey = *s.WrappedKey
+	} else {
+		m.Key = f.MetaKey
+	}
+	writeJSON(w, m)
+}
+
+// zipShare streams the whole folder as a ZIP. The password comes as a form
+// field so the browser can download straight to disk with a plain form
+// submit.
+func zipShare(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	s, err := share.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if !s.IsFolder() {
+		http.Error(w, "ZIP download is only available for folder links", http.StatusBadRequest)
+		return
+	}
+	password := r.FormValue("password")
+	t, err := share.Tree(client, s, password)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := share.Use(client, s, password); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": t.Root.Name + ".zip"}))
+	w.Header().Set("Cache-Control", "no-store")
+
+	fmt.Printf("[SHARE] Zipping %s: %d files, %d bytes\n", s.ID, len(t.Files), t.Size())
+	if err := content.WriteZip(w, client, t); err != nil {
+		// The status line is already sent; drop the connection so the
+		// browser reports a failed download instead of a truncated ZIP.
+		fmt.Printf("[SHARE] ZIP %s failed: %v\n", s.ID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func listing(t *meta.Tree) Listing {
+	out := Listing{
+		Name:    t.Root.Name,
+		Size:    t.Size(),
+		Folders: make([]string, 0, len(t.Folders)),
+		Files:   make([]ListingEntry, 0, len(t.Files)),
+	}
+	for _, d := range t.Folders {
+		out.Folders = append(out.Folders, d.Path)
+	}
+	for _, tf := range t.Files {
+		out.Files = append(out.Files, ListingEntry{
+			ID:       tf.File.ID,
+			Path:     tf.Path,
+			Name:     tf.File.Name,
+			Size:     tf.File.Size,
+			Type:     tf.File.Type,
+			Mime:     tf.File.Mime,
+			Provider: tf.File.MetaProvider,
+		})
+	}
+	return out
+}
+
+func revokeShare(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	s, err := share.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	table, item := "files", s.FileID
+	if s.IsFolder() {
+		table, item = "folders", s.FolderID
+	}
+	if _, ok := authorize(w, r, client, table, item, acl.Write, false); !ok {
+		return
+	}
+	if err := share.Revoke(client, s); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[SHARE] Revoked %s\n", id)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+func info(s *share.Share) ShareInfo {
+	return ShareInfo{
+		ID:            s.ID,
+		FileID:        s.FileID,
+		FolderID:      s.FolderID,
+		HasPassword:   s.NeedsPassword(),
+		KeyInLink:     s.KeyInLink(),
+		ExpiresAt:     s.ExpiresAt,
+		MaxDownloads:  s.MaxDownloads,
+		DownloadCount: s.DownloadCount,
+		Revoked:       s.RevokedAt != nil,
+		Active:        s.Active(),
+		CreatedAt:     s.CreatedAt,
+	}
+}
+
+// authorize checks the link owner's requests: the shared file or folder
+// must be in their workspace, and they need level on it. With whole set,
+// for a new folder link, they also need read access to everything under
+// the folder, since the link gives all of it out. The recipient's
+// requests are allowed by the link itself.
+func authorize(w http.ResponseWriter, r *http.Request, client *meta.Client, table, id, level string, whole bool) (*meta.Client, bool) {
+	a, err := workspace.Resolve(client, r, workspace.Guest)
+	var k *acl.Checker
+	if err == nil {
+		err = workspace.Owns(a.Client, table, id)
+	}
+	if err == nil {
+		k, err = acl.New(a)
+	}
+	if err == nil {
+		err = k.Require(table, id, level)
+	}
+	if err == nil && whole && table == "folders" {
+		err = k.RequireTree(id, acl.Read)
+	}
+	if err != nil {
+		workspace.WriteError(w, err)
+		return nil, false
+	}
+	return a.Client, true
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case meta.ErrNotFound:
+		http.Error(w, "Share link not found", http.StatusNotFound)
+	case share.ErrGone:
+		http.Error(w, err.Error(), http.StatusGone)
+	case share.ErrWrappedKey, share.ErrFolderKey:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case share.ErrPassword:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	default:
+		fmt.Printf("[SHARE] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
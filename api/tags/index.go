@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/tags"
+	"teddrive-web/lib/workspace"
+)
+
+// LabelRequest is the body of POST /api/tags. Exactly one of FileID and
+// FolderID is set. Tags replaces the tags, then Add and Remove adjust
+// them; Metadata is merged in, and a null value removes its key.
+//
+//	{"fileId":"1712345678901","add":["final"],"metadata":{"release":"2.4","draft":null}}
+type LabelRequest struct {
+	FileID   string             `json:"fileId,omitempty"`
+	FolderID string             `json:"folderId,omitempty"`
+	Tags     []string           `json:"tags,omitempty"`
+	Add      []string           `json:"add,omitempty"`
+	Remove   []string           `json:"remove,omitempty"`
+	Metadata map[string]*string `json:"metadata,omitempty"`
+}
+
+// Handler shows (GET ?fileId= or ?folderId=) and changes (POST) the tags
+// and metadata of a file or folder. Changing them needs write access.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+
+	var req LabelRequest
+	if r.Method == "POST" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+	} else {
+		req.FileID, req.FolderID = r.URL.Query().Get("fileId"), r.URL.Query().Get("folderId")
+	}
+	if (req.FileID == "") == (req.FolderID == "") {
+		http.Error(w, "Exactly one of fileId and folderId is required", http.StatusBadRequest)
+		return
+	}
+	table, id := "files", req.FileID
+	if req.FolderID != "" {
+		table, id = "folders", req.FolderID
+	}
+
+	if r.Method == "GET" {
+		if err := acl.Require(access, table, id, acl.Read); err != nil {
+			writeError(w, err)
+			return
+		}
+		labels, err := tags.Get(access.Client, table, id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, labels)
+		return
+	}
+
+	if err := acl.Require(access, table, id, acl.Write); err != nil {
+		writeError(w, err)
+		return
+	}
+	labels, err := tags.Apply(access.Client, table, id, tags.Change{
+		Tags:     req.Tags,
+		Add:      req.Add,
+		Remove:   req.Remove,
+		Metadata: req.Metadata,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[TAGS] %s %s: %d tag(s), %d metadata key(s)\n", table, id, len(labels.Tags), len(labels.Metadata))
+	writeJSON(w, labels)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, tags.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, tags.ErrDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		workspace.WriteError(w, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
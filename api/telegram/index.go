@@ -1,20 +1,20 @@
 package handler
 
 import (
-    "bytes"
-    "crypto/aes"
-    "crypto/cipher"
-    "crypto/rand"
     "encoding/base64"
     "encoding/json"
     "fmt"
     "io"
-    "mime/multipart"
     "net/http"
     "os"
-    "regexp"
     "strings"
-    "time"
+
+    "teddrive-web/lib/acl"
+    "teddrive-web/lib/messages"
+    "teddrive-web/lib/meta"
+    "teddrive-web/lib/quota"
+    "teddrive-web/lib/storage"
+    "teddrive-web/lib/workspace"
 )
 
 type UploadResponse struct {
@@ -25,7 +25,7 @@ func Handler(w http.ResponseWriter, r *http.Request) {
     // Set CORS headers first
     w.Header().Set("Access-Control-Allow-Origin", "*")
     w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-    w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+    w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
     
     if r.Method == "OPTIONS" {
         w.WriteHeader(http.StatusOK)
@@ -40,9 +40,40 @@ func Handler(w http.ResponseWriter, r *http.Request) {
     // Immediate logging
     fmt.Println("[TELEGRAM] Upload handler started")
 
+    // Parse form - Telegram supports larger files (50MB)
+    err := r.ParseMultipartForm(50 << 20) // 50MB limit for Telegram
+    if err != nil {
+        fmt.Printf("[ERROR] Parse form failed: %v\n", err)
+        http.Error(w, "Parse form failed", http.StatusBadRequest)
+        return
+    }
+    defer r.MultipartForm.RemoveAll()
+
+    fmt.Println("[PARSE] Form parsed successfully")
+
+    // The caller's workspace decides where the chunk goes and whose quota
+    // it counts against. Without Supabase there are no workspaces, and
+    // nothing is counted.
+    client, _ := meta.FromEnv()
+    if client != nil {
+        // Same check as /api/discord: write access to the target folder.
+        access, err := workspace.Resolve(client, r, workspace.Guest)
+        if err == nil {
+            err = acl.Require(access, "folders", r.FormValue("folderId"), acl.Write)
+        }
+        if err != nil {
+            workspace.WriteError(w, err)
+            return
+        }
+        client = access.Client
+    }
+
     // Check Telegram environment variables
     token := strings.TrimSpace(os.Getenv("TELEGRAM_BOT_TOKEN"))
-    chatID := strings.TrimSpace(os.Getenv("TELEGRAM_CHAT_ID"))
+    chatID := client.Target("telegram")
+    if chatID == "" {
+        chatID = strings.TrimSpace(os.Getenv("TELEGRAM_CHAT_ID"))
+    }
     
     fmt.Printf("[DEBUG] Token length: %d\n", len(token))
     fmt.Printf("[DEBUG] Chat ID: %s\n", chatID)
@@ -57,17 +88,6 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
     fmt.Println("[ENV] Telegram credentials OK")
 
-    // Parse form - Telegram supports larger files (50MB)
-    err := r.ParseMultipartForm(50 << 20) // 50MB limit for Telegram
-    if err != nil {
-        fmt.Printf("[ERROR] Parse form failed: %v\n", err)
-        http.Error(w, "Parse form failed", http.StatusBadRequest)
-        return
-    }
-    defer r.MultipartForm.RemoveAll()
-
-    fmt.Println("[PARSE] Form parsed successfully")
-
     // Get form values
     keyBase64 := r.FormValue("keyBase64")
     fileName := r.FormValue("fileName")
@@ -110,128 +130,51 @@ func Handler(w http.ResponseWriter, r *http.Request) {
 
     fmt.Println("[CRYPTO] Key decoded")
 
-    // Encrypt
-    block, err := aes.NewCipher(key)
+    // Encrypt (nonce + ciphertext), compressing first when asked to
+    var encryptedData []byte
+    if r.FormValue("compress") == "1" {
+        encryptedData, err = storage.SealCompressed(key, fileData, fileName)
+    } else {
+        encryptedData, err = storage.SealChunk(key, fileData)
+    }
     if err != nil {
         http.Error(w, "Cipher error", http.StatusInternalServerError)
         return
     }
 
-    gcm, err := cipher.NewGCM(block)
-    if err != nil {
-        http.Error(w, "GCM error", http.StatusInternalServerError)
+    fmt.Printf("[ENCRYPT] Encrypted to %d bytes\n", len(encryptedData))
+
+    // Book the bytes against the storage quota
+    stored := int64(len(encryptedData))
+    if err := quota.Reserve(client, quota.Tenant(client), "telegram", stored); err != nil {
+        quota.WriteError(w, err)
         return
     }
 
-    nonce := make([]byte, gcm.NonceSize())
-    rand.Read(nonce)
-
-    ciphertext := gcm.Seal(nil, nonce, fileData, nil)
-    
-    // Combine nonce + ciphertext
-    encryptedData := append(nonce, ciphertext...)
-
-    fmt.Printf("[ENCRYPT] Encrypted to %d bytes\n", len(encryptedData))
-
     // Upload to Telegram
-    link, err := uploadToTelegram(fileName, encryptedData, token, chatID)
+    loc, err := storage.NewTelegram(token, chatID).Upload(fileName, encryptedData)
     if err != nil {
         fmt.Printf("[ERROR] Upload failed: %v\n", err)
+        if err := quota.Release(client, quota.Tenant(client), "telegram", stored); err != nil {
+            fmt.Printf("[WARN] Releasing quota failed: %v\n", err)
+        }
         // Return more detailed error to frontend
         errorMsg := fmt.Sprintf("Telegram upload failed: %v", err)
         http.Error(w, errorMsg, http.StatusInternalServerError)
         return
     }
 
-    fmt.Printf("[SUCCESS] Uploaded: %s\n", link)
+    fmt.Printf("[SUCCESS] Uploaded: %s\n", loc.Ref)
 
-    // Send response
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(UploadResponse{Link: link})
-}
-
-func uploadToTelegram(fileName string, data []byte, token, chatID string) (string, error) {
-    fmt.Printf("[TELEGRAM] Starting upload: %d bytes\n", len(data))
-
-    url := fmt.Sprintf("https://api.telegram.org/bot%s/sendDocument", token)
-    
-    // Create multipart
-    body := &bytes.Buffer{}
-    writer := multipart.NewWriter(body)
-    
-    // Add chat_id field
-    writer.WriteField("chat_id", chatID)
-    
-    // Clean filename
-    cleanName := regexp.MustCompile(`[^\w\.\-]+`).ReplaceAllString(fileName, "_")
-    
-    part, err := writer.CreateFormFile("document", cleanName+".bin")
-    if err != nil {
-        return "", err
-    }
-    
-    part.Write(data)
-    writer.Close()
-
-    // Create request
-    req, err := http.NewRequest("POST", url, body)
-    if err != nil {
-        return "", err
-    }
-    
-    req.Header.Set("Content-Type", writer.FormDataContentType())
-
-    // Make request with longer timeout for Telegram (supports larger files)
-    client := &http.Client{Timeout: 120 * time.Second}
-    resp, err := client.Do(req)
-    if err != nil {
-        return "", fmt.Errorf("HTTP request failed: %v", err)
-    }
-    defer resp.Body.Close()
-
-    respBody, _ := io.ReadAll(resp.Body)
-    fmt.Printf("[TELEGRAM] Response Status: %d\n", resp.StatusCode)
-    fmt.Printf("[TELEGRAM] Response Body: %s\n", string(respBody))
-
-    if resp.StatusCode == 401 {
-        return "", fmt.Errorf("Telegram bot token invalid or expired. Please check TELEGRAM_BOT_TOKEN")
-    }
-    
-    if resp.StatusCode == 403 {
-        return "", fmt.Errorf("Telegram bot lacks permissions or chat not found. Check TELEGRAM_CHAT_ID")
-    }
-    
-    if resp.StatusCode == 429 {
-        return "", fmt.Errorf("Telegram rate limit exceeded. Please wait and try again")
-    }
-
-    if resp.StatusCode != 200 {
-        return "", fmt.Errorf("Telegram API error %d: %s", resp.StatusCode, string(respBody))
-    }
-
-    // Parse response
-    var result map[string]interface{}
-    if err := json.Unmarshal(respBody, &result); err != nil {
-        return "", fmt.Errorf("Failed to parse Telegram response: %v", err)
-    }
-
-    // Check if ok
-    if ok, exists := result["ok"].(bool); !exists || !ok {
-        errorMsg := "Unknown error"
-        if desc, ok := result["description"].(string); ok {
-            errorMsg = desc
+    // Remember the message so the chunk can be deleted when its file is
+    // purged from the trash; a file_id alone can't be traced back to it.
+    if client != nil {
+        if err := messages.Record(client, []storage.Locator{loc}); err != nil {
+            fmt.Printf("[WARN] Recording message failed: %v\n", err)
         }
-        return "", fmt.Errorf("Telegram API error: %s", errorMsg)
     }
 
-    // Get file_id from result
-    if resultData, ok := result["result"].(map[string]interface{}); ok {
-        if document, ok := resultData["document"].(map[string]interface{}); ok {
-            if fileID, ok := document["file_id"].(string); ok {
-                return fileID, nil
-            }
-        }
-    }
-
-    return "", fmt.Errorf("No file_id in Telegram response")
-}
\ No newline at end of file
+    // Send response
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(UploadResponse{Link: loc.Ref})
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/trash"
+	"teddrive-web/lib/workspace"
+)
+
+// DeleteRequest is the body of POST /api/trash. Exactly one of FileID and
+// FolderID is set.
+type DeleteRequest struct {
+	FileID   string `json:"fileId,omitempty"`
+	FolderID string `json:"folderId,omitempty"`
+}
+
+// PurgeRequest is the body of POST /api/trash/purge, which deletes expired
+// items for good. Repeat it until more is false.
+type PurgeRequest struct {
+	MaxItems int `json:"maxItems,omitempty"`
+}
+
+// Items purged per call when maxItems is not given. A folder with many
+// files takes a while, since every chunk's message is deleted one by one.
+const defaultPurgeItems = 5
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// The purge job covers every workspace; everything else only the
+	// caller's.
+	if r.URL.Query().Get("purge") != "" && r.Method == "POST" {
+		purgeExpired(w, r, client)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	checker, err := acl.New(access)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	client = access.Client
+
+	id := r.URL.Query().Get("id")
+	switch {
+	case id == "" && r.Method == "GET":
+		listTrash(w, client, checker)
+	case id == "" && r.Method == "POST":
+		moveToTrash(w, r, client, checker)
+	case id != "" && (r.Method == "POST" || r.Method == "DELETE"):
+		if err := requireItem(client, checker, id); err != nil {
+			writeError(w, err)
+			return
+		}
+		if r.Method == "POST" {
+			restoreItem(w, client, id)
+		} else {
+			purgeItem(w, client, id)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listTrash lists the items the caller may read.
+func listTrash(w http.ResponseWriter, client *meta.Client, checker *acl.Checker) {
+	days := int(trash.Retention() / (24 * time.Hour))
+	items, err := trash.List(client)
+	if errors.Is(err, trash.ErrDisabled) {
+		writeJSON(w, map[string]interface{}{"items": []trash.Item{}, "enabled": false, "retentionDays": days})
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	visible := []trash.Item{}
+	for _, it := range items {
+		level, err := checker.Level(itemTable(it), it.ID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if level != acl.Deny {
+			visible = append(visible, it)
+		}
+	}
+	writeJSON(w, map[string]interface{}{"items": visible, "enabled": true, "retentionDays": days})
+}
+
+// requireItem checks the caller may write trash item id before it is
+// restored or purged.
+func requireItem(client *meta.Client, checker *acl.Checker, id string) error {
+	items, err := trash.List(client)
+	if err != nil {
+		return err
+	}
+	for _, it := range items {
+		if it.ID == id {
+			return checker.Require(itemTable(it), id, acl.Write)
+		}
+	}
+	return meta.ErrNotFound
+}
+
+func itemTable(it trash.Item) string {
+	if it.Folder {
+		return "folders"
+	}
+	return "files"
+}
+
+func moveToTrash(w http.ResponseWriter, r *http.Request, client *meta.Client, checker *acl.Checker) {
+	var req DeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if (req.FileID == "") == (req.FolderID == "") {
+		http.Error(w, "Exactly one of fileId and folderId is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if req.FileID != "" {
+		if err = checker.Require("files", req.FileID, acl.Write); err == nil {
+			err = trash.File(client, req.FileID)
+		}
+	} else {
+		if err = checker.RequireTree(req.FolderID, acl.Write); err == nil {
+			err = trash.Folder(client, req.FolderID)
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[TRASH] Deleted %s%s\n", req.FileID, req.FolderID)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+func restoreItem(w http.ResponseWriter, client *meta.Client, id string) {
+	if err := trash.Restore(client, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[TRASH] Restored %s\n", id)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+func purgeItem(w http.ResponseWriter, client *meta.Client, id string) {
+	if err := trash.Purge(client, id); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[TRASH] Purged %s\n", id)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+// purgeExpired is the purge job, for a cron that calls it with the admin
+// token.
+func purgeExpired(w http.ResponseWriter, r *http.Request, client *meta.Client) {
+	if !auth.AdminEnabled() {
+		http.Error(w, "Admin API disabled - set TEDDRIVE_ADMIN_TOKEN", http.StatusServiceUnavailable)
+		return
+	}
+	if !auth.IsAdmin(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var req PurgeRequest
+	json.NewDecoder(r.Body).Decode(&req)
+	if req.MaxItems <= 0 {
+		req.MaxItems = defaultPurgeItems
+	}
+
+	items, err := trash.Expired(client, trash.Retention())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	purged, failed := 0, 0
+	for _, it := range items {
+		if purged+failed >= req.MaxItems {
+			break
+		}
+		if err := trash.Purge(client, it.ID); err != nil {
+			fmt.Printf("[TRASH] Purging %s (%s) failed: %v\n", it.ID, it.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("[TRASH] Purged %s (%s)\n", it.ID, it.Name)
+		purged++
+	}
+	writeJSON(w, map[string]interface{}{
+		"purged": purged,
+		"failed": failed,
+		"more":   len(items) > purged+failed,
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, meta.ErrNotFound):
+		http.Error(w, "Not found in the trash", http.StatusNotFound)
+	case errors.Is(err, workspace.ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, trash.ErrDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		fmt.Printf("[TRASH] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
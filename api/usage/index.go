@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/workspace"
+)
+
+// RecountRequest is the body of POST /api/usage, which rebuilds the
+// counters from the file metadata: {"action":"recount"}.
+type RecountRequest struct {
+	Action string `json:"action"`
+}
+
+// Handler reports the bytes the caller's workspace has stored on each
+// provider, and its storage quota.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Viewer)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	client = access.Client
+
+	var u *quota.Usage
+	switch r.Method {
+	case "GET":
+		u, err = quota.Get(client, quota.Tenant(client))
+	case "POST":
+		if !auth.AdminEnabled() {
+			http.Error(w, "Admin API disabled - set TEDDRIVE_ADMIN_TOKEN", http.StatusServiceUnavailable)
+			return
+		}
+		if !auth.IsAdmin(r) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var req RecountRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Action != "recount" {
+			http.Error(w, "Unknown action", http.StatusBadRequest)
+			return
+		}
+		u, err = quota.Recount(client)
+		if err == nil {
+			fmt.Printf("[USAGE] Recounted %s: %d bytes\n", u.Tenant, u.Used)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if errors.Is(err, quota.ErrDisabled) {
+		writeJSON(w, map[string]interface{}{"enabled": false})
+		return
+	}
+	if err != nil {
+		fmt.Printf("[USAGE] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, map[string]interface{}{
+		"enabled":   true,
+		"tenant":    u.Tenant,
+		"used":      u.Used,
+		"limit":     u.Limit,
+		"remaining": u.Remaining,
+		"providers": u.Providers,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,254 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/versions"
+	"teddrive-web/lib/workspace"
+)
+
+// RevisionRequest is the body of POST /api/versions?fileId=: the chunks of
+// content the browser has uploaded to replace the file with. BaseKey is the
+// meta_key of the revision the browser saw as current; if the file changed
+// since, nothing is saved and 409 is returned.
+type RevisionRequest struct {
+	Size     int64    `json:"size"`
+	Key      string   `json:"key"`
+	Links    []string `json:"links"`
+	Provider string   `json:"provider"`
+	SHA256   string   `json:"sha256,omitempty"`
+	BaseKey  string   `json:"baseKey"`
+}
+
+// VersionInfo is one entry of a file's history. The current revision comes
+// first, with Current set and no ID.
+type VersionInfo struct {
+	ID        string  `json:"id,omitempty"`
+	Current   bool    `json:"current"`
+	Size      int64   `json:"size"`
+	Provider  string  `json:"provider"`
+	SHA256    *string `json:"sha256"`
+	CreatedAt string  `json:"createdAt,omitempty"`
+}
+
+// Manifest is everything the browser needs to fetch and decrypt one
+// revision.
+type Manifest struct {
+	Name     string   `json:"name"`
+	Size     int64    `json:"size"`
+	Type     string   `json:"type"`
+	Mime     string   `json:"mime"`
+	Provider string   `json:"provider"`
+	Key      string   `json:"key"`
+	Links    []string `json:"links"`
+}
+
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	fileID := r.URL.Query().Get("fileId")
+	id := r.URL.Query().Get("id")
+	if fileID == "" {
+		http.Error(w, "fileId is required", http.StatusBadRequest)
+		return
+	}
+	access, err := workspace.Resolve(client, r, workspace.Guest)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	level := acl.Write
+	if r.Method == "GET" {
+		level = acl.Read
+	}
+	if err := acl.Require(access, "files", fileID, level); err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	client = access.Client
+	f, err := client.GetFile(fileID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == "GET":
+		listVersions(w, client, f)
+	case id == "" && r.Method == "POST":
+		addRevision(w, r, client, f)
+	case id != "" && r.Method == "GET":
+		getVersion(w, client, f, id)
+	case id != "" && r.Method == "POST":
+		restoreVersion(w, client, f, id)
+	case id != "" && r.Method == "DELETE":
+		deleteVersion(w, client, f, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listVersions(w http.ResponseWriter, client *meta.Client, f *meta.File) {
+	out := []VersionInfo{{
+		Current:   true,
+		Size:      f.Size,
+		Provider:  f.MetaProvider,
+		SHA256:    f.SHA256,
+		CreatedAt: f.UpdatedAt,
+	}}
+	ok, err := versions.Installed(client)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if ok {
+		vs, err := versions.List(client, f.ID)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		for _, v := range vs {
+			out = append(out, VersionInfo{
+				ID:        v.ID,
+				Size:      v.Size,
+				Provider:  v.MetaProvider,
+				SHA256:    v.SHA256,
+				CreatedAt: v.CreatedAt,
+			})
+		}
+	}
+	writeJSON(w, map[string]interface{}{"versions": out, "enabled": ok})
+}
+
+func addRevision(w http.ResponseWriter, r *http.Request, client *meta.Client, f *meta.File) {
+	var req RevisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Key == "" || req.Provider == "" || (len(req.Links) == 0 && req.Size > 0) {
+		http.Error(w, "key, provider and links are required", http.StatusBadRequest)
+		return
+	}
+	if req.BaseKey != f.MetaKey {
+		writeError(w, versions.ErrChanged)
+		return
+	}
+	links, err := json.Marshal(req.Links)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	next := versions.Content{
+		Size:         req.Size,
+		MetaKey:      req.Key,
+		MetaLinks:    string(links),
+		MetaProvider: req.Provider,
+	}
+	if req.SHA256 != "" {
+		next.SHA256 = &req.SHA256
+	}
+	if err := versions.Replace(client, f, next); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[VERSIONS] New revision of %s (%d bytes)\n", f.ID, f.Size)
+	writeManifest(w, f)
+}
+
+func getVersion(w http.ResponseWriter, client *meta.Client, f *meta.File, id string) {
+	v, err := versions.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if v.FileID != f.ID {
+		writeError(w, meta.ErrNotFound)
+		return
+	}
+	writeManifest(w, v.File(f))
+}
+
+func restoreVersion(w http.ResponseWriter, client *meta.Client, f *meta.File, id string) {
+	v, err := versions.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := versions.Restore(client, f, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[VERSIONS] Restored %s to %s\n", f.ID, v.ID)
+	writeManifest(w, f)
+}
+
+func deleteVersion(w http.ResponseWriter, client *meta.Client, f *meta.File, id string) {
+	v, err := versions.Get(client, id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if v.FileID != f.ID {
+		writeError(w, meta.ErrNotFound)
+		return
+	}
+	if err := versions.Delete(client, v); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Printf("[VERSIONS] Deleted %s of %s\n", v.ID, f.ID)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+func writeManifest(w http.ResponseWriter, f *meta.File) {
+	links, err := f.Links()
+	if err != nil {
+		http.Error(w, "File metadata is corrupted", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, Manifest{
+		Name:     f.Name,
+		Size:     f.Size,
+		Type:     f.Type,
+		Mime:     f.Mime,
+		Provider: f.MetaProvider,
+		Key:      f.MetaKey,
+		Links:    links,
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, meta.ErrNotFound):
+		http.Error(w, "File or version not found", http.StatusNotFound)
+	case errors.Is(err, versions.ErrChanged):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		fmt.Printf("[VERSIONS] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
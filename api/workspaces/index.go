@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/workspace"
+)
+
+// MemberRequest is the body of POST /api/workspaces/{id}/members, which
+// adds a member or changes their role.
+type MemberRequest struct {
+	UserID string `json:"userId"`
+	Role   string `json:"role"`
+}
+
+// WorkspaceInfo describes a workspace and the caller's role in it.
+type WorkspaceInfo struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	DiscordChannelID *string `json:"discordChannelId"`
+	TelegramChatID   *string `json:"telegramChatId"`
+	Public           bool    `json:"public"`
+	Role             string  `json:"role"`
+}
+
+// MemberInfo is one member of a workspace.
+type MemberInfo struct {
+	UserID    string `json:"userId"`
+	Role      string `json:"role"`
+	CreatedAt string `json:"createdAt,omitempty"`
+}
+
+// Handler manages workspaces and their members. Creating a workspace needs
+// a signed-in user, who becomes its owner; changing one needs its owner.
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Workspace")
+
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	userID, err := auth.UserID(r)
+	if err != nil {
+		workspace.WriteError(w, workspace.ErrUnauthorized)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	members := r.URL.Query().Get("members") != ""
+	switch {
+	case id == "" && r.Method == "GET":
+		listWorkspaces(w, r, client, userID)
+	case id == "" && r.Method == "POST":
+		createWorkspace(w, r, client, userID)
+	case id != "" && !members && r.Method == "POST":
+		updateWorkspace(w, r, client, id)
+	case id != "" && members && r.Method == "GET":
+		listMembers(w, r, client, id)
+	case id != "" && members && r.Method == "POST":
+		setMember(w, r, client, id)
+	case id != "" && members && r.Method == "DELETE":
+		removeMember(w, r, client, id, userID)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listWorkspaces(w http.ResponseWriter, r *http.Request, client *meta.Client, userID string) {
+	entries, err := workspace.List(client, userID, auth.IsAdmin(r))
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	enabled, err := workspace.Installed(client)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	out := make([]WorkspaceInfo, 0, len(entries))
+	for i := range entries {
+		out = append(out, info(&entries[i].Workspace, entries[i].Role))
+	}
+	writeJSON(w, map[string]interface{}{"workspaces": out, "enabled": enabled, "userId": userID})
+}
+
+func createWorkspace(w http.ResponseWriter, r *http.Request, client *meta.Client, userID string) {
+	if userID == "" && !auth.IsAdmin(r) {
+		workspace.WriteError(w, workspace.ErrUnauthorized)
+		return
+	}
+	var req workspace.Settings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	ws, err := workspace.Create(client, userID, req)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	fmt.Printf("[WORKSPACE] Created %s (%q) for %s\n", ws.ID, ws.Name, userID)
+	writeJSON(w, info(ws, workspace.Owner))
+}
+
+func updateWorkspace(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	access, err := workspace.Authorize(client, r, id, workspace.Owner)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	var req workspace.Settings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	ws, err := workspace.Update(client, id, req)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	fmt.Printf("[WORKSPACE] Updated %s\n", id)
+	writeJSON(w, info(ws, access.Role))
+}
+
+func listMembers(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	if _, err := workspace.Authorize(client, r, id, workspace.Viewer); err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	rows, err := workspace.Members(client, id)
+	if err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	out := make([]MemberInfo, 0, len(rows))
+	for _, m := range rows {
+		out = append(out, MemberInfo{UserID: m.UserID, Role: m.Role, CreatedAt: m.CreatedAt})
+	}
+	writeJSON(w, map[string]interface{}{"members": out})
+}
+
+func setMember(w http.ResponseWriter, r *http.Request, client *meta.Client, id string) {
+	if _, err := workspace.Authorize(client, r, id, workspace.Owner); err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	var req MemberRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := workspace.SetMember(client, id, req.UserID, req.Role); err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	fmt.Printf("[WORKSPACE] %s: %s is now %s\n", id, req.UserID, req.Role)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+// removeMember takes ?userId= out of the workspace. Owners can remove
+// anyone; members can leave.
+func removeMember(w http.ResponseWriter, r *http.Request, client *meta.Client, id, userID string) {
+	member := r.URL.Query().Get("userId")
+	role := workspace.Owner
+	if member != "" && member == userID {
+		role = workspace.Viewer
+	}
+	if _, err := workspace.Authorize(client, r, id, role); err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	if err := workspace.RemoveMember(client, id, member); err != nil {
+		workspace.WriteError(w, err)
+		return
+	}
+	fmt.Printf("[WORKSPACE] %s: removed %s\n", id, member)
+	writeJSON(w, map[string]interface{}{"ok": true})
+}
+
+func info(ws *workspace.Workspace, role string) WorkspaceInfo {
+	return WorkspaceInfo{
+		ID:               ws.ID,
+		Name:             ws.Name,
+		DiscordChannelID: ws.DiscordChannelID,
+		TelegramChatID:   ws.TelegramChatID,
+		Public:           ws.Public,
+		Role:             role,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
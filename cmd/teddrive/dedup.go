@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"teddrive-web/lib/dedup"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+)
+
+func runDedup(args []string) error {
+	fs := flag.NewFlagSet("dedup", flag.ExitOnError)
+	gc := fs.Bool("gc", false, "drop unreferenced chunks from the index")
+	grace := fs.Duration("grace", 24*time.Hour, "only touch chunks released longer ago than this")
+	fs.Parse(args)
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	chunks, err := dedup.Unreferenced(client, *grace)
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, ch := range chunks {
+		total += int64(ch.Size)
+	}
+	fmt.Printf("%d unreferenced chunk(s), %d bytes\n", len(chunks), total)
+	if !*gc {
+		return nil
+	}
+
+	for _, ch := range chunks {
+		if err := dedup.Forget(client, ch.ID); err != nil {
+			return err
+		}
+		// The provider copy stays behind; log it so it can be cleaned up.
+		// It no longer counts towards the quota, as a recount would find.
+		fmt.Printf("dropped %s  %s\n", ch.ID, ch.Link)
+		tenant := quota.DefaultTenant
+		if ch.WorkspaceID != nil {
+			tenant = *ch.WorkspaceID
+		}
+		if err := quota.Release(client, tenant, storage.DedupProvider, int64(ch.Size)+storage.SealOverhead); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"teddrive-web/lib/imports"
+	"teddrive-web/lib/workspace"
+)
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	folder := fs.String("folder", "", "folder ID to import into (default: top level)")
+	name := fs.String("name", "", "file name (default from the server or the URL)")
+	provider := fs.String("provider", "discord", "provider to store on: discord, telegram or erasure")
+	status := fs.Bool("status", false, "list unfinished imports and exit")
+	retry := fs.Bool("retry", false, "also resume failed imports")
+	batch := fs.Int("batch", 4, "chunks to store between progress reports")
+	fs.Parse(args)
+
+	// The workspace comes from TEDDRIVE_WORKSPACE.
+	client, err := workspace.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	if *status {
+		jobs, err := imports.Unfinished(client)
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			fmt.Printf("%s  %-8s  %s  %s  %s  %s\n", j.ID, j.Status, progress(&j), j.Name, j.URL, j.Error)
+		}
+		return nil
+	}
+	if *name != "" && fs.NArg() > 1 {
+		return fmt.Errorf("-name needs a single URL")
+	}
+
+	for _, u := range fs.Args() {
+		job, err := imports.Enqueue(client, "", imports.Request{URL: u, Name: *name, FolderID: *folder, Provider: *provider})
+		if err != nil {
+			return fmt.Errorf("%s: %v", u, err)
+		}
+		fmt.Printf("Queued %s as %s\n", u, job.ID)
+	}
+
+	// Without URLs this resumes whatever is unfinished.
+	jobs, err := imports.Unfinished(client)
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for i := range jobs {
+		j := &jobs[i]
+		if j.Status == imports.StatusFailed {
+			if !*retry {
+				continue
+			}
+			if err := imports.Retry(client, j); err != nil {
+				return err
+			}
+		}
+		for j.Status == imports.StatusPending || j.Status == imports.StatusRunning {
+			_, err := imports.Step(client, j, *batch)
+			if errors.Is(err, imports.ErrBusy) {
+				fmt.Printf("Skipping %s: %v\n", j.ID, err)
+				break
+			}
+			if err != nil && j.Status != imports.StatusFailed {
+				return err
+			}
+			fmt.Printf("%s  %s  %s\n", j.ID, progress(j), j.Name)
+		}
+		switch j.Status {
+		case imports.StatusDone:
+			fmt.Printf("Imported %s as file %s\n", j.Name, *j.FileID)
+		case imports.StatusFailed:
+			failed++
+			fmt.Printf("FAILED %s (%s): %s\n", j.ID, j.URL, j.Error)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d import(s) failed; run again with -retry to resume them", failed)
+	}
+	return nil
+}
+
+// progress formats the bytes a job has stored, out of its size if known.
+func progress(j *imports.Job) string {
+	if j.Size == nil {
+		return fmt.Sprintf("%d bytes", j.DoneBytes)
+	}
+	return fmt.Sprintf("%d/%d bytes", j.DoneBytes, *j.Size)
+}
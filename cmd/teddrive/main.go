@@ -0,0 +1,61 @@
+// Command teddrive is the command-line companion to the TEDDRIVE web app.
+// It reads the same environment variables as the API functions.
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"migrate", "copy files to another provider or channel", runMigrate},
+	{"dedup", "report and collect unreferenced dedup chunks", runDedup},
+	{"webdav", "serve the drive over WebDAV", runWebDAV},
+	{"s3", "serve the drive over an S3-compatible API", runS3},
+	{"mount", "mount the drive as a filesystem (Linux)", runMount},
+	{"sync", "keep a local directory and a drive folder in sync", runSync},
+	{"trash", "list and purge expired items in the trash", runTrash},
+	{"usage", "show stored bytes and the storage quota", runUsage},
+	{"import", "fetch files from URLs into the drive", runImport},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, cmd := range commands {
+		if cmd.name == os.Args[1] {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, "teddrive:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: teddrive <command> [flags]")
+	fmt.Fprintln(os.Stderr)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+// envOr returns the environment variable, or def when it is unset or blank.
+func envOr(name, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
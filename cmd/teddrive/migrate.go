@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/migrate"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	fileID := fs.String("file", "", "migrate a single file by ID")
+	from := fs.String("from", "", "migrate every file with chunks on this provider")
+	fromTarget := fs.String("from-target", "", "only files with chunks on this channel (Discord) or in erasure shards on this target")
+	to := fs.String("to", "", "destination provider: discord, telegram or erasure")
+	toTarget := fs.String("to-target", "", "destination channel or chat ID (default from env)")
+	status := fs.Bool("status", false, "list migration jobs and exit")
+	retry := fs.String("retry", "", "requeue a failed job by ID")
+	batch := fs.Int("batch", 10, "chunks to copy between progress reports")
+	fs.Parse(args)
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	if *status {
+		jobs, err := migrate.List(client, "", "")
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			fmt.Printf("%s  %-8s  file %s -> %s %s  %d/%d  %s\n",
+				j.ID, j.Status, j.FileID, j.ToProvider, j.ToTarget, j.DoneChunks, j.TotalChunks, j.Error)
+		}
+		return nil
+	}
+
+	if *retry != "" {
+		if err := migrate.Retry(client, *retry); err != nil {
+			return err
+		}
+	}
+
+	if *to != "" {
+		jobs, err := migrate.Enqueue(client,
+			migrate.Selector{FileID: *fileID, FromProvider: *from, FromTarget: *fromTarget},
+			migrate.Destination{Provider: *to, Target: *toTarget})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Queued %d file(s)\n", len(jobs))
+	}
+
+	// Without -to this resumes whatever is already queued.
+	total := 0
+	for {
+		n, err := migrate.Run(client, *batch)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+		fmt.Printf("Copied %d chunk(s) so far\n", total)
+	}
+
+	failed, err := migrate.List(client, "", migrate.StatusFailed)
+	if err != nil {
+		return err
+	}
+	for _, j := range failed {
+		fmt.Printf("FAILED %s (file %s): %s\n", j.ID, j.FileID, j.Error)
+	}
+	fmt.Printf("Done: %d chunk(s) copied\n", total)
+	return nil
+}
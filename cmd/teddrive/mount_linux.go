@@ -0,0 +1,67 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"teddrive-web/lib/fusefs"
+	"teddrive-web/lib/workspace"
+)
+
+func runMount(args []string) error {
+	fs := flag.NewFlagSet("mount", flag.ExitOnError)
+	provider := fs.String("provider", envOr("MOUNT_PROVIDER", "discord"), "provider for files written to the mount: discord, telegram, erasure or dedup")
+	cacheDir := fs.String("cache", envOr("MOUNT_CACHE_DIR", defaultCacheDir()), "directory for cached chunks and files being written")
+	cacheMB := fs.Int64("cache-size", 1024, "MB of chunks to keep in the cache")
+	debug := fs.Bool("debug", false, "log every FUSE request")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: teddrive mount [flags] <mountpoint>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := workspace.FromEnv()
+	if err != nil {
+		return err
+	}
+	server, err := fusefs.Mount(fs.Arg(0), client, fusefs.Options{
+		Provider:  *provider,
+		CacheDir:  *cacheDir,
+		CacheSize: *cacheMB << 20,
+		Debug:     *debug,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Unmount on Ctrl-C so the mountpoint isn't left dangling.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		if err := server.Unmount(); err != nil {
+			fmt.Fprintln(os.Stderr, "teddrive: unmount:", err)
+		}
+	}()
+
+	fmt.Printf("Mounted on %s (cache in %s, new files on %s); press Ctrl-C or run fusermount -u to unmount\n", fs.Arg(0), *cacheDir, *provider)
+	server.Wait()
+	return nil
+}
+
+func defaultCacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "teddrive")
+	}
+	return filepath.Join(os.TempDir(), "teddrive-cache")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/s3gw"
+)
+
+func runS3(args []string) error {
+	fs := flag.NewFlagSet("s3", flag.ExitOnError)
+	addr := fs.String("addr", ":9000", "address to listen on")
+	provider := fs.String("provider", envOr("S3_PROVIDER", "discord"), "provider for objects written over S3: discord, telegram, erasure or dedup")
+	tempDir := fs.String("tmp", envOr("S3_TMPDIR", os.TempDir()), "directory for multipart upload parts")
+	newKey := fs.Bool("new-key", false, "make an access key for -user in -workspace and exit")
+	user := fs.String("user", "", "Supabase Auth user ID a new key acts as, or whose keys -keys lists")
+	ws := fs.String("workspace", strings.TrimSpace(os.Getenv("TEDDRIVE_WORKSPACE")), "workspace a new key works in (default: the default workspace)")
+	listKeys := fs.Bool("keys", false, "list access keys, of -user when set, and exit")
+	revoke := fs.String("revoke-key", "", "delete this access key and exit")
+	fs.Parse(args)
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *newKey:
+		k, err := s3gw.NewKey(client, *user, *ws)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("access key  %s\nsecret key  %s\n", k.AccessKey, k.Secret)
+		fmt.Println("The secret is not shown again.")
+		return nil
+	case *listKeys:
+		keys, err := s3gw.Keys(client, *user)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			fmt.Printf("%s  %s  %s  %s\n", k.AccessKey, k.UserID, k.WorkspaceID, k.CreatedAt)
+		}
+		return nil
+	case *revoke != "":
+		return s3gw.RevokeKey(client, *revoke)
+	}
+
+	if _, err := s3gw.Keys(client, ""); err != nil {
+		return err
+	}
+	handler := &s3gw.Handler{
+		Client:   client,
+		Provider: *provider,
+		TempDir:  *tempDir,
+	}
+	fmt.Printf("S3 gateway listening on %s (new objects on %s)\n", *addr, *provider)
+	return http.ListenAndServe(*addr, handler)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"teddrive-web/lib/syncer"
+	"teddrive-web/lib/workspace"
+)
+
+func runSync(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	provider := fs.String("provider", envOr("SYNC_PROVIDER", "discord"), "provider for uploaded files: discord, telegram, erasure or dedup")
+	interval := fs.Duration("interval", 30*time.Second, "how often to check the drive for remote changes")
+	once := fs.Bool("once", false, "sync once and exit instead of watching")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: teddrive sync [flags] <local-dir> <remote-folder>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	client, err := workspace.FromEnv()
+	if err != nil {
+		return err
+	}
+	s, err := syncer.New(client, *provider, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	if *once {
+		return s.Sync()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("Syncing %s with %s (new files on %s); press Ctrl-C to stop\n", fs.Arg(0), fs.Arg(1), *provider)
+	return s.Watch(ctx, *interval)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/trash"
+)
+
+func runTrash(args []string) error {
+	fs := flag.NewFlagSet("trash", flag.ExitOnError)
+	purge := fs.Bool("purge", false, "delete expired items and their chunks for good")
+	after := fs.Duration("after", trash.Retention(), "items deleted longer ago than this have expired")
+	fs.Parse(args)
+
+	client, err := meta.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	items, err := trash.Expired(client, *after)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d expired item(s) in the trash\n", len(items))
+	if !*purge {
+		for _, it := range items {
+			fmt.Printf("%s  %s  %s\n", it.ID, it.DeletedAt, it.Name)
+		}
+		return nil
+	}
+
+	failed := 0
+	for _, it := range items {
+		start := time.Now()
+		if err := trash.Purge(client, it.ID); err != nil {
+			fmt.Printf("failed  %s  %s: %v\n", it.ID, it.Name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("purged  %s  %s (%s)\n", it.ID, it.Name, time.Since(start).Round(time.Millisecond))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d item(s) could not be purged; run again to retry", failed)
+	}
+	return nil
+}
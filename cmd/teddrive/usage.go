@@ -0,0 +1,48 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/workspace"
+)
+
+func runUsage(args []string) error {
+	fs := flag.NewFlagSet("usage", flag.ExitOnError)
+	recount := fs.Bool("recount", false, "rebuild the counters from the file metadata")
+	fs.Parse(args)
+
+	// The workspace comes from TEDDRIVE_WORKSPACE.
+	client, err := workspace.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	var u *quota.Usage
+	if *recount {
+		u, err = quota.Recount(client)
+	} else {
+		u, err = quota.Get(client, quota.Tenant(client))
+	}
+	if err != nil {
+		return err
+	}
+
+	providers := make([]string, 0, len(u.Providers))
+	for p := range u.Providers {
+		providers = append(providers, p)
+	}
+	sort.Strings(providers)
+	for _, p := range providers {
+		fmt.Printf("%-10s %14d bytes\n", p, u.Providers[p])
+	}
+	fmt.Printf("%-10s %14d bytes\n", "total", u.Used)
+	if u.Limit == nil {
+		fmt.Println("no limit")
+	} else {
+		fmt.Printf("limit %d bytes, %d left\n", *u.Limit, *u.Remaining)
+	}
+	return nil
+}
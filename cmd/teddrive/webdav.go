@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"teddrive-web/lib/davfs"
+	"teddrive-web/lib/workspace"
+)
+
+func runWebDAV(args []string) error {
+	fs := flag.NewFlagSet("webdav", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	provider := fs.String("provider", envOr("WEBDAV_PROVIDER", "discord"), "provider for files written over WebDAV: discord, telegram, erasure or dedup")
+	user := fs.String("user", envOr("WEBDAV_USER", "teddrive"), "user name for basic auth")
+	fs.Parse(args)
+
+	password := envOr("WEBDAV_PASSWORD", strings.TrimSpace(os.Getenv("TEDDRIVE_ADMIN_TOKEN")))
+	if password == "" {
+		return fmt.Errorf("set WEBDAV_PASSWORD or TEDDRIVE_ADMIN_TOKEN; the WebDAV server always requires a password")
+	}
+
+	client, err := workspace.FromEnv()
+	if err != nil {
+		return err
+	}
+
+	dfs := &davfs.FS{Client: client, Provider: *provider}
+	dav := &webdav.Handler{
+		FileSystem: dfs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				fmt.Printf("[WEBDAV] %s %s: %v\n", r.Method, r.URL.Path, err)
+			} else {
+				fmt.Printf("[WEBDAV] %s %s\n", r.Method, r.URL.Path)
+			}
+		},
+	}
+
+	// GET and HEAD also serve folder indexes, for browsers and rclone's
+	// http remote.
+	browse := dfs.Browse(dav)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(*user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="TEDDRIVE"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			fmt.Printf("[WEBDAV] %s %s\n", r.Method, r.URL.Path)
+		}
+		browse.ServeHTTP(w, r)
+	})
+
+	fmt.Printf("WebDAV listening on %s (user %q, new files on %s)\n", *addr, *user, *provider)
+	return http.ListenAndServe(*addr, handler)
+}
@@ -1,3 +1,16 @@
 module teddrive-web
 
 go 1.22
+
+require (
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/hanwen/go-fuse/v2 v2.5.1
+	github.com/klauspost/compress v1.17.11
+	github.com/klauspost/reedsolomon v1.12.4
+	golang.org/x/net v0.33.0
+)
+
+require (
+	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
+	golang.org/x/sys v0.28.0 // indirect
+)
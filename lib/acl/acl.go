@@ -0,0 +1,329 @@
+// Package acl gives single users deny, read or write access to a file, or
+// to a folder and everything under it, on top of their workspace role
+// (supabase/migrations/013_acl.sql). The nearest entry up the parent_id
+// chain wins, so a grant on a subfolder works inside a read-only folder
+// and a deny hides a folder from an editor. Without an entry the role
+// applies: editors write, viewers read, guests get nothing. Owners are
+// never restricted, and only they change the lists.
+//
+// Row-level security applies the same rules to the browser through the
+// acl_access function; handlers call Require before they touch an item.
+package acl
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/workspace"
+)
+
+const entriesTable = "acl_entries"
+
+// Access levels, from least to most allowed.
+const (
+	Deny  = "deny"
+	Read  = "read"
+	Write = "write"
+)
+
+var rank = map[string]int{Deny: 1, Read: 2, Write: 3}
+
+var (
+	// ErrDisabled is returned for changes to the lists while the migration
+	// is not applied.
+	ErrDisabled = errors.New("access lists need supabase/migrations/013_acl.sql")
+	// ErrAccess is returned for an access level that is not deny, read or
+	// write.
+	ErrAccess = errors.New("access must be deny, read or write")
+	// ErrDenied is returned when the caller may read an item but not
+	// change it. It is a workspace.ErrForbidden.
+	ErrDenied error = denied{}
+)
+
+type denied struct{}
+
+func (denied) Error() string        { return "the access list does not allow this" }
+func (denied) Is(target error) bool { return target == workspace.ErrForbidden }
+
+// Entry mirrors a row of the acl_entries table.
+type Entry struct {
+	ID          string  `json:"id"`
+	WorkspaceID string  `json:"workspace_id,omitempty"`
+	FileID      *string `json:"file_id"`
+	FolderID    *string `json:"folder_id"`
+	UserID      string  `json:"user_id"`
+	Access      string  `json:"access"`
+	CreatedAt   string  `json:"created_at,omitempty"`
+}
+
+var (
+	installedMu sync.Mutex
+	installed   = make(map[string]bool)
+)
+
+// Installed reports whether the acl_entries table exists. A yes is
+// remembered; a no is checked again next time.
+func Installed(c *meta.Client) (bool, error) {
+	installedMu.Lock()
+	ok := installed[c.URL]
+	installedMu.Unlock()
+	if ok {
+		return true, nil
+	}
+	var rows []Entry
+	err := c.Select(entriesTable, url.Values{"select": {"id"}, "limit": {"1"}}, &rows)
+	var apiErr *meta.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	installedMu.Lock()
+	installed[c.URL] = true
+	installedMu.Unlock()
+	return true, nil
+}
+
+// Checker answers what one caller may do with items of their workspace.
+type Checker struct {
+	access *workspace.Access
+	// listed is whether the caller has any entries in the workspace.
+	// Without them only the role counts, and no query is needed.
+	listed bool
+}
+
+// New returns a Checker for the caller of a.
+func New(a *workspace.Access) (*Checker, error) {
+	k := &Checker{access: a}
+	if a.Role == workspace.Owner || a.UserID == "" {
+		return k, nil
+	}
+	ok, err := Installed(a.Client)
+	if err != nil || !ok {
+		return k, err
+	}
+	var rows []Entry
+	err = a.Client.Select(entriesTable, url.Values{
+		"select":  {"id"},
+		"user_id": {meta.Eq(a.UserID)},
+		"limit":   {"1"},
+	}, &rows)
+	if err != nil {
+		return nil, err
+	}
+	k.listed = len(rows) > 0
+	return k, nil
+}
+
+// Level returns what the caller may do with row id of table, "files" or
+// "folders": Write, Read or Deny. An empty id is the workspace's top
+// level, where only the role counts.
+func (k *Checker) Level(table, id string) (string, error) {
+	role := k.access.Role
+	if !k.listed || id == "" {
+		return roleLevel(role), nil
+	}
+	args := map[string]interface{}{"p_user": k.access.UserID, "p_file": nil, "p_folder": nil, "p_role": role}
+	if table == "files" {
+		args["p_file"] = id
+	} else {
+		args["p_folder"] = id
+	}
+	var level *string
+	if err := k.access.Client.RPC("acl_access", args, &level); err != nil {
+		return "", err
+	}
+	if level == nil {
+		return Deny, nil
+	}
+	return *level, nil
+}
+
+// Require returns nil when the caller has at least level on row id of
+// table. An item they may not read is meta.ErrNotFound, as it is hidden
+// from them everywhere else; one they may only read is ErrDenied.
+func (k *Checker) Require(table, id, level string) error {
+	got, err := k.Level(table, id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case rank[got] >= rank[level]:
+		return nil
+	case got == Deny:
+		return meta.ErrNotFound
+	default:
+		return ErrDenied
+	}
+}
+
+// RequireTree is Require for folder id and everything under it, for
+// changes to a whole tree: deleting a folder needs write access all the
+// way down, copying or sharing one read access.
+func (k *Checker) RequireTree(id, level string) error {
+	if err := k.Require("folders", id, level); err != nil {
+		return err
+	}
+	if !k.listed {
+		return nil
+	}
+	below := []string{Deny}
+	if level == Write {
+		below = append(below, Read)
+	}
+	var rows []Entry
+	err := k.access.Client.Select(entriesTable, url.Values{
+		"user_id": {meta.Eq(k.access.UserID)},
+		"access":  {meta.In(below)},
+	}, &rows)
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+	tree, err := k.access.Client.GetTree(id)
+	if err != nil {
+		return err
+	}
+	inside := make(map[string]bool)
+	for _, f := range tree.Folders {
+		inside[f.Folder.ID] = true
+	}
+	for _, f := range tree.Files {
+		inside[f.File.ID] = true
+	}
+	for _, e := range rows {
+		if (e.FolderID != nil && inside[*e.FolderID]) || (e.FileID != nil && inside[*e.FileID]) {
+			return ErrDenied
+		}
+	}
+	return nil
+}
+
+// Require checks one item for the caller of a; see Checker.Require.
+func Require(a *workspace.Access, table, id, level string) error {
+	k, err := New(a)
+	if err != nil {
+		return err
+	}
+	return k.Require(table, id, level)
+}
+
+func roleLevel(role string) string {
+	switch role {
+	case workspace.Owner, workspace.Editor:
+		return Write
+	case workspace.Viewer:
+		return Read
+	}
+	return Deny
+}
+
+// List returns the entries on row id of table, in the workspace c is
+// confined to.
+func List(c *meta.Client, table, id string) ([]Entry, error) {
+	col, err := column(table)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := Installed(c)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var rows []Entry
+	err = c.Select(entriesTable, url.Values{col: {meta.Eq(id)}, "order": {"created_at.asc"}}, &rows)
+	return rows, err
+}
+
+// Set gives userID access to row id of table, replacing the entry they
+// had on it.
+func Set(c *meta.Client, table, id, userID, access string) (*Entry, error) {
+	col, err := column(table)
+	if err != nil {
+		return nil, err
+	}
+	if rank[access] == 0 {
+		return nil, ErrAccess
+	}
+	if !workspace.ValidUser(userID) {
+		return nil, workspace.ErrUser
+	}
+	ok, err := Installed(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDisabled
+	}
+	if err := workspace.Owns(c, table, id); err != nil {
+		return nil, err
+	}
+
+	var rows []Entry
+	q := url.Values{col: {meta.Eq(id)}, "user_id": {meta.Eq(userID)}}
+	if err := c.Update(entriesTable, q, map[string]string{"access": access}, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		return &rows[0], nil
+	}
+	e := Entry{ID: newID(), UserID: userID, Access: access}
+	if table == "files" {
+		e.FileID = &id
+	} else {
+		e.FolderID = &id
+	}
+	if err := c.Insert(entriesTable, e, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("access list insert returned no row")
+	}
+	return &rows[0], nil
+}
+
+// Remove deletes userID's entry on row id of table, so their role or an
+// entry further up applies again.
+func Remove(c *meta.Client, table, id, userID string) error {
+	col, err := column(table)
+	if err != nil {
+		return err
+	}
+	ok, err := Installed(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDisabled
+	}
+	var rows []Entry
+	q := url.Values{col: {meta.Eq(id)}, "user_id": {meta.Eq(userID)}}
+	if err := c.Select(entriesTable, q, &rows); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return meta.ErrNotFound
+	}
+	return c.Delete(entriesTable, q)
+}
+
+func column(table string) (string, error) {
+	switch table {
+	case "files":
+		return "file_id", nil
+	case "folders":
+		return "folder_id", nil
+	}
+	return "", fmt.Errorf("no access lists on %s", table)
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "a_" + base64.RawURLEncoding.EncodeToString(b)
+}
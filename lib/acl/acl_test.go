@@ -0,0 +1,243 @@
+package acl
+
+import (
+	"errors"
+	"testing"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/meta/metatest"
+	"teddrive-web/lib/workspace"
+)
+
+const (
+	alice = "0b5f3c1e-2a4d-4e6f-8a9b-0c1d2e3f4a5b"
+	bob   = "7e8f9a0b-1c2d-4e3f-9a4b-5c6d7e8f9a0b"
+)
+
+// fixture is the tree
+//
+//	proj/               readme
+//	proj/docs/          plan
+//	proj/docs/private/  secret
+//	other/              notes
+//
+// with alice given write on docs, deny on docs/private and read on plan,
+// and acl_access as in supabase/migrations/013_acl.sql. calls counts the
+// acl_access calls.
+func fixture(t *testing.T) (s *metatest.Server, calls *int) {
+	s = metatest.New(t)
+	s.Table("files", "id")
+	s.Table("folders", "id")
+	s.Table("acl_entries", "id")
+	s.Add("folders",
+		metatest.Row{"id": "proj", "name": "proj", "parent_id": nil},
+		metatest.Row{"id": "docs", "name": "docs", "parent_id": "proj"},
+		metatest.Row{"id": "private", "name": "private", "parent_id": "docs"},
+		metatest.Row{"id": "other", "name": "other", "parent_id": nil},
+	)
+	s.Add("files",
+		metatest.Row{"id": "readme", "name": "readme", "folder_id": "proj"},
+		metatest.Row{"id": "plan", "name": "plan", "folder_id": "docs"},
+		metatest.Row{"id": "secret", "name": "secret", "folder_id": "private"},
+		metatest.Row{"id": "notes", "name": "notes", "folder_id": "other"},
+	)
+	s.Add("acl_entries",
+		metatest.Row{"id": "1", "user_id": alice, "folder_id": "docs", "file_id": nil, "access": Write},
+		metatest.Row{"id": "2", "user_id": alice, "folder_id": "private", "file_id": nil, "access": Deny},
+		metatest.Row{"id": "3", "user_id": alice, "folder_id": nil, "file_id": "plan", "access": Read},
+	)
+	calls = new(int)
+	s.Func("acl_access", func(args map[string]interface{}) (interface{}, error) {
+		*calls++
+		return access(s, args), nil
+	})
+	return s, calls
+}
+
+// access is acl_access: the user's entry on the file, else the nearest
+// entry up the folder chain, else the role.
+func access(s *metatest.Server, args map[string]interface{}) interface{} {
+	user, role := args["p_user"], args["p_role"]
+	if role == workspace.Owner {
+		return Write
+	}
+	entry := func(col string, id interface{}) interface{} {
+		for _, e := range s.Rows("acl_entries") {
+			if e["user_id"] == user && e[col] == id {
+				return e["access"]
+			}
+		}
+		return nil
+	}
+	folder := args["p_folder"]
+	if file := args["p_file"]; file != nil {
+		if a := entry("file_id", file); a != nil {
+			return a
+		}
+		for _, f := range s.Rows("files") {
+			if f["id"] == file {
+				folder = f["folder_id"]
+			}
+		}
+	}
+	for folder != nil {
+		if a := entry("folder_id", folder); a != nil {
+			return a
+		}
+		var parent interface{}
+		for _, f := range s.Rows("folders") {
+			if f["id"] == folder {
+				parent = f["parent_id"]
+			}
+		}
+		folder = parent
+	}
+	switch role {
+	case workspace.Editor:
+		return Write
+	case workspace.Viewer:
+		return Read
+	}
+	return nil
+}
+
+func checker(t *testing.T, c *meta.Client, role, userID string) *Checker {
+	k, err := New(&workspace.Access{Role: role, UserID: userID, Client: c})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestLevel(t *testing.T) {
+	s, calls := fixture(t)
+	c := s.Client()
+	tests := []struct {
+		name        string
+		role, user  string
+		table, id   string
+		want        string
+		usesEntries bool
+	}{
+		{name: "viewer, no entry", role: workspace.Viewer, user: alice, table: "files", id: "readme", want: Read, usesEntries: true},
+		{name: "viewer, grant on folder", role: workspace.Viewer, user: alice, table: "folders", id: "docs", want: Write, usesEntries: true},
+		{name: "viewer, file under grant", role: workspace.Viewer, user: alice, table: "files", id: "plan", want: Read, usesEntries: true},
+		{name: "viewer, deny below grant", role: workspace.Viewer, user: alice, table: "folders", id: "private", want: Deny, usesEntries: true},
+		{name: "viewer, file under deny", role: workspace.Viewer, user: alice, table: "files", id: "secret", want: Deny, usesEntries: true},
+		{name: "editor, deny wins over role", role: workspace.Editor, user: alice, table: "files", id: "secret", want: Deny, usesEntries: true},
+		{name: "editor, elsewhere", role: workspace.Editor, user: alice, table: "files", id: "notes", want: Write, usesEntries: true},
+		{name: "guest, grant", role: workspace.Guest, user: alice, table: "folders", id: "docs", want: Write, usesEntries: true},
+		{name: "guest, elsewhere", role: workspace.Guest, user: alice, table: "files", id: "notes", want: Deny, usesEntries: true},
+		{name: "top level is the role", role: workspace.Viewer, user: alice, table: "folders", id: "", want: Read},
+		{name: "owner", role: workspace.Owner, user: alice, table: "files", id: "secret", want: Write},
+		{name: "unlisted editor", role: workspace.Editor, user: bob, table: "files", id: "secret", want: Write},
+		{name: "unlisted viewer", role: workspace.Viewer, user: bob, table: "files", id: "secret", want: Read},
+		{name: "unlisted guest", role: workspace.Guest, user: bob, table: "files", id: "secret", want: Deny},
+		{name: "anonymous", role: workspace.Editor, user: "", table: "files", id: "secret", want: Write},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := *calls
+			got, err := checker(t, c, tt.role, tt.user).Level(tt.table, tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("Level = %s, want %s", got, tt.want)
+			}
+			if asked := *calls > before; asked != tt.usesEntries {
+				t.Errorf("asked acl_access: %v, want %v", asked, tt.usesEntries)
+			}
+		})
+	}
+}
+
+func TestRequire(t *testing.T) {
+	s, _ := fixture(t)
+	k := checker(t, s.Client(), workspace.Viewer, alice)
+	tests := []struct {
+		table, id, level string
+		want             error
+	}{
+		{"folders", "docs", Write, nil},
+		{"files", "plan", Read, nil},
+		{"files", "plan", Write, ErrDenied},
+		{"files", "readme", Write, ErrDenied},
+		{"files", "secret", Read, meta.ErrNotFound},
+		{"folders", "private", Write, meta.ErrNotFound},
+	}
+	for _, tt := range tests {
+		if err := k.Require(tt.table, tt.id, tt.level); err != tt.want {
+			t.Errorf("Require(%s %s, %s) = %v, want %v", tt.table, tt.id, tt.level, err, tt.want)
+		}
+	}
+	if !errors.Is(ErrDenied, workspace.ErrForbidden) {
+		t.Error("ErrDenied is not a workspace.ErrForbidden")
+	}
+}
+
+func TestRequireTree(t *testing.T) {
+	s, _ := fixture(t)
+	c := s.Client()
+	tests := []struct {
+		name       string
+		role, user string
+		id, level  string
+		want       error
+	}{
+		// alice's deny on private and read on plan sit below these.
+		{name: "read over a deny", role: workspace.Editor, user: alice, id: "proj", level: Read, want: ErrDenied},
+		{name: "write over a deny", role: workspace.Editor, user: alice, id: "docs", level: Write, want: ErrDenied},
+		{name: "write elsewhere", role: workspace.Editor, user: alice, id: "other", level: Write},
+		{name: "denied root", role: workspace.Editor, user: alice, id: "private", level: Read, want: meta.ErrNotFound},
+		{name: "read-only root", role: workspace.Viewer, user: alice, id: "other", level: Write, want: ErrDenied},
+		{name: "owner", role: workspace.Owner, user: alice, id: "proj", level: Write},
+		{name: "unlisted", role: workspace.Editor, user: bob, id: "proj", level: Write},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checker(t, c, tt.role, tt.user).RequireTree(tt.id, tt.level); err != tt.want {
+				t.Errorf("RequireTree = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// Without the deny, only the read entry on plan is left below docs:
+	// it stops writing docs whole but not reading it.
+	set := func(id, level string) {
+		s.Update("acl_entries", func(r metatest.Row) bool {
+			if r["id"] != id {
+				return false
+			}
+			r["access"] = level
+			return true
+		})
+	}
+	set("2", Write)
+	k := checker(t, c, workspace.Editor, alice)
+	if err := k.RequireTree("docs", Write); err != ErrDenied {
+		t.Errorf("RequireTree(docs, write) over a read = %v, want ErrDenied", err)
+	}
+	if err := k.RequireTree("proj", Read); err != nil {
+		t.Errorf("RequireTree(proj, read) over a read = %v", err)
+	}
+	set("3", Write)
+	if err := k.RequireTree("proj", Write); err != nil {
+		t.Errorf("RequireTree(proj, write) = %v", err)
+	}
+}
+
+func TestNotInstalled(t *testing.T) {
+	s := metatest.New(t)
+	c := s.Client()
+	k := checker(t, c, workspace.Viewer, alice)
+	if got, err := k.Level("files", "plan"); got != Read || err != nil {
+		t.Errorf("Level = %s, %v, want the role's read", got, err)
+	}
+	if err := k.RequireTree("docs", Read); err != nil {
+		t.Errorf("RequireTree = %v", err)
+	}
+	if _, err := Set(c, "files", "plan", bob, Read); err != ErrDisabled {
+		t.Errorf("Set = %v, want ErrDisabled", err)
+	}
+}
@@ -0,0 +1,34 @@
+// Package auth checks the credentials presented to the Go API handlers.
+package auth
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// BearerToken returns the token from an "Authorization: Bearer" header.
+func BearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// AdminEnabled reports whether TEDDRIVE_ADMIN_TOKEN is set.
+func AdminEnabled() bool {
+	return strings.TrimSpace(os.Getenv("TEDDRIVE_ADMIN_TOKEN")) != ""
+}
+
+// IsAdmin reports whether the request carries TEDDRIVE_ADMIN_TOKEN. It is
+// always false when the token is not configured.
+func IsAdmin(r *http.Request) bool {
+	want := strings.TrimSpace(os.Getenv("TEDDRIVE_ADMIN_TOKEN"))
+	got := BearerToken(r)
+	if want == "" || got == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
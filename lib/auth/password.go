@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const passwordIterations = 210000
+
+// HashPassword returns a PBKDF2-SHA256 hash in the form
+// "pbkdf2-sha256$<iterations>$<salt>$<hash>".
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := pbkdf2([]byte(password), salt, passwordIterations)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(sum)), nil
+}
+
+// CheckPassword reports whether password matches a HashPassword hash.
+func CheckPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter <= 0 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	got := pbkdf2([]byte(password), salt, iter)
+	return subtle.ConstantTimeCompare(got, want) == 1
+}
+
+// pbkdf2 derives one SHA-256 block (32 bytes), which is all we store.
+func pbkdf2(password, salt []byte, iter int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	var idx [4]byte
+	binary.BigEndian.PutUint32(idx[:], 1)
+	prf.Write(idx[:])
+	u := prf.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
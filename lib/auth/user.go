@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrSession is returned for a bearer token Supabase Auth does not accept.
+var ErrSession = errors.New("invalid or expired session")
+
+var userClient = &http.Client{Timeout: 10 * time.Second}
+
+// UserID returns the Supabase Auth user whose access token the request
+// carries, or "" when it carries none. The admin token is not a session
+// and also gives "".
+func UserID(r *http.Request) (string, error) {
+	token := BearerToken(r)
+	if token == "" || IsAdmin(r) {
+		return "", nil
+	}
+	base := strings.TrimRight(strings.TrimSpace(os.Getenv("SUPABASE_URL")), "/")
+	key := strings.TrimSpace(os.Getenv("SUPABASE_ANON_KEY"))
+	if key == "" {
+		key = strings.TrimSpace(os.Getenv("SUPABASE_SERVICE_ROLE_KEY"))
+	}
+	if base == "" || key == "" {
+		return "", fmt.Errorf("Supabase not configured - missing SUPABASE_URL or key")
+	}
+
+	req, err := http.NewRequest("GET", base+"/auth/v1/user", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("apikey", key)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := userClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Supabase Auth request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", ErrSession
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Supabase Auth error %d", resp.StatusCode)
+	}
+	var user struct {
+		ID string `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return "", err
+	}
+	if user.ID == "" {
+		return "", ErrSession
+	}
+	return user.ID, nil
+}
@@ -0,0 +1,57 @@
+// Package content reads files back on the server: it fetches each chunk of
+// a file, decrypts it with the file's key and hands out the plaintext.
+// Features that serve whole files (folder ZIPs, gateways) build on it.
+package content
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"teddrive-web/lib/dedup"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/storage"
+)
+
+// Chunk returns the plaintext of one meta_links entry of f.
+func Chunk(c *meta.Client, f *meta.File, link string) ([]byte, error) {
+	if storage.ProviderOf(link) == storage.DedupProvider {
+		g, err := dedup.ParseGroup(link)
+		if err != nil {
+			return nil, err
+		}
+		return dedup.Load(c, g)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(f.MetaKey)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("file %s has no valid key", f.ID)
+	}
+	sealed, err := storage.GetChunk(link)
+	if err != nil {
+		return nil, err
+	}
+	return storage.OpenChunk(key, sealed)
+}
+
+// Copy writes the plaintext of f to w one chunk at a time, so memory use
+// stays at about one chunk whatever the file size.
+func Copy(w io.Writer, c *meta.Client, f *meta.File) (int64, error) {
+	links, err := f.Links()
+	if err != nil {
+		return 0, fmt.Errorf("file %s: invalid meta_links: %v", f.ID, err)
+	}
+	var written int64
+	for i, link := range links {
+		data, err := Chunk(c, f, link)
+		if err != nil {
+			return written, fmt.Errorf("file %s chunk %d: %v", f.ID, i, err)
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,132 @@
+package content
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/storage"
+)
+
+// Reader gives random access to the plaintext of a file. It keeps the last
+// chunk it decrypted, so sequential reads fetch each chunk once.
+type Reader struct {
+	c         *meta.Client
+	f         *meta.File
+	links     []string
+	chunkSize int64
+	off       int64
+
+	cur int // index of buf's chunk, -1 when empty
+	buf []byte
+
+	aheadTo int64  // fetch the next chunk early if it starts before this
+	ahead   *fetch // the next chunk, being fetched
+}
+
+// fetch is a chunk being fetched in the background.
+type fetch struct {
+	i    int
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewReader returns a Reader positioned at the start of f.
+func NewReader(c *meta.Client, f *meta.File) (*Reader, error) {
+	links, err := f.Links()
+	if err != nil {
+		return nil, fmt.Errorf("file %s: invalid meta_links: %v", f.ID, err)
+	}
+	return &Reader{
+		c:         c,
+		f:         f,
+		links:     links,
+		chunkSize: int64(storage.ChunkSize(f.MetaProvider)),
+		cur:       -1,
+	}, nil
+}
+
+// Size returns the plaintext size of the file.
+func (r *Reader) Size() int64 {
+	return r.f.Size
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.off >= r.f.Size {
+		return 0, io.EOF
+	}
+	i := int(r.off / r.chunkSize)
+	if err := r.load(i); err != nil {
+		return 0, err
+	}
+	start := r.off - int64(i)*r.chunkSize
+	if start >= int64(len(r.buf)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	n := copy(p, r.buf[start:])
+	r.off += int64(n)
+	return n, nil
+}
+
+// ReadAhead makes the Reader fetch the next chunk while the current one is
+// read, as long as that chunk starts before end. Streams set end to the
+// end of the range they serve, so nothing past it is fetched.
+func (r *Reader) ReadAhead(end int64) {
+	r.aheadTo = end
+}
+
+// Seek implements io.Seeker. Seeking is free; the chunk is only fetched by
+// the next Read.
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.f.Size
+	default:
+		return 0, errors.New("content: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("content: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+func (r *Reader) load(i int) error {
+	if i == r.cur {
+		return nil
+	}
+	if i >= len(r.links) {
+		return fmt.Errorf("file %s: chunk %d missing (%d chunks)", r.f.ID, i, len(r.links))
+	}
+	var data []byte
+	var err error
+	if a := r.ahead; a != nil && a.i == i {
+		<-a.done
+		data, err = a.data, a.err
+	} else {
+		data, err = Chunk(r.c, r.f, r.links[i])
+	}
+	r.ahead = nil
+	if err != nil {
+		return fmt.Errorf("file %s chunk %d: %v", r.f.ID, i, err)
+	}
+	if i < len(r.links)-1 && int64(len(data)) != r.chunkSize {
+		return fmt.Errorf("file %s chunk %d: %d bytes, expected %d", r.f.ID, i, len(data), r.chunkSize)
+	}
+	r.cur, r.buf = i, data
+
+	if next := i + 1; next < len(r.links) && int64(next)*r.chunkSize < r.aheadTo {
+		a := &fetch{i: next, done: make(chan struct{})}
+		r.ahead = a
+		go func() {
+			a.data, a.err = Chunk(r.c, r.f, r.links[next])
+			close(a.done)
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package content
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+
+	"teddrive-web/lib/dedup"
+	"teddrive-web/lib/messages"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+)
+
+// Writer stores plaintext as the chunks of a new file, the same way the web
+// app does: one random key per file, chunks of storage.ChunkSize(provider)
+// sealed and uploaded as soon as they fill up. Call Close, then Apply to
+// put the result into a files row.
+type Writer struct {
+	c        *meta.Client
+	provider string
+	name     string
+	key      []byte
+	buf      []byte
+	links    []string
+	size     int64
+	sum      hash.Hash
+	closed   bool
+}
+
+// NewWriter starts a new file that will be stored with provider.
+func NewWriter(c *meta.Client, provider, name string) (*Writer, error) {
+	switch provider {
+	case "discord", "telegram", storage.ErasureProvider, storage.DedupProvider:
+	default:
+		return nil, fmt.Errorf("unknown provider %q", provider)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return &Writer{
+		c:        c,
+		provider: provider,
+		name:     name,
+		key:      key,
+		buf:      make([]byte, 0, storage.ChunkSize(provider)),
+		sum:      sha256.New(),
+	}, nil
+}
+
+// Checkpoint is the state of a Writer between two chunks, enough for
+// Resume to carry on with the same file in another process. It holds the
+// file's key, so it is kept on the server.
+type Checkpoint struct {
+	Key   string   `json:"key"`
+	Links []string `json:"links"`
+	Size  int64    `json:"size"`
+	Sum   string   `json:"sum"` // the SHA-256 state, base64
+}
+
+// Resume returns a Writer that carries on from cp. The chunks cp lists are
+// already uploaded; what is written next follows them.
+func Resume(c *meta.Client, provider, name string, cp *Checkpoint) (*Writer, error) {
+	w, err := NewWriter(c, provider, name)
+	if err != nil {
+		return nil, err
+	}
+	if w.key, err = base64.StdEncoding.DecodeString(cp.Key); err != nil {
+		return nil, fmt.Errorf("content: bad checkpoint key: %v", err)
+	}
+	state, err := base64.StdEncoding.DecodeString(cp.Sum)
+	if err == nil {
+		err = w.sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("content: bad checkpoint hash: %v", err)
+	}
+	w.links = append([]string(nil), cp.Links...)
+	w.size = cp.Size
+	return w, nil
+}
+
+// Checkpoint returns the state to Resume from. It is only possible right
+// after a full chunk was uploaded, when nothing is buffered.
+func (w *Writer) Checkpoint() (*Checkpoint, error) {
+	if len(w.buf) > 0 || w.closed {
+		return nil, errors.New("content: checkpoint inside a chunk")
+	}
+	state, err := w.sum.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return &Checkpoint{
+		Key:   base64.StdEncoding.EncodeToString(w.key),
+		Links: append([]string{}, w.links...),
+		Size:  w.size,
+		Sum:   base64.StdEncoding.EncodeToString(state),
+	}, nil
+}
+
+// Size returns the number of bytes written so far.
+func (w *Writer) Size() int64 {
+	return w.size
+}
+
+// SHA256 returns the hex SHA-256 of the plaintext written so far.
+func (w *Writer) SHA256() string {
+	return hex.EncodeToString(w.sum.Sum(nil))
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("content: write after close")
+	}
+	w.sum.Write(p)
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		w.size += int64(n)
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close uploads the last partial chunk.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if len(w.buf) > 0 {
+		return w.flush()
+	}
+	return nil
+}
+
+// Apply stores the new manifest, key and size in f.
+func (w *Writer) Apply(f *meta.File) {
+	links, _ := json.Marshal(w.links)
+	if w.links == nil {
+		links = []byte("[]")
+	}
+	f.Size = w.size
+	f.MetaKey = base64.StdEncoding.EncodeToString(w.key)
+	f.MetaLinks = string(links)
+	f.MetaProvider = w.provider
+}
+
+// Release gives back the dedup chunk references of what was written, for
+// content that will not be put into a row. Other providers hold none.
+func (w *Writer) Release() error {
+	if w.provider != storage.DedupProvider {
+		return nil
+	}
+	return dedup.Release(w.c, w.links)
+}
+
+func (w *Writer) flush() error {
+	index := len(w.links)
+	var link string
+	if w.provider == storage.DedupProvider {
+		g, _, err := dedup.Store(w.c, w.name, bytes.NewReader(w.buf))
+		if err != nil {
+			return fmt.Errorf("chunk %d: %v", index, err)
+		}
+		link = g.String()
+	} else {
+		sealed, err := storage.SealChunk(w.key, w.buf)
+		if err != nil {
+			return err
+		}
+		var locs []storage.Locator
+		link, locs, err = quota.Put(w.c, w.provider, "", w.name, sealed, index)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %v", index, err)
+		}
+		if err := messages.Record(w.c, locs); err != nil {
+			fmt.Printf("[CONTENT] Recording messages of chunk %d failed: %v\n", index, err)
+		}
+	}
+	w.links = append(w.links, link)
+	w.buf = w.buf[:0]
+	return nil
+}
@@ -0,0 +1,502 @@
+// Package davfs exposes the TEDDRIVE folder tree as a webdav.FileSystem.
+// Folders and files map to their metadata rows; reading a file decrypts its
+// chunks on demand and writing one uploads new chunks with the configured
+// provider.
+package davfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/folders"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/trash"
+	"teddrive-web/lib/versions"
+)
+
+// FS is a webdav.FileSystem over the files and folders tables.
+type FS struct {
+	Client *meta.Client
+	// Provider stores files written through WebDAV.
+	Provider string
+	// ACL, when set, limits the FS to what one caller may do: items they
+	// may not read do not exist, and changes need write access. Nil
+	// allows everything Client can reach.
+	ACL *acl.Checker
+}
+
+var _ webdav.FileSystem = (*FS)(nil)
+
+// node is a resolved path: the root (both nil), a folder or a file.
+type node struct {
+	folder *meta.Folder
+	file   *meta.File
+}
+
+func (n *node) isDir() bool { return n.file == nil }
+
+// folderID is the ID to use as parent_id/folder_id for children of n.
+func (n *node) folderID() *string {
+	if n.folder == nil {
+		return nil
+	}
+	return &n.folder.ID
+}
+
+func split(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// parentFilter builds the query for children of parent.
+func parentFilter(parent *string) string {
+	if parent == nil {
+		return "is.null"
+	}
+	return meta.Eq(*parent)
+}
+
+func (fs *FS) childFolder(parent *string, name string) (*meta.Folder, error) {
+	rows, err := fs.Client.ListFolders(url.Values{
+		"parent_id": {parentFilter(parent)},
+		"name":      {meta.Eq(name)},
+		"order":     {"id.asc"},
+		"limit":     {"1"},
+	})
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return &rows[0], nil
+}
+
+func (fs *FS) childFile(parent *string, name string) (*meta.File, error) {
+	rows, err := fs.Client.ListFiles(url.Values{
+		"folder_id": {parentFilter(parent)},
+		"name":      {meta.Eq(name)},
+		"order":     {"id.asc"},
+		"limit":     {"1"},
+	})
+	if err != nil || len(rows) == 0 {
+		return nil, err
+	}
+	return &rows[0], nil
+}
+
+// resolve is lookup for an item the caller may read.
+func (fs *FS) resolve(name string) (*node, error) {
+	n, err := fs.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return n, fs.check(n, acl.Read)
+}
+
+// check returns nil when the caller may do level with n: os.ErrNotExist
+// when they may not read it, os.ErrPermission when they may only read it.
+// Anyone may look at the root; what they see in it is filtered.
+func (fs *FS) check(n *node, level string) error {
+	if fs.ACL == nil {
+		return nil
+	}
+	table, id := "folders", ""
+	switch {
+	case n.file != nil:
+		table, id = "files", n.file.ID
+	case n.folder != nil:
+		id = n.folder.ID
+	case level == acl.Read:
+		return nil
+	}
+	return fsError(fs.ACL.Require(table, id, level))
+}
+
+// visible reports whether the caller may read n, for listings.
+func (fs *FS) visible(n *node) (bool, error) {
+	err := fs.check(n, acl.Read)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func fsError(err error) error {
+	switch {
+	case errors.Is(err, meta.ErrNotFound):
+		return os.ErrNotExist
+	case errors.Is(err, acl.ErrDenied):
+		return os.ErrPermission
+	}
+	return err
+}
+
+// lookup walks name from the root. It returns os.ErrNotExist when any part
+// is missing. When a folder and a file share a name, the folder wins.
+func (fs *FS) lookup(name string) (*node, error) {
+	parts := split(name)
+	n := &node{}
+	for i, part := range parts {
+		if !n.isDir() {
+			return nil, os.ErrNotExist
+		}
+		folder, err := fs.childFolder(n.folderID(), part)
+		if err != nil {
+			return nil, err
+		}
+		if folder != nil {
+			n = &node{folder: folder}
+			continue
+		}
+		if i == len(parts)-1 {
+			file, err := fs.childFile(n.folderID(), part)
+			if err != nil {
+				return nil, err
+			}
+			if file != nil {
+				return &node{file: file}, nil
+			}
+		}
+		return nil, os.ErrNotExist
+	}
+	return n, nil
+}
+
+// resolveParent returns the folder that would hold name, and its base name.
+func (fs *FS) resolveParent(name string) (*node, string, error) {
+	parts := split(name)
+	if len(parts) == 0 {
+		return nil, "", os.ErrInvalid
+	}
+	parent, err := fs.resolve(strings.Join(parts[:len(parts)-1], "/"))
+	if err != nil {
+		return nil, "", err
+	}
+	if !parent.isDir() {
+		return nil, "", os.ErrNotExist
+	}
+	return parent, parts[len(parts)-1], nil
+}
+
+func (fs *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parent, base, err := fs.resolveParent(name)
+	if err != nil {
+		return err
+	}
+	if err := fs.check(parent, acl.Write); err != nil {
+		return err
+	}
+	if _, err := fs.lookup(name); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return fs.Client.InsertFolder(&meta.Folder{Name: base, ParentID: parent.folderID()})
+}
+
+func (fs *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		n, err := fs.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		if n.isDir() {
+			return &dirHandle{fs: fs, n: n}, nil
+		}
+		return &readHandle{fs: fs, f: n.file}, nil
+	}
+
+	parent, base, err := fs.resolveParent(name)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := fs.lookup(name)
+	switch {
+	case err == nil && existing.isDir():
+		return nil, os.ErrPermission
+	case err == nil && flag&os.O_EXCL != 0:
+		return nil, os.ErrExist
+	case errors.Is(err, os.ErrNotExist) && flag&os.O_CREATE == 0:
+		return nil, os.ErrNotExist
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	target := parent
+	if existing != nil {
+		target = existing
+	}
+	if err := fs.check(target, acl.Write); err != nil {
+		return nil, err
+	}
+
+	w, err := content.NewWriter(fs.Client, fs.Provider, base)
+	if err != nil {
+		return nil, err
+	}
+	h := &writeHandle{fs: fs, w: w, f: &meta.File{Name: base, FolderID: parent.folderID()}}
+	if existing != nil {
+		h.f = existing.file
+		h.exists = true
+	}
+	return h, nil
+}
+
+func (fs *FS) RemoveAll(ctx context.Context, name string) error {
+	n, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case n.file != nil:
+		if err := fs.check(n, acl.Write); err != nil {
+			return err
+		}
+		return trash.File(fs.Client, n.file.ID)
+	case n.folder == nil:
+		return os.ErrPermission // the root
+	}
+	if fs.ACL != nil {
+		if err := fsError(fs.ACL.RequireTree(n.folder.ID, acl.Write)); err != nil {
+			return err
+		}
+	}
+	return trash.Folder(fs.Client, n.folder.ID)
+}
+
+func (fs *FS) Rename(ctx context.Context, oldName, newName string) error {
+	n, err := fs.resolve(oldName)
+	if err != nil {
+		return err
+	}
+	if n.folder == nil && n.file == nil {
+		return os.ErrPermission
+	}
+	if err := fs.check(n, acl.Write); err != nil {
+		return err
+	}
+	parent, base, err := fs.resolveParent(newName)
+	if err != nil {
+		return err
+	}
+	if err := fs.check(parent, acl.Write); err != nil {
+		return err
+	}
+	if _, err := fs.lookup(newName); err == nil {
+		return os.ErrExist
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if n.file != nil {
+		return fs.Client.Update("files", url.Values{"id": {meta.Eq(n.file.ID)}},
+			map[string]interface{}{"name": base, "folder_id": parent.folderID()}, nil)
+	}
+
+	switch err := folders.Move(fs.Client, n.folder.ID, parent.folderID(), base); {
+	case errors.Is(err, folders.ErrCycle), errors.Is(err, folders.ErrBadName):
+		return os.ErrInvalid
+	case errors.Is(err, folders.ErrExists):
+		return os.ErrExist
+	default:
+		return err
+	}
+}
+
+func (fs *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(), nil
+}
+
+// Walk calls fn for every folder and file below the folder name, with paths
+// relative to it. The subtree is loaded a level at a time, as for a ZIP
+// download, rather than resolved path by path. It returns os.ErrInvalid when
+// name is a file or the root.
+func (fs *FS) Walk(name string, fn func(rel string, fi os.FileInfo) error) error {
+	n, err := fs.resolve(name)
+	if err != nil {
+		return err
+	}
+	if n.folder == nil {
+		return os.ErrInvalid
+	}
+	t, err := fs.Client.GetTree(n.folder.ID)
+	if err != nil {
+		return err
+	}
+	var nodes []*node
+	var paths []string
+	for i := range t.Folders {
+		nodes = append(nodes, &node{folder: &t.Folders[i].Folder})
+		paths = append(paths, t.Folders[i].Path)
+	}
+	for i := range t.Files {
+		nodes = append(nodes, &node{file: &t.Files[i].File})
+		paths = append(paths, t.Files[i].Path)
+	}
+	for i, n := range nodes {
+		ok, err := fs.visible(n)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := fn(paths[i], n.info()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dirHandle is an open folder.
+type dirHandle struct {
+	fs      *FS
+	n       *node
+	entries []os.FileInfo
+	listed  bool
+}
+
+func (d *dirHandle) Close() error                   { return nil }
+func (d *dirHandle) Read(p []byte) (int, error)     { return 0, os.ErrInvalid }
+func (d *dirHandle) Write(p []byte) (int, error)    { return 0, os.ErrInvalid }
+func (d *dirHandle) Seek(int64, int) (int64, error) { return 0, nil }
+func (d *dirHandle) Stat() (os.FileInfo, error)     { return d.n.info(), nil }
+
+func (d *dirHandle) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.listed {
+		parent := d.n.folderID()
+		folders, err := d.fs.Client.ListFolders(url.Values{
+			"parent_id": {parentFilter(parent)},
+			"order":     {"name.asc"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		files, err := d.fs.Client.ListFiles(url.Values{
+			"select":    {"id,name,size,mime,folder_id,meta_key,meta_provider,created_at"},
+			"folder_id": {parentFilter(parent)},
+			"order":     {"name.asc"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		var nodes []*node
+		for i := range folders {
+			nodes = append(nodes, &node{folder: &folders[i]})
+		}
+		for i := range files {
+			nodes = append(nodes, &node{file: &files[i]})
+		}
+		for _, n := range nodes {
+			ok, err := d.fs.visible(n)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				d.entries = append(d.entries, n.info())
+			}
+		}
+		d.listed = true
+	}
+
+	if count <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+	out := d.entries[:count]
+	d.entries = d.entries[count:]
+	return out, nil
+}
+
+// readHandle is a file opened for reading. The chunk reader is created on
+// the first Read or Seek so that Stat-only opens cost nothing.
+type readHandle struct {
+	fs *FS
+	f  *meta.File
+	r  *content.Reader
+}
+
+func (h *readHandle) reader() (*content.Reader, error) {
+	if h.r == nil {
+		r, err := content.NewReader(h.fs.Client, h.f)
+		if err != nil {
+			return nil, err
+		}
+		h.r = r
+	}
+	return h.r, nil
+}
+
+func (h *readHandle) Read(p []byte) (int, error) {
+	r, err := h.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Read(p)
+}
+
+func (h *readHandle) Seek(offset int64, whence int) (int64, error) {
+	r, err := h.reader()
+	if err != nil {
+		return 0, err
+	}
+	return r.Seek(offset, whence)
+}
+
+func (h *readHandle) Close() error                       { return nil }
+func (h *readHandle) Write(p []byte) (int, error)        { return 0, os.ErrPermission }
+func (h *readHandle) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (h *readHandle) Stat() (os.FileInfo, error)         { return (&node{file: h.f}).info(), nil }
+
+// writeHandle is a file opened for writing. Data is chunked and uploaded
+// as it arrives; the files row is only written on Close, so readers keep
+// seeing the old content until the upload is complete.
+type writeHandle struct {
+	fs     *FS
+	w      *content.Writer
+	f      *meta.File
+	exists bool
+}
+
+func (h *writeHandle) Write(p []byte) (int, error) { return h.w.Write(p) }
+
+func (h *writeHandle) Close() error {
+	if err := h.w.Close(); err != nil {
+		h.w.Release()
+		return err
+	}
+	if !h.exists {
+		h.f.Mime = meta.MimeOf(h.f.Name)
+	}
+	return versions.Overwrite(h.fs.Client, h.f, h.w)
+}
+
+func (h *writeHandle) Read(p []byte) (int, error)         { return 0, os.ErrPermission }
+func (h *writeHandle) Seek(int64, int) (int64, error)     { return 0, os.ErrPermission }
+func (h *writeHandle) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+
+func (h *writeHandle) Stat() (os.FileInfo, error) {
+	f := *h.f
+	f.Size = h.w.Size()
+	return (&node{file: &f}).info(), nil
+}
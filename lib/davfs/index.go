@@ -0,0 +1,125 @@
+package davfs
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Browse serves GET and HEAD itself and passes every other method to next.
+// Files are served decrypted, with ranges. Folders are served as an HTML
+// index of plain links, the format rclone's http remote and wget -r
+// follow, or as JSON when the client accepts application/json. WebDAV
+// leaves GET on a collection undefined, so this does not get in the way of
+// WebDAV clients.
+func (fs *FS) Browse(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n, err := fs.resolve(r.URL.Path)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			http.NotFound(w, r)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !n.isDir() {
+			info := n.info()
+			w.Header().Set("Content-Type", mimeOrDefault(info.mime))
+			w.Header().Set("ETag", info.etag)
+			http.ServeContent(w, r, info.name, info.mod, &readHandle{fs: fs, f: n.file})
+			return
+		}
+		// Relative links in the index need the trailing slash.
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			u := *r.URL
+			u.Path += "/"
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		d := &dirHandle{fs: fs, n: n}
+		infos, err := d.Readdir(0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries := make([]indexEntry, 0, len(infos))
+		for _, fi := range infos {
+			entries = append(entries, newIndexEntry(fi.(*fileInfo)))
+		}
+		sort.SliceStable(entries, func(i, j int) bool { return entries[i].Dir && !entries[j].Dir })
+
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			if r.Method == http.MethodGet {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"path":    path.Clean(r.URL.Path),
+					"entries": entries,
+				})
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if r.Method == http.MethodGet {
+			indexPage.Execute(w, map[string]interface{}{"Path": path.Clean(r.URL.Path), "Entries": entries})
+		}
+	})
+}
+
+// indexEntry is one line of a folder index.
+type indexEntry struct {
+	Name     string    `json:"name"`
+	Dir      bool      `json:"dir"`
+	Size     int64     `json:"size"`
+	Mime     string    `json:"mime,omitempty"`
+	Modified time.Time `json:"modified"`
+	Href     string    `json:"-"`
+}
+
+func newIndexEntry(fi *fileInfo) indexEntry {
+	name := fi.name
+	if fi.dir {
+		name += "/"
+	}
+	// url.URL escapes the name and prefixes ./ when it would otherwise
+	// parse as a scheme, like "a:b".
+	href := (&url.URL{Path: name}).String()
+	e := indexEntry{Name: fi.name, Dir: fi.dir, Modified: fi.mod.UTC(), Href: href}
+	if !fi.dir {
+		e.Size = fi.size
+		e.Mime = mimeOrDefault(fi.mime)
+	}
+	return e
+}
+
+func mimeOrDefault(mime string) string {
+	if mime == "" {
+		return "application/octet-stream"
+	}
+	return mime
+}
+
+var indexPage = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{range .Entries}}<tr><td><a href="{{.Href}}">{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{if not .Dir}}{{.Size}}{{end}}</td><td>{{.Modified.Format "2006-01-02 15:04:05"}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,79 @@
+package davfs
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"time"
+)
+
+// fileInfo describes a node. It also answers the webdav package's
+// ContentTyper and ETager interfaces so PROPFIND never has to open a file
+// and download a chunk just to sniff its type.
+type fileInfo struct {
+	name string
+	size int64
+	dir  bool
+	mod  time.Time
+	mime string
+	etag string
+	tags []string
+	meta map[string]string
+}
+
+func (n *node) info() *fileInfo {
+	switch {
+	case n.file != nil:
+		return &fileInfo{
+			name: n.file.Name,
+			size: n.file.Size,
+			mod:  n.file.Modified(),
+			mime: n.file.Mime,
+			etag: etag(n.file.ID, n.file.MetaKey),
+			tags: n.file.Tags,
+			meta: n.file.Metadata,
+		}
+	case n.folder != nil:
+		return &fileInfo{name: n.folder.Name, dir: true, mod: n.folder.Modified(),
+			tags: n.folder.Tags, meta: n.folder.Metadata}
+	}
+	return &fileInfo{name: "/", dir: true, mod: time.Now()}
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.mod }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() interface{}   { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ContentType(ctx context.Context) (string, error) {
+	return mimeOrDefault(fi.mime), nil
+}
+
+func (fi *fileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.etag == "" {
+		return fmt.Sprintf(`"%x-%x"`, fi.mod.UnixNano(), fi.size), nil
+	}
+	return fi.etag, nil
+}
+
+// Labels returns the tags and metadata set through lib/tags, which the S3
+// gateway sends with objects.
+func (fi *fileInfo) Labels() ([]string, map[string]string) {
+	return fi.tags, fi.meta
+}
+
+// etag changes whenever a file is rewritten: every write picks a new key.
+func etag(id, key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return fmt.Sprintf(`"%s-%x"`, id, h.Sum64())
+}
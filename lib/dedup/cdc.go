@@ -0,0 +1,130 @@
+package dedup
+
+import (
+	"io"
+)
+
+// Chunk size bounds for content-defined chunking.
+const (
+	MinChunk = 256 << 10
+	AvgChunk = 1 << 20
+	MaxChunk = 4 << 20
+)
+
+// gear is the FastCDC rolling-hash table. It is generated from a fixed seed
+// and must never change, or existing chunks stop matching new uploads.
+var gear [256]uint64
+
+func init() {
+	x := uint64(0x7465646472697665) // "teddrive"
+	for i := range gear {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits a stream with FastCDC normalized chunking: cut points
+// depend on the content, so an insertion only changes the chunks around it.
+type Chunker struct {
+	r          io.Reader
+	buf        []byte
+	start, end int
+	eof        bool
+
+	min, avg, max int
+	maskS, maskL  uint64
+}
+
+// NewChunker returns a chunker using MinChunk, AvgChunk and MaxChunk.
+func NewChunker(r io.Reader) *Chunker {
+	return newChunker(r, MinChunk, AvgChunk, MaxChunk)
+}
+
+func newChunker(r io.Reader, min, avg, max int) *Chunker {
+	bits := 0
+	for 1<<bits < avg {
+		bits++
+	}
+	return &Chunker{
+		r:   r,
+		buf: make([]byte, 2*max),
+		min: min,
+		avg: avg,
+		max: max,
+		// Masks take the top bits of the hash, which depend on the most
+		// bytes. The stricter mask applies below the average size and the
+		// looser one above it, pulling sizes toward the average.
+		maskS: ^uint64(0) << (64 - (bits + 2)),
+		maskL: ^uint64(0) << (64 - (bits - 2)),
+	}
+}
+
+// Next returns the next chunk, or io.EOF when the stream is exhausted. The
+// returned slice is only valid until the next call.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= c.max {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := c.avg
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -0,0 +1,156 @@
+package dedup
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/iotest"
+)
+
+// random returns n bytes that are the same on every run.
+func random(seed int64, n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+// split runs a chunker over data and returns copies of its chunks.
+func split(t *testing.T, r io.Reader, min, avg, max int) [][]byte {
+	t.Helper()
+	c := newChunker(r, min, avg, max)
+	var chunks [][]byte
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		chunks = append(chunks, append([]byte(nil), chunk...))
+	}
+}
+
+func sizes(chunks [][]byte) []int {
+	out := make([]int, len(chunks))
+	for i, c := range chunks {
+		out[i] = len(c)
+	}
+	return out
+}
+
+func TestChunkerBounds(t *testing.T) {
+	const min, avg, max = 64, 256, 1024
+	tests := []struct {
+		name string
+		data []byte
+		want []int // chunk sizes, when they follow from the bounds alone
+	}{
+		{name: "empty", data: nil, want: []int{}},
+		{name: "one byte", data: []byte{1}, want: []int{1}},
+		{name: "exactly min", data: random(1, min), want: []int{min}},
+		{name: "zeros", data: make([]byte, 5000)},
+		{name: "random", data: random(2, 100000)},
+		{name: "repeated block", data: bytes.Repeat(random(3, 300), 50)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := split(t, bytes.NewReader(tt.data), min, avg, max)
+			if tt.want != nil {
+				if got := sizes(chunks); !reflect.DeepEqual(got, tt.want) {
+					t.Fatalf("sizes = %v, want %v", got, tt.want)
+				}
+			}
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Fatalf("chunks do not add up to the input: %d of %d bytes", len(got), len(tt.data))
+			}
+			for i, c := range chunks {
+				if len(c) > max {
+					t.Errorf("chunk %d is %d bytes, over max %d", i, len(c), max)
+				}
+				if len(c) < min && i != len(chunks)-1 {
+					t.Errorf("chunk %d is %d bytes, under min %d", i, len(c), min)
+				}
+			}
+		})
+	}
+}
+
+// Boundaries depend on the content only, not on how the reader hands it
+// over.
+func TestChunkerReads(t *testing.T) {
+	data := random(4, 200000)
+	want := sizes(split(t, bytes.NewReader(data), 64, 256, 1024))
+	readers := []struct {
+		name string
+		r    io.Reader
+	}{
+		{"one byte", iotest.OneByteReader(bytes.NewReader(data))},
+		{"half", iotest.HalfReader(bytes.NewReader(data))},
+		{"data with EOF", iotest.DataErrReader(bytes.NewReader(data))},
+	}
+	for _, tt := range readers {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sizes(split(t, tt.r, 64, 256, 1024)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("sizes = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// An edit only changes the chunks around it, so most chunks of the edited
+// stream are ones the original already had.
+func TestChunkerEdits(t *testing.T) {
+	data := random(5, 300000)
+	tests := []struct {
+		name string
+		edit func([]byte) []byte
+	}{
+		{"insert at start", func(b []byte) []byte { return append([]byte("hello"), b...) }},
+		{"insert in middle", func(b []byte) []byte {
+			return append(append(append([]byte(nil), b[:150000]...), random(6, 37)...), b[150000:]...)
+		}},
+		{"delete in middle", func(b []byte) []byte {
+			return append(append([]byte(nil), b[:100000]...), b[100999:]...)
+		}},
+		{"overwrite at end", func(b []byte) []byte {
+			b = append([]byte(nil), b...)
+			copy(b[len(b)-10:], "0123456789")
+			return b
+		}},
+	}
+	seen := make(map[[32]byte]bool)
+	for _, c := range split(t, bytes.NewReader(data), 64, 256, 1024) {
+		seen[sha256.Sum256(c)] = true
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := split(t, bytes.NewReader(tt.edit(data)), 64, 256, 1024)
+			changed := 0
+			for _, c := range chunks {
+				if !seen[sha256.Sum256(c)] {
+					changed++
+				}
+			}
+			if changed > 4 {
+				t.Errorf("%d of %d chunks changed, want at most 4", changed, len(chunks))
+			}
+		})
+	}
+}
+
+// The gear table and masks decide every cut point, and stored chunks only
+// match new uploads while they stay the same.
+func TestChunkerStable(t *testing.T) {
+	data := random(7, 3*MaxChunk)
+	want := []int{
+		765074, 1121825, 1122356, 1170178, 538536, 915082,
+		1122317, 1105439, 1165717, 1160828, 1629058, 766502,
+	}
+	if got := sizes(split(t, bytes.NewReader(data), MinChunk, AvgChunk, MaxChunk)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("sizes = %v, want %v", got, want)
+	}
+}
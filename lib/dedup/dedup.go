@@ -0,0 +1,397 @@
+// Package dedup stores file data as content-defined chunks that are shared
+// between files. Chunk IDs are keyed hashes of the plaintext (HMAC with
+// DEDUP_SECRET), so identical content gets the same ID and is uploaded once,
+// while nobody without the secret can confirm a file's presence from the
+// chunk index. Each chunk is encrypted with a key derived from its ID.
+//
+// Each workspace (see lib/workspace) has its own key derived from the
+// secret, so workspaces never share chunks or learn what another stored.
+//
+// A file in dedup mode has meta_provider "dedup". Each meta_links entry is a
+// Group: the chunk IDs for one upload window of the file. The chunks table
+// keeps one reference per window that uses a chunk; a trigger releases them
+// when the file row is deleted.
+package dedup
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+	"teddrive-web/lib/workspace"
+)
+
+const table = "chunks"
+
+// Chunk mirrors a row of the chunks table.
+type Chunk struct {
+	ID         string  `json:"id"`
+	Size       int     `json:"size"`
+	Link       string  `json:"link"`
+	RefCount   int     `json:"ref_count"`
+	CreatedAt  string  `json:"created_at,omitempty"`
+	ReleasedAt *string `json:"released_at,omitempty"`
+	// WorkspaceID is nil for the default workspace.
+	WorkspaceID *string `json:"workspace_id,omitempty"`
+}
+
+// Group is one meta_links entry of a dedup file.
+type Group struct {
+	Chunks []string `json:"cdc"`
+	Size   int64    `json:"size"`
+	// Workspace keys the chunks; empty for the default workspace.
+	Workspace string `json:"ws,omitempty"`
+}
+
+// Stats describes what a Store call did.
+type Stats struct {
+	Chunks   int   `json:"chunks"`
+	New      int   `json:"new"`
+	Bytes    int64 `json:"bytes"`
+	NewBytes int64 `json:"newBytes"`
+}
+
+// Enabled reports whether DEDUP_SECRET is configured.
+func Enabled() bool {
+	return secret() != nil
+}
+
+func secret() []byte {
+	s := strings.TrimSpace(os.Getenv("DEDUP_SECRET"))
+	if s == "" {
+		return nil
+	}
+	return []byte(s)
+}
+
+// Provider is where new chunks are uploaded: DEDUP_PROVIDER, or Discord.
+func Provider() string {
+	if p := strings.TrimSpace(os.Getenv("DEDUP_PROVIDER")); p != "" {
+		return p
+	}
+	return "discord"
+}
+
+// secretFor returns the key of a workspace's chunks. The default workspace
+// uses DEDUP_SECRET itself, so chunks from before workspaces keep their IDs.
+func secretFor(ws string) []byte {
+	key := secret()
+	if key == nil || ws == "" {
+		return key
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("workspace:"))
+	mac.Write([]byte(ws))
+	return mac.Sum(nil)
+}
+
+// space returns the Group.Workspace of chunks stored through c.
+func space(c *meta.Client) string {
+	if c.Workspace == workspace.DefaultID {
+		return ""
+	}
+	return c.Workspace
+}
+
+func chunkID(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("id:"))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func chunkKey(key []byte, id string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("key:"))
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
+
+// ParseGroup decodes a dedup meta_links entry.
+func ParseGroup(link string) (*Group, error) {
+	var g Group
+	if err := json.Unmarshal([]byte(link), &g); err != nil || g.Chunks == nil {
+		return nil, fmt.Errorf("invalid chunk group")
+	}
+	return &g, nil
+}
+
+// String returns the JSON form stored in meta_links.
+func (g *Group) String() string {
+	b, _ := json.Marshal(g)
+	return string(b)
+}
+
+// Store splits r into content-defined chunks, uploads the ones the index
+// doesn't have yet and takes a reference on every chunk it uses. It returns
+// the Group to store as the window's meta_links entry. On error the
+// references it took are given back; a caller that gets a Group but never
+// writes it into a row gives them back with Release.
+func Store(c *meta.Client, fileName string, r io.Reader) (group *Group, stats Stats, err error) {
+	ws := space(c)
+	key := secretFor(ws)
+	if key == nil {
+		return nil, stats, fmt.Errorf("dedup not configured - missing DEDUP_SECRET")
+	}
+
+	// Chunk and hash everything first so existing chunks can be claimed in
+	// one round trip.
+	group = &Group{Chunks: []string{}, Workspace: ws}
+	pieces := make(map[string][]byte)
+	chunker := NewChunker(r)
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, stats, err
+		}
+		id := chunkID(key, data)
+		group.Chunks = append(group.Chunks, id)
+		group.Size += int64(len(data))
+		if _, ok := pieces[id]; !ok {
+			pieces[id] = append([]byte(nil), data...)
+		}
+	}
+	stats.Chunks = len(group.Chunks)
+	stats.Bytes = group.Size
+
+	ids := make([]string, 0, len(pieces))
+	for id := range pieces {
+		ids = append(ids, id)
+	}
+	var claimed []Chunk
+	if len(ids) > 0 {
+		if err := c.RPC("claim_chunks", map[string]interface{}{"p_ids": ids}, &claimed); err != nil {
+			return nil, stats, fmt.Errorf("claim chunks: %v", err)
+		}
+	}
+	// Every chunk in held has one reference from this call.
+	held := make([]string, 0, len(ids))
+	defer func() {
+		if err != nil {
+			release(c, held)
+		}
+	}()
+	for _, ch := range claimed {
+		delete(pieces, ch.ID)
+		held = append(held, ch.ID)
+	}
+
+	// Upload in the group's order so logs and rate limits are predictable.
+	for i, id := range group.Chunks {
+		data, ok := pieces[id]
+		if !ok {
+			continue
+		}
+		delete(pieces, id)
+
+		sealed, err := storage.SealChunk(chunkKey(key, id), data)
+		if err != nil {
+			return nil, stats, err
+		}
+		// Shared chunks are counted once, under dedup, when first stored.
+		booked := storage.StoredSize(Provider(), len(sealed))
+		if err := quota.Reserve(c, quota.Tenant(c), storage.DedupProvider, booked); err != nil {
+			return nil, stats, fmt.Errorf("upload chunk: %w", err)
+		}
+		link, locs, err := storage.Put(Provider(), c.Target(Provider()), fileName, sealed, i)
+		if err != nil {
+			if rerr := quota.Release(c, quota.Tenant(c), storage.DedupProvider, booked); rerr != nil {
+				fmt.Printf("[DEDUP] Releasing %d bytes failed: %v\n", booked, rerr)
+			}
+			return nil, stats, fmt.Errorf("upload chunk: %v", err)
+		}
+		var stored string
+		args := map[string]interface{}{
+			"p_id":   id,
+			"p_size": len(data),
+			"p_link": link,
+		}
+		if ws != "" {
+			args["p_workspace"] = ws
+		}
+		err = c.RPC("register_chunk", args, &stored)
+		if err != nil {
+			discard(c, locs, booked)
+			return nil, stats, fmt.Errorf("register chunk: %v", err)
+		}
+		held = append(held, id)
+		if stored != link {
+			fmt.Printf("[DEDUP] Chunk %s was stored concurrently, dropping duplicate upload\n", id[:12])
+			discard(c, locs, booked)
+			continue
+		}
+		stats.New++
+		stats.NewBytes += int64(len(data))
+	}
+
+	fmt.Printf("[DEDUP] %d chunks (%d bytes), %d new (%d bytes)\n", stats.Chunks, stats.Bytes, stats.New, stats.NewBytes)
+	return group, stats, nil
+}
+
+// discard deletes an upload the index does not use and gives its bytes
+// back. What cannot be deleted is only logged: the upload did its job
+// either way.
+func discard(c *meta.Client, locs []storage.Locator, booked int64) {
+	for _, loc := range locs {
+		if loc.MessageID == "" {
+			continue
+		}
+		if err := storage.DeleteMessage(loc); err != nil {
+			fmt.Printf("[DEDUP] Deleting unused upload %s failed: %v\n", loc.MessageID, err)
+		}
+	}
+	if err := quota.Release(c, quota.Tenant(c), storage.DedupProvider, booked); err != nil {
+		fmt.Printf("[DEDUP] Releasing %d bytes failed: %v\n", booked, err)
+	}
+}
+
+// Claim takes one more reference on every chunk of a dedup file's
+// meta_links, as a second upload of the same content would. It is needed
+// when another row starts pointing at the same groups, like a restored
+// version.
+func Claim(c *meta.Client, links []string) error {
+	for _, link := range links {
+		g, err := ParseGroup(link)
+		if err != nil {
+			return err
+		}
+		ids := distinct(g.Chunks)
+		if len(ids) == 0 {
+			continue
+		}
+		if err := c.RPC("claim_chunks", map[string]interface{}{"p_ids": ids}, nil); err != nil {
+			return fmt.Errorf("claim chunks: %v", err)
+		}
+	}
+	return nil
+}
+
+// Release gives back the references Store or Claim took for a dedup
+// file's meta_links, for content that never made it into a row.
+func Release(c *meta.Client, links []string) error {
+	for _, link := range links {
+		g, err := ParseGroup(link)
+		if err != nil {
+			return err
+		}
+		if len(g.Chunks) == 0 {
+			continue
+		}
+		if err := c.RPC("release_chunks", map[string]interface{}{"p_ids": distinct(g.Chunks)}, nil); err != nil {
+			return fmt.Errorf("release chunks: %v", err)
+		}
+	}
+	return nil
+}
+
+// release is Release for the chunks of a failed Store; errors are only
+// logged, as the store failed already.
+func release(c *meta.Client, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	if err := c.RPC("release_chunks", map[string]interface{}{"p_ids": ids}, nil); err != nil {
+		fmt.Printf("[DEDUP] Releasing %d chunks failed: %v\n", len(ids), err)
+	}
+}
+
+// distinct returns ids without repeats: a window holds one reference per
+// chunk, however often it uses it, which is what release_file_chunks
+// gives back.
+func distinct(ids []string) []string {
+	seen := make(map[string]bool)
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// Load reassembles the plaintext of a Group.
+func Load(c *meta.Client, g *Group) ([]byte, error) {
+	key := secretFor(g.Workspace)
+	if key == nil {
+		return nil, fmt.Errorf("dedup not configured - missing DEDUP_SECRET")
+	}
+
+	rows, err := lookup(c, g.Chunks)
+	if err != nil {
+		return nil, err
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, g.Size))
+	cache := make(map[string][]byte)
+	for _, id := range g.Chunks {
+		data, ok := cache[id]
+		if !ok {
+			row, found := rows[id]
+			if !found {
+				return nil, fmt.Errorf("chunk %s missing from index", id)
+			}
+			sealed, err := storage.GetChunk(row.Link)
+			if err != nil {
+				return nil, fmt.Errorf("chunk %s: %v", id, err)
+			}
+			data, err = storage.OpenChunk(chunkKey(key, id), sealed)
+			if err != nil {
+				return nil, fmt.Errorf("chunk %s: %v", id, err)
+			}
+			if chunkID(key, data) != id {
+				return nil, fmt.Errorf("chunk %s: content does not match ID", id)
+			}
+			cache[id] = data
+		}
+		out.Write(data)
+	}
+	return out.Bytes(), nil
+}
+
+func lookup(c *meta.Client, ids []string) (map[string]Chunk, error) {
+	rows := make(map[string]Chunk)
+	if len(ids) == 0 {
+		return rows, nil
+	}
+	var found []Chunk
+	q := url.Values{"id": {"in.(" + strings.Join(ids, ",") + ")"}}
+	if err := c.Select(table, q, &found); err != nil {
+		return nil, err
+	}
+	for _, ch := range found {
+		rows[ch.ID] = ch
+	}
+	return rows, nil
+}
+
+// Unreferenced lists chunks nothing refers to any more that were released
+// longer than grace ago.
+func Unreferenced(c *meta.Client, grace time.Duration) ([]Chunk, error) {
+	cutoff := time.Now().UTC().Add(-grace).Format(time.RFC3339)
+	var rows []Chunk
+	err := c.Select(table, url.Values{
+		"ref_count":   {"lte.0"},
+		"released_at": {"lt." + cutoff},
+	}, &rows)
+	return rows, err
+}
+
+// Forget removes a chunk from the index if it is still unreferenced.
+func Forget(c *meta.Client, id string) error {
+	return c.Delete(table, url.Values{"id": {meta.Eq(id)}, "ref_count": {"lte.0"}})
+}
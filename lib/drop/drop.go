@@ -0,0 +1,282 @@
+// Package drop manages drop links ("file requests"): upload-only links that
+// let someone without an account send files into one folder. A link can
+// carry a password, an expiry time and a byte limit, and can be revoked.
+// Links are enforced by /api/drop; the drops table is not readable with the
+// browser's anon key.
+package drop
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/storage"
+)
+
+const (
+	table      = "drops"
+	chunkTable = "drop_chunks"
+)
+
+var (
+	// ErrGone is returned for links that are revoked or expired.
+	ErrGone = errors.New("drop link has expired or been revoked")
+	// ErrPassword is returned when the password is missing or wrong.
+	ErrPassword = errors.New("wrong password")
+	// ErrFull is returned when an upload would go over the byte limit.
+	ErrFull = errors.New("drop link size limit reached")
+	// ErrProvider is returned for providers drop links cannot upload to.
+	ErrProvider = errors.New("unsupported provider for drop links")
+	// ErrReceipt is returned when a chunk receipt does not verify.
+	ErrReceipt = errors.New("invalid chunk receipt")
+	// ErrReused is returned when a chunk is already part of a file.
+	ErrReused = errors.New("chunk receipt already used")
+)
+
+// Drop mirrors a row of the drops table.
+type Drop struct {
+	ID           string  `json:"id"`
+	FolderID     string  `json:"folder_id"`
+	Provider     string  `json:"provider"`
+	PasswordHash *string `json:"password_hash"`
+	ExpiresAt    *string `json:"expires_at"`
+	MaxBytes     *int64  `json:"max_bytes"`
+	BytesUsed    int64   `json:"bytes_used"`
+	FileCount    int     `json:"file_count"`
+	RevokedAt    *string `json:"revoked_at"`
+	Secret       string  `json:"secret,omitempty"` // signs chunk receipts; never leaves the server
+	CreatedAt    string  `json:"created_at,omitempty"`
+}
+
+// Options are the settings chosen when a link is created.
+type Options struct {
+	Provider  string
+	Password  string
+	ExpiresAt *time.Time
+	MaxBytes  *int64
+}
+
+// Create makes a new drop link into a folder.
+func Create(c *meta.Client, folderID string, opts Options) (*Drop, error) {
+	if _, err := c.GetFolder(folderID); err != nil {
+		return nil, err
+	}
+	switch opts.Provider {
+	case "":
+		opts.Provider = "discord"
+	case "discord", "telegram", storage.ErasureProvider:
+	default:
+		return nil, ErrProvider
+	}
+
+	d := &Drop{
+		ID:       newID(),
+		FolderID: folderID,
+		Provider: opts.Provider,
+		MaxBytes: opts.MaxBytes,
+		Secret:   randomString(32),
+	}
+	if opts.Password != "" {
+		hash, err := auth.HashPassword(opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		d.PasswordHash = &hash
+	}
+	if opts.ExpiresAt != nil {
+		v := opts.ExpiresAt.UTC().Format(time.RFC3339)
+		d.ExpiresAt = &v
+	}
+
+	var rows []Drop
+	if err := c.Insert(table, d, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		return &rows[0], nil
+	}
+	return d, nil
+}
+
+// Get looks up a link by ID.
+func Get(c *meta.Client, id string) (*Drop, error) {
+	var rows []Drop
+	if err := c.Select(table, url.Values{"id": {meta.Eq(id)}}, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// List returns the links into a folder, newest first.
+func List(c *meta.Client, folderID string) ([]Drop, error) {
+	var rows []Drop
+	err := c.Select(table, url.Values{
+		"folder_id": {meta.Eq(folderID)},
+		"order":     {"created_at.desc"},
+	}, &rows)
+	return rows, err
+}
+
+// Revoke disables a link for good. Files already received stay.
+func Revoke(c *meta.Client, d *Drop) error {
+	return c.Update(table, url.Values{"id": {meta.Eq(d.ID)}},
+		map[string]interface{}{"revoked_at": time.Now().UTC().Format(time.RFC3339)}, nil)
+}
+
+// Active reports whether the link still accepts uploads.
+func (d *Drop) Active() bool {
+	if d.RevokedAt != nil {
+		return false
+	}
+	if d.ExpiresAt != nil {
+		if t, err := time.Parse(time.RFC3339, *d.ExpiresAt); err == nil && !time.Now().Before(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// NeedsPassword reports whether the link is password protected.
+func (d *Drop) NeedsPassword() bool {
+	return d.PasswordHash != nil && *d.PasswordHash != ""
+}
+
+// BytesLeft returns the remaining byte allowance, or nil when unlimited.
+func (d *Drop) BytesLeft() *int64 {
+	if d.MaxBytes == nil {
+		return nil
+	}
+	left := *d.MaxBytes - d.BytesUsed
+	if left < 0 {
+		left = 0
+	}
+	return &left
+}
+
+// Check verifies that the link is usable with the given password.
+func Check(d *Drop, password string) error {
+	if !d.Active() {
+		return ErrGone
+	}
+	if d.NeedsPassword() && !auth.CheckPassword(*d.PasswordHash, password) {
+		return ErrPassword
+	}
+	return nil
+}
+
+// Reserve books n bytes against the limit before a chunk is uploaded. A
+// negative n hands bytes back after a failed upload. The check happens in
+// the database so parallel uploads can't go over the limit together.
+func Reserve(c *meta.Client, d *Drop, n int64) error {
+	var rows []Drop
+	if err := c.RPC("reserve_drop_bytes", map[string]interface{}{"p_id": d.ID, "p_bytes": n}, &rows); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		if !d.Active() {
+			return ErrGone
+		}
+		return ErrFull
+	}
+	*d = rows[0]
+	return nil
+}
+
+// Receipt signs a stored chunk so that the finished file can only list
+// chunks this link actually uploaded, with their real sizes.
+func (d *Drop) Receipt(index int, link string, size int64) string {
+	mac := hmac.New(sha256.New, []byte(d.Secret))
+	fmt.Fprintf(mac, "%d\x00%d\x00%s", index, size, link)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Part is one uploaded chunk as reported back by the uploader.
+type Part struct {
+	Link    string `json:"link"`
+	Size    int64  `json:"size"`
+	Receipt string `json:"receipt"`
+}
+
+// Finish checks the chunk receipts and adds the file to the link's folder.
+// The returned file's Size is the sum of the verified chunk sizes. Each
+// chunk goes into one file only; receipts sent again give ErrReused.
+func Finish(c *meta.Client, d *Drop, name, mime, key string, parts []Part) (*meta.File, error) {
+	if !d.Active() {
+		return nil, ErrGone
+	}
+	if len(parts) == 0 {
+		return nil, ErrReceipt
+	}
+	links := make([]string, len(parts))
+	var size int64
+	for i, p := range parts {
+		want := d.Receipt(i, p.Link, p.Size)
+		if !hmac.Equal([]byte(want), []byte(p.Receipt)) {
+			return nil, ErrReceipt
+		}
+		links[i] = p.Link
+		size += p.Size
+	}
+	linksJSON, _ := json.Marshal(links)
+	if err := claimChunks(c, d, links); err != nil {
+		return nil, err
+	}
+
+	folderID := d.FolderID
+	f := &meta.File{
+		Name:         meta.CleanName(name, "upload"),
+		Size:         size,
+		Mime:         mime,
+		FolderID:     &folderID,
+		MetaKey:      key,
+		MetaLinks:    string(linksJSON),
+		MetaProvider: d.Provider,
+	}
+	if err := c.InsertFile(f); err != nil {
+		// Let the uploader try again with the same receipts.
+		if derr := c.Delete(chunkTable, url.Values{"link": {meta.In(links)}}); derr != nil {
+			fmt.Printf("[DROP] Releasing chunks for %s failed: %v\n", d.ID, derr)
+		}
+		return nil, err
+	}
+	if err := c.RPC("count_drop_file", map[string]string{"p_id": d.ID}, nil); err != nil {
+		fmt.Printf("[DROP] Counting file for %s failed: %v\n", d.ID, err)
+	}
+	return f, nil
+}
+
+// claimChunks records links as used by d, all or none. A link that is
+// already recorded, or listed twice, is ErrReused.
+func claimChunks(c *meta.Client, d *Drop, links []string) error {
+	rows := make([]map[string]string, len(links))
+	for i, link := range links {
+		rows[i] = map[string]string{"link": link, "drop_id": d.ID}
+	}
+	err := c.Insert(chunkTable, rows, nil)
+	if pg := meta.AsPostgres(err); pg != nil && pg.Code == "23505" {
+		return ErrReused
+	}
+	return err
+}
+
+func newID() string {
+	return "d_" + randomString(12)
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,248 @@
+package drop
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/meta/metatest"
+)
+
+// fixture is a folder "inbox", the drops and drop_chunks tables, and the
+// functions from supabase/migrations/006_drops.sql.
+func fixture(t *testing.T) (*metatest.Server, *meta.Client) {
+	s := metatest.New(t)
+	s.Table("files", "id")
+	s.Table("folders", "id")
+	s.Table("drops", "id")
+	s.Table("drop_chunks", "link")
+	s.Add("folders", metatest.Row{"id": "inbox", "name": "inbox", "parent_id": nil})
+	s.Func("reserve_drop_bytes", func(args map[string]interface{}) (interface{}, error) {
+		n := args["p_bytes"].(float64)
+		return s.Update("drops", func(r metatest.Row) bool {
+			if r["id"] != args["p_id"] || r["revoked_at"] != nil {
+				return false
+			}
+			used := r["bytes_used"].(float64)
+			if max, ok := r["max_bytes"].(float64); ok && n > 0 && used+n > max {
+				return false
+			}
+			r["bytes_used"] = used + n
+			if used+n < 0 {
+				r["bytes_used"] = 0
+			}
+			return true
+		}), nil
+	})
+	s.Func("count_drop_file", func(args map[string]interface{}) (interface{}, error) {
+		s.Update("drops", func(r metatest.Row) bool {
+			if r["id"] != args["p_id"] {
+				return false
+			}
+			r["file_count"] = r["file_count"].(float64) + 1
+			return true
+		})
+		return nil, nil
+	})
+	return s, s.Client()
+}
+
+// parts signs chunks of the given sizes the way /api/drop does after
+// storing them.
+func parts(d *Drop, sizes ...int64) []Part {
+	out := make([]Part, len(sizes))
+	for i, n := range sizes {
+		link := "https://cdn.example/" + d.ID + "/" + string(rune('a'+i))
+		out[i] = Part{Link: link, Size: n, Receipt: d.Receipt(i, link, n)}
+	}
+	return out
+}
+
+func newDrop(t *testing.T, c *meta.Client, opts Options) *Drop {
+	d, err := Create(c, "inbox", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestFinish(t *testing.T) {
+	s, c := fixture(t)
+	d := newDrop(t, c, Options{})
+	f, err := Finish(c, d, "report.pdf", "application/pdf", "key", parts(d, 100, 50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Size != 150 || f.Name != "report.pdf" || f.FolderID == nil || *f.FolderID != "inbox" || f.MetaProvider != "discord" {
+		t.Errorf("Finish = %+v", f)
+	}
+	links, err := f.Links()
+	if err != nil || len(links) != 2 {
+		t.Errorf("links = %v, %v", links, err)
+	}
+	if n := len(s.Rows("files")); n != 1 {
+		t.Errorf("%d files, want 1", n)
+	}
+	if got, _ := Get(c, d.ID); got.FileCount != 1 {
+		t.Errorf("file_count = %d, want 1", got.FileCount)
+	}
+}
+
+func TestFinishReplay(t *testing.T) {
+	s, c := fixture(t)
+	d := newDrop(t, c, Options{})
+	p := parts(d, 10, 20)
+	if _, err := Finish(c, d, "a.txt", "text/plain", "key", p); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same receipts again, alone or next to a new chunk.
+	if _, err := Finish(c, d, "b.txt", "text/plain", "key", p); err != ErrReused {
+		t.Errorf("replay = %v, want ErrReused", err)
+	}
+	mixed := parts(d, 10, 20, 30)
+	mixed[0] = p[0]
+	if _, err := Finish(c, d, "c.txt", "text/plain", "key", mixed); err != ErrReused {
+		t.Errorf("replay with a new chunk = %v, want ErrReused", err)
+	}
+	// The new chunks of a refused request are not claimed either.
+	if n := len(s.Rows("drop_chunks")); n != 2 {
+		t.Errorf("%d chunks claimed, want 2", n)
+	}
+	if n := len(s.Rows("files")); n != 1 {
+		t.Errorf("%d files, want 1", n)
+	}
+}
+
+func TestFinishDuplicate(t *testing.T) {
+	_, c := fixture(t)
+	d := newDrop(t, c, Options{})
+	link := "https://cdn.example/once"
+	p := []Part{
+		{Link: link, Size: 10, Receipt: d.Receipt(0, link, 10)},
+		{Link: link, Size: 10, Receipt: d.Receipt(1, link, 10)},
+	}
+	if _, err := Finish(c, d, "twice.bin", "", "key", p); err != ErrReused {
+		t.Errorf("one chunk listed twice = %v, want ErrReused", err)
+	}
+}
+
+func TestFinishReceipts(t *testing.T) {
+	_, c := fixture(t)
+	d := newDrop(t, c, Options{})
+	other := newDrop(t, c, Options{})
+
+	bigger := parts(d, 10)
+	bigger[0].Size = 1 << 30
+	moved := parts(d, 10, 20)
+	moved[0], moved[1] = moved[1], moved[0]
+	forged := parts(d, 10)
+	forged[0].Receipt = other.Receipt(0, forged[0].Link, 10)
+
+	tests := []struct {
+		name  string
+		parts []Part
+	}{
+		{name: "none"},
+		{name: "size changed", parts: bigger},
+		{name: "reordered", parts: moved},
+		{name: "other link's receipt", parts: forged},
+		{name: "no receipt", parts: []Part{{Link: "https://cdn.example/x", Size: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Finish(c, d, "x", "", "key", tt.parts); err != ErrReceipt {
+				t.Errorf("Finish = %v, want ErrReceipt", err)
+			}
+		})
+	}
+}
+
+func TestFinishReleasesOnFailure(t *testing.T) {
+	s, c := fixture(t)
+	// A files table that refuses a second a.txt stands in for an insert
+	// that fails.
+	s.Table("files", "id", "name")
+	s.Add("files", metatest.Row{"id": "1", "name": "a.txt", "folder_id": "inbox"})
+	d := newDrop(t, c, Options{})
+	p := parts(d, 10, 20)
+
+	if _, err := Finish(c, d, "a.txt", "", "key", p); err == nil || err == ErrReused {
+		t.Fatalf("Finish = %v, want the insert's error", err)
+	}
+	if n := len(s.Rows("drop_chunks")); n != 0 {
+		t.Errorf("%d chunks still claimed, want 0", n)
+	}
+	// The uploader may try again with the same receipts.
+	if _, err := Finish(c, d, "b.txt", "", "key", p); err != nil {
+		t.Errorf("Finish again = %v", err)
+	}
+}
+
+func TestRevoked(t *testing.T) {
+	_, c := fixture(t)
+	d := newDrop(t, c, Options{})
+	if err := Revoke(c, d); err != nil {
+		t.Fatal(err)
+	}
+	d, err := Get(c, d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(d, ""); err != ErrGone {
+		t.Errorf("Check = %v, want ErrGone", err)
+	}
+	if _, err := Finish(c, d, "a.txt", "", "key", parts(d, 1)); err != ErrGone {
+		t.Errorf("Finish = %v, want ErrGone", err)
+	}
+	if err := Reserve(c, d, 1); err != ErrGone {
+		t.Errorf("Reserve = %v, want ErrGone", err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	_, c := fixture(t)
+	max := int64(100)
+	d := newDrop(t, c, Options{MaxBytes: &max})
+	if err := Reserve(c, d, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reserve(c, d, 50); err != ErrFull {
+		t.Errorf("over the limit = %v, want ErrFull", err)
+	}
+	if err := Reserve(c, d, -60); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reserve(c, d, 100); err != nil {
+		t.Errorf("after giving bytes back = %v", err)
+	}
+	if left := d.BytesLeft(); left == nil || *left != 0 {
+		t.Errorf("BytesLeft = %v, want 0", left)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	_, c := fixture(t)
+	if _, err := Create(c, "inbox", Options{Provider: "dropbox"}); err != ErrProvider {
+		t.Errorf("unknown provider = %v, want ErrProvider", err)
+	}
+	if _, err := Create(c, "nope", Options{}); !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("missing folder = %v, want ErrNotFound", err)
+	}
+	past := time.Now().Add(-time.Minute)
+	d := newDrop(t, c, Options{Provider: "telegram", Password: "pw", ExpiresAt: &past})
+	if d.Provider != "telegram" || d.Secret == "" {
+		t.Errorf("Create = %+v", d)
+	}
+	if err := Check(d, "pw"); err != ErrGone {
+		t.Errorf("Check of an expired link = %v, want ErrGone", err)
+	}
+	d.ExpiresAt = nil
+	if err := Check(d, "nope"); err != ErrPassword {
+		t.Errorf("Check with the wrong password = %v, want ErrPassword", err)
+	}
+	if err := Check(d, "pw"); err != nil {
+		t.Errorf("Check = %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package folders renames, moves, copies and deletes whole folders on the
+// server. With supabase/migrations/010_folder_ops.sql applied each
+// operation is a single transaction, however deep the tree; moving or
+// deleting without it falls back to the steps clients used to take.
+package folders
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/trash"
+)
+
+var (
+	// ErrExists is returned when the target folder already has a folder
+	// with the name.
+	ErrExists = errors.New("a folder with that name already exists there")
+	// ErrCycle is returned for moving or copying a folder into itself or
+	// into a folder below it.
+	ErrCycle = errors.New("a folder cannot go inside itself")
+	// ErrBadName is returned for an empty name or one containing a slash.
+	ErrBadName = errors.New("invalid folder name")
+	// ErrDisabled is returned by Copy while the migration is not applied.
+	ErrDisabled = errors.New("copying folders needs supabase/migrations/010_folder_ops.sql")
+)
+
+// Rename gives a folder a new name in the same place.
+func Rename(c *meta.Client, id, name string) error {
+	f, err := c.GetFolder(id)
+	if err != nil {
+		return err
+	}
+	return Move(c, id, f.ParentID, name)
+}
+
+// Move puts a folder, under name, into parent, or at the top level when
+// parent is nil. Everything in it goes along.
+func Move(c *meta.Client, id string, parent *string, name string) error {
+	name = strings.TrimSpace(name)
+	if !validName(name) {
+		return ErrBadName
+	}
+	if err := inScope(c, id); err != nil {
+		return err
+	}
+	err := c.RPC("move_folder", map[string]interface{}{"p_id": id, "p_parent": parent, "p_name": name}, nil)
+	if meta.MissingFunction(err) {
+		return moveSteps(c, id, parent, name)
+	}
+	return translate(err)
+}
+
+// inScope checks that a scoped client's workspace has the folder before a
+// function that only takes IDs touches it. The functions keep the target
+// parent in the folder's workspace themselves.
+func inScope(c *meta.Client, id string) error {
+	if c.Workspace == "" {
+		return nil
+	}
+	_, err := c.GetFolder(id)
+	return err
+}
+
+// moveSteps is Move without the migration. The checks and the update are
+// separate requests, so a concurrent move can still slip in between.
+func moveSteps(c *meta.Client, id string, parent *string, name string) error {
+	if _, err := c.GetFolder(id); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for p := parent; p != nil; {
+		if *p == id {
+			return ErrCycle
+		}
+		if seen[*p] {
+			break // an old cycle above the target; not this move's doing
+		}
+		seen[*p] = true
+		f, err := c.GetFolder(*p)
+		if err != nil {
+			return err
+		}
+		p = f.ParentID
+	}
+	parentFilter := "is.null"
+	if parent != nil {
+		parentFilter = meta.Eq(*parent)
+	}
+	taken, err := c.ListFolders(url.Values{
+		"select":    {"id"},
+		"parent_id": {parentFilter},
+		"name":      {meta.Eq(name)},
+		"id":        {"neq." + id},
+		"limit":     {"1"},
+	})
+	if err != nil {
+		return err
+	}
+	if len(taken) > 0 {
+		return ErrExists
+	}
+	return c.Update("folders", url.Values{"id": {meta.Eq(id)}},
+		map[string]interface{}{"name": name, "parent_id": parent}, nil)
+}
+
+// Copy copies a folder with everything in it into parent under name, and
+// returns the new folder's ID. The copied files share the originals'
+// chunks, so nothing is downloaded or uploaded; their version history is
+// not copied.
+func Copy(c *meta.Client, id string, parent *string, name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if !validName(name) {
+		return "", ErrBadName
+	}
+	if err := inScope(c, id); err != nil {
+		return "", err
+	}
+	// IDs start from the current time in milliseconds like everywhere else,
+	// stepping forward if another copy took that millisecond.
+	base := time.Now().UnixMilli()
+	for attempt := 0; ; attempt++ {
+		var newID string
+		err := c.RPC("copy_folder", map[string]interface{}{
+			"p_id":     id,
+			"p_parent": parent,
+			"p_name":   name,
+			"p_base":   strconv.FormatInt(base+int64(attempt), 10),
+		}, &newID)
+		if meta.MissingFunction(err) {
+			return "", ErrDisabled
+		}
+		if pg := meta.AsPostgres(err); pg != nil && pg.Code == "23505" && pg.Hint != "name_taken" && attempt < 5 {
+			continue
+		}
+		return newID, translate(err)
+	}
+}
+
+// Delete moves a folder to the trash with everything in it, or deletes it
+// for good right away when permanent is set, along with the provider
+// messages holding its files' chunks.
+func Delete(c *meta.Client, id string, permanent bool) error {
+	if err := trash.Folder(c, id); err != nil {
+		return err
+	}
+	if !permanent {
+		return nil
+	}
+	err := trash.Purge(c, id)
+	if errors.Is(err, trash.ErrDisabled) {
+		// trash.Folder already deleted it.
+		return nil
+	}
+	return err
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\")
+}
+
+// translate maps the SQLSTATEs raised by the migration's functions.
+func translate(err error) error {
+	pg := meta.AsPostgres(err)
+	switch {
+	case pg == nil:
+		return err
+	case pg.Code == "P0002":
+		return meta.ErrNotFound
+	case pg.Code == "23514":
+		return ErrCycle
+	case pg.Code == "23505" && pg.Hint == "name_taken":
+		return ErrExists
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/storage"
+)
+
+// chunkCache keeps decrypted chunks on local disk, sealed again with the
+// file's own key so the cache is no easier to read than the provider copy.
+// When it grows past limit the least recently used chunks are removed.
+type chunkCache struct {
+	dir   string
+	limit int64
+
+	mu       sync.Mutex
+	size     int64
+	inflight map[string]*fetch
+}
+
+// fetch is a download in progress, shared by everyone who asks for the
+// same chunk meanwhile.
+type fetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func newChunkCache(dir string, limit int64) (*chunkCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	c := &chunkCache{dir: dir, limit: limit, inflight: make(map[string]*fetch)}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil {
+			c.size += info.Size()
+		}
+	}
+	return c, nil
+}
+
+// fileKey returns the file's AES key, or nil if it has none the cache can
+// use.
+func fileKey(f *meta.File) []byte {
+	key, err := base64.StdEncoding.DecodeString(f.MetaKey)
+	if err != nil || len(key) != 32 {
+		return nil
+	}
+	return key
+}
+
+func (c *chunkCache) path(f *meta.File, link string) string {
+	sum := sha256.Sum256([]byte(f.MetaKey + "\n" + link))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:]))
+}
+
+// get returns the plaintext of one chunk of f, from disk if it is cached.
+func (c *chunkCache) get(client *meta.Client, f *meta.File, link string) ([]byte, error) {
+	key := fileKey(f)
+	name := c.path(f, link)
+	if key != nil {
+		if sealed, err := os.ReadFile(name); err == nil {
+			if plain, err := storage.OpenChunk(key, sealed); err == nil {
+				now := time.Now()
+				os.Chtimes(name, now, now)
+				return plain, nil
+			}
+		}
+	}
+
+	c.mu.Lock()
+	if fl := c.inflight[name]; fl != nil {
+		c.mu.Unlock()
+		<-fl.done
+		return fl.data, fl.err
+	}
+	fl := &fetch{done: make(chan struct{})}
+	c.inflight[name] = fl
+	c.mu.Unlock()
+
+	fl.data, fl.err = content.Chunk(client, f, link)
+	if fl.err == nil && key != nil {
+		if err := c.put(name, key, fl.data); err != nil {
+			fmt.Printf("[MOUNT] cache: %v\n", err)
+		}
+	}
+	c.mu.Lock()
+	delete(c.inflight, name)
+	c.mu.Unlock()
+	close(fl.done)
+	return fl.data, fl.err
+}
+
+// prefetch downloads a chunk into the cache in the background.
+func (c *chunkCache) prefetch(client *meta.Client, f *meta.File, link string) {
+	if fileKey(f) == nil {
+		return // nowhere to keep it
+	}
+	name := c.path(f, link)
+	c.mu.Lock()
+	_, busy := c.inflight[name]
+	c.mu.Unlock()
+	if busy {
+		return
+	}
+	if _, err := os.Stat(name); err == nil {
+		return
+	}
+	go c.get(client, f, link)
+}
+
+func (c *chunkCache) put(name string, key, plain []byte) error {
+	sealed, err := storage.SealChunk(key, plain)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(sealed); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += int64(len(sealed))
+	if c.size > c.limit {
+		c.evict()
+	}
+	return nil
+}
+
+// evict removes the least recently used chunks until the cache is at 90%
+// of its limit. c.mu must be held.
+func (c *chunkCache) evict() {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	var total int64
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && info.Mode().IsRegular() {
+			infos = append(infos, info)
+			total += info.Size()
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().Before(infos[j].ModTime()) })
+	for _, info := range infos {
+		if total <= c.limit/10*9 {
+			break
+		}
+		if os.Remove(filepath.Join(c.dir, info.Name())) == nil {
+			total -= info.Size()
+		}
+	}
+	c.size = total
+}
+
+// fileReader reads the plaintext of a saved file through the cache.
+type fileReader struct {
+	fsys      *FS
+	f         *meta.File
+	links     []string
+	chunkSize int64
+
+	mu  sync.Mutex
+	cur int
+	buf []byte
+}
+
+func newFileReader(fsys *FS, f *meta.File) (*fileReader, error) {
+	links, err := f.Links()
+	if err != nil {
+		return nil, fmt.Errorf("file %s: invalid meta_links: %v", f.ID, err)
+	}
+	return &fileReader{
+		fsys:      fsys,
+		f:         f,
+		links:     links,
+		chunkSize: int64(storage.ChunkSize(f.MetaProvider)),
+		cur:       -1,
+	}, nil
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *fileReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for n < len(p) && off < r.f.Size {
+		i := int(off / r.chunkSize)
+		data, err := r.chunk(i)
+		if err != nil {
+			return n, err
+		}
+		start := off - int64(i)*r.chunkSize
+		if start >= int64(len(data)) {
+			return n, io.ErrUnexpectedEOF
+		}
+		m := copy(p[n:], data[start:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// chunk returns chunk i and starts fetching the next one, since reads are
+// usually sequential. r.mu must be held.
+func (r *fileReader) chunk(i int) ([]byte, error) {
+	if i == r.cur {
+		return r.buf, nil
+	}
+	if i >= len(r.links) {
+		return nil, fmt.Errorf("file %s: chunk %d missing (%d chunks)", r.f.ID, i, len(r.links))
+	}
+	data, err := r.fsys.cache.get(r.fsys.client, r.f, r.links[i])
+	if err != nil {
+		return nil, fmt.Errorf("file %s chunk %d: %v", r.f.ID, i, err)
+	}
+	r.cur, r.buf = i, data
+	if i+1 < len(r.links) {
+		r.fsys.cache.prefetch(r.fsys.client, r.f, r.links[i+1])
+	}
+	return data, nil
+}
@@ -0,0 +1,442 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/trash"
+)
+
+// listColumns leaves out meta_links, which can be large; it is loaded when
+// a file is opened.
+const listColumns = "id,name,size,mime,type,date,folder_id,meta_key,meta_provider,created_at"
+
+// renameNoReplace is RENAME_NOREPLACE from renameat2(2).
+const renameNoReplace = 1
+
+// dirNode is a folder, or the root when folder is nil. It keeps its last
+// listing for cacheTTL so that a Readdir followed by a Lookup of every
+// entry (ls -l) costs two queries instead of two per entry.
+type dirNode struct {
+	fs.Inode
+	fsys *FS
+
+	mu      sync.Mutex
+	folder  *meta.Folder
+	listed  time.Time
+	folders map[string]meta.Folder
+	files   map[string]meta.File
+}
+
+var (
+	_ fs.NodeLookuper  = (*dirNode)(nil)
+	_ fs.NodeReaddirer = (*dirNode)(nil)
+	_ fs.NodeGetattrer = (*dirNode)(nil)
+	_ fs.NodeMkdirer   = (*dirNode)(nil)
+	_ fs.NodeCreater   = (*dirNode)(nil)
+	_ fs.NodeUnlinker  = (*dirNode)(nil)
+	_ fs.NodeRmdirer   = (*dirNode)(nil)
+	_ fs.NodeRenamer   = (*dirNode)(nil)
+	_ fs.NodeStatfser  = (*dirNode)(nil)
+)
+
+// id is the parent_id/folder_id of the folder's children.
+func (d *dirNode) id() *string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.folder == nil {
+		return nil
+	}
+	id := d.folder.ID
+	return &id
+}
+
+func parentFilter(parent *string) string {
+	if parent == nil {
+		return "is.null"
+	}
+	return meta.Eq(*parent)
+}
+
+// list returns the folder's children by name. When a folder and a file, or
+// two rows, share a name, the folder and then the oldest row win.
+func (d *dirNode) list() (map[string]meta.Folder, map[string]meta.File, error) {
+	parent := d.id()
+	d.mu.Lock()
+	fresh := time.Since(d.listed) < cacheTTL
+	folders, files := d.folders, d.files
+	d.mu.Unlock()
+	if fresh {
+		return folders, files, nil
+	}
+
+	folderRows, err := d.fsys.client.ListFolders(url.Values{
+		"parent_id": {parentFilter(parent)},
+		"order":     {"id.asc"},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	fileRows, err := d.fsys.client.ListFiles(url.Values{
+		"select":    {listColumns},
+		"folder_id": {parentFilter(parent)},
+		"order":     {"id.asc"},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	folders = make(map[string]meta.Folder)
+	for _, f := range folderRows {
+		if _, ok := folders[f.Name]; !ok && validName(f.Name) {
+			folders[f.Name] = f
+		}
+	}
+	files = make(map[string]meta.File)
+	for _, f := range fileRows {
+		_, isDir := folders[f.Name]
+		if _, ok := files[f.Name]; !ok && !isDir && validName(f.Name) {
+			files[f.Name] = f
+		}
+	}
+
+	d.mu.Lock()
+	d.folders, d.files, d.listed = folders, files, time.Now()
+	d.mu.Unlock()
+	return folders, files, nil
+}
+
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.Contains(name, "/")
+}
+
+// invalidate drops the cached listing after a change.
+func (d *dirNode) invalidate() {
+	d.mu.Lock()
+	d.listed = time.Time{}
+	d.mu.Unlock()
+}
+
+// pendingFile returns the child file name if it is open and not saved yet.
+// Such files are not in the listing.
+func (d *dirNode) pendingFile(name string) *fs.Inode {
+	ch := d.GetChild(name)
+	if ch == nil {
+		return nil
+	}
+	if fn, ok := ch.Operations().(*fileNode); ok && fn.pending() {
+		return ch
+	}
+	return nil
+}
+
+func (d *dirNode) folderInode(ctx context.Context, f meta.Folder) *fs.Inode {
+	ch := d.NewInode(ctx, &dirNode{fsys: d.fsys, folder: &f}, fs.StableAttr{Mode: fuse.S_IFDIR, Ino: ino('d', f.ID)})
+	if dn, ok := ch.Operations().(*dirNode); ok {
+		dn.mu.Lock()
+		dn.folder = &f
+		dn.mu.Unlock()
+	}
+	return ch
+}
+
+func (d *dirNode) fileInode(ctx context.Context, f meta.File) *fs.Inode {
+	ch := d.NewInode(ctx, &fileNode{fsys: d.fsys, f: f}, fs.StableAttr{Mode: fuse.S_IFREG, Ino: ino('f', f.ID)})
+	if fn, ok := ch.Operations().(*fileNode); ok {
+		fn.refresh(f)
+	}
+	return ch
+}
+
+func (d *dirNode) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if ch := d.pendingFile(name); ch != nil {
+		ch.Operations().(*fileNode).getattr(&out.Attr)
+		return ch, 0
+	}
+	folders, files, err := d.list()
+	if err != nil {
+		return nil, errno("lookup "+name, err)
+	}
+	if f, ok := folders[name]; ok {
+		ch := d.folderInode(ctx, f)
+		ch.Operations().(*dirNode).getattr(&out.Attr)
+		return ch, 0
+	}
+	if f, ok := files[name]; ok {
+		ch := d.fileInode(ctx, f)
+		ch.Operations().(*fileNode).getattr(&out.Attr)
+		return ch, 0
+	}
+	return nil, syscall.ENOENT
+}
+
+func (d *dirNode) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
+	folders, files, err := d.list()
+	if err != nil {
+		return nil, errno("readdir", err)
+	}
+	entries := make([]fuse.DirEntry, 0, len(folders)+len(files))
+	for name, f := range folders {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFDIR, Ino: ino('d', f.ID)})
+	}
+	for name, f := range files {
+		entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG, Ino: ino('f', f.ID)})
+	}
+	for name, ch := range d.Children() {
+		_, isDir := folders[name]
+		_, isFile := files[name]
+		if !isDir && !isFile && d.pendingFile(name) != nil {
+			entries = append(entries, fuse.DirEntry{Name: name, Mode: fuse.S_IFREG, Ino: ch.StableAttr().Ino})
+		}
+	}
+	return fs.NewListDirStream(entries), 0
+}
+
+func (d *dirNode) getattr(a *fuse.Attr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	a.Mode = fuse.S_IFDIR | 0755
+	a.Nlink = 1
+	t := time.Now()
+	if d.folder != nil {
+		t = d.folder.Modified()
+	}
+	a.SetTimes(nil, &t, &t)
+}
+
+func (d *dirNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	d.getattr(&out.Attr)
+	return 0
+}
+
+// Statfs reports plenty of free space: providers have no fixed size, and
+// some copy tools check before writing.
+func (d *dirNode) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
+	const blocks = 1 << 32
+	out.Bsize = 4096
+	out.Frsize = 4096
+	out.Blocks, out.Bfree, out.Bavail = blocks, blocks, blocks
+	out.Files, out.Ffree = 1<<20, 1<<20
+	out.NameLen = 255
+	return 0
+}
+
+func (d *dirNode) exists(name string) (bool, error) {
+	if d.pendingFile(name) != nil {
+		return true, nil
+	}
+	folders, files, err := d.list()
+	if err != nil {
+		return false, err
+	}
+	_, isDir := folders[name]
+	_, isFile := files[name]
+	return isDir || isFile, nil
+}
+
+func (d *dirNode) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if found, err := d.exists(name); err != nil || found {
+		if err != nil {
+			return nil, errno("mkdir "+name, err)
+		}
+		return nil, syscall.EEXIST
+	}
+	f := meta.Folder{Name: name, ParentID: d.id()}
+	if err := d.fsys.client.InsertFolder(&f); err != nil {
+		return nil, errno("mkdir "+name, err)
+	}
+	d.invalidate()
+	ch := d.folderInode(ctx, f)
+	ch.Operations().(*dirNode).getattr(&out.Attr)
+	return ch, 0
+}
+
+func (d *dirNode) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, syscall.Errno) {
+	fn := &fileNode{fsys: d.fsys, f: meta.File{Name: name, FolderID: d.id(), Mime: meta.MimeOf(name)}}
+	fn.mu.Lock()
+	err := fn.beginWrite(true)
+	fn.writers = 1
+	fn.mu.Unlock()
+	if err != nil {
+		return nil, nil, 0, errno("create "+name, err)
+	}
+	// Ino 0 lets go-fuse pick one; the file has no ID until it is saved.
+	ch := d.NewInode(ctx, fn, fs.StableAttr{Mode: fuse.S_IFREG})
+	fn.getattr(&out.Attr)
+	return ch, &handle{write: true}, 0, 0
+}
+
+func (d *dirNode) Unlink(ctx context.Context, name string) syscall.Errno {
+	id := ""
+	if ch := d.GetChild(name); ch != nil {
+		if fn, ok := ch.Operations().(*fileNode); ok {
+			if id = fn.unlink(); id == "" {
+				return 0 // never saved
+			}
+		}
+	}
+	if id == "" {
+		_, files, err := d.list()
+		if err != nil {
+			return errno("unlink "+name, err)
+		}
+		f, ok := files[name]
+		if !ok {
+			return syscall.ENOENT
+		}
+		id = f.ID
+	}
+	if err := trash.File(d.fsys.client, id); err != nil {
+		return errno("unlink "+name, err)
+	}
+	d.invalidate()
+	return 0
+}
+
+// isEmpty reports whether the folder id has no children.
+func (fsys *FS) isEmpty(id string) (bool, error) {
+	folders, err := fsys.client.ListFolders(url.Values{"select": {"id"}, "parent_id": {meta.Eq(id)}, "limit": {"1"}})
+	if err != nil {
+		return false, err
+	}
+	files, err := fsys.client.ListFiles(url.Values{"select": {"id"}, "folder_id": {meta.Eq(id)}, "limit": {"1"}})
+	if err != nil {
+		return false, err
+	}
+	return len(folders) == 0 && len(files) == 0, nil
+}
+
+func (d *dirNode) Rmdir(ctx context.Context, name string) syscall.Errno {
+	folders, _, err := d.list()
+	if err != nil {
+		return errno("rmdir "+name, err)
+	}
+	f, ok := folders[name]
+	if !ok {
+		return syscall.ENOENT
+	}
+	if empty, err := d.fsys.isEmpty(f.ID); err != nil || !empty {
+		if err != nil {
+			return errno("rmdir "+name, err)
+		}
+		return syscall.ENOTEMPTY
+	}
+	if err := trash.Folder(d.fsys.client, f.ID); err != nil {
+		return errno("rmdir "+name, err)
+	}
+	d.invalidate()
+	return 0
+}
+
+// Rename moves or renames a child, replacing a file or empty folder of the
+// same name like rename(2) does. Editors rely on that to save files.
+func (d *dirNode) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	if flags&^renameNoReplace != 0 {
+		return syscall.ENOTSUP
+	}
+	dst, ok := newParent.(*dirNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	op := "rename " + name + " to " + newName
+
+	src := d.GetChild(name)
+	if src == nil {
+		var out fuse.EntryOut
+		var e syscall.Errno
+		if src, e = d.Lookup(ctx, name, &out); e != 0 {
+			return e
+		}
+	}
+
+	// Whatever is at the destination now.
+	var oldFile *fileNode
+	var oldFolder *meta.Folder
+	if ch := dst.pendingFile(newName); ch != nil {
+		oldFile = ch.Operations().(*fileNode)
+	} else {
+		folders, files, err := dst.list()
+		if err != nil {
+			return errno(op, err)
+		}
+		if f, ok := folders[newName]; ok {
+			oldFolder = &f
+		} else if f, ok := files[newName]; ok {
+			oldFile = &fileNode{f: f}
+			if ch := dst.GetChild(newName); ch != nil {
+				if fn, ok := ch.Operations().(*fileNode); ok {
+					oldFile = fn
+				}
+			}
+		}
+	}
+	if (oldFile != nil || oldFolder != nil) && flags&renameNoReplace != 0 {
+		return syscall.EEXIST
+	}
+
+	switch n := src.Operations().(type) {
+	case *fileNode:
+		if oldFolder != nil {
+			return syscall.EISDIR
+		}
+		if oldFile == n {
+			return 0
+		}
+		if err := n.move(newName, dst.id()); err != nil {
+			return errno(op, err)
+		}
+		if oldFile != nil {
+			if id := oldFile.unlink(); id != "" {
+				if err := trash.File(d.fsys.client, id); err != nil {
+					return errno(op, err)
+				}
+			}
+		}
+
+	case *dirNode:
+		if oldFile != nil {
+			return syscall.ENOTDIR
+		}
+		n.mu.Lock()
+		folder := *n.folder
+		n.mu.Unlock()
+		if oldFolder != nil {
+			if oldFolder.ID == folder.ID {
+				return 0
+			}
+			if empty, err := d.fsys.isEmpty(oldFolder.ID); err != nil || !empty {
+				if err != nil {
+					return errno(op, err)
+				}
+				return syscall.ENOTEMPTY
+			}
+		}
+		parent := dst.id()
+		if err := d.fsys.client.Update("folders", url.Values{"id": {meta.Eq(folder.ID)}},
+			map[string]interface{}{"name": newName, "parent_id": parent}, nil); err != nil {
+			return errno(op, err)
+		}
+		n.mu.Lock()
+		n.folder.Name, n.folder.ParentID = newName, parent
+		n.mu.Unlock()
+		if oldFolder != nil {
+			if err := trash.Folder(d.fsys.client, oldFolder.ID); err != nil {
+				return errno(op, err)
+			}
+		}
+	}
+
+	d.invalidate()
+	dst.invalidate()
+	return 0
+}
@@ -0,0 +1,333 @@
+//go:build linux
+
+package fusefs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/versions"
+)
+
+// fileNode is a file. While it is open for writing, buf holds the whole
+// plaintext locally and reads are served from it; closing the file uploads
+// buf as new chunks and points the row at them.
+type fileNode struct {
+	fs.Inode
+	fsys *FS
+
+	mu       sync.Mutex
+	f        meta.File // ID is empty until the file is first saved
+	buf      *os.File
+	writers  int
+	dirty    bool
+	unlinked bool
+}
+
+var (
+	_ fs.NodeGetattrer = (*fileNode)(nil)
+	_ fs.NodeSetattrer = (*fileNode)(nil)
+	_ fs.NodeOpener    = (*fileNode)(nil)
+	_ fs.NodeReader    = (*fileNode)(nil)
+	_ fs.NodeWriter    = (*fileNode)(nil)
+	_ fs.NodeFlusher   = (*fileNode)(nil)
+	_ fs.NodeFsyncer   = (*fileNode)(nil)
+	_ fs.NodeReleaser  = (*fileNode)(nil)
+)
+
+// handle is an open file. Readers keep their own chunk reader so
+// sequential reads decrypt each chunk once.
+type handle struct {
+	write bool
+
+	mu sync.Mutex
+	rd *fileReader
+}
+
+// refresh takes a newer row from a listing, unless local changes are
+// pending.
+func (n *fileNode) refresh(f meta.File) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.buf == nil && f.ID == n.f.ID {
+		n.f = f
+	}
+}
+
+// pending reports whether the file was created here and not saved yet.
+func (n *fileNode) pending() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.f.ID == "" && !n.unlinked
+}
+
+// unlink marks the file as deleted so it is never saved again, and returns
+// the ID of its row, if any.
+func (n *fileNode) unlink() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.unlinked = true
+	return n.f.ID
+}
+
+// move renames the file's row, or just the pending file.
+func (n *fileNode) move(name string, folderID *string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.f.ID != "" {
+		err := n.fsys.client.Update("files", url.Values{"id": {meta.Eq(n.f.ID)}},
+			map[string]interface{}{"name": name, "folder_id": folderID}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	n.f.Name, n.f.FolderID = name, folderID
+	return nil
+}
+
+func (n *fileNode) getattr(a *fuse.Attr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.attr(a)
+}
+
+// attr fills in a. n.mu must be held.
+func (n *fileNode) attr(a *fuse.Attr) {
+	size := n.f.Size
+	if n.buf != nil {
+		if fi, err := n.buf.Stat(); err == nil {
+			size = fi.Size()
+		}
+	}
+	t := time.Now()
+	if n.f.CreatedAt != "" {
+		t = n.f.Modified()
+	}
+	a.Mode = fuse.S_IFREG | 0644
+	a.Nlink = 1
+	a.Size = uint64(size)
+	a.Blocks = uint64(size+511) / 512
+	a.SetTimes(nil, &t, &t)
+}
+
+func (n *fileNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	n.getattr(&out.Attr)
+	return 0
+}
+
+// Setattr supports truncation. Modes, owners and times are not stored and
+// are accepted silently so that cp -p and touch work.
+func (n *fileNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if size, ok := in.GetSize(); ok {
+		opened := n.buf != nil
+		err := n.beginWrite(size == 0)
+		if err == nil {
+			err = n.buf.Truncate(int64(size))
+			n.dirty = true
+		}
+		if err == nil && !opened {
+			err = n.commit()
+			n.discard()
+		}
+		if err != nil {
+			return errno("truncate "+n.f.Name, err)
+		}
+	}
+	n.attr(&out.Attr)
+	return 0
+}
+
+func (n *fileNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) == 0 {
+		return &handle{}, 0, 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if err := n.beginWrite(flags&syscall.O_TRUNC != 0); err != nil {
+		return nil, 0, errno("open "+n.f.Name, err)
+	}
+	n.writers++
+	return &handle{write: true}, 0, 0
+}
+
+// beginWrite makes sure there is a local copy to write to, downloading the
+// current content unless it is about to be truncated. n.mu must be held.
+func (n *fileNode) beginWrite(truncate bool) error {
+	if n.buf == nil {
+		tmp, err := os.CreateTemp(n.fsys.tmpDir, "write-")
+		if err != nil {
+			return err
+		}
+		if !truncate && n.f.Size > 0 {
+			err = n.download(tmp)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return err
+		}
+		n.buf = tmp
+	}
+	if truncate {
+		n.dirty = true
+		return n.buf.Truncate(0)
+	}
+	return nil
+}
+
+func (n *fileNode) download(w io.Writer) error {
+	full, err := n.fsys.client.GetFile(n.f.ID)
+	if err != nil {
+		return err
+	}
+	rd, err := newFileReader(n.fsys, full)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(rd, 0, full.Size))
+	return err
+}
+
+func (n *fileNode) Read(ctx context.Context, fh fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n.mu.Lock()
+	if n.buf != nil {
+		cnt, err := n.buf.ReadAt(dest, off)
+		n.mu.Unlock()
+		if err != nil && err != io.EOF {
+			return nil, errno("read "+n.f.Name, err)
+		}
+		return fuse.ReadResultData(dest[:cnt]), 0
+	}
+	f := n.f
+	n.mu.Unlock()
+
+	h := fh.(*handle)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rd == nil || h.rd.f.MetaKey != f.MetaKey {
+		// Open the row as it is now; meta_links is not in listings.
+		full, err := n.fsys.client.GetFile(f.ID)
+		if err == nil {
+			h.rd, err = newFileReader(n.fsys, full)
+		}
+		if err != nil {
+			return nil, errno("read "+f.Name, err)
+		}
+	}
+	cnt, err := h.rd.ReadAt(dest, off)
+	if err != nil && err != io.EOF {
+		return nil, errno("read "+f.Name, err)
+	}
+	return fuse.ReadResultData(dest[:cnt]), 0
+}
+
+func (n *fileNode) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, syscall.Errno) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.buf == nil {
+		return 0, syscall.EBADF
+	}
+	cnt, err := n.buf.WriteAt(data, off)
+	n.dirty = true
+	if err != nil {
+		return uint32(cnt), errno("write "+n.f.Name, err)
+	}
+	return uint32(cnt), 0
+}
+
+// Flush uploads pending changes when a descriptor is closed, so close(2)
+// reports upload errors.
+func (n *fileNode) Flush(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	if !fh.(*handle).write {
+		return 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return errno("upload "+n.f.Name, n.commit())
+}
+
+func (n *fileNode) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) syscall.Errno {
+	return n.Flush(ctx, fh)
+}
+
+func (n *fileNode) Release(ctx context.Context, fh fs.FileHandle) syscall.Errno {
+	if !fh.(*handle).write {
+		return 0
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.writers--
+	if err := n.commit(); err != nil {
+		// Nobody is left to report to; keep the data.
+		fmt.Printf("[MOUNT] upload %s: %v; local copy kept at %s\n", n.f.Name, err, n.buf.Name())
+		if n.writers == 0 {
+			n.buf.Close()
+			n.buf = nil
+		}
+		return syscall.EIO
+	}
+	if n.writers == 0 {
+		n.discard()
+	}
+	return 0
+}
+
+// discard drops the local copy. n.mu must be held.
+func (n *fileNode) discard() {
+	if n.buf != nil {
+		n.buf.Close()
+		os.Remove(n.buf.Name())
+		n.buf = nil
+	}
+}
+
+// commit uploads the local copy if it changed and saves the row. n.mu must
+// be held.
+func (n *fileNode) commit() error {
+	if !n.dirty || n.unlinked {
+		return nil
+	}
+	fi, err := n.buf.Stat()
+	if err != nil {
+		return err
+	}
+	w, err := content.NewWriter(n.fsys.client, n.fsys.provider, n.f.Name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(n.buf, 0, fi.Size())); err != nil {
+		w.Release()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		w.Release()
+		return err
+	}
+
+	f := n.f
+	if err := versions.Overwrite(n.fsys.client, &f, w); err != nil {
+		return err
+	}
+	n.f, n.dirty = f, false
+	fmt.Printf("[MOUNT] uploaded %s (%d bytes)\n", f.Name, f.Size)
+
+	if _, parent := n.Parent(); parent != nil {
+		if d, ok := parent.Operations().(*dirNode); ok {
+			d.invalidate()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+//go:build linux
+
+// Package fusefs mounts the TEDDRIVE folder tree as a Linux filesystem.
+// Folders and files map to their metadata rows. Reads fetch and decrypt
+// chunks on demand and keep them in an on-disk cache; writes go to a local
+// copy of the file that is chunked, encrypted and uploaded when it is
+// closed.
+package fusefs
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+)
+
+// cacheTTL is how long the kernel and the folder listings trust metadata.
+// Changes made in the web app show up after at most this long.
+const cacheTTL = 5 * time.Second
+
+// Options configure a mount.
+type Options struct {
+	// Provider stores new and rewritten files.
+	Provider string
+	// CacheDir holds cached chunks and the local copies of files open for
+	// writing.
+	CacheDir string
+	// CacheSize is how many bytes of chunks to keep.
+	CacheSize int64
+	// Debug logs every FUSE request.
+	Debug bool
+}
+
+// FS is the state shared by all nodes of a mount.
+type FS struct {
+	client   *meta.Client
+	provider string
+	cache    *chunkCache
+	tmpDir   string
+}
+
+// Mount mounts the drive on dir. The caller waits on the returned server
+// and unmounts it.
+func Mount(dir string, c *meta.Client, opts Options) (*fuse.Server, error) {
+	if _, err := content.NewWriter(c, opts.Provider, ""); err != nil {
+		return nil, err
+	}
+	cache, err := newChunkCache(filepath.Join(opts.CacheDir, "chunks"), opts.CacheSize)
+	if err != nil {
+		return nil, err
+	}
+	tmpDir := filepath.Join(opts.CacheDir, "writes")
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return nil, err
+	}
+
+	fsys := &FS{client: c, provider: opts.Provider, cache: cache, tmpDir: tmpDir}
+	ttl := cacheTTL
+	return fs.Mount(dir, &dirNode{fsys: fsys}, &fs.Options{
+		MountOptions: fuse.MountOptions{
+			FsName: "teddrive",
+			Name:   "teddrive",
+			Debug:  opts.Debug,
+			// Mount directly when running as root, else via fusermount.
+			DirectMount: true,
+		},
+		EntryTimeout: &ttl,
+		AttrTimeout:  &ttl,
+		UID:          uint32(os.Getuid()),
+		GID:          uint32(os.Getgid()),
+	})
+}
+
+// errno logs err and turns it into the errno returned to the kernel.
+func errno(op string, err error) syscall.Errno {
+	if err == nil {
+		return 0
+	}
+	if errors.Is(err, meta.ErrNotFound) {
+		return syscall.ENOENT
+	}
+	fmt.Printf("[MOUNT] %s: %v\n", op, err)
+	return syscall.EIO
+}
+
+// ino derives a stable inode number from a row ID. It stays below 2^63,
+// where go-fuse starts handing out numbers for files not saved yet.
+func ino(kind byte, id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte{kind})
+	h.Write([]byte(id))
+	n := h.Sum64() &^ (1 << 63)
+	if n < 2 {
+		n += 2 // 1 is the root
+	}
+	return n
+}
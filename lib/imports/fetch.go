@@ -0,0 +1,151 @@
+package imports
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"teddrive-web/lib/meta"
+)
+
+// client fetches imports. It only connects to public addresses, also
+// after redirects, so a URL cannot reach the server's own network or the
+// cloud's metadata service. No proxy is used for the same reason.
+var client = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: publicOnly,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return ErrURL
+		}
+		return nil
+	},
+}
+
+// ErrAddress is returned for URLs whose host is not on the internet.
+var ErrAddress = errors.New("URLs on local or private networks cannot be imported")
+
+// sharedSpace is the carrier-grade NAT range, private in all but name.
+var sharedSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// publicOnly refuses connections to addresses that are not public. It runs
+// after the name is resolved, so a name pointing inside is caught too.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsMulticast() ||
+		sharedSpace.Contains(ip) || (ip.To4() != nil && ip.To4()[0] == 0) {
+		return ErrAddress
+	}
+	return nil
+}
+
+// open requests the job's URL from where it stopped. The first answer
+// fills in the name, type, size and ETag.
+func open(job *Job) (*http.Response, error) {
+	req, err := http.NewRequest("GET", job.URL, nil)
+	if err != nil {
+		return nil, ErrURL
+	}
+	req.Header.Set("User-Agent", "TEDDRIVE-import")
+	if job.DoneBytes > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", job.DoneBytes))
+		if job.ETag != "" && !strings.HasPrefix(job.ETag, "W/") {
+			req.Header.Set("If-Range", job.ETag)
+		}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(err error) (*http.Response, error) {
+		resp.Body.Close()
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && job.DoneBytes > 0:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", job.DoneBytes)) {
+			return fail(fmt.Errorf("unexpected Content-Range %q", resp.Header.Get("Content-Range")))
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && job.DoneBytes > 0 &&
+		(job.Size == nil || *job.Size == job.DoneBytes):
+		// Stopped right after the last full chunk: nothing is left.
+		resp.Body.Close()
+		resp.Body = http.NoBody
+	case resp.StatusCode == http.StatusOK:
+		if job.DoneBytes == 0 {
+			describe(job, resp)
+			break
+		}
+		// No ranges: skip what is stored already, if it is the same file.
+		if etag := resp.Header.Get("ETag"); job.ETag != "" && etag != job.ETag {
+			return fail(ErrChanged)
+		}
+		if job.Size != nil && resp.ContentLength >= 0 && resp.ContentLength != *job.Size {
+			return fail(ErrChanged)
+		}
+		if _, err := io.CopyN(io.Discard, resp.Body, job.DoneBytes); err != nil {
+			return fail(err)
+		}
+	default:
+		return fail(fmt.Errorf("%s answered %s", req.URL.Host, resp.Status))
+	}
+	return resp, nil
+}
+
+// describe fills in what the first answer tells about the file.
+func describe(job *Job, resp *http.Response) {
+	if job.Name == "" {
+		name := ""
+		if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+			name = params["filename"]
+		}
+		if name == "" {
+			// The URL after redirects.
+			if base := path.Base(resp.Request.URL.Path); base != "/" && base != "." {
+				name = base
+			}
+		}
+		if name == "" {
+			name = resp.Request.URL.Hostname()
+		}
+		job.Name = meta.CleanName(name, "download")
+	}
+	job.Mime = ""
+	if t, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil && t != "application/octet-stream" {
+		job.Mime = t
+	}
+	if job.Mime == "" {
+		job.Mime, _, _ = strings.Cut(mime.TypeByExtension(path.Ext(job.Name)), ";")
+	}
+	if job.Mime == "" {
+		job.Mime = "application/octet-stream"
+	}
+	job.Size = nil
+	if resp.ContentLength >= 0 {
+		n := resp.ContentLength
+		job.Size = &n
+	}
+	job.ETag = resp.Header.Get("ETag")
+}
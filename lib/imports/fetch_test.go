@@ -0,0 +1,69 @@
+package imports
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublicOnly(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{"93.184.216.34:443", true},
+		{"1.1.1.1:80", true},
+		{"[2606:4700:4700::1111]:443", true},
+		{"100.63.255.255:80", true},
+		{"100.128.0.0:80", true},
+		{"127.0.0.1:80", false},
+		{"127.8.9.10:8080", false},
+		{"[::1]:80", false},
+		{"[::ffff:127.0.0.1]:80", false},
+		{"0.0.0.0:80", false},
+		{"0.1.2.3:80", false},
+		{"[::]:80", false},
+		{"10.0.0.1:80", false},
+		{"172.16.5.4:80", false},
+		{"192.168.1.1:80", false},
+		{"[::ffff:192.168.1.1]:80", false},
+		{"[fd00::1]:80", false},
+		{"169.254.169.254:80", false},
+		{"[fe80::1]:80", false},
+		{"100.64.0.1:80", false},
+		{"100.127.255.254:80", false},
+		{"224.0.0.1:80", false},
+		{"[ff02::1]:80", false},
+		{"not-an-ip:80", false},
+		{"1.1.1.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := publicOnly("tcp", tt.address, nil)
+			if tt.public && err != nil {
+				t.Errorf("publicOnly(%q) = %v, want nil", tt.address, err)
+			}
+			if !tt.public && err == nil {
+				t.Errorf("publicOnly(%q) = nil, want an error", tt.address)
+			}
+		})
+	}
+}
+
+// The check runs when the client dials, after the name is resolved.
+func TestClientRefusesLocal(t *testing.T) {
+	inside := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer inside.Close()
+
+	resp, err := client.Get(inside.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("fetched a loopback URL")
+	}
+	if !errors.Is(err, ErrAddress) {
+		t.Errorf("err = %v, want ErrAddress", err)
+	}
+}
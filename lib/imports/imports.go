@@ -0,0 +1,362 @@
+// Package imports fetches files from URLs on the server and stores them
+// like uploads: chunked, encrypted and sent to the chosen provider without
+// going through the browser. An import is a job in the imports table,
+// worked on a few chunks at a time so each call fits in a serverless time
+// limit. After every chunk the job records where it is, so an import that
+// stopped, or failed, carries on from the last chunk with a Range request.
+package imports
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/messages"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+	"teddrive-web/lib/versions"
+)
+
+const table = "imports"
+
+// Job statuses.
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// lease is how long a call may work on a job before another may take it
+// over, for calls that were cut off without letting go.
+const lease = 5 * time.Minute
+
+var (
+	// ErrURL is returned for URLs that are not http or https.
+	ErrURL = errors.New("only http and https URLs can be imported")
+	// ErrProvider is returned for providers imports cannot upload to.
+	ErrProvider = errors.New("unsupported provider for imports")
+	// ErrBusy is returned while another call works on the job.
+	ErrBusy = errors.New("import is already running")
+	// ErrChanged is returned when the file at the URL changed between two
+	// calls, so the parts would not fit together.
+	ErrChanged = errors.New("the file at the URL changed since the import started")
+)
+
+// Job mirrors a row of the imports table. Size is nil until the server
+// at the URL says, or the import is done.
+type Job struct {
+	ID           string              `json:"id"`
+	UserID       string              `json:"user_id"`
+	URL          string              `json:"url"`
+	Name         string              `json:"name"`
+	Mime         string              `json:"mime"`
+	FolderID     *string             `json:"folder_id"`
+	Provider     string              `json:"provider"`
+	Status       string              `json:"status"`
+	Size         *int64              `json:"size"`
+	DoneBytes    int64               `json:"done_bytes"`
+	ETag         string              `json:"etag"`
+	State        *content.Checkpoint `json:"state"` // holds the file's key; never leaves the server
+	FileID       *string             `json:"file_id"`
+	Error        string              `json:"error"`
+	ClaimedUntil *string             `json:"claimed_until"`
+	CreatedAt    string              `json:"created_at,omitempty"`
+	UpdatedAt    string              `json:"updated_at,omitempty"`
+}
+
+// Request is what to import. Name, when empty, comes from the server's
+// answer; an empty FolderID is the top level.
+type Request struct {
+	URL      string
+	Name     string
+	FolderID string
+	Provider string
+}
+
+// Enqueue creates a pending job for userID ("" for anonymous callers).
+// Nothing is fetched yet.
+func Enqueue(c *meta.Client, userID string, req Request) (*Job, error) {
+	u, err := url.Parse(strings.TrimSpace(req.URL))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrURL
+	}
+	switch req.Provider {
+	case "":
+		req.Provider = "discord"
+	case "discord", "telegram", storage.ErasureProvider:
+	default:
+		return nil, ErrProvider
+	}
+	job := &Job{
+		ID:        newID(),
+		UserID:    userID,
+		URL:       u.String(),
+		Provider:  req.Provider,
+		Status:    StatusPending,
+		UpdatedAt: now(),
+	}
+	if name := strings.TrimSpace(req.Name); name != "" {
+		job.Name = meta.CleanName(name, "download")
+	}
+	if req.FolderID != "" {
+		if _, err := c.GetFolder(req.FolderID); err != nil {
+			return nil, err
+		}
+		job.FolderID = &req.FolderID
+	}
+	if err := c.Insert(table, job, nil); err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// Get looks up a job by ID.
+func Get(c *meta.Client, id string) (*Job, error) {
+	var rows []Job
+	if err := c.Select(table, url.Values{"id": {meta.Eq(id)}}, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// List returns the jobs of userID, newest first.
+func List(c *meta.Client, userID string) ([]Job, error) {
+	var rows []Job
+	err := c.Select(table, url.Values{
+		"user_id": {meta.Eq(userID)},
+		"order":   {"created_at.desc"},
+	}, &rows)
+	return rows, err
+}
+
+// Unfinished returns the jobs of every user that are not done, oldest
+// first, for the command line.
+func Unfinished(c *meta.Client) ([]Job, error) {
+	var rows []Job
+	err := c.Select(table, url.Values{
+		"status": {"in.(pending,running,failed)"},
+		"order":  {"created_at.asc"},
+	}, &rows)
+	return rows, err
+}
+
+// Retry puts a failed job back in the queue. Chunks already stored are
+// kept.
+func Retry(c *meta.Client, job *Job) error {
+	if job.Status != StatusFailed {
+		return nil
+	}
+	job.Status = StatusPending
+	job.Error = ""
+	job.UpdatedAt = now()
+	return c.Update(table, url.Values{"id": {meta.Eq(job.ID)}, "status": {meta.Eq(StatusFailed)}},
+		map[string]interface{}{"status": job.Status, "error": "", "updated_at": job.UpdatedAt}, nil)
+}
+
+// Step fetches and stores up to budget chunks of a pending or running
+// job, and creates the file once the download ends. It returns the number
+// of chunks stored. Errors mark the job failed; progress is kept. Jobs
+// that are done or failed are left as they are, and ErrBusy is returned
+// while another call works on the job.
+func Step(c *meta.Client, job *Job, budget int) (int, error) {
+	ok, err := claim(c, job, StatusPending, StatusRunning)
+	if err != nil || !ok {
+		return 0, err
+	}
+	stored, err := step(c, job, budget)
+	if err != nil {
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	}
+	job.ClaimedUntil = nil
+	if serr := save(c, job); err == nil {
+		err = serr
+	}
+	return stored, err
+}
+
+// Delete removes a job. An unfinished import's chunks are deleted and
+// their bytes given back; the file a finished one made stays.
+func Delete(c *meta.Client, job *Job) error {
+	if job.Status != StatusDone {
+		ok, err := claim(c, job, StatusPending, StatusRunning, StatusFailed)
+		if err != nil {
+			return err
+		}
+		if ok && job.State != nil {
+			if err := discard(c, job); err != nil {
+				job.Status = StatusFailed
+				job.Error = err.Error()
+				job.ClaimedUntil = nil
+				save(c, job)
+				return err
+			}
+		}
+	}
+	return c.Delete(table, url.Values{"id": {meta.Eq(job.ID)}})
+}
+
+// claim takes the job for this call if its status is one of statuses and
+// no other call holds it, and refreshes job from the row. It reports
+// false, with job refreshed, when the status is another.
+func claim(c *meta.Client, job *Job, statuses ...string) (bool, error) {
+	at := time.Now().UTC()
+	var rows []Job
+	err := c.Update(table, url.Values{
+		"id":     {meta.Eq(job.ID)},
+		"status": {"in.(" + strings.Join(statuses, ",") + ")"},
+		"or":     {"(claimed_until.is.null,claimed_until.lt." + at.Format(time.RFC3339) + ")"},
+	}, map[string]interface{}{
+		"status":        StatusRunning,
+		"claimed_until": at.Add(lease).Format(time.RFC3339),
+	}, &rows)
+	if err != nil {
+		return false, err
+	}
+	if len(rows) > 0 {
+		*job = rows[0]
+		return true, nil
+	}
+	cur, err := Get(c, job.ID)
+	if err != nil {
+		return false, err
+	}
+	*job = *cur
+	for _, s := range statuses {
+		if job.Status == s {
+			return false, ErrBusy
+		}
+	}
+	return false, nil
+}
+
+func step(c *meta.Client, job *Job, budget int) (int, error) {
+	resp, err := open(job)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var w *content.Writer
+	if job.State == nil {
+		w, err = content.NewWriter(c, job.Provider, job.Name)
+	} else {
+		w, err = content.Resume(c, job.Provider, job.Name, job.State)
+	}
+	if err != nil {
+		return 0, err
+	}
+	chunk := int64(storage.ChunkSize(job.Provider))
+	stored := 0
+	for stored < budget {
+		n, err := io.CopyN(w, resp.Body, chunk)
+		if err == io.EOF {
+			if n > 0 {
+				stored++
+			}
+			return stored, finish(c, job, w)
+		}
+		if err != nil {
+			return stored, err
+		}
+		stored++
+		if job.Size != nil && w.Size() > *job.Size {
+			return stored, fmt.Errorf("the server sent more than the %d bytes it announced", *job.Size)
+		}
+		if job.State, err = w.Checkpoint(); err != nil {
+			return stored, err
+		}
+		job.DoneBytes = w.Size()
+		if err := save(c, job); err != nil {
+			return stored, err
+		}
+		fmt.Printf("[IMPORT] %s: %d bytes stored\n", job.ID, job.DoneBytes)
+	}
+	return stored, nil
+}
+
+// finish uploads the last chunk and adds the file.
+func finish(c *meta.Client, job *Job, w *content.Writer) error {
+	if job.Size != nil && w.Size() != *job.Size {
+		return fmt.Errorf("the download ended after %d of %d bytes", w.Size(), *job.Size)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	f := meta.File{Name: job.Name, Mime: job.Mime, FolderID: job.FolderID}
+	if err := versions.Save(c, &f, w); err != nil {
+		return err
+	}
+	job.Status = StatusDone
+	job.Size = &f.Size
+	job.DoneBytes = f.Size
+	job.FileID = &f.ID
+	job.State = nil
+	job.Error = ""
+	fmt.Printf("[IMPORT] %s: %s done (%d bytes)\n", job.ID, job.Name, f.Size)
+	return nil
+}
+
+// discard deletes the chunks an unfinished job stored and gives their
+// bytes back.
+func discard(c *meta.Client, job *Job) error {
+	links := job.State.Links
+	sizes := quota.LinkSizes(job.State.Size, job.Provider, links)
+	freed := make(map[string]int64)
+	for i, link := range links {
+		err := messages.Delete(c, link)
+		switch {
+		case errors.Is(err, messages.ErrUntracked), errors.Is(err, storage.ErrUndeletable):
+			fmt.Printf("[IMPORT] %s: chunk left on %s: %v\n", job.ID, storage.ProviderOf(link), err)
+		case err != nil:
+			return err
+		default:
+			freed[storage.ProviderOf(link)] += sizes[i]
+		}
+	}
+	tenant := quota.Tenant(c)
+	for provider, n := range freed {
+		if err := quota.Release(c, tenant, provider, n); err != nil {
+			fmt.Printf("[IMPORT] %s: releasing %d bytes on %s failed: %v\n", job.ID, n, provider, err)
+		}
+	}
+	return nil
+}
+
+func save(c *meta.Client, job *Job) error {
+	job.UpdatedAt = now()
+	return c.Update(table, url.Values{"id": {meta.Eq(job.ID)}}, map[string]interface{}{
+		"name":          job.Name,
+		"mime":          job.Mime,
+		"status":        job.Status,
+		"size":          job.Size,
+		"done_bytes":    job.DoneBytes,
+		"etag":          job.ETag,
+		"state":         job.State,
+		"file_id":       job.FileID,
+		"error":         job.Error,
+		"claimed_until": job.ClaimedUntil,
+		"updated_at":    job.UpdatedAt,
+	}, nil)
+}
+
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("imp_%d_%s", time.Now().UnixMilli(), hex.EncodeToString(b))
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
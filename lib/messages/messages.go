@@ -0,0 +1,183 @@
+// Package messages finds and deletes the provider messages that hold
+// stored chunks, so purged files can be removed from Discord and Telegram
+// for good.
+//
+// Erasure stripes record the message of every shard. Other chunks only
+// carry a Discord attachment URL or a Telegram file_id, so the message of
+// each upload is recorded in the telegram_messages and discord_messages
+// tables (supabase/migrations/009_trash.sql and 023_discord_messages.sql).
+// Discord chunks uploaded before that are searched for in their channel,
+// and not finding one is an error; Telegram ones cannot be traced and stay
+// on Telegram.
+package messages
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/storage"
+)
+
+const (
+	table        = "telegram_messages"
+	discordTable = "discord_messages"
+)
+
+// ErrUntracked is returned for Telegram chunks whose message was never
+// recorded.
+var ErrUntracked = errors.New("no message recorded for this Telegram chunk")
+
+type telegramMessage struct {
+	FileID    string `json:"file_id"`
+	ChatID    string `json:"chat_id"`
+	MessageID int64  `json:"message_id"`
+}
+
+type discordMessage struct {
+	URL       string `json:"url"`
+	ChannelID string `json:"channel_id"`
+	MessageID string `json:"message_id"`
+}
+
+// Record remembers the messages of Discord and Telegram uploads. Other
+// locators are skipped, as is a provider while its table does not exist
+// yet.
+func Record(c *meta.Client, locs []storage.Locator) error {
+	var rows []telegramMessage
+	var discordRows []discordMessage
+	for _, loc := range locs {
+		if loc.MessageID == "" {
+			continue
+		}
+		switch loc.Provider {
+		case "telegram":
+			id, err := strconv.ParseInt(loc.MessageID, 10, 64)
+			if err != nil {
+				return fmt.Errorf("telegram message ID %q: %v", loc.MessageID, err)
+			}
+			rows = append(rows, telegramMessage{FileID: loc.Ref, ChatID: loc.Target, MessageID: id})
+		case "discord":
+			discordRows = append(discordRows, discordMessage{URL: loc.Ref, ChannelID: loc.Target, MessageID: loc.MessageID})
+		}
+	}
+	if len(rows) > 0 {
+		if err := insert(c, table, rows); err != nil {
+			return err
+		}
+	}
+	if len(discordRows) > 0 {
+		return insert(c, discordTable, discordRows)
+	}
+	return nil
+}
+
+func insert(c *meta.Client, table string, rows interface{}) error {
+	err := c.Insert(table, rows, nil)
+	if missing(err) {
+		return nil
+	}
+	return err
+}
+
+// missing reports whether err is PostgREST saying the table does not exist.
+func missing(err error) bool {
+	var apiErr *meta.APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Locate returns the messages holding one meta_links entry. Dedup groups
+// have none of their own: their chunks are shared and collected through
+// the chunk index.
+func Locate(c *meta.Client, link string) ([]storage.Locator, error) {
+	switch storage.ProviderOf(link) {
+	case storage.DedupProvider:
+		return nil, nil
+	case storage.ErasureProvider:
+		stripe, err := storage.ParseStripe(link)
+		if err != nil {
+			return nil, err
+		}
+		return stripe.Shards, nil
+	case "discord":
+		return locateDiscord(c, link)
+	}
+
+	var rows []telegramMessage
+	err := c.Select(table, url.Values{"file_id": {meta.Eq(link)}}, &rows)
+	if missing(err) {
+		return nil, ErrUntracked
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrUntracked
+	}
+	return []storage.Locator{{
+		Provider:  "telegram",
+		Target:    rows[0].ChatID,
+		MessageID: strconv.FormatInt(rows[0].MessageID, 10),
+		Ref:       link,
+	}}, nil
+}
+
+func locateDiscord(c *meta.Client, link string) ([]storage.Locator, error) {
+	var rows []discordMessage
+	err := c.Select(discordTable, url.Values{"url": {meta.Eq(link)}}, &rows)
+	if err != nil && !missing(err) {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		return []storage.Locator{{
+			Provider:  "discord",
+			Target:    rows[0].ChannelID,
+			MessageID: rows[0].MessageID,
+			Ref:       link,
+		}}, nil
+	}
+	// Not finding the message is an error: it may still be there, and the
+	// chunk's metadata must stay until it is gone.
+	loc, err := storage.FindDiscordMessage(link)
+	if err != nil {
+		return nil, err
+	}
+	return []storage.Locator{loc}, nil
+}
+
+// Delete deletes every message holding one meta_links entry. It stops at
+// the first message it fails to delete, except for ones the provider will
+// never delete (storage.ErrUndeletable, returned at the end). Deleting
+// again later picks up where it stopped, since messages already gone count
+// as deleted.
+func Delete(c *meta.Client, link string) error {
+	locs, err := Locate(c, link)
+	if err != nil {
+		return err
+	}
+	var kept error
+	for _, loc := range locs {
+		err := storage.DeleteMessage(loc)
+		if errors.Is(err, storage.ErrUndeletable) {
+			kept = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	switch storage.ProviderOf(link) {
+	case "telegram":
+		if err := c.Delete(table, url.Values{"file_id": {meta.Eq(link)}}); err != nil {
+			return err
+		}
+	case "discord":
+		if err := c.Delete(discordTable, url.Values{"url": {meta.Eq(link)}}); err != nil && !missing(err) {
+			return err
+		}
+	}
+	return kept
+}
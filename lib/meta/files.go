@@ -0,0 +1,224 @@
+package meta
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File mirrors a row of the files table.
+type File struct {
+	ID           string  `json:"id"`
+	Name         string  `json:"name"`
+	Size         int64   `json:"size"`
+	Type         string  `json:"type"`
+	Mime         string  `json:"mime"`
+	Date         string  `json:"date"`
+	FolderID     *string `json:"folder_id"`
+	MetaKey      string  `json:"meta_key"`
+	MetaLinks    string  `json:"meta_links"`
+	MetaProvider string  `json:"meta_provider"`
+	SHA256       *string `json:"sha256,omitempty"` // hex; set by lib/versions
+	IsPublic     bool    `json:"is_public,omitempty"`
+	ShareID      *string `json:"share_id"`
+	CreatedAt    string  `json:"created_at,omitempty"`
+	UpdatedAt    string  `json:"updated_at,omitempty"`
+	DeletedAt    *string `json:"deleted_at,omitempty"` // set while in the trash
+	TrashRoot    *string `json:"trash_root,omitempty"` // the folder it was trashed with
+	WorkspaceID  string  `json:"workspace_id,omitempty"`
+	// Tags and Metadata are set through lib/tags.
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Links decodes meta_links.
+func (f *File) Links() ([]string, error) {
+	var links []string
+	if f.MetaLinks == "" {
+		return links, nil
+	}
+	err := json.Unmarshal([]byte(f.MetaLinks), &links)
+	return links, err
+}
+
+// Folder mirrors a row of the folders table.
+type Folder struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	ParentID    *string `json:"parent_id"`
+	Created     string  `json:"created"`
+	IsPublic    bool    `json:"is_public,omitempty"`
+	ShareID     *string `json:"share_id"`
+	CreatedAt   string  `json:"created_at,omitempty"`
+	UpdatedAt   string  `json:"updated_at,omitempty"`
+	DeletedAt   *string `json:"deleted_at,omitempty"`
+	TrashRoot   *string `json:"trash_root,omitempty"`
+	WorkspaceID string  `json:"workspace_id,omitempty"`
+	// Tags and Metadata, as on File.
+	Tags     []string          `json:"tags,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// GetFile loads one file by ID. Files in the trash are not found.
+func (c *Client) GetFile(id string) (*File, error) {
+	rows, err := c.ListFiles(url.Values{"id": {Eq(id)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// ListFiles returns files matching a PostgREST query. Files in the trash
+// are left out unless the query filters on deleted_at.
+func (c *Client) ListFiles(query url.Values) ([]File, error) {
+	query, err := c.live(query)
+	if err != nil {
+		return nil, err
+	}
+	var rows []File
+	err = c.Select("files", query, &rows)
+	return rows, err
+}
+
+// GetFolder loads one folder by ID. Folders in the trash are not found.
+func (c *Client) GetFolder(id string) (*Folder, error) {
+	rows, err := c.ListFolders(url.Values{"id": {Eq(id)}})
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// ListFolders returns folders matching a PostgREST query, leaving out the
+// trash like ListFiles.
+func (c *Client) ListFolders(query url.Values) ([]Folder, error) {
+	query, err := c.live(query)
+	if err != nil {
+		return nil, err
+	}
+	var rows []Folder
+	err = c.Select("folders", query, &rows)
+	return rows, err
+}
+
+// CleanName keeps a file name from outside, such as an uploader's or a
+// server's, readable but strips path separators and control characters.
+// An empty name becomes fallback.
+func CleanName(name, fallback string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case r < 0x20 || r == 0x7f:
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if len(name) > 255 {
+		name = strings.ToValidUTF8(name[:255], "")
+	}
+	if name == "" {
+		name = fallback
+	}
+	return name
+}
+
+// MimeOf guesses a MIME type from the file name like the browser would.
+func MimeOf(name string) string {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+// TypeOf maps a MIME type to the files.type categories the web app uses.
+func TypeOf(mime string) string {
+	switch {
+	case strings.HasPrefix(mime, "video"):
+		return "video"
+	case strings.HasPrefix(mime, "image"):
+		return "image"
+	case strings.HasPrefix(mime, "audio"):
+		return "audio"
+	}
+	return "other"
+}
+
+// Modified returns when the file row last changed, or when it was created
+// if updated_at was not selected or its migration is not applied.
+func (f *File) Modified() time.Time {
+	if f.UpdatedAt != "" {
+		return ParseTime(f.UpdatedAt)
+	}
+	return ParseTime(f.CreatedAt)
+}
+
+// Modified returns when the folder row last changed, or when it was
+// created.
+func (f *Folder) Modified() time.Time {
+	if f.UpdatedAt != "" {
+		return ParseTime(f.UpdatedAt)
+	}
+	return ParseTime(f.CreatedAt)
+}
+
+// ParseTime parses a Supabase timestamp, with or without a time zone. It
+// returns the current time for values it cannot read.
+func ParseTime(ts string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999"} {
+		if t, err := time.Parse(layout, ts); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// localDate formats a date like the web app's toLocaleDateString().
+const localDate = "1/2/2006"
+
+// InsertFile adds a file row created on the server. Date and Type are
+// filled in when empty.
+func (c *Client) InsertFile(f *File) error {
+	if f.Date == "" {
+		f.Date = time.Now().Format(localDate)
+	}
+	if f.Type == "" {
+		f.Type = TypeOf(f.Mime)
+	}
+	return c.insertNew("files", f, func(id string) { f.ID = id })
+}
+
+// InsertFolder adds a folder row created on the server. Created is filled
+// in when empty.
+func (c *Client) InsertFolder(f *Folder) error {
+	if f.Created == "" {
+		f.Created = time.Now().Format(localDate)
+	}
+	return c.insertNew("folders", f, func(id string) { f.ID = id })
+}
+
+// insertNew inserts row under a new ID. Like the web app it uses the current
+// time in milliseconds, stepping forward if another insert took that
+// millisecond.
+func (c *Client) insertNew(table string, row interface{}, setID func(string)) error {
+	id := time.Now().UnixMilli()
+	for attempt := 0; ; attempt++ {
+		setID(strconv.FormatInt(id+int64(attempt), 10))
+		err := c.Insert(table, row, nil)
+		if apiErr, ok := err.(*APIError); ok && apiErr.StatusCode == http.StatusConflict && attempt < 5 {
+			continue
+		}
+		return err
+	}
+}
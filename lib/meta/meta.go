@@ -0,0 +1,252 @@
+// Package meta talks to the Supabase (PostgREST) tables that hold file and
+// folder metadata.
+package meta
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when a lookup by ID matches no row.
+var ErrNotFound = errors.New("not found")
+
+// Client is a minimal PostgREST client for the Supabase project.
+type Client struct {
+	URL  string
+	Key  string
+	HTTP *http.Client
+
+	// Workspace, when set, confines the client to one workspace's files,
+	// folders and access lists (supabase/migrations/012_workspaces.sql and
+	// 013_acl.sql): reads, updates and deletes only match its rows, and
+	// inserted rows go into it. See In and lib/workspace.
+	Workspace string
+	// Targets are the workspace's own upload targets by provider, used
+	// instead of DISCORD_CHANNEL_ID and TELEGRAM_CHAT_ID.
+	Targets map[string]string
+}
+
+// scopedTables are the tables whose rows belong to a workspace.
+var scopedTables = map[string]bool{"files": true, "folders": true, "acl_entries": true, "imports": true}
+
+// In returns a copy of c confined to workspace, uploading to targets.
+func (c *Client) In(workspace string, targets map[string]string) *Client {
+	cp := *c
+	cp.Workspace = workspace
+	cp.Targets = targets
+	return &cp
+}
+
+// Target returns where uploads with provider go: the workspace's own
+// channel or chat, or "" for the default from the environment.
+func (c *Client) Target(provider string) string {
+	if c == nil {
+		return ""
+	}
+	return c.Targets[provider]
+}
+
+// FromEnv builds a client from SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY,
+// falling back to SUPABASE_ANON_KEY when no service key is set.
+func FromEnv() (*Client, error) {
+	baseURL := strings.TrimRight(strings.TrimSpace(os.Getenv("SUPABASE_URL")), "/")
+	key := strings.TrimSpace(os.Getenv("SUPABASE_SERVICE_ROLE_KEY"))
+	if key == "" {
+		key = strings.TrimSpace(os.Getenv("SUPABASE_ANON_KEY"))
+	}
+	if baseURL == "" || key == "" {
+		return nil, fmt.Errorf("Supabase not configured - missing SUPABASE_URL or key")
+	}
+	return &Client{URL: baseURL, Key: key, HTTP: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// APIError is a non-2xx answer from PostgREST.
+type APIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Supabase error %d: %s", e.StatusCode, e.Body)
+}
+
+// PostgresError is the body PostgREST sends with an error. Code is a
+// Postgres SQLSTATE such as "23505", or a PostgREST code such as "PGRST202".
+type PostgresError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details string `json:"details"`
+	Hint    string `json:"hint"`
+}
+
+// AsPostgres decodes the body of an APIError. It returns nil for other
+// errors and for bodies that are not a PostgREST error.
+func AsPostgres(err error) *PostgresError {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return nil
+	}
+	var pg PostgresError
+	if json.Unmarshal([]byte(apiErr.Body), &pg) != nil || pg.Code == "" {
+		return nil
+	}
+	return &pg
+}
+
+// MissingFunction reports whether err says an RPC function does not exist,
+// usually because its migration is not applied yet.
+func MissingFunction(err error) bool {
+	pg := AsPostgres(err)
+	return pg != nil && (pg.Code == "PGRST202" || pg.Code == "42883")
+}
+
+func (c *Client) do(method, path string, query url.Values, body interface{}, prefer string, out interface{}) error {
+	if c.Workspace != "" && scopedTables[path] {
+		var err error
+		if query, body, err = c.scope(method, query, body); err != nil {
+			return err
+		}
+	}
+	u := c.URL + "/rest/v1/" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", c.Key)
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+	req.Header.Set("Content-Type", "application/json")
+	if prefer != "" {
+		req.Header.Set("Prefer", prefer)
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("Supabase request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &APIError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	if out != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, out)
+	}
+	return nil
+}
+
+// scope adds the workspace to a request on a scoped table: as a filter,
+// or to every inserted row.
+func (c *Client) scope(method string, query url.Values, body interface{}) (url.Values, interface{}, error) {
+	if method != "POST" {
+		q := make(url.Values, len(query)+1)
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Add("workspace_id", Eq(c.Workspace))
+		return q, body, nil
+	}
+
+	// Rows are structs or maps, one or a slice; set the column on their
+	// JSON form.
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var rows interface{}
+	if err := json.Unmarshal(b, &rows); err != nil {
+		return nil, nil, err
+	}
+	switch v := rows.(type) {
+	case map[string]interface{}:
+		v["workspace_id"] = c.Workspace
+	case []interface{}:
+		for _, row := range v {
+			if m, ok := row.(map[string]interface{}); ok {
+				m["workspace_id"] = c.Workspace
+			}
+		}
+	}
+	return query, rows, nil
+}
+
+// Select reads rows from table into out, which must be a pointer to a slice.
+func (c *Client) Select(table string, query url.Values, out interface{}) error {
+	return c.do("GET", table, query, nil, "", out)
+}
+
+// Insert adds row to table. When out is not nil the stored row(s) are
+// decoded into it.
+func (c *Client) Insert(table string, row interface{}, out interface{}) error {
+	prefer := "return=minimal"
+	if out != nil {
+		prefer = "return=representation"
+	}
+	return c.do("POST", table, nil, row, prefer, out)
+}
+
+// Update patches every row matching query and returns the updated rows
+// in out when it is not nil.
+func (c *Client) Update(table string, query url.Values, patch interface{}, out interface{}) error {
+	prefer := "return=minimal"
+	if out != nil {
+		prefer = "return=representation"
+	}
+	return c.do("PATCH", table, query, patch, prefer, out)
+}
+
+// Delete removes every row matching query.
+func (c *Client) Delete(table string, query url.Values) error {
+	return c.do("DELETE", table, query, nil, "", nil)
+}
+
+// RPC calls a Postgres function exposed by PostgREST.
+func (c *Client) RPC(fn string, args interface{}, out interface{}) error {
+	return c.do("POST", "rpc/"+fn, nil, args, "", out)
+}
+
+// Eq builds a PostgREST equality filter value.
+func Eq(v string) string {
+	return "eq." + v
+}
+
+// In builds a PostgREST membership filter value. Values are quoted so IDs
+// containing commas or parentheses stay intact.
+func In(vs []string) string {
+	return "in.(" + quoteAll(vs) + ")"
+}
+
+// Contains builds a PostgREST filter value matching array columns that
+// hold every one of vs.
+func Contains(vs []string) string {
+	return "cs.{" + quoteAll(vs) + "}"
+}
+
+func quoteAll(vs []string) string {
+	quoted := make([]string, len(vs))
+	for i, v := range vs {
+		quoted[i] = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+	}
+	return strings.Join(quoted, ",")
+}
@@ -0,0 +1,507 @@
+// Package metatest runs an in-memory stand-in for the Supabase project's
+// PostgREST API, for tests of the packages built on lib/meta. Rows are
+// kept as decoded JSON objects without a schema. It understands the
+// filters, inserts, updates, deletes and function calls those packages
+// send; anything else is answered with a 400 so a test notices.
+package metatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"teddrive-web/lib/meta"
+)
+
+// Row is one row of a table, as PostgREST sends it.
+type Row = map[string]interface{}
+
+// Func stands in for a Postgres function called through Client.RPC. It
+// gets the decoded arguments; its result is sent back as JSON. An error
+// from Error is sent as that error, any other as a 500.
+type Func func(args map[string]interface{}) (interface{}, error)
+
+// Error builds the error PostgREST answers with: status, and a body whose
+// code is a SQLSTATE such as "23505" or a PostgREST code.
+func Error(status int, code string) error {
+	body, _ := json.Marshal(map[string]string{"code": code, "message": "metatest: " + code})
+	return &meta.APIError{StatusCode: status, Body: string(body)}
+}
+
+type table struct {
+	rows   []Row
+	unique []string
+}
+
+// Server is the stand-in. Tables that were not created with Table are
+// missing, as before their migration: requests to them get a 404.
+type Server struct {
+	srv  *httptest.Server
+	base string
+
+	mu     sync.Mutex
+	tables map[string]*table
+	funcs  map[string]Func
+}
+
+// servers numbers the servers, so caches kept by Client.URL never carry
+// over from one test to the next.
+var servers int64
+
+// New starts a Server that is shut down when t ends.
+func New(t testing.TB) *Server {
+	s := &Server{tables: make(map[string]*table), funcs: make(map[string]Func)}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	s.base = fmt.Sprintf("%s/%d", s.srv.URL, atomic.AddInt64(&servers, 1))
+	t.Cleanup(s.srv.Close)
+	return s
+}
+
+// Client returns a client for the server with the full access of the
+// service role.
+func (s *Server) Client() *meta.Client {
+	return &meta.Client{URL: s.base, Key: "service-role", HTTP: s.srv.Client()}
+}
+
+// Table creates table name, empty unless it exists already. Each of the
+// unique columns refuses a value another row has, with a 409 and SQLSTATE
+// 23505.
+func (s *Server) Table(name string, unique ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tables[name] == nil {
+		s.tables[name] = &table{}
+	}
+	s.tables[name].unique = unique
+}
+
+// Add puts rows into table name as they are, without the unique checks.
+func (s *Server) Add(name string, rows ...Row) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.mustTable(name)
+	for _, r := range rows {
+		t.rows = append(t.rows, normalize(r))
+	}
+}
+
+// Rows returns a copy of the rows of table name.
+func (s *Server) Rows(name string) []Row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.mustTable(name)
+	out := make([]Row, len(t.rows))
+	for i, r := range t.rows {
+		out[i] = copyRow(r)
+	}
+	return out
+}
+
+// Update runs change on every row of table name, in place, and returns
+// copies of the rows it reports it changed.
+func (s *Server) Update(name string, change func(Row) bool) []Row {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := []Row{}
+	for _, r := range s.mustTable(name).rows {
+		if change(r) {
+			changed = append(changed, copyRow(r))
+		}
+	}
+	return changed
+}
+
+// Func registers fn as Postgres function name. Functions that are not
+// registered are missing, with PostgREST's PGRST202.
+func (s *Server) Func(name string, fn Func) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.funcs[name] = fn
+}
+
+func (s *Server) mustTable(name string) *table {
+	t := s.tables[name]
+	if t == nil {
+		panic("metatest: no table " + name)
+	}
+	return t
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	i := strings.Index(r.URL.Path, "/rest/v1/")
+	if i < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name := r.URL.Path[i+len("/rest/v1/"):]
+	body, _ := io.ReadAll(r.Body)
+
+	var out interface{}
+	var err error
+	if fn := strings.TrimPrefix(name, "rpc/"); fn != name && r.Method == "POST" {
+		out, err = s.call(fn, body)
+	} else {
+		out, err = s.table(r, name, body)
+	}
+	if err != nil {
+		if apiErr, ok := err.(*meta.APIError); ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(apiErr.StatusCode)
+			io.WriteString(w, apiErr.Body)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if out == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+func (s *Server) call(name string, body []byte) (interface{}, error) {
+	s.mu.Lock()
+	fn := s.funcs[name]
+	s.mu.Unlock()
+	if fn == nil {
+		return nil, Error(http.StatusNotFound, "PGRST202")
+	}
+	args := make(map[string]interface{})
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, &args); err != nil {
+			return nil, Error(http.StatusBadRequest, "PGRST102")
+		}
+	}
+	// Functions run unlocked so they can use Rows and Add.
+	out, err := fn(args)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return json.RawMessage("null"), nil
+	}
+	return out, nil
+}
+
+func (s *Server) table(r *http.Request, name string, body []byte) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.tables[name]
+	if t == nil {
+		return nil, Error(http.StatusNotFound, "42P01")
+	}
+	representation := strings.Contains(r.Header.Get("Prefer"), "return=representation")
+
+	if r.Method == "POST" {
+		rows, err := decodeRows(body)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.check(rows); err != nil {
+			return nil, err
+		}
+		t.rows = append(t.rows, rows...)
+		if representation {
+			return copyRows(rows), nil
+		}
+		return nil, nil
+	}
+
+	q := r.URL.Query()
+	match, err := filter(q)
+	if err != nil {
+		return nil, err
+	}
+	switch r.Method {
+	case "GET":
+		var rows []Row
+		for _, row := range t.rows {
+			if match(row) {
+				rows = append(rows, copyRow(row))
+			}
+		}
+		return page(rows, q)
+	case "PATCH":
+		var patch Row
+		if err := json.Unmarshal(body, &patch); err != nil {
+			return nil, Error(http.StatusBadRequest, "PGRST102")
+		}
+		updated := []Row{}
+		for _, row := range t.rows {
+			if match(row) {
+				for k, v := range patch {
+					row[k] = v
+				}
+				updated = append(updated, copyRow(row))
+			}
+		}
+		if representation {
+			return updated, nil
+		}
+		return nil, nil
+	case "DELETE":
+		kept := t.rows[:0]
+		for _, row := range t.rows {
+			if !match(row) {
+				kept = append(kept, row)
+			}
+		}
+		t.rows = kept
+		return nil, nil
+	}
+	return nil, Error(http.StatusMethodNotAllowed, "PGRST117")
+}
+
+// check refuses rows that repeat a unique value, among themselves or
+// with rows already stored. A batch goes in whole or not at all.
+func (t *table) check(rows []Row) error {
+	for _, col := range t.unique {
+		seen := make(map[string]bool)
+		for _, row := range t.rows {
+			if v, ok := text(row[col]); ok {
+				seen[v] = true
+			}
+		}
+		for _, row := range rows {
+			v, ok := text(row[col])
+			if !ok {
+				continue
+			}
+			if seen[v] {
+				return Error(http.StatusConflict, "23505")
+			}
+			seen[v] = true
+		}
+	}
+	return nil
+}
+
+func decodeRows(body []byte) ([]Row, error) {
+	var rows []Row
+	if err := json.Unmarshal(body, &rows); err == nil {
+		return rows, nil
+	}
+	var row Row
+	if err := json.Unmarshal(body, &row); err != nil {
+		return nil, Error(http.StatusBadRequest, "PGRST102")
+	}
+	return []Row{row}, nil
+}
+
+// ignored are the query parameters that are not filters. The columns in
+// select are not picked out: every row comes back whole.
+var ignored = map[string]bool{"select": true, "order": true, "limit": true, "offset": true}
+
+// filter returns a test for the rows matching every filter in q.
+func filter(q map[string][]string) (func(Row) bool, error) {
+	var tests []func(Row) bool
+	for col, values := range q {
+		if ignored[col] {
+			continue
+		}
+		for _, v := range values {
+			test, err := condition(col, v)
+			if err != nil {
+				return nil, err
+			}
+			tests = append(tests, test)
+		}
+	}
+	return func(row Row) bool {
+		for _, test := range tests {
+			if !test(row) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func condition(col, v string) (func(Row) bool, error) {
+	op, arg, _ := strings.Cut(v, ".")
+	switch op {
+	case "is":
+		if arg == "null" {
+			return func(row Row) bool { return row[col] == nil }, nil
+		}
+	case "not":
+		if arg == "is.null" {
+			return func(row Row) bool { return row[col] != nil }, nil
+		}
+	case "eq", "neq", "gt", "gte", "lt", "lte":
+		return func(row Row) bool {
+			got, ok := text(row[col])
+			if !ok {
+				return false // NULL compares to nothing
+			}
+			c := compare(got, arg)
+			switch op {
+			case "eq":
+				return c == 0
+			case "neq":
+				return c != 0
+			case "gt":
+				return c > 0
+			case "gte":
+				return c >= 0
+			case "lt":
+				return c < 0
+			}
+			return c <= 0
+		}, nil
+	case "in":
+		if strings.HasPrefix(arg, "(") && strings.HasSuffix(arg, ")") {
+			set := make(map[string]bool)
+			for _, item := range splitList(arg[1 : len(arg)-1]) {
+				set[item] = true
+			}
+			return func(row Row) bool {
+				got, ok := text(row[col])
+				return ok && set[got]
+			}, nil
+		}
+	}
+	return nil, Error(http.StatusBadRequest, "metatest: filter "+col+"="+v+" not supported")
+}
+
+// splitList splits the inside of an in.(...) filter, unquoting items the
+// way meta.In quotes them.
+func splitList(s string) []string {
+	var items []string
+	var cur strings.Builder
+	quoted, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			items = append(items, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	return append(items, cur.String())
+}
+
+// page orders and cuts rows as order, offset and limit ask.
+func page(rows []Row, q map[string][]string) ([]Row, error) {
+	if rows == nil {
+		rows = []Row{}
+	}
+	if order := first(q, "order"); order != "" {
+		keys := strings.Split(order, ",")
+		sort.SliceStable(rows, func(i, j int) bool {
+			for _, key := range keys {
+				col, dir, _ := strings.Cut(key, ".")
+				a, _ := text(rows[i][col])
+				b, _ := text(rows[j][col])
+				if c := compare(a, b); c != 0 {
+					return (c < 0) != (dir == "desc")
+				}
+			}
+			return false
+		})
+	}
+	if v := first(q, "offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, Error(http.StatusBadRequest, "PGRST103")
+		}
+		if n > len(rows) {
+			n = len(rows)
+		}
+		rows = rows[n:]
+	}
+	if v := first(q, "limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, Error(http.StatusBadRequest, "PGRST103")
+		}
+		if n < len(rows) {
+			rows = rows[:n]
+		}
+	}
+	return rows, nil
+}
+
+func first(q map[string][]string, key string) string {
+	if v := q[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// text is a column value as it appears in a filter; false for NULL.
+func text(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	b, _ := json.Marshal(v)
+	return string(b), true
+}
+
+// compare compares numbers as numbers and anything else as text.
+func compare(a, b string) int {
+	x, errA := strconv.ParseFloat(a, 64)
+	y, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// normalize gives a row the types decoding JSON would.
+func normalize(r Row) Row {
+	b, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	var out Row
+	json.Unmarshal(b, &out)
+	return out
+}
+
+func copyRow(r Row) Row {
+	out := make(Row, len(r))
+	for k, v := range r {
+		out[k] = v
+	}
+	return out
+}
+
+func copyRows(rows []Row) []Row {
+	out := make([]Row, len(rows))
+	for i, r := range rows {
+		out[i] = copyRow(r)
+	}
+	return out
+}
@@ -0,0 +1,210 @@
+package meta
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// selectionBatch keeps ID lists in query strings short.
+const selectionBatch = 100
+
+// GetSelection loads a set of files and folders, with everything below
+// the folders, as one Tree. Paths follow the parent_id chain from the
+// deepest folder the selection has in common, which becomes the Root (the
+// zero Folder when that is the top level), so files picked from different
+// folders keep their place relative to each other. Items inside a selected
+// folder come with it and are not listed twice. A missing ID is
+// ErrNotFound.
+func (c *Client) GetSelection(fileIDs, folderIDs []string) (*Tree, error) {
+	files, err := listBatched(fileIDs, c.ListFiles)
+	if err != nil {
+		return nil, err
+	}
+	picked, err := listBatched(folderIDs, c.ListFolders)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) != len(unique(fileIDs)) || len(picked) != len(unique(folderIDs)) {
+		return nil, ErrNotFound
+	}
+
+	// Load every folder up the parent_id chains, one level per round trip.
+	known := make(map[string]Folder)
+	var pending []string
+	want := func(id *string) {
+		if id != nil {
+			if _, ok := known[*id]; !ok {
+				known[*id] = Folder{}
+				pending = append(pending, *id)
+			}
+		}
+	}
+	for _, f := range picked {
+		known[f.ID] = f
+	}
+	for _, f := range picked {
+		want(f.ParentID)
+	}
+	for _, f := range files {
+		want(f.FolderID)
+	}
+	for depth := 0; len(pending) > 0; depth++ {
+		if depth >= maxTreeDepth {
+			return nil, fmt.Errorf("folders are nested more than %d levels deep", maxTreeDepth)
+		}
+		level, err := listBatched(pending, c.ListFolders)
+		if err != nil {
+			return nil, err
+		}
+		pending = nil
+		for _, f := range level {
+			known[f.ID] = f
+		}
+		for _, f := range level {
+			want(f.ParentID)
+		}
+	}
+
+	// chain returns the folders above parent, outermost first.
+	chain := func(parent *string) ([]string, error) {
+		var ids []string
+		for p := parent; p != nil; p = known[*p].ParentID {
+			if known[*p].ID == "" {
+				// In the trash, or gone.
+				return nil, ErrNotFound
+			}
+			if len(ids) >= maxTreeDepth {
+				return nil, fmt.Errorf("folder %s is nested more than %d levels deep", *parent, maxTreeDepth)
+			}
+			ids = append(ids, *p)
+		}
+		for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+			ids[i], ids[j] = ids[j], ids[i]
+		}
+		return ids, nil
+	}
+	selected := make(map[string]bool)
+	for _, f := range picked {
+		selected[f.ID] = true
+	}
+	// inside reports whether a chain passes through a selected folder.
+	inside := func(ids []string) bool {
+		for _, id := range ids {
+			if selected[id] {
+				return true
+			}
+		}
+		return false
+	}
+
+	type item struct {
+		file   *File
+		folder *Folder
+		chain  []string
+	}
+	var items []item
+	var common []string
+	for i := range picked {
+		ids, err := chain(picked[i].ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if !inside(ids) {
+			items = append(items, item{folder: &picked[i], chain: ids})
+		}
+	}
+	for i := range files {
+		ids, err := chain(files[i].FolderID)
+		if err != nil {
+			return nil, err
+		}
+		if !inside(ids) {
+			items = append(items, item{file: &files[i], chain: ids})
+		}
+	}
+	for i, it := range items {
+		if i == 0 {
+			common = it.chain
+			continue
+		}
+		n := 0
+		for n < len(common) && n < len(it.chain) && common[n] == it.chain[n] {
+			n++
+		}
+		common = common[:n]
+	}
+	// A single folder is its own root.
+	if len(items) == 1 && items[0].folder != nil {
+		return c.GetTree(items[0].folder.ID)
+	}
+
+	t := &Tree{}
+	if len(common) > 0 {
+		t.Root = known[common[len(common)-1]]
+	}
+	taken := make(map[string]bool)
+	paths := make(map[string]string) // folder ID to its path in the tree
+	// dir returns the path of the last folder in ids, adding the folders on
+	// the way.
+	var dir func(ids []string) string
+	dir = func(ids []string) string {
+		if len(ids) <= len(common) {
+			return ""
+		}
+		id := ids[len(ids)-1]
+		if p, ok := paths[id]; ok {
+			return p
+		}
+		p := uniquePath(taken, dir(ids[:len(ids)-1]), known[id].Name)
+		paths[id] = p
+		t.Folders = append(t.Folders, TreeFolder{Path: p, Folder: known[id]})
+		return p
+	}
+	for _, it := range items {
+		parent := dir(it.chain)
+		if it.file != nil {
+			t.Files = append(t.Files, TreeFile{Path: uniquePath(taken, parent, it.file.Name), File: *it.file})
+			continue
+		}
+		sub, err := c.GetTree(it.folder.ID)
+		if err != nil {
+			return nil, err
+		}
+		p := dir(append(append([]string(nil), it.chain...), it.folder.ID))
+		for _, f := range sub.Folders {
+			t.Folders = append(t.Folders, TreeFolder{Path: p + "/" + f.Path, Folder: f.Folder})
+		}
+		for _, f := range sub.Files {
+			t.Files = append(t.Files, TreeFile{Path: p + "/" + f.Path, File: f.File})
+		}
+	}
+	return t, nil
+}
+
+// listBatched runs list for ids a batch at a time.
+func listBatched[T any](ids []string, list func(url.Values) ([]T, error)) ([]T, error) {
+	ids = unique(ids)
+	var out []T
+	for len(ids) > 0 {
+		n := min(len(ids), selectionBatch)
+		rows, err := list(url.Values{"id": {In(ids[:n])}, "order": {"name.asc"}})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, rows...)
+		ids = ids[n:]
+	}
+	return out, nil
+}
+
+func unique(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
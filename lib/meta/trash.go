@@ -0,0 +1,60 @@
+package meta
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	trashMu sync.Mutex
+	trashOK = make(map[string]bool)
+)
+
+// HasTrash reports whether files and folders have the deleted_at column
+// added by supabase/migrations/009_trash.sql. A yes is remembered; a no is
+// checked again next time, so applying the migration takes effect without
+// a restart.
+func (c *Client) HasTrash() (bool, error) {
+	trashMu.Lock()
+	ok := trashOK[c.URL]
+	trashMu.Unlock()
+	if ok {
+		return true, nil
+	}
+	var rows []File
+	err := c.Select("files", url.Values{"select": {"deleted_at"}, "limit": {"1"}}, &rows)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusBadRequest && strings.Contains(apiErr.Body, "42703") {
+		// undefined_column
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	trashMu.Lock()
+	trashOK[c.URL] = true
+	trashMu.Unlock()
+	return true, nil
+}
+
+// live returns query with trashed rows filtered out, unless it filters on
+// deleted_at itself. Everything that lists or looks up files and folders
+// goes through it, so trashed items disappear from every view at once.
+func (c *Client) live(query url.Values) (url.Values, error) {
+	if _, ok := query["deleted_at"]; ok {
+		return query, nil
+	}
+	ok, err := c.HasTrash()
+	if err != nil || !ok {
+		return query, err
+	}
+	q := make(url.Values, len(query)+1)
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("deleted_at", "is.null")
+	return q, nil
+}
@@ -0,0 +1,130 @@
+package meta
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxTreeDepth stops runaway walks if parent_id ever forms a cycle.
+const maxTreeDepth = 64
+
+// TreeFolder is a folder inside a Tree with its path relative to the root.
+type TreeFolder struct {
+	Path   string
+	Folder Folder
+}
+
+// TreeFile is a file inside a Tree with its path relative to the root.
+type TreeFile struct {
+	Path string
+	File File
+}
+
+// Tree is a folder and everything below it. Paths use "/" and never start
+// with one; names that clash within a folder get a " (2)", " (3)", ...
+// suffix so every path is unique.
+type Tree struct {
+	Root    Folder
+	Folders []TreeFolder
+	Files   []TreeFile
+}
+
+// Size returns the total size of the files in the tree.
+func (t *Tree) Size() int64 {
+	var n int64
+	for _, f := range t.Files {
+		n += f.File.Size
+	}
+	return n
+}
+
+// Find returns the file with the given ID, or nil if it is not in the tree.
+func (t *Tree) Find(fileID string) *TreeFile {
+	for i := range t.Files {
+		if t.Files[i].File.ID == fileID {
+			return &t.Files[i]
+		}
+	}
+	return nil
+}
+
+// GetTree loads the folder rootID and its whole subtree, one level per
+// round trip.
+func (c *Client) GetTree(rootID string) (*Tree, error) {
+	root, err := c.GetFolder(rootID)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tree{Root: *root}
+
+	// dirs maps folder IDs on the current level to their path.
+	dirs := map[string]string{root.ID: ""}
+	seen := map[string]bool{root.ID: true}
+	for depth := 0; len(dirs) > 0; depth++ {
+		if depth >= maxTreeDepth {
+			return nil, fmt.Errorf("folder %s is nested more than %d levels deep", rootID, maxTreeDepth)
+		}
+		ids := make([]string, 0, len(dirs))
+		for id := range dirs {
+			ids = append(ids, id)
+		}
+
+		files, err := c.ListFiles(url.Values{
+			"folder_id": {In(ids)},
+			"order":     {"name.asc"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		subs, err := c.ListFolders(url.Values{
+			"parent_id": {In(ids)},
+			"order":     {"name.asc"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		taken := make(map[string]bool)
+		next := make(map[string]string)
+		for _, f := range subs {
+			if seen[f.ID] {
+				continue
+			}
+			seen[f.ID] = true
+			p := uniquePath(taken, dirs[*f.ParentID], f.Name)
+			t.Folders = append(t.Folders, TreeFolder{Path: p, Folder: f})
+			next[f.ID] = p
+		}
+		for _, f := range files {
+			p := uniquePath(taken, dirs[*f.FolderID], f.Name)
+			t.Files = append(t.Files, TreeFile{Path: p, File: f})
+		}
+		dirs = next
+	}
+	return t, nil
+}
+
+// uniquePath joins dir and name, cleaning the name so it cannot escape the
+// tree, and numbers it if the path is already taken.
+func uniquePath(taken map[string]bool, dir, name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(strings.TrimSpace(name))
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	p := path.Join(dir, name)
+	if taken[strings.ToLower(p)] {
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 2; ; i++ {
+			candidate := path.Join(dir, fmt.Sprintf("%s (%d)%s", base, i, ext))
+			if !taken[strings.ToLower(candidate)] {
+				p = candidate
+				break
+			}
+		}
+	}
+	taken[strings.ToLower(p)] = true
+	return p
+}
@@ -0,0 +1,422 @@
+// Package migrate copies a file's chunks from one provider or target to
+// another, verifies the copies and then swaps the file's manifest in a single
+// conditional update. Progress is kept in the migrations table so a job can
+// be resumed from the last copied chunk. Once the manifest is swapped the
+// old chunks are deleted.
+package migrate
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"teddrive-web/lib/messages"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+	"teddrive-web/lib/versions"
+	"teddrive-web/lib/workspace"
+)
+
+const table = "migrations"
+
+// lease is how long a worker may hold a job before another may take it
+// over, for workers that were cut off without letting go.
+const lease = 5 * time.Minute
+
+// Job statuses.
+const (
+	StatusPending = "pending"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// Job mirrors a row of the migrations table.
+type Job struct {
+	ID           string  `json:"id"`
+	FileID       string  `json:"file_id"`
+	ToProvider   string  `json:"to_provider"`
+	ToTarget     string  `json:"to_target"`
+	Status       string  `json:"status"`
+	DoneChunks   int     `json:"done_chunks"`
+	TotalChunks  int     `json:"total_chunks"`
+	SourceLinks  string  `json:"source_links"`
+	NewLinks     string  `json:"new_links"`
+	Error        string  `json:"error"`
+	ClaimedUntil *string `json:"claimed_until"` // set while a worker copies chunks
+	CreatedAt    string  `json:"created_at,omitempty"`
+	UpdatedAt    string  `json:"updated_at,omitempty"`
+}
+
+// Selector picks the files to migrate: one file by ID, or every file with
+// at least one chunk on FromProvider (and FromTarget, when set).
+type Selector struct {
+	FileID       string
+	FromProvider string
+	FromTarget   string
+}
+
+// Destination is where chunks are copied to. Target may be empty to use the
+// default channel or chat.
+type Destination struct {
+	Provider string
+	Target   string
+}
+
+// Enqueue creates a pending job for every selected file that does not
+// already have one in progress.
+func Enqueue(c *meta.Client, sel Selector, dst Destination) ([]Job, error) {
+	if dst.Provider != storage.ErasureProvider {
+		if _, err := storage.BackendFor(dst.Provider, dst.Target); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []meta.File
+	switch {
+	case sel.FileID != "":
+		f, err := c.GetFile(sel.FileID)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *f)
+	case sel.FromProvider != "":
+		all, err := c.ListFiles(url.Values{"select": {"*"}, "order": {"created_at.asc"}})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range all {
+			links, err := f.Links()
+			if err != nil {
+				continue
+			}
+			for _, link := range links {
+				if storage.OnTarget(link, sel.FromProvider, sel.FromTarget) {
+					files = append(files, f)
+					break
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("select a file ID or a source provider")
+	}
+
+	var active []Job
+	if err := c.Select(table, url.Values{"status": {"in.(pending,running)"}}, &active); err != nil {
+		return nil, err
+	}
+	busy := make(map[string]bool)
+	for _, j := range active {
+		busy[j.FileID] = true
+	}
+
+	var jobs []Job
+	for _, f := range files {
+		if busy[f.ID] {
+			fmt.Printf("[MIGRATE] Skipping %s: migration already in progress\n", f.ID)
+			continue
+		}
+		if f.MetaProvider == storage.DedupProvider {
+			// Dedup chunks are shared with other files through the chunk index.
+			fmt.Printf("[MIGRATE] Skipping %s: dedup files can't be migrated\n", f.ID)
+			continue
+		}
+		if err := sameChunkSize(f.MetaProvider, dst.Provider); err != nil {
+			fmt.Printf("[MIGRATE] Skipping %s: %v\n", f.ID, err)
+			continue
+		}
+		links, err := f.Links()
+		if err != nil {
+			fmt.Printf("[MIGRATE] Skipping %s: bad meta_links: %v\n", f.ID, err)
+			continue
+		}
+		job := Job{
+			ID:          newID(),
+			FileID:      f.ID,
+			ToProvider:  dst.Provider,
+			ToTarget:    dst.Target,
+			Status:      StatusPending,
+			TotalChunks: len(links),
+			SourceLinks: f.MetaLinks,
+			NewLinks:    "[]",
+			UpdatedAt:   now(),
+		}
+		if err := c.Insert(table, job, nil); err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// List returns jobs, newest first, optionally filtered by ID or status.
+func List(c *meta.Client, id, status string) ([]Job, error) {
+	q := url.Values{"select": {"*"}, "order": {"created_at.desc"}}
+	if id != "" {
+		q.Set("id", meta.Eq(id))
+	}
+	if status != "" {
+		q.Set("status", meta.Eq(status))
+	}
+	var jobs []Job
+	err := c.Select(table, q, &jobs)
+	return jobs, err
+}
+
+// Retry puts a failed job back in the queue. Chunks already copied are kept.
+func Retry(c *meta.Client, id string) error {
+	return c.Update(table, url.Values{"id": {meta.Eq(id)}, "status": {meta.Eq(StatusFailed)}},
+		map[string]interface{}{"status": StatusPending, "error": "", "updated_at": now()}, nil)
+}
+
+// Run works through queued jobs, oldest first, copying at most maxChunks
+// chunks in total so a call fits in a serverless time limit. It returns the
+// number of chunks copied; call it again until it returns zero.
+func Run(c *meta.Client, maxChunks int) (int, error) {
+	var jobs []Job
+	q := url.Values{"select": {"*"}, "status": {"in.(pending,running)"}, "order": {"created_at.asc"}}
+	if err := c.Select(table, q, &jobs); err != nil {
+		return 0, err
+	}
+
+	copied := 0
+	for i := range jobs {
+		if copied >= maxChunks {
+			break
+		}
+		n, err := Step(c, &jobs[i], maxChunks-copied)
+		copied += n
+		if err != nil {
+			fmt.Printf("[MIGRATE] Job %s failed: %v\n", jobs[i].ID, err)
+		}
+	}
+	return copied, nil
+}
+
+// Step copies up to budget chunks of one job and swaps the manifest once
+// every chunk is in place. Errors mark the job failed; progress is kept. A
+// job another worker holds, or that is no longer queued, is skipped.
+func Step(c *meta.Client, job *Job, budget int) (int, error) {
+	ok, err := claim(c, job)
+	if err != nil || !ok {
+		return 0, err
+	}
+	copied, err := step(c, job, budget)
+	if err != nil {
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	}
+	job.ClaimedUntil = nil
+	if serr := save(c, job); err == nil {
+		err = serr
+	}
+	return copied, err
+}
+
+// claim takes a queued job for this worker unless another holds it, and
+// refreshes job from the row. It reports false when it did not.
+func claim(c *meta.Client, job *Job) (bool, error) {
+	at := time.Now().UTC()
+	var rows []Job
+	err := c.Update(table, url.Values{
+		"id":     {meta.Eq(job.ID)},
+		"status": {"in.(pending,running)"},
+		"or":     {"(claimed_until.is.null,claimed_until.lt." + at.Format(time.RFC3339) + ")"},
+	}, map[string]interface{}{
+		"status":        StatusRunning,
+		"claimed_until": at.Add(lease).Format(time.RFC3339),
+	}, &rows)
+	if err != nil || len(rows) == 0 {
+		if err == nil {
+			fmt.Printf("[MIGRATE] Skipping %s: another worker has it\n", job.ID)
+		}
+		return false, err
+	}
+	*job = rows[0]
+	return true, nil
+}
+
+func step(c *meta.Client, job *Job, budget int) (int, error) {
+	file, err := c.GetFile(job.FileID)
+	if err != nil {
+		return 0, fmt.Errorf("load file: %v", err)
+	}
+	if file.MetaLinks != job.SourceLinks {
+		if job.DoneChunks > 0 {
+			return 0, fmt.Errorf("file changed since migration started")
+		}
+		job.SourceLinks = file.MetaLinks
+	}
+	if err := sameChunkSize(file.MetaProvider, job.ToProvider); err != nil {
+		return 0, err
+	}
+
+	var source, copies []string
+	if err := json.Unmarshal([]byte(job.SourceLinks), &source); err != nil {
+		return 0, fmt.Errorf("bad source links: %v", err)
+	}
+	if err := json.Unmarshal([]byte(job.NewLinks), &copies); err != nil {
+		return 0, fmt.Errorf("bad new links: %v", err)
+	}
+	job.Status = StatusRunning
+	job.TotalChunks = len(source)
+
+	// Copies are counted against, and without a target go to, the file's
+	// workspace.
+	into, err := workspace.For(c, file.WorkspaceID)
+	if err != nil {
+		return 0, err
+	}
+	copied := 0
+	for i := len(copies); i < len(source) && copied < budget; i++ {
+		link, err := copyChunk(into, file.Name, source[i], i, job)
+		if err != nil {
+			return copied, fmt.Errorf("chunk %d: %v", i+1, err)
+		}
+		copies = append(copies, link)
+		copied++
+
+		b, _ := json.Marshal(copies)
+		job.NewLinks = string(b)
+		job.DoneChunks = len(copies)
+		if err := save(c, job); err != nil {
+			return copied, err
+		}
+		fmt.Printf("[MIGRATE] %s: chunk %d/%d copied\n", job.FileID, job.DoneChunks, job.TotalChunks)
+	}
+
+	if len(copies) < len(source) {
+		return copied, nil
+	}
+
+	var swapped bool
+	err = c.RPC("swap_file_manifest", map[string]string{
+		"p_file_id":      job.FileID,
+		"p_old_links":    job.SourceLinks,
+		"p_new_links":    job.NewLinks,
+		"p_new_provider": job.ToProvider,
+	}, &swapped)
+	if err != nil {
+		return copied, fmt.Errorf("swap manifest: %v", err)
+	}
+	if !swapped {
+		return copied, fmt.Errorf("file changed since migration started")
+	}
+
+	job.Status = StatusDone
+	job.Error = ""
+	fmt.Printf("[MIGRATE] %s: manifest swapped to %s\n", job.FileID, job.ToProvider)
+	removeSource(c, into, file, source, copies)
+	return copied, nil
+}
+
+// removeSource deletes the chunks the file no longer uses after the swap
+// and gives their bytes back. Copies of the file and versions with its key
+// still use them, and then they stay. The file is already migrated, so
+// failures are only logged.
+func removeSource(c, into *meta.Client, file *meta.File, source, copies []string) {
+	shared, err := versions.Shared(c, file.MetaKey, []string{file.ID}, nil)
+	if err != nil || shared {
+		fmt.Printf("[MIGRATE] %s: keeping the old chunks (shared: %v, error: %v)\n", file.ID, shared, err)
+		return
+	}
+	kept := make(map[string]bool)
+	for _, link := range copies {
+		kept[link] = true
+	}
+	var links []string
+	sizes := make(map[string]int64)
+	for i, n := range quota.LinkSizes(file.Size, file.MetaProvider, source) {
+		if !kept[source[i]] {
+			links = append(links, source[i])
+			sizes[source[i]] = n
+		}
+	}
+	label := "migration of " + file.ID
+	freed, err := versions.DeleteChunks(c, label, links, sizes)
+	if err != nil {
+		fmt.Printf("[MIGRATE] %s: deleting the old chunks failed: %v\n", file.ID, err)
+	}
+	versions.Release(into, quota.Tenant(into), label, freed)
+}
+
+// copyChunk copies one chunk as-is (it stays encrypted) and reads the copy
+// back to check it before it is recorded.
+func copyChunk(c *meta.Client, fileName, link string, index int, job *Job) (string, error) {
+	if alreadyThere(link, job) {
+		return link, nil
+	}
+
+	data, err := storage.GetChunk(link)
+	if err != nil {
+		return "", fmt.Errorf("read source: %v", err)
+	}
+	newLink, locs, err := quota.Put(c, job.ToProvider, job.ToTarget, fileName, data, index)
+	if err != nil {
+		return "", fmt.Errorf("write copy: %v", err)
+	}
+	if err := messages.Record(c, locs); err != nil {
+		fmt.Printf("[MIGRATE] Recording messages of chunk %d failed: %v\n", index, err)
+	}
+	check, err := storage.GetChunk(newLink)
+	if err != nil {
+		return "", fmt.Errorf("verify copy: %v", err)
+	}
+	if !bytes.Equal(check, data) {
+		return "", fmt.Errorf("verify copy: content mismatch")
+	}
+	return newLink, nil
+}
+
+// sameChunkSize checks that files of provider from can move to provider
+// to. Chunks are copied as they are, and readers work out where each chunk
+// starts from the file's provider, so both must cut files the same way.
+func sameChunkSize(from, to string) error {
+	if storage.ChunkSize(from) != storage.ChunkSize(to) {
+		return fmt.Errorf("%s and %s use different chunk sizes", from, to)
+	}
+	return nil
+}
+
+// alreadyThere reports whether a chunk can be kept as-is because it is
+// already stored on the destination.
+func alreadyThere(link string, job *Job) bool {
+	provider := storage.ProviderOf(link)
+	if provider != job.ToProvider || provider == storage.ErasureProvider {
+		return false
+	}
+	if provider == "telegram" {
+		// file_ids don't say which chat they live in.
+		return job.ToTarget == ""
+	}
+	return job.ToTarget != "" && storage.OnTarget(link, provider, job.ToTarget)
+}
+
+func save(c *meta.Client, job *Job) error {
+	job.UpdatedAt = now()
+	return c.Update(table, url.Values{"id": {meta.Eq(job.ID)}}, map[string]interface{}{
+		"status":        job.Status,
+		"done_chunks":   job.DoneChunks,
+		"total_chunks":  job.TotalChunks,
+		"source_links":  job.SourceLinks,
+		"new_links":     job.NewLinks,
+		"error":         job.Error,
+		"claimed_until": job.ClaimedUntil,
+		"updated_at":    job.UpdatedAt,
+	}, nil)
+}
+
+func newID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("mig_%d_%s", time.Now().UnixMilli(), hex.EncodeToString(b))
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
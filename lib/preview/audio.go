@@ -0,0 +1,162 @@
+package preview
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// Waveforms have this many peaks.
+const waveformPeaks = 200
+
+// waveform returns the peaks of the audio in r. WAV files are read
+// directly; other formats are decoded with ffmpeg when it is installed.
+func waveform(r io.ReadSeeker, mime string) ([]byte, error) {
+	var blocks []int
+	var err error
+	if mime == "audio/wav" || mime == "audio/x-wav" || mime == "audio/wave" {
+		blocks, err = wavBlocks(r)
+	} else {
+		blocks, err = ffmpegBlocks(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, errors.New("no samples")
+	}
+	return encodeWaveform(peaks(blocks, waveformPeaks))
+}
+
+// blockSamples is how many samples each block, the unit the decoders
+// report, covers.
+const blockSamples = 1024
+
+// blocks collects the loudest of every blockSamples samples, as 0 to 100.
+type blocks struct {
+	out  []int
+	peak int
+	n    int
+}
+
+func (b *blocks) add(sample, full int) {
+	if sample < 0 {
+		sample = -sample
+	}
+	if sample > b.peak {
+		b.peak = sample
+	}
+	b.n++
+	if b.n == blockSamples {
+		b.flush(full)
+	}
+}
+
+func (b *blocks) flush(full int) {
+	if b.n > 0 {
+		b.out = append(b.out, min(100, b.peak*100/full))
+	}
+	b.peak, b.n = 0, 0
+}
+
+// peaks merges blocks into n peaks, or fewer for very short audio.
+func peaks(blocks []int, n int) []int {
+	if len(blocks) <= n {
+		return blocks
+	}
+	out := make([]int, n)
+	for i := range out {
+		for _, v := range blocks[i*len(blocks)/n : (i+1)*len(blocks)/n] {
+			out[i] = max(out[i], v)
+		}
+	}
+	return out
+}
+
+// wavBlocks reads 8- or 16-bit PCM from a WAV file, all channels mixed.
+func wavBlocks(r io.Reader) ([]int, error) {
+	br := bufio.NewReader(r)
+	var riff [12]byte
+	if _, err := io.ReadFull(br, riff[:]); err != nil {
+		return nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+	bits := 0
+	for {
+		var hdr [8]byte
+		if _, err := io.ReadFull(br, hdr[:]); err != nil {
+			return nil, err
+		}
+		id, size := string(hdr[0:4]), int64(binary.LittleEndian.Uint32(hdr[4:8]))
+		switch id {
+		case "fmt ":
+			fmtChunk := make([]byte, size)
+			if _, err := io.ReadFull(br, fmtChunk); err != nil {
+				return nil, err
+			}
+			if size < 16 || binary.LittleEndian.Uint16(fmtChunk[0:2]) != 1 {
+				return nil, errors.New("only PCM WAV files are supported")
+			}
+			bits = int(binary.LittleEndian.Uint16(fmtChunk[14:16]))
+			if bits != 8 && bits != 16 {
+				return nil, fmt.Errorf("%d-bit WAV files are not supported", bits)
+			}
+		case "data":
+			if bits == 0 {
+				return nil, errors.New("WAV data before its format")
+			}
+			var b blocks
+			data := io.LimitReader(br, size)
+			if bits == 8 {
+				buf := make([]byte, 1)
+				for _, err := io.ReadFull(data, buf); err == nil; _, err = io.ReadFull(data, buf) {
+					b.add(int(buf[0])-128, 128)
+				}
+			} else {
+				buf := make([]byte, 2)
+				for _, err := io.ReadFull(data, buf); err == nil; _, err = io.ReadFull(data, buf) {
+					b.add(int(int16(binary.LittleEndian.Uint16(buf))), 32768)
+				}
+			}
+			b.flush(32768 >> (16 - bits))
+			return b.out, nil
+		default:
+			if _, err := io.CopyN(io.Discard, br, size+size%2); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// ffmpegBlocks decodes any audio ffmpeg reads to 8 kHz mono 16-bit PCM.
+func ffmpegBlocks(r io.Reader) ([]int, error) {
+	bin, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.New("ffmpeg is not installed")
+	}
+	cmd := exec.Command(bin, "-v", "error", "-i", "pipe:0", "-ac", "1", "-ar", "8000", "-f", "s16le", "pipe:1")
+	cmd.Stdin = r
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	var b blocks
+	br := bufio.NewReader(out)
+	buf := make([]byte, 2)
+	for _, err := io.ReadFull(br, buf); err == nil; _, err = io.ReadFull(br, buf) {
+		b.add(int(int16(binary.LittleEndian.Uint16(buf))), 32768)
+	}
+	b.flush(32768)
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %v", err)
+	}
+	return b.out, nil
+}
@@ -0,0 +1,86 @@
+package preview
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	_ "image/png" // registers the PNG decoder
+	"io"
+)
+
+// Thumbnails fit in a ThumbSize square.
+const ThumbSize = 320
+
+// maxPixels keeps a small file with huge dimensions from using gigabytes
+// of memory once decoded.
+const maxPixels = 50_000_000
+
+// thumbnail scales the image in r down to fit ThumbSize and encodes it as
+// a JPEG.
+func thumbnail(r io.ReadSeeker) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxPixels {
+		return nil, fmt.Errorf("%dx%d is too large to decode", cfg.Width, cfg.Height)
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	return encodeJPEG(scale(img, ThumbSize))
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scale shrinks img to fit a size by size square, averaging the source
+// pixels behind each target pixel. Smaller images are only flattened onto
+// white, as JPEG has no transparency.
+func scale(img image.Image, size int) *image.RGBA {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	dw, dh := sw, sh
+	if sw > size || sh > size {
+		if sw >= sh {
+			dw, dh = size, max(1, sh*size/sw)
+		} else {
+			dw, dh = max(1, sw*size/sh), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+max((y+1)*sh/dh, y*sh/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+max((x+1)*sw/dw, x*sw/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// Premultiplied, so adding what alpha leaves out puts it on white.
+			white := n*0xffff - a
+			i := dst.PixOffset(x, y)
+			dst.Pix[i+0] = uint8((r + white) / n >> 8)
+			dst.Pix[i+1] = uint8((g + white) / n >> 8)
+			dst.Pix[i+2] = uint8((bl + white) / n >> 8)
+			dst.Pix[i+3] = 0xff
+		}
+	}
+	return dst
+}
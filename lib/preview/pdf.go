@@ -0,0 +1,49 @@
+package preview
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// errNoRenderer is returned for PDFs where pdftoppm is not installed. Go
+// has no PDF renderer of its own.
+var errNoRenderer = errors.New("pdftoppm (poppler-utils) is not installed")
+
+// renderPDF renders the first page of the PDF in r with pdftoppm, scaled
+// to fit ThumbSize.
+func renderPDF(r io.Reader) ([]byte, error) {
+	bin, err := exec.LookPath("pdftoppm")
+	if err != nil {
+		return nil, errNoRenderer
+	}
+	dir, err := os.MkdirTemp("", "teddrive-preview-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in := filepath.Join(dir, "in.pdf")
+	f, err := os.Create(in)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out := filepath.Join(dir, "page")
+	cmd := exec.Command(bin, "-f", "1", "-l", "1", "-singlefile", "-jpeg",
+		"-scale-to", strconv.Itoa(ThumbSize), in, out)
+	if msg, err := cmd.CombinedOutput(); err != nil {
+		return nil, errors.New("pdftoppm: " + string(msg))
+	}
+	return os.ReadFile(out + ".jpg")
+}
@@ -0,0 +1,277 @@
+// Package preview makes small previews of files on the server: thumbnails
+// of images, a render of a PDF's first page, and waveform peaks of audio.
+// A preview is made the first time it is asked for, then stored like a
+// file of its own, encrypted on the file's provider, and recorded in the
+// file's preview column (supabase/migrations/016_previews.sql). It is made
+// again once the file's content changes.
+package preview
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/messages"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+)
+
+// MaxSource is the largest file a preview is made of. Larger files keep
+// their type icon.
+const MaxSource = 32 << 20
+
+var (
+	// ErrDisabled is returned while the migration is not applied.
+	ErrDisabled = errors.New("previews need supabase/migrations/016_previews.sql")
+	// ErrNone is returned for files without a preview: types that have
+	// none, files over MaxSource, and content that could not be read.
+	ErrNone = errors.New("no preview for this file")
+)
+
+// Preview is the preview column of a files row.
+type Preview struct {
+	// Source is the meta_key of the content the preview was made from.
+	Source string `json:"source"`
+	// Mime is image/jpeg for thumbnails and application/json for
+	// waveforms, or "" when the file has no preview.
+	Mime     string `json:"mime,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Links    string `json:"links,omitempty"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// file returns the stored preview as a files row content can read.
+func (p *Preview) file(id string) *meta.File {
+	return &meta.File{
+		ID:           id + "-preview",
+		Name:         "preview",
+		Size:         p.Size,
+		MetaKey:      p.Key,
+		MetaLinks:    p.Links,
+		MetaProvider: p.Provider,
+	}
+}
+
+var (
+	installedMu sync.Mutex
+	installed   = make(map[string]bool)
+)
+
+// Installed reports whether the files table has the preview column. A yes
+// is remembered; a no is checked again next time.
+func Installed(c *meta.Client) (bool, error) {
+	installedMu.Lock()
+	ok := installed[c.URL]
+	installedMu.Unlock()
+	if ok {
+		return true, nil
+	}
+	var rows []struct{}
+	err := c.Select("files", url.Values{"select": {"preview"}, "limit": {"1"}}, &rows)
+	if pg := meta.AsPostgres(err); pg != nil && pg.Code == "42703" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	installedMu.Lock()
+	installed[c.URL] = true
+	installedMu.Unlock()
+	return true, nil
+}
+
+// Stored returns the preview recorded for file id, or nil if there is
+// none, whatever content it was made from.
+func Stored(c *meta.Client, id string) (*Preview, error) {
+	ok, err := Installed(c)
+	if err != nil || !ok {
+		return nil, err
+	}
+	var rows []struct {
+		Preview *Preview `json:"preview"`
+	}
+	if err := c.Select("files", url.Values{"select": {"preview"}, "id": {meta.Eq(id)}}, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return rows[0].Preview, nil
+}
+
+// Content returns the stored preview as a files row, for deleting its
+// chunks along with the file. It is nil when nothing is stored.
+func (p *Preview) Content(id string) *meta.File {
+	if p == nil || p.Mime == "" {
+		return nil
+	}
+	return p.file(id)
+}
+
+// Open returns the preview of f and its MIME type, making it first if
+// there is none yet for f's content.
+func Open(c *meta.Client, f *meta.File) ([]byte, string, error) {
+	ok, err := Installed(c)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ok {
+		return nil, "", ErrDisabled
+	}
+	p, err := Stored(c, f.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if p != nil && p.Source == f.MetaKey {
+		if p.Mime == "" {
+			return nil, "", ErrNone
+		}
+		var buf bytes.Buffer
+		if _, err := content.Copy(&buf, c, p.file(f.ID)); err != nil {
+			return nil, "", err
+		}
+		return buf.Bytes(), p.Mime, nil
+	}
+
+	data, mime, err := Make(c, f)
+	if errors.Is(err, ErrNone) {
+		// Remember, so the file is not read again for nothing.
+		return nil, "", record(c, f, p, &Preview{Source: f.MetaKey})
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	next, err := store(c, f, data, mime)
+	var exceeded *quota.ExceededError
+	if errors.As(err, &exceeded) {
+		// Made again next time, once there is room.
+		return data, mime, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := record(c, f, p, next); err != nil {
+		return nil, "", err
+	}
+	return data, mime, nil
+}
+
+// Make renders the preview of f without storing it.
+func Make(c *meta.Client, f *meta.File) ([]byte, string, error) {
+	kind := kindOf(f)
+	if kind == "" || f.Size > MaxSource || f.Size == 0 {
+		return nil, "", ErrNone
+	}
+	r, err := content.NewReader(c, f)
+	if err != nil {
+		return nil, "", err
+	}
+	var data []byte
+	var mime string
+	switch kind {
+	case "image":
+		data, err = thumbnail(r)
+		mime = "image/jpeg"
+	case "pdf":
+		data, err = renderPDF(r)
+		mime = "image/jpeg"
+	case "audio":
+		data, err = waveform(r, f.Mime)
+		mime = "application/json"
+	}
+	if err != nil {
+		fmt.Printf("[PREVIEW] %s (%s): %v\n", f.ID, f.Mime, err)
+		return nil, "", ErrNone
+	}
+	return data, mime, nil
+}
+
+func kindOf(f *meta.File) string {
+	switch {
+	case f.Mime == "image/jpeg", f.Mime == "image/png", f.Mime == "image/gif":
+		return "image"
+	case f.Mime == "application/pdf" || strings.HasSuffix(strings.ToLower(f.Name), ".pdf"):
+		return "pdf"
+	case strings.HasPrefix(f.Mime, "audio/"):
+		return "audio"
+	}
+	return ""
+}
+
+// store uploads a preview like a small file of its own. Dedup files keep
+// theirs on a plain provider, as their chunks are counted by reference.
+func store(c *meta.Client, f *meta.File, data []byte, mime string) (*Preview, error) {
+	provider := f.MetaProvider
+	if provider == storage.DedupProvider {
+		provider = "discord"
+		if _, err := storage.BackendFor("discord", c.Target("discord")); err != nil {
+			provider = "telegram"
+		}
+	}
+	w, err := content.NewWriter(c, provider, f.Name+".preview")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	var row meta.File
+	w.Apply(&row)
+	return &Preview{
+		Source:   f.MetaKey,
+		Mime:     mime,
+		Size:     row.Size,
+		Key:      row.MetaKey,
+		Links:    row.MetaLinks,
+		Provider: row.MetaProvider,
+	}, nil
+}
+
+// record saves next as f's preview and deletes the chunks of prev, the one
+// made from earlier content, giving their bytes back to the quota.
+func record(c *meta.Client, f *meta.File, prev, next *Preview) error {
+	if err := c.Update("files", url.Values{"id": {meta.Eq(f.ID)}}, map[string]interface{}{"preview": next}, nil); err != nil {
+		return err
+	}
+	old := prev.Content(f.ID)
+	if old == nil {
+		return nil
+	}
+	links, _ := old.Links()
+	sizes := quota.LinkSizes(old.Size, old.MetaProvider, links)
+	tenant := quota.DefaultTenant
+	if f.WorkspaceID != "" {
+		tenant = f.WorkspaceID
+	}
+	for i, link := range links {
+		if err := messages.Delete(c, link); err != nil {
+			fmt.Printf("[PREVIEW] %s: old preview chunk left on %s: %v\n", f.ID, storage.ProviderOf(link), err)
+			continue
+		}
+		if err := quota.Release(c, tenant, storage.ProviderOf(link), sizes[i]); err != nil {
+			fmt.Printf("[PREVIEW] %s: releasing %d bytes failed: %v\n", f.ID, sizes[i], err)
+		}
+	}
+	return nil
+}
+
+// Waveform is the preview of an audio file: Peaks loudest sample of each
+// equal slice of the file, from 0 to 100.
+type Waveform struct {
+	Peaks []int `json:"peaks"`
+}
+
+func encodeWaveform(peaks []int) ([]byte, error) {
+	return json.Marshal(Waveform{Peaks: peaks})
+}
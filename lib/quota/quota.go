@@ -0,0 +1,420 @@
+// Package quota counts the bytes stored on each provider and enforces a
+// storage limit. What counts is what the providers actually hold: chunks
+// as uploaded, encrypted, with every shard of an erasure stripe, and every
+// dedup chunk once however many files use it.
+//
+// Uploads book their bytes before they start and give them back if they
+// fail; purging the trash gives back what it deleted. The counters live in
+// the storage_usage table (supabase/migrations/011_quotas.sql), and until
+// it exists nothing is counted or limited.
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/storage"
+)
+
+// DefaultTenant is the tenant of the default workspace, and of everything
+// before workspaces.
+const DefaultTenant = "default"
+
+// Tenant is who uploads through c are counted against: its workspace (see
+// lib/workspace), or DefaultTenant.
+func Tenant(c *meta.Client) string {
+	if c == nil || c.Workspace == "" {
+		return DefaultTenant
+	}
+	return c.Workspace
+}
+
+// ErrDisabled is returned by Get and Recount while the migration is not
+// applied.
+var ErrDisabled = errors.New("usage accounting needs supabase/migrations/011_quotas.sql")
+
+// ExceededError is returned when an upload would go over the limit.
+type ExceededError struct {
+	Used  int64
+	Limit int64
+	Need  int64
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("storage quota exceeded: %d of %d bytes used, %d more needed", e.Used, e.Limit, e.Need)
+}
+
+// Remaining returns how many bytes can still be stored.
+func (e *ExceededError) Remaining() int64 {
+	if e.Used >= e.Limit {
+		return 0
+	}
+	return e.Limit - e.Used
+}
+
+// DefaultLimit reads STORAGE_QUOTA_GB, the limit of tenants without a row
+// in the quotas table. It returns nil, no limit, when it is not set.
+func DefaultLimit() *int64 {
+	gb, err := strconv.ParseFloat(strings.TrimSpace(os.Getenv("STORAGE_QUOTA_GB")), 64)
+	if err != nil || gb <= 0 {
+		return nil
+	}
+	n := int64(gb * (1 << 30))
+	return &n
+}
+
+type reservation struct {
+	OK       bool   `json:"ok"`
+	Used     int64  `json:"used"`
+	MaxBytes *int64 `json:"max_bytes"`
+}
+
+// Reserve books n bytes on provider before they are uploaded, and returns
+// an *ExceededError instead when that would take the tenant over its
+// limit. The check happens in the database, so parallel uploads cannot go
+// over together. A nil client, as for uploads without Supabase, books
+// nothing.
+func Reserve(c *meta.Client, tenant, provider string, n int64) error {
+	if c == nil || n <= 0 {
+		return nil
+	}
+	var rows []reservation
+	err := c.RPC("reserve_storage", map[string]interface{}{
+		"p_tenant":        tenant,
+		"p_provider":      provider,
+		"p_bytes":         n,
+		"p_default_limit": DefaultLimit(),
+	}, &rows)
+	if meta.MissingFunction(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("quota: %v", err)
+	}
+	if len(rows) == 0 || rows[0].OK {
+		return nil
+	}
+	e := &ExceededError{Used: rows[0].Used, Need: n}
+	if rows[0].MaxBytes != nil {
+		e.Limit = *rows[0].MaxBytes
+	}
+	return e
+}
+
+// Release gives back n bytes on provider, after a failed upload or once the
+// chunks are deleted.
+func Release(c *meta.Client, tenant, provider string, n int64) error {
+	if c == nil || n <= 0 {
+		return nil
+	}
+	err := c.RPC("reserve_storage", map[string]interface{}{
+		"p_tenant":        tenant,
+		"p_provider":      provider,
+		"p_bytes":         -n,
+		"p_default_limit": nil,
+	}, nil)
+	if meta.MissingFunction(err) {
+		return nil
+	}
+	return err
+}
+
+// Put is storage.Put with the chunk's stored size booked on provider for
+// c's tenant first, and given back if the upload fails. An empty target is
+// the workspace's own channel or chat, if it has one; erasure stripes go
+// to the workspace's channel and chat too.
+func Put(c *meta.Client, provider, target, fileName string, data []byte, index int) (string, []storage.Locator, error) {
+	tenant := Tenant(c)
+	if target == "" {
+		target = c.Target(provider)
+	}
+	n := storage.StoredSize(provider, len(data))
+	if err := Reserve(c, tenant, provider, n); err != nil {
+		return "", nil, err
+	}
+	var link string
+	var locs []storage.Locator
+	var err error
+	if provider == storage.ErasureProvider {
+		link, locs, err = storage.PutStripe(storage.BackendsFor(map[string]string{
+			"discord":  c.Target("discord"),
+			"telegram": c.Target("telegram"),
+		}), fileName, data, index)
+	} else {
+		link, locs, err = storage.Put(provider, target, fileName, data, index)
+	}
+	if err != nil {
+		if rerr := Release(c, tenant, provider, n); rerr != nil {
+			fmt.Printf("[QUOTA] Releasing %d bytes failed: %v\n", n, rerr)
+		}
+		return "", nil, err
+	}
+	return link, locs, nil
+}
+
+// Usage is a tenant's stored bytes by provider and its limit.
+type Usage struct {
+	Tenant    string           `json:"tenant"`
+	Used      int64            `json:"used"`
+	Limit     *int64           `json:"limit"`
+	Remaining *int64           `json:"remaining"`
+	Providers map[string]int64 `json:"providers"`
+}
+
+type usageRow struct {
+	Tenant   string `json:"tenant"`
+	Provider string `json:"provider"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Get returns the tenant's usage as counted.
+func Get(c *meta.Client, tenant string) (*Usage, error) {
+	var rows []usageRow
+	err := c.Select("storage_usage", url.Values{"tenant": {meta.Eq(tenant)}}, &rows)
+	var apiErr *meta.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, ErrDisabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	u := &Usage{Tenant: tenant, Providers: make(map[string]int64)}
+	for _, r := range rows {
+		u.Providers[r.Provider] = r.Bytes
+		u.Used += r.Bytes
+	}
+
+	var limits []struct {
+		MaxBytes *int64 `json:"max_bytes"`
+	}
+	if err := c.Select("quotas", url.Values{"tenant": {meta.Eq(tenant)}}, &limits); err != nil {
+		return nil, err
+	}
+	if len(limits) > 0 {
+		u.Limit = limits[0].MaxBytes
+	} else {
+		u.Limit = DefaultLimit()
+	}
+	if u.Limit != nil {
+		left := *u.Limit - u.Used
+		if left < 0 {
+			left = 0
+		}
+		u.Remaining = &left
+	}
+	return u, nil
+}
+
+// LinkSizes returns the bytes stored for each meta_links entry of a
+// manifest of size plaintext bytes uploaded with provider. Dedup groups
+// are 0: their chunks are shared and counted in the chunk index. Plain
+// chunks may have been compressed, which the manifest does not record, so
+// they count as their plaintext size plus SealOverhead.
+func LinkSizes(size int64, provider string, links []string) []int64 {
+	out := make([]int64, len(links))
+	chunk := int64(storage.ChunkSize(provider))
+	left := size
+	for i, link := range links {
+		plain := chunk
+		if left < plain {
+			plain = left
+		}
+		left -= plain
+		switch storage.ProviderOf(link) {
+		case storage.DedupProvider:
+		case storage.ErasureProvider:
+			if stripe, err := storage.ParseStripe(link); err == nil {
+				out[i] = stripe.StoredSize()
+			}
+		default:
+			out[i] = plain + storage.SealOverhead
+		}
+	}
+	return out
+}
+
+// Recount works out the usage of c's tenant from the metadata and
+// replaces the counters with it, for data uploaded before the migration or
+// counters that drifted. Files in the trash and old versions count: their
+// chunks are still stored. Chunks shared between copies count once.
+func Recount(c *meta.Client) (*Usage, error) {
+	tenant := Tenant(c)
+	if _, err := Get(c, tenant); err != nil {
+		return nil, err
+	}
+	totals := make(map[string]int64)
+	seen := make(map[string]bool)
+	add := func(size int64, provider, linksJSON string) {
+		f := meta.File{MetaLinks: linksJSON}
+		links, err := f.Links()
+		if err != nil {
+			return
+		}
+		sizes := LinkSizes(size, provider, links)
+		for i, link := range links {
+			if sizes[i] == 0 || seen[link] {
+				continue
+			}
+			seen[link] = true
+			totals[storage.ProviderOf(link)] += sizes[i]
+		}
+	}
+
+	type manifest struct {
+		ID           string `json:"id"`
+		FileID       string `json:"file_id"`
+		Size         int64  `json:"size"`
+		MetaLinks    string `json:"meta_links"`
+		MetaProvider string `json:"meta_provider"`
+		// Stored previews, from supabase/migrations/016_previews.sql.
+		Preview *struct {
+			Size     int64  `json:"size"`
+			Links    string `json:"links"`
+			Provider string `json:"provider"`
+		} `json:"preview"`
+	}
+	var probe []struct{}
+	err := c.Select("files", url.Values{"select": {"preview"}, "limit": {"1"}}, &probe)
+	if pg := meta.AsPostgres(err); err != nil && (pg == nil || pg.Code != "42703") {
+		return nil, err
+	}
+	previews := err == nil
+	// A scoped client only pages the workspace's files; their versions are
+	// picked out by file.
+	files := make(map[string]bool)
+	for _, table := range []string{"files", "file_versions"} {
+		columns := "id,size,meta_links,meta_provider"
+		if table == "file_versions" {
+			columns += ",file_id"
+		} else if previews {
+			columns += ",preview"
+		}
+		err := pages(c, table, columns, nil, func(raw json.RawMessage) (string, error) {
+			var rows []manifest
+			if err := json.Unmarshal(raw, &rows); err != nil {
+				return "", err
+			}
+			for _, r := range rows {
+				if table == "files" {
+					files[r.ID] = true
+				} else if c.Workspace != "" && !files[r.FileID] {
+					continue
+				}
+				add(r.Size, r.MetaProvider, r.MetaLinks)
+				if r.Preview != nil && r.Preview.Links != "" {
+					add(r.Preview.Size, r.Preview.Provider, r.Preview.Links)
+				}
+			}
+			if len(rows) == 0 {
+				return "", nil
+			}
+			return rows[len(rows)-1].ID, nil
+		})
+		var apiErr *meta.APIError
+		if table == "file_versions" && errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			continue // no version history
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Dedup chunks record their workspace, NULL for the default one.
+	var chunkFilter url.Values
+	if c.Workspace != "" {
+		chunkFilter = url.Values{"workspace_id": {"is.null"}}
+		if tenant != DefaultTenant {
+			chunkFilter.Set("workspace_id", meta.Eq(tenant))
+		}
+	}
+	err = pages(c, "chunks", "id,size", chunkFilter, func(raw json.RawMessage) (string, error) {
+		var rows []struct {
+			ID   string `json:"id"`
+			Size int64  `json:"size"`
+		}
+		if err := json.Unmarshal(raw, &rows); err != nil {
+			return "", err
+		}
+		for _, r := range rows {
+			totals[storage.DedupProvider] += r.Size + storage.SealOverhead
+		}
+		if len(rows) == 0 {
+			return "", nil
+		}
+		return rows[len(rows)-1].ID, nil
+	})
+	var apiErr *meta.APIError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound) {
+		return nil, err
+	}
+
+	if err := c.Delete("storage_usage", url.Values{"tenant": {meta.Eq(tenant)}}); err != nil {
+		return nil, err
+	}
+	providers := make([]string, 0, len(totals))
+	for p := range totals {
+		providers = append(providers, p)
+	}
+	sort.Strings(providers)
+	rows := make([]usageRow, 0, len(providers))
+	for _, p := range providers {
+		rows = append(rows, usageRow{Tenant: tenant, Provider: p, Bytes: totals[p]})
+	}
+	if len(rows) > 0 {
+		if err := c.Insert("storage_usage", rows, nil); err != nil {
+			return nil, err
+		}
+	}
+	return Get(c, tenant)
+}
+
+// pages reads every row of table matching filter in pages ordered by id.
+// fn handles one page and returns its last id, or "" when it was empty.
+func pages(c *meta.Client, table, columns string, filter url.Values, fn func(json.RawMessage) (string, error)) error {
+	const size = 500
+	last := ""
+	for {
+		q := url.Values{"select": {columns}, "order": {"id.asc"}, "limit": {strconv.Itoa(size)}}
+		for k, v := range filter {
+			q[k] = v
+		}
+		if last != "" {
+			q.Set("id", "gt."+last)
+		}
+		var raw json.RawMessage
+		if err := c.Select(table, q, &raw); err != nil {
+			return err
+		}
+		next, err := fn(raw)
+		if err != nil || next == "" {
+			return err
+		}
+		last = next
+	}
+}
+
+// WriteError answers an upload that Reserve refused: 413 with the
+// remaining capacity for an *ExceededError, 503 for anything else.
+func WriteError(w http.ResponseWriter, err error) {
+	var e *ExceededError
+	if !errors.As(err, &e) {
+		fmt.Printf("[QUOTA] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":     "Storage quota exceeded",
+		"used":      e.Used,
+		"limit":     e.Limit,
+		"remaining": e.Remaining(),
+	})
+}
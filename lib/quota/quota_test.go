@@ -0,0 +1,276 @@
+package quota
+
+import (
+	"errors"
+	"testing"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/meta/metatest"
+	"teddrive-web/lib/storage"
+)
+
+// fixture has the tables and reserve_storage of
+// supabase/migrations/011_quotas.sql, with a 100-byte quota for "small".
+func fixture(t *testing.T) (*metatest.Server, *meta.Client) {
+	t.Setenv("STORAGE_QUOTA_GB", "")
+	s := metatest.New(t)
+	s.Table("storage_usage")
+	s.Table("quotas", "tenant")
+	s.Add("quotas", metatest.Row{"tenant": "small", "max_bytes": 100})
+	s.Func("reserve_storage", func(args map[string]interface{}) (interface{}, error) {
+		tenant, provider := args["p_tenant"], args["p_provider"]
+		n := args["p_bytes"].(float64)
+		var used float64
+		for _, r := range s.Rows("storage_usage") {
+			if r["tenant"] == tenant {
+				used += r["bytes"].(float64)
+			}
+		}
+		limit := args["p_default_limit"]
+		for _, q := range s.Rows("quotas") {
+			if q["tenant"] == tenant {
+				limit = q["max_bytes"]
+			}
+		}
+		if max, ok := limit.(float64); ok && n > 0 && used+n > max {
+			return []metatest.Row{{"ok": false, "used": used, "max_bytes": limit}}, nil
+		}
+		found := s.Update("storage_usage", func(r metatest.Row) bool {
+			if r["tenant"] != tenant || r["provider"] != provider {
+				return false
+			}
+			r["bytes"] = clampZero(r["bytes"].(float64) + n)
+			return true
+		})
+		if len(found) == 0 {
+			s.Add("storage_usage", metatest.Row{"tenant": tenant, "provider": provider, "bytes": clampZero(n)})
+		}
+		return []metatest.Row{{"ok": true, "used": clampZero(used + n), "max_bytes": limit}}, nil
+	})
+	return s, s.Client()
+}
+
+func clampZero(n float64) float64 {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+func TestReserve(t *testing.T) {
+	_, c := fixture(t)
+	if err := Reserve(c, "small", "discord", 60); err != nil {
+		t.Fatal(err)
+	}
+	err := Reserve(c, "small", "telegram", 50)
+	var e *ExceededError
+	if !errors.As(err, &e) {
+		t.Fatalf("Reserve over the quota = %v, want an *ExceededError", err)
+	}
+	if e.Used != 60 || e.Limit != 100 || e.Need != 50 || e.Remaining() != 40 {
+		t.Errorf("ExceededError = %+v, remaining %d", e, e.Remaining())
+	}
+	if err := Release(c, "small", "discord", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reserve(c, "small", "telegram", 100); err != nil {
+		t.Errorf("Reserve after Release = %v", err)
+	}
+	if err := Reserve(c, "small", "telegram", 1); !errors.As(err, &e) {
+		t.Errorf("Reserve of the last byte over = %v, want an *ExceededError", err)
+	}
+
+	// Without a row in quotas there is no limit, unless STORAGE_QUOTA_GB
+	// sets one.
+	if err := Reserve(c, "big", "discord", 1<<40); err != nil {
+		t.Errorf("Reserve without a limit = %v", err)
+	}
+	t.Setenv("STORAGE_QUOTA_GB", "0.5")
+	if err := Reserve(c, "other", "discord", 1<<29); err != nil {
+		t.Errorf("Reserve up to the default limit = %v", err)
+	}
+	if err := Reserve(c, "other", "discord", 1); !errors.As(err, &e) || e.Limit != 1<<29 {
+		t.Errorf("Reserve over the default limit = %v, want a limit of %d", err, 1<<29)
+	}
+}
+
+func TestReserveNothing(t *testing.T) {
+	s, c := fixture(t)
+	if err := Reserve(nil, DefaultTenant, "discord", 10); err != nil {
+		t.Errorf("Reserve without a client = %v", err)
+	}
+	if err := Reserve(c, "small", "discord", 0); err != nil {
+		t.Errorf("Reserve of nothing = %v", err)
+	}
+	if err := Release(c, "small", "discord", -5); err != nil {
+		t.Errorf("Release of less than nothing = %v", err)
+	}
+	if n := len(s.Rows("storage_usage")); n != 0 {
+		t.Errorf("%d usage rows, want none", n)
+	}
+
+	// Before the migration nothing is counted or refused.
+	c = metatest.New(t).Client()
+	if err := Reserve(c, "small", "discord", 1<<40); err != nil {
+		t.Errorf("Reserve before the migration = %v", err)
+	}
+	if err := Release(c, "small", "discord", 1<<40); err != nil {
+		t.Errorf("Release before the migration = %v", err)
+	}
+	if _, err := Get(c, "small"); err != ErrDisabled {
+		t.Errorf("Get before the migration = %v, want ErrDisabled", err)
+	}
+}
+
+func TestGet(t *testing.T) {
+	s, c := fixture(t)
+	s.Add("storage_usage",
+		metatest.Row{"tenant": "small", "provider": "discord", "bytes": 70},
+		metatest.Row{"tenant": "small", "provider": "telegram", "bytes": 50},
+		metatest.Row{"tenant": "big", "provider": "discord", "bytes": 5},
+	)
+	u, err := Get(c, "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Used != 120 || u.Providers["discord"] != 70 || u.Providers["telegram"] != 50 {
+		t.Errorf("Get = %+v", u)
+	}
+	if u.Limit == nil || *u.Limit != 100 || u.Remaining == nil || *u.Remaining != 0 {
+		t.Errorf("limit %v, remaining %v, want 100 and 0", u.Limit, u.Remaining)
+	}
+
+	u, err = Get(c, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Used != 5 || u.Limit != nil || u.Remaining != nil {
+		t.Errorf("Get without a limit = %+v", u)
+	}
+	t.Setenv("STORAGE_QUOTA_GB", "1")
+	u, err = Get(c, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Limit == nil || *u.Limit != 1<<30 || *u.Remaining != 1<<30-5 {
+		t.Errorf("Get with the default limit = %+v", u)
+	}
+}
+
+func TestPutReleasesOnFailure(t *testing.T) {
+	s, c := fixture(t)
+	t.Setenv("DISCORD_BOT_TOKEN", "")
+	c = c.In("small", nil)
+	if _, _, err := Put(c, "discord", "", "a.bin", make([]byte, 40), 0); err == nil {
+		t.Fatal("Put without Discord configured succeeded")
+	}
+	for _, r := range s.Rows("storage_usage") {
+		if r["bytes"] != float64(0) {
+			t.Errorf("usage after a failed upload = %v, want 0", r)
+		}
+	}
+
+	// Over the quota the upload is not tried at all.
+	_, _, err := Put(c, "discord", "", "a.bin", make([]byte, 101), 0)
+	var e *ExceededError
+	if !errors.As(err, &e) {
+		t.Errorf("Put over the quota = %v, want an *ExceededError", err)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	c := &meta.Client{}
+	if got := Tenant(nil); got != DefaultTenant {
+		t.Errorf("Tenant(nil) = %q", got)
+	}
+	if got := Tenant(c); got != DefaultTenant {
+		t.Errorf("Tenant of an unscoped client = %q", got)
+	}
+	if got := Tenant(c.In("team", nil)); got != "team" {
+		t.Errorf("Tenant in team = %q", got)
+	}
+}
+
+func TestDefaultLimit(t *testing.T) {
+	tests := []struct {
+		env  string
+		want int64 // 0 for none
+	}{
+		{"", 0},
+		{"0", 0},
+		{"-1", 0},
+		{"ten", 0},
+		{"1", 1 << 30},
+		{" 2 ", 2 << 30},
+		{"0.25", 1 << 28},
+	}
+	for _, tt := range tests {
+		t.Setenv("STORAGE_QUOTA_GB", tt.env)
+		got := DefaultLimit()
+		if (got == nil) != (tt.want == 0) || (got != nil && *got != tt.want) {
+			t.Errorf("DefaultLimit with %q = %v, want %d", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestLinkSizes(t *testing.T) {
+	const mb = 1 << 20
+	stripe := (&storage.Stripe{
+		Version: 1, Data: 2, Parity: 1, Size: 11,
+		Shards: make([]storage.Locator, 3),
+		Sums:   make([]string, 3),
+	}).String()
+	tests := []struct {
+		name     string
+		size     int64
+		provider string
+		links    []string
+		want     []int64
+	}{
+		{
+			name: "discord", size: 16*mb + 100, provider: "discord",
+			links: []string{"https://a", "https://b", "https://c"},
+			want:  []int64{8*mb + storage.SealOverhead, 8*mb + storage.SealOverhead, 100 + storage.SealOverhead},
+		},
+		{
+			name: "telegram", size: 60 * mb, provider: "telegram",
+			links: []string{"1:2", "1:3"},
+			want:  []int64{50*mb + storage.SealOverhead, 10*mb + storage.SealOverhead},
+		},
+		{
+			name: "fallback to discord in a telegram file", size: 60 * mb, provider: "telegram",
+			links: []string{"1:2", "https://b"},
+			want:  []int64{50*mb + storage.SealOverhead, 10*mb + storage.SealOverhead},
+		},
+		{
+			name: "erasure", size: 11, provider: storage.ErasureProvider,
+			links: []string{stripe},
+			want:  []int64{18},
+		},
+		{
+			name: "broken stripe", size: 11, provider: storage.ErasureProvider,
+			links: []string{"{not a stripe"},
+			want:  []int64{0},
+		},
+		{
+			name: "dedup", size: 100, provider: storage.DedupProvider,
+			links: []string{`{"cdc":1}`},
+			want:  []int64{0},
+		},
+		{name: "empty", size: 0, provider: "discord"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := LinkSizes(tt.size, tt.provider, tt.links)
+			if len(got) != len(tt.want) {
+				t.Fatalf("LinkSizes = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("LinkSizes = %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
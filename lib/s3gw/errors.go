@@ -0,0 +1,89 @@
+package s3gw
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// apiError is an S3 error response.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errAccessDenied       = &apiError{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errUnsupportedAuth    = &apiError{http.StatusBadRequest, "InvalidRequest", "Only AWS4-HMAC-SHA256 signatures are supported"}
+	errAuthMalformed      = &apiError{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed"}
+	errInvalidAccessKey   = &apiError{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID does not exist"}
+	errSignature          = &apiError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match"}
+	errTimeSkewed         = &apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The request time is too far from the server time"}
+	errExpired            = &apiError{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errMissingPayloadHash = &apiError{http.StatusBadRequest, "InvalidRequest", "Missing x-amz-content-sha256"}
+	errInvalidPayloadHash = &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid x-amz-content-sha256"}
+	errContentSHA256      = &apiError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match the body"}
+	errInvalidDigest      = &apiError{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 is not valid"}
+	errBadDigest          = &apiError{http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match the body"}
+	errIncompleteBody     = &apiError{http.StatusBadRequest, "IncompleteBody", "The chunked body is malformed or truncated"}
+	errNoSuchBucket       = &apiError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey          = &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errBucketExists       = &apiError{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists"}
+	errBucketNotEmpty     = &apiError{http.StatusConflict, "BucketNotEmpty", "The bucket is not empty"}
+	errInvalidBucket      = &apiError{http.StatusBadRequest, "InvalidBucketName", "The bucket name is not valid"}
+	errInvalidKey         = &apiError{http.StatusBadRequest, "InvalidArgument", "Object keys cannot contain empty, \".\" or \"..\" segments"}
+	errKeyConflict        = &apiError{http.StatusConflict, "InvalidRequest", "The key clashes with an existing folder or file"}
+	errInvalidArgument    = &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	errMalformedXML       = &apiError{http.StatusBadRequest, "MalformedXML", "The XML is not well-formed"}
+	errNoSuchUpload       = &apiError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errInvalidPart        = &apiError{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errInvalidPartOrder   = &apiError{http.StatusBadRequest, "InvalidPartOrder", "The parts must be listed in ascending order"}
+	errMethodNotAllowed   = &apiError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed against this resource"}
+	errNotImplemented     = &apiError{http.StatusNotImplemented, "NotImplemented", "This operation is not supported by the TEDDRIVE gateway"}
+)
+
+// errorBody is the XML body of an error response.
+type errorBody struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+}
+
+// toAPIError maps err to an S3 error. notFound is used for os.ErrNotExist.
+func toAPIError(err error, notFound *apiError) *apiError {
+	var e *apiError
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, os.ErrNotExist) && notFound != nil:
+		return notFound
+	case errors.Is(err, os.ErrPermission):
+		return errAccessDenied
+	}
+	return &apiError{http.StatusInternalServerError, "InternalError", err.Error()}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error, notFound *apiError) {
+	e := toAPIError(err, notFound)
+	fmt.Printf("[S3] %s %s: %v\n", r.Method, r.URL.Path, err)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.Status)
+		return
+	}
+	writeXML(w, e.Status, errorBody{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,102 @@
+package s3gw
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/workspace"
+)
+
+const keysTable = "s3_keys"
+
+// ErrKeysDisabled is returned while the s3_keys table does not exist.
+var ErrKeysDisabled = errors.New("S3 keys need supabase/migrations/024_s3_keys.sql")
+
+// Key is an S3 access key: an API token for one user in one workspace
+// (supabase/migrations/024_s3_keys.sql). Requests signed with it may do
+// what that user may do there.
+type Key struct {
+	AccessKey   string `json:"access_key"`
+	Secret      string `json:"secret,omitempty"`
+	UserID      string `json:"user_id"`
+	WorkspaceID string `json:"workspace_id"`
+	CreatedAt   string `json:"created_at,omitempty"`
+}
+
+// NewKey makes a key for userID in workspace workspaceID, or the default
+// workspace. The user must have access there already; the secret is only
+// returned here.
+func NewKey(c *meta.Client, userID, workspaceID string) (*Key, error) {
+	if !workspace.ValidUser(userID) {
+		return nil, errors.New("user must be a Supabase Auth user ID")
+	}
+	if workspaceID == "" {
+		workspaceID = workspace.DefaultID
+	}
+	if _, err := workspace.Open(c, workspaceID, userID, false); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 10)
+	secret := make([]byte, 30)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	k := &Key{
+		AccessKey:   "TD" + strings.ToUpper(hex.EncodeToString(id)),
+		Secret:      base64.RawStdEncoding.EncodeToString(secret),
+		UserID:      userID,
+		WorkspaceID: workspaceID,
+	}
+	if err := c.Insert(keysTable, k, nil); err != nil {
+		return nil, keysError(err)
+	}
+	return k, nil
+}
+
+// Keys lists the keys, without their secrets, of userID or of everyone
+// when userID is "".
+func Keys(c *meta.Client, userID string) ([]Key, error) {
+	q := url.Values{"select": {"access_key,user_id,workspace_id,created_at"}, "order": {"created_at.asc"}}
+	if userID != "" {
+		q.Set("user_id", meta.Eq(userID))
+	}
+	var rows []Key
+	if err := c.Select(keysTable, q, &rows); err != nil {
+		return nil, keysError(err)
+	}
+	return rows, nil
+}
+
+// RevokeKey deletes a key; requests signed with it fail from then on.
+func RevokeKey(c *meta.Client, accessKey string) error {
+	return keysError(c.Delete(keysTable, url.Values{"access_key": {meta.Eq(accessKey)}}))
+}
+
+// lookupKey returns the key clients sign with as accessKey.
+func lookupKey(c *meta.Client, accessKey string) (*Key, error) {
+	var rows []Key
+	if err := c.Select(keysTable, url.Values{"access_key": {meta.Eq(accessKey)}}, &rows); err != nil {
+		return nil, keysError(err)
+	}
+	if len(rows) == 0 {
+		return nil, errInvalidAccessKey
+	}
+	return &rows[0], nil
+}
+
+func keysError(err error) error {
+	var apiErr *meta.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return ErrKeysDisabled
+	}
+	return err
+}
@@ -0,0 +1,223 @@
+package s3gw
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxListKeys = 1000
+
+type object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listResult struct {
+	XMLName               string         `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Marker                *string        `xml:"Marker"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	KeyCount              *int           `xml:"KeyCount"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	Contents              []object       `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listObjects answers ListObjectsV2 (list-type=2) and the original
+// ListObjects. With the "/" delimiter only the folder holding the prefix is
+// read; otherwise the whole subtree below it is.
+func (h *Handler) listObjects(w http.ResponseWriter, r *http.Request, bucket string) {
+	ctx := r.Context()
+	if err := h.checkBucket(ctx, bucket); err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := maxListKeys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeError(w, r, errInvalidArgument, nil)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			raw, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				writeError(w, r, errInvalidArgument, nil)
+				return
+			}
+			after = string(raw)
+		}
+	}
+
+	objects, err := h.collect(ctx, bucket, prefix, delimiter == "/")
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	res := listResult{Xmlns: xmlns, Name: bucket, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys}
+	last := ""
+	for _, o := range objects {
+		// Keys below a delimiter roll up into one common prefix.
+		item, rolled := o.Key, false
+		if delimiter != "" {
+			if i := strings.Index(o.Key[len(prefix):], delimiter); i >= 0 {
+				item, rolled = o.Key[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if item <= after || item == last {
+			continue
+		}
+		if len(res.Contents)+len(res.CommonPrefixes) >= maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		last = item
+		if rolled {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{item})
+		} else {
+			res.Contents = append(res.Contents, o)
+		}
+	}
+
+	if v2 {
+		count := len(res.Contents) + len(res.CommonPrefixes)
+		res.KeyCount = &count
+		res.ContinuationToken = q.Get("continuation-token")
+		res.StartAfter = q.Get("start-after")
+		if res.IsTruncated {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := q.Get("marker")
+		res.Marker = &marker
+		if res.IsTruncated {
+			res.NextMarker = last
+		}
+	}
+
+	if q.Get("encoding-type") == "url" {
+		res.EncodingType = "url"
+		res.Prefix = url.QueryEscape(res.Prefix)
+		res.Delimiter = url.QueryEscape(res.Delimiter)
+		res.StartAfter = url.QueryEscape(res.StartAfter)
+		res.NextMarker = url.QueryEscape(res.NextMarker)
+		for i := range res.Contents {
+			res.Contents[i].Key = url.QueryEscape(res.Contents[i].Key)
+		}
+		for i := range res.CommonPrefixes {
+			res.CommonPrefixes[i].Prefix = url.QueryEscape(res.CommonPrefixes[i].Prefix)
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+// collect returns the objects in bucket whose keys start with prefix,
+// sorted by key. Folders are listed as "name/" markers. With shallow set
+// only the folder that holds the prefix is read, which is all a "/"
+// delimiter listing needs.
+func (h *Handler) collect(ctx context.Context, bucket, prefix string, shallow bool) ([]object, error) {
+	dir := prefix[:strings.LastIndex(prefix, "/")+1]
+	name := "/" + bucket
+	if dir != "" {
+		var err error
+		if name, err = objectPath(bucket, dir); err != nil {
+			return nil, nil // no folder can match
+		}
+	}
+
+	var objects []object
+	add := func(rel string, fi os.FileInfo) error {
+		key := dir + rel
+		if fi.IsDir() {
+			key += "/"
+		}
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, object{
+				Key:          key,
+				LastModified: timestamp(fi.ModTime()),
+				ETag:         etagOf(ctx, fi),
+				Size:         fi.Size(),
+				StorageClass: "STANDARD",
+			})
+		}
+		return nil
+	}
+
+	var err error
+	if shallow {
+		err = h.readDir(ctx, name, add)
+	} else {
+		err = fsOf(ctx).Walk(name, add)
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrInvalid) {
+		return nil, nil // the prefix's folder is missing or a file
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+	return objects, nil
+}
+
+func (h *Handler) readDir(ctx context.Context, name string, fn func(string, os.FileInfo) error) error {
+	fi, err := fsOf(ctx).Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return os.ErrInvalid
+	}
+	f, err := fsOf(ctx).OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entries, err := f.Readdir(0)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), "/") {
+			continue // can't be addressed as a key
+		}
+		if err := fn(e.Name(), e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package s3gw
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxPartNumber = 10000
+
+// keepAliveInterval is how often whitespace is sent while a completed
+// multipart upload is being stored, so clients don't time out.
+const keepAliveInterval = 10 * time.Second
+
+// upload is a multipart upload in progress. Parts are spooled to disk,
+// because a file's chunks have a fixed size that S3 parts don't follow;
+// CompleteMultipartUpload streams them into the drive in order. Uploads only
+// live as long as the process.
+type upload struct {
+	bucket, key string
+	dir         string
+	owner       string // access key that started it
+
+	mu    sync.Mutex
+	parts map[int]string // part number -> quoted MD5 ETag
+}
+
+func (u *upload) partPath(n int) string {
+	return filepath.Join(u.dir, strconv.Itoa(n))
+}
+
+func (h *Handler) getUpload(r *http.Request, bucket, key string) (*upload, error) {
+	return h.findUpload(r, bucket, key, false)
+}
+
+// takeUpload removes the upload from the table so no other request can
+// complete or abort it.
+func (h *Handler) takeUpload(r *http.Request, bucket, key string) (*upload, error) {
+	return h.findUpload(r, bucket, key, true)
+}
+
+func (h *Handler) findUpload(r *http.Request, bucket, key string, remove bool) (*upload, error) {
+	id := r.URL.Query().Get("uploadId")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	u := h.uploads[id]
+	if u == nil || u.bucket != bucket || u.key != key || u.owner != sessionOf(r.Context()).key.AccessKey {
+		return nil, errNoSuchUpload
+	}
+	if remove {
+		delete(h.uploads, id)
+	}
+	return u, nil
+}
+
+type initiateResult struct {
+	XMLName  string `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string `xml:"xmlns,attr"`
+	Bucket   string `xml:"Bucket"`
+	Key      string `xml:"Key"`
+	UploadID string `xml:"UploadId"`
+}
+
+func (h *Handler) createUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	if _, err := objectPath(bucket, key); err != nil || strings.HasSuffix(key, "/") {
+		writeError(w, r, errInvalidKey, nil)
+		return
+	}
+	if err := h.checkBucket(r.Context(), bucket); err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	dir, err := os.MkdirTemp(h.TempDir, "teddrive-s3-")
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	h.mu.Lock()
+	if h.uploads == nil {
+		h.uploads = make(map[string]*upload)
+	}
+	h.uploads[id] = &upload{bucket: bucket, key: key, dir: dir, owner: sessionOf(r.Context()).key.AccessKey, parts: make(map[int]string)}
+	h.mu.Unlock()
+
+	writeXML(w, http.StatusOK, initiateResult{Xmlns: xmlns, Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (h *Handler) uploadPart(w http.ResponseWriter, r *http.Request, sig *signature, bucket, key string) {
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxPartNumber {
+		writeError(w, r, errInvalidArgument, nil)
+		return
+	}
+	u, err := h.getUpload(r, bucket, key)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	body, err := sig.payload(r)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	// Write to a temporary name so a failed retry never replaces a good part.
+	tmp, err := os.CreateTemp(u.dir, "part-")
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	sum := md5.New()
+	_, err = io.Copy(io.MultiWriter(tmp, sum), body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), u.partPath(n))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		writeError(w, r, err, nil)
+		return
+	}
+
+	etag := `"` + hex.EncodeToString(sum.Sum(nil)) + `"`
+	u.mu.Lock()
+	u.parts[n] = etag
+	u.mu.Unlock()
+	w.Header().Set("ETag", etag)
+}
+
+type completeRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeResult struct {
+	XMLName  string `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string `xml:"xmlns,attr"`
+	Location string `xml:"Location"`
+	Bucket   string `xml:"Bucket"`
+	Key      string `xml:"Key"`
+	ETag     string `xml:"ETag"`
+}
+
+func (h *Handler) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	var req completeRequest
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		writeError(w, r, errMalformedXML, nil)
+		return
+	}
+	u, err := h.getUpload(r, bucket, key)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	u.mu.Lock()
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			err = errInvalidPartOrder
+			break
+		}
+		if etag, ok := u.parts[p.PartNumber]; !ok || strings.Trim(etag, `"`) != strings.Trim(p.ETag, `"`) {
+			err = errInvalidPart
+			break
+		}
+	}
+	u.mu.Unlock()
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	if u, err = h.takeUpload(r, bucket, key); err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	defer os.RemoveAll(u.dir)
+
+	files := make([]io.Reader, 0, len(req.Parts))
+	for _, p := range req.Parts {
+		f, err := os.Open(u.partPath(p.PartNumber))
+		if err != nil {
+			writeError(w, r, err, nil)
+			return
+		}
+		defer f.Close()
+		files = append(files, f)
+	}
+
+	// Storing can take minutes for large files. Like S3, answer 200 at once
+	// and keep the connection busy; a failure is reported in the body.
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	stop := keepAlive(w)
+	name, _ := objectPath(bucket, key)
+	etag, err := h.store(r.Context(), name, io.MultiReader(files...))
+	stop()
+
+	if err != nil {
+		e := toAPIError(err, nil)
+		fmt.Printf("[S3] %s %s: %v\n", r.Method, r.URL.Path, err)
+		xml.NewEncoder(w).Encode(errorBody{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+		return
+	}
+	xml.NewEncoder(w).Encode(completeResult{
+		Xmlns:    xmlns,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag,
+	})
+}
+
+// keepAlive writes a space every keepAliveInterval until the returned
+// function is called.
+func keepAlive(w http.ResponseWriter) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(keepAliveInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				io.WriteString(w, " ")
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+func (h *Handler) abortUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	u, err := h.takeUpload(r, bucket, key)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	os.RemoveAll(u.dir)
+	w.WriteHeader(http.StatusNoContent)
+}
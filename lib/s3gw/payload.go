@@ -0,0 +1,152 @@
+package s3gw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxPayloadChunk bounds one aws-chunked chunk. SDKs send 64 KiB to 1 MiB.
+const maxPayloadChunk = 16 << 20
+
+// payload returns the object data of r after checking it against what the
+// client signed. Mismatches surface as an error in place of io.EOF, so a
+// caller that copies the body to the end never stores a bad upload.
+func (sig *signature) payload(r *http.Request) (io.Reader, error) {
+	var body io.Reader = r.Body
+	switch p := sig.payloadHash; {
+	case p == unsignedPayload:
+	case p == streamingPayload:
+		body = &chunkedReader{r: bufio.NewReader(r.Body), sig: sig, prev: sig.seed}
+	case p == streamingUnsignedTrail:
+		body = &chunkedReader{r: bufio.NewReader(r.Body)}
+	case strings.HasPrefix(p, "STREAMING-"):
+		return nil, errNotImplemented
+	default:
+		want, err := hex.DecodeString(p)
+		if err != nil || len(want) != sha256.Size {
+			return nil, errInvalidPayloadHash
+		}
+		body = &verifyReader{r: body, h: sha256.New(), want: want, err: errContentSHA256}
+	}
+
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		want, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(want) != md5.Size {
+			return nil, errInvalidDigest
+		}
+		body = &verifyReader{r: body, h: md5.New(), want: want, err: errBadDigest}
+	}
+	return body, nil
+}
+
+// verifyReader hashes everything read and compares the sum at EOF.
+type verifyReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want []byte
+	err  error
+}
+
+func (v *verifyReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.h.Sum(nil), v.want) {
+		err = v.err
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body: a series of
+// "<hex size>[;chunk-signature=<sig>]\r\n<data>\r\n" ending with an empty
+// chunk and optional trailers. With sig set every chunk signature is
+// checked against the previous one, starting from the request signature.
+// Trailing checksums are not verified.
+type chunkedReader struct {
+	r    *bufio.Reader
+	sig  *signature
+	prev string
+	buf  []byte
+	done bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) next() error {
+	line, err := c.line()
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxPayloadChunk {
+		return errIncompleteBody
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errIncompleteBody
+	}
+	if c.sig != nil {
+		got := strings.TrimPrefix(ext, "chunk-signature=")
+		if got != c.sig.chunkSignature(c.prev, data) {
+			return errSignature
+		}
+		c.prev = got
+	}
+
+	if size == 0 {
+		// Trailers, if any, up to the closing blank line.
+		for {
+			line, err := c.line()
+			if err != nil {
+				return err
+			}
+			if line == "" {
+				break
+			}
+		}
+		c.done = true
+		return nil
+	}
+	if crlf, err := c.line(); err != nil || crlf != "" {
+		return errIncompleteBody
+	}
+	c.buf = data
+	return nil
+}
+
+func (c *chunkedReader) line() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", errIncompleteBody
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (sig *signature) chunkSignature(prev string, data []byte) string {
+	sum := sha256.Sum256(data)
+	toSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + sig.amzDate + "\n" + sig.scope + "\n" +
+		prev + "\n" + emptySHA256 + "\n" + hex.EncodeToString(sum[:])
+	return hex.EncodeToString(hmacSHA256(sig.key, []byte(toSign)))
+}
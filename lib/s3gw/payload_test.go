@@ -0,0 +1,131 @@
+package s3gw
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The streaming PUT example from the AWS documentation: 64 KiB and then
+// 1 KiB of 'a', each chunk signed on top of the one before.
+const (
+	exampleSeed = "4f232c4386841ef735655705268965c44a0e4690baa4adea153f7db9fa80a0a9"
+	exampleSig1 = "ad80c730a21e5b8d04586a2213dd63b9a0e99e0e2307b0ade35a65485a288648"
+	exampleSig2 = "0055627c9e194cb4542bae2aa5492e3c1575bbb81b612b7d234b86a503ef5497"
+	exampleSig3 = "b6c6ea8a5354eaf15b3cb7646744f4275b71ea724fed81ceb9323e279d449df9"
+)
+
+// chunk is one aws-chunked chunk; an empty sig leaves the extension off.
+type chunk struct {
+	data []byte
+	sig  string
+}
+
+func encodeChunks(chunks []chunk, trailer string) string {
+	var b strings.Builder
+	for _, c := range chunks {
+		b.WriteString(strconv.FormatInt(int64(len(c.data)), 16))
+		if c.sig != "" {
+			b.WriteString(";chunk-signature=" + c.sig)
+		}
+		b.WriteString("\r\n")
+		b.Write(c.data)
+		if len(c.data) > 0 {
+			b.WriteString("\r\n")
+		}
+	}
+	b.WriteString(trailer + "\r\n")
+	return b.String()
+}
+
+func TestStreamingPayload(t *testing.T) {
+	one := bytes.Repeat([]byte{'a'}, 64<<10)
+	two := bytes.Repeat([]byte{'a'}, 1<<10)
+	tests := []struct {
+		name    string
+		payload string
+		body    string
+		want    []byte
+		err     error
+	}{
+		{
+			name:    "signed chunks",
+			payload: streamingPayload,
+			body:    encodeChunks([]chunk{{one, exampleSig1}, {two, exampleSig2}, {nil, exampleSig3}}, ""),
+			want:    append(append([]byte(nil), one...), two...),
+		},
+		{
+			name:    "chunk changed",
+			payload: streamingPayload,
+			body:    encodeChunks([]chunk{{one, exampleSig1}, {bytes.Repeat([]byte{'b'}, 1<<10), exampleSig2}, {nil, exampleSig3}}, ""),
+			err:     errSignature,
+		},
+		{
+			name:    "chunks swapped",
+			payload: streamingPayload,
+			body:    encodeChunks([]chunk{{two, exampleSig2}, {one, exampleSig1}, {nil, exampleSig3}}, ""),
+			err:     errSignature,
+		},
+		{
+			name:    "chunk dropped",
+			payload: streamingPayload,
+			body:    encodeChunks([]chunk{{two, exampleSig2}, {nil, exampleSig3}}, ""),
+			err:     errSignature,
+		},
+		{
+			name:    "final chunk unsigned",
+			payload: streamingPayload,
+			body:    encodeChunks([]chunk{{one, exampleSig1}, {two, exampleSig2}, {nil, ""}}, ""),
+			err:     errSignature,
+		},
+		{
+			name:    "cut off",
+			payload: streamingPayload,
+			body:    encodeChunks([]chunk{{one, exampleSig1}}, "")[:1000],
+			err:     errIncompleteBody,
+		},
+		{
+			name:    "unsigned with trailer",
+			payload: streamingUnsignedTrail,
+			body:    encodeChunks([]chunk{{one, ""}, {two, ""}, {nil, ""}}, "x-amz-checksum-crc32:AAAAAA==\r\n"),
+			want:    append(append([]byte(nil), one...), two...),
+		},
+		{
+			name:    "bad size",
+			payload: streamingUnsignedTrail,
+			body:    "zz\r\nabc\r\n0\r\n\r\n",
+			err:     errIncompleteBody,
+		},
+	}
+	sig := &signature{
+		key:     signingKey(exampleSecret, "20130524", "us-east-1"),
+		amzDate: exampleDate,
+		scope:   exampleScope,
+		seed:    exampleSeed,
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := http.NewRequest("PUT", "https://s3.amazonaws.com/examplebucket/chunkObject.txt", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := *sig
+			s.payloadHash = tt.payload
+			body, err := s.payload(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(body)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("err = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !bytes.Equal(got, tt.want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(tt.want))
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+// Package s3gw serves the TEDDRIVE folder tree over a subset of the S3 API:
+// ListBuckets, ListObjects(V2), Get/Put/Head/DeleteObject, GetObjectTagging
+// and multipart uploads. Buckets are top-level folders and object keys are paths below
+// them; the files themselves are read and written through davfs, so they
+// are chunked and encrypted exactly like WebDAV and browser uploads.
+//
+// Requests must be path-style (http://host/bucket/key) and signed with
+// SigV4 using an access key from the s3_keys table (see NewKey). Each key
+// belongs to one user in one workspace, and requests see and change only
+// what that user may there.
+package s3gw
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/davfs"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/workspace"
+)
+
+const xmlns = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// emptyETag is the MD5 of no data, used for folder markers.
+const emptyETag = `"d41d8cd98f00b204e9800998ecf8427e"`
+
+// Handler is the S3 gateway.
+type Handler struct {
+	// Client reads the access keys and, confined to each key's
+	// workspace, the drive.
+	Client *meta.Client
+	// Provider stores objects written over S3.
+	Provider string
+	// TempDir holds multipart upload parts until the upload completes.
+	// Empty means os.TempDir().
+	TempDir string
+
+	mu      sync.Mutex
+	uploads map[string]*upload
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sig, signer, err := h.authenticate(r)
+	if err == nil {
+		r, err = h.open(r, signer)
+	}
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	fmt.Printf("[S3] %s %s\n", r.Method, r.URL.Path)
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	q := r.URL.Query()
+	switch {
+	case bucket == "":
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed, nil)
+			return
+		}
+		h.listBuckets(w, r)
+	case key == "":
+		switch r.Method {
+		case http.MethodGet:
+			switch {
+			case q.Has("location"):
+				h.bucketLocation(w, r, bucket)
+			case q.Has("uploads"), q.Has("versioning"), q.Has("policy"), q.Has("acl"):
+				writeError(w, r, errNotImplemented, nil)
+			default:
+				h.listObjects(w, r, bucket)
+			}
+		case http.MethodHead:
+			if err := h.checkBucket(r.Context(), bucket); err != nil {
+				writeError(w, r, err, nil)
+			}
+		case http.MethodPut:
+			h.createBucket(w, r, bucket)
+		case http.MethodDelete:
+			h.deleteBucket(w, r, bucket)
+		case http.MethodPost:
+			writeError(w, r, errNotImplemented, nil)
+		default:
+			writeError(w, r, errMethodNotAllowed, nil)
+		}
+	default:
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			if q.Has("uploadId") || q.Has("acl") || (q.Has("tagging") && r.Method == http.MethodHead) {
+				writeError(w, r, errNotImplemented, nil)
+				return
+			}
+			h.getObject(w, r, bucket, key)
+		case http.MethodPut:
+			switch {
+			case q.Has("uploadId"):
+				h.uploadPart(w, r, sig, bucket, key)
+			case r.Header.Get("X-Amz-Copy-Source") != "", q.Has("acl"), q.Has("tagging"):
+				writeError(w, r, errNotImplemented, nil)
+			default:
+				h.putObject(w, r, sig, bucket, key)
+			}
+		case http.MethodPost:
+			switch {
+			case q.Has("uploads"):
+				h.createUpload(w, r, bucket, key)
+			case q.Has("uploadId"):
+				h.completeUpload(w, r, bucket, key)
+			default:
+				writeError(w, r, errNotImplemented, nil)
+			}
+		case http.MethodDelete:
+			if q.Has("uploadId") {
+				h.abortUpload(w, r, bucket, key)
+				return
+			}
+			h.deleteObject(w, r, bucket, key)
+		default:
+			writeError(w, r, errMethodNotAllowed, nil)
+		}
+	}
+}
+
+type sessionKey struct{}
+
+// session is who signed a request, and the drive as they see it.
+type session struct {
+	key *Key
+	fs  *davfs.FS
+}
+
+// open attaches the session of key to r: the key's workspace as its user
+// sees it, with their role and access list.
+func (h *Handler) open(r *http.Request, key *Key) (*http.Request, error) {
+	a, err := workspace.Open(h.Client, key.WorkspaceID, key.UserID, false)
+	if errors.Is(err, workspace.ErrUnauthorized) || errors.Is(err, workspace.ErrForbidden) {
+		return r, errAccessDenied
+	}
+	if err != nil {
+		return r, err
+	}
+	checker, err := acl.New(a)
+	if err != nil {
+		return r, err
+	}
+	s := &session{key: key, fs: &davfs.FS{Client: a.Client, Provider: h.Provider, ACL: checker}}
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, s)), nil
+}
+
+func sessionOf(ctx context.Context) *session {
+	return ctx.Value(sessionKey{}).(*session)
+}
+
+// fsOf returns the drive as the signer of the request sees it.
+func fsOf(ctx context.Context) *davfs.FS {
+	return sessionOf(ctx).fs
+}
+
+// objectPath maps a bucket and key to a path in the folder tree. Keys
+// ending in "/" name folders.
+func objectPath(bucket, key string) (string, error) {
+	if bucket == "." || bucket == ".." {
+		return "", errInvalidBucket
+	}
+	segments := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, s := range segments {
+		if s == "" || s == "." || s == ".." {
+			return "", errInvalidKey
+		}
+	}
+	return "/" + bucket + "/" + strings.Join(segments, "/"), nil
+}
+
+func (h *Handler) checkBucket(ctx context.Context, bucket string) error {
+	if bucket == "." || bucket == ".." {
+		return errInvalidBucket
+	}
+	fi, err := fsOf(ctx).Stat(ctx, "/"+bucket)
+	if errors.Is(err, os.ErrNotExist) || err == nil && !fi.IsDir() {
+		return errNoSuchBucket
+	}
+	return err
+}
+
+// mkdirAll creates the folders of dir that don't exist yet.
+func (h *Handler) mkdirAll(ctx context.Context, dir string) error {
+	p := ""
+	for _, name := range strings.Split(strings.Trim(dir, "/"), "/") {
+		p += "/" + name
+		err := fsOf(ctx).Mkdir(ctx, p, 0755)
+		if errors.Is(err, os.ErrExist) {
+			fi, statErr := fsOf(ctx).Stat(ctx, p)
+			if statErr != nil {
+				return statErr
+			}
+			if !fi.IsDir() {
+				return errKeyConflict
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether the folder name has no children.
+func (h *Handler) isEmpty(ctx context.Context, name string) (bool, error) {
+	f, err := fsOf(ctx).OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	entries, err := f.Readdir(1)
+	if err == io.EOF {
+		return true, nil
+	}
+	return len(entries) == 0, err
+}
+
+// etagOf returns the ETag davfs gives a file. It is not an MD5, so clients
+// don't try to compare it with one.
+func etagOf(ctx context.Context, fi os.FileInfo) string {
+	if fi.IsDir() {
+		return emptyETag
+	}
+	if e, ok := fi.(webdav.ETager); ok {
+		if tag, err := e.ETag(ctx); err == nil {
+			return tag
+		}
+	}
+	return fmt.Sprintf(`"%x-%x"`, fi.ModTime().UnixNano(), fi.Size())
+}
+
+// timestamp formats times the way S3 XML responses do.
+func timestamp(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listBucketsResult struct {
+	XMLName string        `xml:"ListAllMyBucketsResult"`
+	Xmlns   string        `xml:"xmlns,attr"`
+	Owner   owner         `xml:"Owner"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+func (h *Handler) listBuckets(w http.ResponseWriter, r *http.Request) {
+	root, err := fsOf(r.Context()).OpenFile(r.Context(), "/", os.O_RDONLY, 0)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	defer root.Close()
+	entries, err := root.Readdir(0)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	res := listBucketsResult{Xmlns: xmlns, Owner: owner{"teddrive", "teddrive"}, Buckets: []bucketEntry{}}
+	for _, fi := range entries {
+		if fi.IsDir() && !strings.Contains(fi.Name(), "/") {
+			res.Buckets = append(res.Buckets, bucketEntry{fi.Name(), timestamp(fi.ModTime())})
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+type locationResult struct {
+	XMLName string `xml:"LocationConstraint"`
+	Xmlns   string `xml:"xmlns,attr"`
+}
+
+func (h *Handler) bucketLocation(w http.ResponseWriter, r *http.Request, bucket string) {
+	if err := h.checkBucket(r.Context(), bucket); err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	// An empty constraint means us-east-1, which every client accepts.
+	writeXML(w, http.StatusOK, locationResult{Xmlns: xmlns})
+}
+
+func (h *Handler) createBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	io.Copy(io.Discard, r.Body) // CreateBucketConfiguration; the region is ignored
+	if bucket == "." || bucket == ".." {
+		writeError(w, r, errInvalidBucket, nil)
+		return
+	}
+	switch err := fsOf(r.Context()).Mkdir(r.Context(), "/"+bucket, 0755); {
+	case errors.Is(err, os.ErrExist):
+		writeError(w, r, errBucketExists, nil)
+	case err != nil:
+		writeError(w, r, err, nil)
+	default:
+		w.Header().Set("Location", "/"+bucket)
+	}
+}
+
+func (h *Handler) deleteBucket(w http.ResponseWriter, r *http.Request, bucket string) {
+	ctx := r.Context()
+	if err := h.checkBucket(ctx, bucket); err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	empty, err := h.isEmpty(ctx, "/"+bucket)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	if !empty {
+		writeError(w, r, errBucketNotEmpty, nil)
+		return
+	}
+	if err := fsOf(ctx).RemoveAll(ctx, "/"+bucket); err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *Handler) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	ctx := r.Context()
+	name, err := objectPath(bucket, key)
+	if err == nil {
+		err = h.checkBucket(ctx, bucket)
+	}
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	fi, err := fsOf(ctx).Stat(ctx, name)
+	if err == nil && fi.IsDir() != strings.HasSuffix(key, "/") {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		writeError(w, r, err, errNoSuchKey)
+		return
+	}
+
+	if r.URL.Query().Has("tagging") {
+		writeTagging(w, fi)
+		return
+	}
+	w.Header().Set("ETag", etagOf(ctx, fi))
+	w.Header().Set("Accept-Ranges", "bytes")
+	setLabels(w, fi)
+	if fi.IsDir() {
+		w.Header().Set("Content-Type", "application/x-directory")
+		w.Header().Set("Last-Modified", fi.ModTime().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", "0")
+		return
+	}
+	contentType := "application/octet-stream"
+	if ct, ok := fi.(webdav.ContentTyper); ok {
+		if v, err := ct.ContentType(ctx); err == nil {
+			contentType = v
+		}
+	}
+	// Setting the type keeps ServeContent from downloading a chunk to sniff it.
+	w.Header().Set("Content-Type", contentType)
+
+	f, err := fsOf(ctx).OpenFile(ctx, name, os.O_RDONLY, 0)
+	if err != nil {
+		writeError(w, r, err, errNoSuchKey)
+		return
+	}
+	defer f.Close()
+	http.ServeContent(w, r, "", fi.ModTime(), f)
+}
+
+// labeler is implemented by the file infos of davfs, for the tags and
+// metadata set through lib/tags.
+type labeler interface {
+	Labels() (tags []string, metadata map[string]string)
+}
+
+// setLabels sends an object's metadata as x-amz-meta-* headers, with
+// non-ASCII values encoded as RFC 2047 words like S3 does, and how many
+// tags it has. Keys that cannot be header names are left out.
+func setLabels(w http.ResponseWriter, fi os.FileInfo) {
+	l, ok := fi.(labeler)
+	if !ok {
+		return
+	}
+	tags, metadata := l.Labels()
+	for k, v := range metadata {
+		if validHeaderName(k) {
+			w.Header().Set("X-Amz-Meta-"+k, mime.QEncoding.Encode("utf-8", v))
+		}
+	}
+	if len(tags) > 0 {
+		w.Header().Set("X-Amz-Tagging-Count", fmt.Sprint(len(tags)))
+	}
+}
+
+func validHeaderName(s string) bool {
+	for _, c := range s {
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+type tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type taggingResult struct {
+	XMLName string `xml:"Tagging"`
+	Xmlns   string `xml:"xmlns,attr"`
+	TagSet  []tag  `xml:"TagSet>Tag"`
+}
+
+// writeTagging answers GetObjectTagging. Drive tags are labels without
+// values, so each is a key with an empty value.
+func writeTagging(w http.ResponseWriter, fi os.FileInfo) {
+	res := taggingResult{Xmlns: xmlns, TagSet: []tag{}}
+	if l, ok := fi.(labeler); ok {
+		tags, _ := l.Labels()
+		for _, t := range tags {
+			res.TagSet = append(res.TagSet, tag{Key: t})
+		}
+	}
+	writeXML(w, http.StatusOK, res)
+}
+
+func (h *Handler) putObject(w http.ResponseWriter, r *http.Request, sig *signature, bucket, key string) {
+	ctx := r.Context()
+	name, err := objectPath(bucket, key)
+	if err == nil {
+		err = h.checkBucket(ctx, bucket)
+	}
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	body, err := sig.payload(r)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	if strings.HasSuffix(key, "/") {
+		// A folder marker, as created by consoles and some sync tools.
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			writeError(w, r, err, nil)
+			return
+		}
+		if err := h.mkdirAll(ctx, name); err != nil {
+			writeError(w, r, err, nil)
+			return
+		}
+		w.Header().Set("ETag", emptyETag)
+		return
+	}
+
+	etag, err := h.store(ctx, name, body)
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+	w.Header().Set("ETag", etag)
+}
+
+// store writes body to the file name, creating its folders, and returns the
+// new ETag. If reading body fails the files row is left untouched.
+func (h *Handler) store(ctx context.Context, name string, body io.Reader) (string, error) {
+	if err := h.mkdirAll(ctx, path.Dir(name)); err != nil {
+		return "", err
+	}
+	f, err := fsOf(ctx).OpenFile(ctx, name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if errors.Is(err, os.ErrPermission) {
+		return "", errKeyConflict // a folder has this name
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		// Not closing f means the uploaded chunks are never referenced.
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	fi, err := fsOf(ctx).Stat(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return etagOf(ctx, fi), nil
+}
+
+func (h *Handler) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	ctx := r.Context()
+	name, err := objectPath(bucket, key)
+	if err == nil {
+		err = h.checkBucket(ctx, bucket)
+	}
+	if err != nil {
+		writeError(w, r, err, nil)
+		return
+	}
+
+	fi, err := fsOf(ctx).Stat(ctx, name)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Deleting a missing key succeeds in S3.
+	case err != nil:
+		writeError(w, r, err, nil)
+		return
+	case fi.IsDir():
+		// Only empty folders go away with their marker; S3 keeps the
+		// objects under a deleted marker, and so do we.
+		if !strings.HasSuffix(key, "/") {
+			break
+		}
+		empty, err := h.isEmpty(ctx, name)
+		if err == nil && empty {
+			err = fsOf(ctx).RemoveAll(ctx, name)
+		}
+		if err != nil {
+			writeError(w, r, err, nil)
+			return
+		}
+	case !strings.HasSuffix(key, "/"):
+		if err := fsOf(ctx).RemoveAll(ctx, name); err != nil {
+			writeError(w, r, err, nil)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,216 @@
+package s3gw
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigAlgorithm = "AWS4-HMAC-SHA256"
+	timeFormat   = "20060102T150405Z"
+
+	unsignedPayload        = "UNSIGNED-PAYLOAD"
+	streamingPayload       = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrail = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256            = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxSkew is how far the request time may be from the server's clock.
+	maxSkew = 15 * time.Minute
+	// maxPresignExpiry is the longest X-Amz-Expires AWS accepts.
+	maxPresignExpiry = 7 * 24 * time.Hour
+)
+
+// signature is a verified SigV4 signature. Streaming uploads chain each
+// payload chunk's signature onto it.
+type signature struct {
+	key         []byte // derived signing key
+	amzDate     string
+	scope       string
+	seed        string // the request signature
+	payloadHash string // x-amz-content-sha256
+}
+
+// authenticate checks the SigV4 signature of r, sent either in the
+// Authorization header or as a presigned URL, and returns the key it was
+// signed with.
+func (h *Handler) authenticate(r *http.Request) (*signature, *Key, error) {
+	q := r.URL.Query()
+	var (
+		credential, signedHeaders, sig, amzDate, payload string
+		expires                                          time.Duration
+		presigned                                        bool
+	)
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		if !strings.HasPrefix(authz, sigAlgorithm+" ") {
+			return nil, nil, errUnsupportedAuth
+		}
+		for _, field := range strings.Split(strings.TrimPrefix(authz, sigAlgorithm+" "), ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				signedHeaders = v
+			case "Signature":
+				sig = v
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			return nil, nil, errMissingPayloadHash
+		}
+	} else if q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != sigAlgorithm {
+			return nil, nil, errUnsupportedAuth
+		}
+		presigned = true
+		credential = q.Get("X-Amz-Credential")
+		signedHeaders = q.Get("X-Amz-SignedHeaders")
+		sig = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		payload = unsignedPayload
+		secs, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || secs <= 0 || time.Duration(secs)*time.Second > maxPresignExpiry {
+			return nil, nil, errAuthMalformed
+		}
+		expires = time.Duration(secs) * time.Second
+	} else {
+		return nil, nil, errAccessDenied
+	}
+
+	// Credential is <access key>/<yyyymmdd>/<region>/s3/aws4_request.
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signedHeaders == "" || sig == "" {
+		return nil, nil, errAuthMalformed
+	}
+	key, err := lookupKey(h.Client, parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := time.Parse(timeFormat, amzDate)
+	if err != nil || t.Format("20060102") != parts[1] {
+		return nil, nil, errAuthMalformed
+	}
+	now := time.Now()
+	if presigned {
+		if t.After(now.Add(maxSkew)) || now.After(t.Add(expires)) {
+			return nil, nil, errExpired
+		}
+	} else if t.Before(now.Add(-maxSkew)) || t.After(now.Add(maxSkew)) {
+		return nil, nil, errTimeSkewed
+	}
+
+	headers := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(headers) {
+		return nil, nil, errAuthMalformed
+	}
+	canonical := canonicalRequest(r, headers, payload, presigned)
+	scope := strings.Join(parts[1:], "/")
+	signing := signingKey(key.Secret, parts[1], parts[2])
+	want := hex.EncodeToString(hmacSHA256(signing, stringToSign(amzDate, scope, canonical)))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(sig)) != 1 {
+		return nil, nil, errSignature
+	}
+	return &signature{key: signing, amzDate: amzDate, scope: scope, seed: sig, payloadHash: payload}, key, nil
+}
+
+func canonicalRequest(r *http.Request, headers []string, payload string, presigned bool) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uriEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(r.URL.Query(), presigned))
+	b.WriteByte('\n')
+	for _, name := range headers {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(headerValue(r, name))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(headers, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payload)
+	return b.String()
+}
+
+func canonicalQuery(q url.Values, presigned bool) string {
+	var pairs []string
+	for k, vs := range q {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// headerValue returns a header as it appears in the canonical request:
+// values joined by commas, with runs of spaces squeezed.
+func headerValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if r.Header.Get("Content-Length") == "" && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	}
+	var vs []string
+	for _, v := range r.Header.Values(name) {
+		vs = append(vs, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(vs, ",")
+}
+
+// uriEncode escapes everything but the unreserved characters, as SigV4
+// requires. Slashes are kept in paths.
+func uriEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func stringToSign(amzDate, scope, canonical string) []byte {
+	sum := sha256.Sum256([]byte(canonical))
+	return []byte(sigAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:]))
+}
+
+func signingKey(secret, date, region string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	k = hmacSHA256(k, []byte(region))
+	k = hmacSHA256(k, []byte("s3"))
+	return hmacSHA256(k, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
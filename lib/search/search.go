@@ -0,0 +1,360 @@
+// Package search finds files and folders in a workspace by name, place,
+// type, size and modification time. With supabase/migrations/014_search.sql
+// applied the database ranks full-text, substring and fuzzy name matches;
+// without it Run falls back to substring matches in name order, reading
+// every match to count them.
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"teddrive-web/lib/acl"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/workspace"
+)
+
+// Page sizes.
+const (
+	DefaultLimit = 50
+	MaxLimit     = 200
+)
+
+// ErrPath is returned for a folder path that does not exist or that the
+// caller may not see.
+var ErrPath = errors.New("no such folder")
+
+// Query selects what to find. The zero value matches everything.
+type Query struct {
+	Text  string // words or part of a name
+	Fuzzy bool   // also match names spelled a little differently
+	// Folder limits the search to everything below a folder ID.
+	Folder string
+	Mime   string // MIME type prefix, such as "image/" or "application/pdf"
+	Type   string // files.type: video, image, audio or other
+	// MinSize and MaxSize bound file sizes in bytes; 0 is no bound.
+	MinSize, MaxSize int64
+	// After and Before bound the modification time; zero is no bound.
+	After, Before time.Time
+	// Tags and Metadata must all be on a match (lib/tags).
+	Tags          []string
+	Metadata      map[string]string
+	Limit, Offset int
+}
+
+// filesOnly reports whether the query has a filter only files can match.
+func (q *Query) filesOnly() bool {
+	return q.Mime != "" || q.Type != "" || q.MinSize > 0 || q.MaxSize > 0
+}
+
+// Result is one match, as search_drive returns it.
+type Result struct {
+	Kind      string            `json:"kind"` // "file" or "folder"
+	ID        string            `json:"id"`
+	Name      string            `json:"name"`
+	ParentID  *string           `json:"parent_id"`
+	Size      int64             `json:"size"`
+	Mime      string            `json:"mime"`
+	Type      string            `json:"type"`
+	UpdatedAt string            `json:"updated_at"`
+	Tags      []string          `json:"tags"`
+	Metadata  map[string]string `json:"metadata"`
+	Rank      float64           `json:"rank"`
+	Total     int               `json:"total"`
+	// Path is the folder the match is in, such as "/Projects/2024", as far
+	// up as the caller may see.
+	Path string `json:"-"`
+}
+
+// Page is one page of matches and how many there are on all pages.
+type Page struct {
+	Results []Result
+	Total   int
+}
+
+// Run returns the page of matches q asks for that the caller of a may
+// read.
+func Run(a *workspace.Access, q Query) (*Page, error) {
+	if q.Limit <= 0 {
+		q.Limit = DefaultLimit
+	}
+	if q.Limit > MaxLimit {
+		q.Limit = MaxLimit
+	}
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	q.Text = strings.TrimSpace(q.Text)
+
+	k, err := acl.New(a)
+	if err != nil {
+		return nil, err
+	}
+	if q.Folder != "" {
+		if err := k.Require("folders", q.Folder, acl.Read); err != nil {
+			return nil, err
+		}
+	}
+
+	var rows []Result
+	err = a.Client.RPC("search_drive", args(a, q), &rows)
+	if meta.MissingFunction(err) {
+		rows, err = scan(a.Client, k, q)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	page := &Page{Results: rows}
+	if len(rows) > 0 {
+		page.Total = rows[0].Total
+	} else if q.Offset > 0 {
+		// Past the last page: count the matches again from the start.
+		first := q
+		first.Limit, first.Offset = 1, 0
+		again, err := Run(a, first)
+		if err != nil {
+			return nil, err
+		}
+		page.Total = again.Total
+	}
+	if err := addPaths(a.Client, k, page.Results); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func args(a *workspace.Access, q Query) map[string]interface{} {
+	m := map[string]interface{}{
+		"p_workspace": nil, "p_user": nil, "p_role": a.Role,
+		"p_query": q.Text, "p_fuzzy": q.Fuzzy, "p_folder": nil,
+		"p_mime": nil, "p_type": nil, "p_min_size": nil, "p_max_size": nil,
+		"p_after": nil, "p_before": nil,
+		"p_limit": q.Limit, "p_offset": q.Offset,
+	}
+	set := func(key, v string) {
+		if v != "" {
+			m[key] = v
+		}
+	}
+	set("p_workspace", a.Client.Workspace)
+	set("p_user", a.UserID)
+	set("p_folder", q.Folder)
+	set("p_mime", q.Mime)
+	set("p_type", q.Type)
+	if q.MinSize > 0 {
+		m["p_min_size"] = q.MinSize
+	}
+	if q.MaxSize > 0 {
+		m["p_max_size"] = q.MaxSize
+	}
+	if !q.After.IsZero() {
+		m["p_after"] = q.After.UTC().Format(time.RFC3339)
+	}
+	if !q.Before.IsZero() {
+		m["p_before"] = q.Before.UTC().Format(time.RFC3339)
+	}
+	// Left out unless set, for databases without 015_tags.sql.
+	if len(q.Tags) > 0 {
+		m["p_tags"] = q.Tags
+	}
+	if len(q.Metadata) > 0 {
+		m["p_metadata"] = q.Metadata
+	}
+	return m
+}
+
+// scan is Run without the migration: PostgREST filters, then the access
+// list and the page in Go.
+func scan(c *meta.Client, k *acl.Checker, q Query) ([]Result, error) {
+	var in []string
+	if q.Folder != "" {
+		tree, err := c.GetTree(q.Folder)
+		if err != nil {
+			return nil, err
+		}
+		in = append(in, q.Folder)
+		for _, f := range tree.Folders {
+			in = append(in, f.Folder.ID)
+		}
+	}
+	common := func(parent string) url.Values {
+		v := url.Values{"order": {"name.asc"}}
+		if q.Text != "" {
+			v.Set("name", "ilike.*"+q.Text+"*")
+		}
+		if in != nil {
+			v.Set(parent, meta.In(in))
+		}
+		var and []string
+		if !q.After.IsZero() {
+			and = append(and, "updated_at.gte."+q.After.UTC().Format(time.RFC3339))
+		}
+		if !q.Before.IsZero() {
+			and = append(and, "updated_at.lte."+q.Before.UTC().Format(time.RFC3339))
+		}
+		if q.MinSize > 0 {
+			and = append(and, "size.gte."+strconv.FormatInt(q.MinSize, 10))
+		}
+		if q.MaxSize > 0 {
+			and = append(and, "size.lte."+strconv.FormatInt(q.MaxSize, 10))
+		}
+		if len(and) > 0 {
+			v.Set("and", "("+strings.Join(and, ",")+")")
+		}
+		if len(q.Tags) > 0 {
+			v.Set("tags", meta.Contains(q.Tags))
+		}
+		if len(q.Metadata) > 0 {
+			b, _ := json.Marshal(q.Metadata)
+			v.Set("metadata", "cs."+string(b))
+		}
+		return v
+	}
+
+	var rows []Result
+	if !q.filesOnly() {
+		folders, err := c.ListFolders(common("parent_id"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range folders {
+			rows = append(rows, Result{Kind: "folder", ID: f.ID, Name: f.Name, ParentID: f.ParentID, UpdatedAt: f.UpdatedAt,
+				Tags: f.Tags, Metadata: f.Metadata})
+		}
+	}
+	v := common("folder_id")
+	if q.Mime != "" {
+		v.Set("mime", "like."+q.Mime+"*")
+	}
+	if q.Type != "" {
+		v.Set("type", meta.Eq(q.Type))
+	}
+	files, err := c.ListFiles(v)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		rows = append(rows, Result{Kind: "file", ID: f.ID, Name: f.Name, ParentID: f.FolderID, Size: f.Size,
+			Mime: f.Mime, Type: f.Type, UpdatedAt: f.UpdatedAt, Tags: f.Tags, Metadata: f.Metadata})
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return strings.ToLower(rows[i].Name) < strings.ToLower(rows[j].Name)
+	})
+
+	readable := rows[:0]
+	for _, r := range rows {
+		table := "files"
+		if r.Kind == "folder" {
+			table = "folders"
+		}
+		level, err := k.Level(table, r.ID)
+		if err != nil {
+			return nil, err
+		}
+		if level != acl.Deny {
+			readable = append(readable, r)
+		}
+	}
+	total := len(readable)
+	if q.Offset >= total {
+		return nil, nil
+	}
+	readable = readable[q.Offset:]
+	if len(readable) > q.Limit {
+		readable = readable[:q.Limit]
+	}
+	for i := range readable {
+		readable[i].Total = total
+	}
+	return readable, nil
+}
+
+// addPaths fills in the Path of each result. A path stops below the first
+// folder up the chain the caller may not read, so it never names one.
+func addPaths(c *meta.Client, k *acl.Checker, rows []Result) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	folders, err := c.ListFolders(url.Values{"select": {"id,name,parent_id"}})
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]meta.Folder, len(folders))
+	for _, f := range folders {
+		byID[f.ID] = f
+	}
+	paths := map[string]string{"": ""}
+	var pathOf func(id string, depth int) (string, error)
+	pathOf = func(id string, depth int) (string, error) {
+		if p, ok := paths[id]; ok {
+			return p, nil
+		}
+		f, ok := byID[id]
+		if !ok || depth > 64 {
+			return "", nil
+		}
+		level, err := k.Level("folders", id)
+		if err != nil {
+			return "", err
+		}
+		if level == acl.Deny {
+			paths[id] = ""
+			return "", nil
+		}
+		parent := ""
+		if f.ParentID != nil {
+			if parent, err = pathOf(*f.ParentID, depth+1); err != nil {
+				return "", err
+			}
+		}
+		paths[id] = parent + "/" + f.Name
+		return paths[id], nil
+	}
+	for i := range rows {
+		parent := ""
+		if rows[i].ParentID != nil {
+			parent = *rows[i].ParentID
+		}
+		p, err := pathOf(parent, 0)
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			p = "/"
+		}
+		rows[i].Path = p
+	}
+	return nil
+}
+
+// FolderAt returns the ID of the folder at path, such as "/Projects/2024",
+// in the workspace c is confined to. "/" and "" are the top level, "".
+func FolderAt(c *meta.Client, path string) (string, error) {
+	id := ""
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		q := url.Values{"select": {"id"}, "name": {meta.Eq(name)}, "limit": {"1"}}
+		if id == "" {
+			q.Set("parent_id", "is.null")
+		} else {
+			q.Set("parent_id", meta.Eq(id))
+		}
+		rows, err := c.ListFolders(q)
+		if err != nil {
+			return "", err
+		}
+		if len(rows) == 0 {
+			return "", ErrPath
+		}
+		id = rows[0].ID
+	}
+	return id, nil
+}
@@ -0,0 +1,329 @@
+// Package share manages share links. Each link points at one file or one
+// folder (and everything below it) and can carry a password, an expiry
+// time and a download limit, and can be revoked. Links are enforced by
+// /api/share; the shares table is not readable with the browser's anon key.
+//
+// A link can also keep the decryption key out of the database: the browser
+// wraps the file key with a fresh share key, only the wrapped key is stored
+// here, and the share key travels in the URL fragment, which browsers never
+// send to the server. The file key itself is only handed to users who may
+// read the file (022_file_keys.sql), so in a workspace that is not public a
+// leak of this table does not expose the file.
+package share
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"time"
+
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+)
+
+const table = "shares"
+
+var (
+	// ErrGone is returned for links that are revoked, expired or used up.
+	ErrGone = errors.New("share link has expired or been revoked")
+	// ErrPassword is returned when the password is missing or wrong.
+	ErrPassword = errors.New("wrong password")
+	// ErrWrappedKey is returned by Create for a malformed wrapped key.
+	ErrWrappedKey = errors.New("invalid wrapped key")
+	// ErrFolderKey is returned when a folder link is asked to keep its key
+	// in the fragment; folder downloads are decrypted by the server.
+	ErrFolderKey = errors.New("folder links cannot keep the key in the link")
+)
+
+// Share mirrors a row of the shares table.
+type Share struct {
+	ID            string  `json:"id"`
+	FileID        string  `json:"file_id,omitempty"`
+	FolderID      string  `json:"folder_id,omitempty"`
+	PasswordHash  *string `json:"password_hash"`
+	ExpiresAt     *string `json:"expires_at"`
+	MaxDownloads  *int    `json:"max_downloads"`
+	DownloadCount int     `json:"download_count"`
+	RevokedAt     *string `json:"revoked_at"`
+	WrappedKey    *string `json:"wrapped_key"` // base64 nonce+ciphertext of the file key
+	CreatedAt     string  `json:"created_at,omitempty"`
+
+	// Legacy is set for links that only exist as files.share_id or
+	// folders.share_id.
+	Legacy bool `json:"-"`
+}
+
+// Options are the restrictions set when a link is created.
+type Options struct {
+	Password     string
+	ExpiresAt    *time.Time
+	MaxDownloads *int
+	// WrappedKey is the file key sealed with AES-GCM under a share key
+	// that only the link holder has. When set, the file key is never
+	// returned for this link.
+	WrappedKey string
+}
+
+// wrappedKeySize is a 12-byte nonce, a 32-byte key and a 16-byte tag.
+const wrappedKeySize = 12 + 32 + 16
+
+// Create makes a new share link for a file.
+func Create(c *meta.Client, fileID string, opts Options) (*Share, error) {
+	if _, err := c.GetFile(fileID); err != nil {
+		return nil, err
+	}
+	return insert(c, &Share{FileID: fileID}, opts)
+}
+
+// CreateFolder makes a new share link for a folder and its subtree.
+func CreateFolder(c *meta.Client, folderID string, opts Options) (*Share, error) {
+	if opts.WrappedKey != "" {
+		return nil, ErrFolderKey
+	}
+	if _, err := c.GetFolder(folderID); err != nil {
+		return nil, err
+	}
+	return insert(c, &Share{FolderID: folderID}, opts)
+}
+
+func insert(c *meta.Client, s *Share, opts Options) (*Share, error) {
+	s.ID = newID()
+	s.MaxDownloads = opts.MaxDownloads
+	if opts.Password != "" {
+		hash, err := auth.HashPassword(opts.Password)
+		if err != nil {
+			return nil, err
+		}
+		s.PasswordHash = &hash
+	}
+	if opts.WrappedKey != "" {
+		raw, err := base64.StdEncoding.DecodeString(opts.WrappedKey)
+		if err != nil || len(raw) != wrappedKeySize {
+			return nil, ErrWrappedKey
+		}
+		s.WrappedKey = &opts.WrappedKey
+	}
+	if opts.ExpiresAt != nil {
+		v := opts.ExpiresAt.UTC().Format(time.RFC3339)
+		s.ExpiresAt = &v
+	}
+
+	var rows []Share
+	if err := c.Insert(table, s, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		return &rows[0], nil
+	}
+	return s, nil
+}
+
+// Get looks up a link by ID. Links created before the shares table existed
+// are found through files.share_id or folders.share_id and have no
+// restrictions.
+func Get(c *meta.Client, id string) (*Share, error) {
+	var rows []Share
+	if err := c.Select(table, url.Values{"id": {meta.Eq(id)}}, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) > 0 {
+		return &rows[0], nil
+	}
+
+	files, err := c.ListFiles(url.Values{
+		"select":    {"id"},
+		"share_id":  {meta.Eq(id)},
+		"is_public": {"eq.true"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) > 0 {
+		return &Share{ID: id, FileID: files[0].ID, Legacy: true}, nil
+	}
+
+	folders, err := c.ListFolders(url.Values{
+		"select":    {"id"},
+		"share_id":  {meta.Eq(id)},
+		"is_public": {"eq.true"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(folders) > 0 {
+		return &Share{ID: id, FolderID: folders[0].ID, Legacy: true}, nil
+	}
+	return nil, meta.ErrNotFound
+}
+
+// List returns the links for a file, newest first.
+func List(c *meta.Client, fileID string) ([]Share, error) {
+	return list(c, "file_id", fileID)
+}
+
+// ListFolder returns the links for a folder, newest first.
+func ListFolder(c *meta.Client, folderID string) ([]Share, error) {
+	return list(c, "folder_id", folderID)
+}
+
+func list(c *meta.Client, column, id string) ([]Share, error) {
+	var rows []Share
+	err := c.Select(table, url.Values{
+		column:  {meta.Eq(id)},
+		"order": {"created_at.desc"},
+	}, &rows)
+	return rows, err
+}
+
+// Revoke disables a link for good. Legacy links are revoked by clearing
+// the share_id of their file or folder.
+func Revoke(c *meta.Client, s *Share) error {
+	if s.Legacy {
+		target, id := "files", s.FileID
+		if s.IsFolder() {
+			target, id = "folders", s.FolderID
+		}
+		return c.Update(target, url.Values{"id": {meta.Eq(id)}},
+			map[string]interface{}{"share_id": nil, "is_public": false}, nil)
+	}
+	return c.Update(table, url.Values{"id": {meta.Eq(s.ID)}},
+		map[string]interface{}{"revoked_at": time.Now().UTC().Format(time.RFC3339)}, nil)
+}
+
+// Active reports whether the link can still be used.
+func (s *Share) Active() bool {
+	if s.RevokedAt != nil {
+		return false
+	}
+	if expired(s) {
+		return false
+	}
+	if s.MaxDownloads != nil && s.DownloadCount >= *s.MaxDownloads {
+		return false
+	}
+	return true
+}
+
+func expired(s *Share) bool {
+	if s.ExpiresAt == nil {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, *s.ExpiresAt)
+	return err == nil && !time.Now().Before(t)
+}
+
+// IsFolder reports whether the link shares a folder rather than a file.
+func (s *Share) IsFolder() bool {
+	return s.FolderID != ""
+}
+
+// NeedsPassword reports whether the link is password protected.
+func (s *Share) NeedsPassword() bool {
+	return s.PasswordHash != nil && *s.PasswordHash != ""
+}
+
+// KeyInLink reports whether the decryption key is carried in the link's
+// fragment instead of being handed out by the server.
+func (s *Share) KeyInLink() bool {
+	return s.WrappedKey != nil && *s.WrappedKey != ""
+}
+
+// DownloadsLeft returns the remaining downloads, or nil when unlimited.
+func (s *Share) DownloadsLeft() *int {
+	if s.MaxDownloads == nil {
+		return nil
+	}
+	left := *s.MaxDownloads - s.DownloadCount
+	if left < 0 {
+		left = 0
+	}
+	return &left
+}
+
+// Check verifies that the link is usable with the given password without
+// counting a download.
+func Check(s *Share, password string) error {
+	if s.Legacy {
+		return nil
+	}
+	if !s.Active() {
+		return ErrGone
+	}
+	if s.NeedsPassword() && !auth.CheckPassword(*s.PasswordHash, password) {
+		return ErrPassword
+	}
+	return nil
+}
+
+// Use is Check plus counting one download.
+func Use(c *meta.Client, s *Share, password string) error {
+	if err := Check(s, password); err != nil || s.Legacy {
+		return err
+	}
+	// Count the download in the database so concurrent requests can't go
+	// over the limit.
+	var used []Share
+	if err := c.RPC("use_share", map[string]string{"p_id": s.ID}, &used); err != nil {
+		return err
+	}
+	if len(used) == 0 {
+		return ErrGone
+	}
+	*s = used[0]
+	return nil
+}
+
+// Open checks the password and counts one download. It is the only way to
+// get at the file behind a file link.
+func Open(c *meta.Client, s *Share, password string) (*meta.File, error) {
+	if err := Use(c, s, password); err != nil {
+		return nil, err
+	}
+	return c.GetFile(s.FileID)
+}
+
+// Tree checks the password and returns the shared folder's subtree. It
+// does not count a download.
+func Tree(c *meta.Client, s *Share, password string) (*meta.Tree, error) {
+	if err := Check(s, password); err != nil {
+		return nil, err
+	}
+	return c.GetTree(s.FolderID)
+}
+
+// File returns the file a link gives access to, for fetching the chunks
+// of a download Open or Use already counted: fileID is the shared file, or
+// one in the shared folder. It checks the password but counts nothing, and
+// a download limit reached by that very download does not stop it.
+func File(c *meta.Client, s *Share, password, fileID string) (*meta.File, error) {
+	if !s.Legacy {
+		if s.RevokedAt != nil || expired(s) {
+			return nil, ErrGone
+		}
+		if s.NeedsPassword() && !auth.CheckPassword(*s.PasswordHash, password) {
+			return nil, ErrPassword
+		}
+	}
+	if !s.IsFolder() {
+		if fileID != s.FileID {
+			return nil, meta.ErrNotFound
+		}
+		return c.GetFile(fileID)
+	}
+	t, err := c.GetTree(s.FolderID)
+	if err != nil {
+		return nil, err
+	}
+	tf := t.Find(fileID)
+	if tf == nil {
+		return nil, meta.ErrNotFound
+	}
+	return &tf.File, nil
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "s_" + base64.RawURLEncoding.EncodeToString(b)
+}
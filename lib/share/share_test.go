@@ -0,0 +1,275 @@
+package share
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/meta/metatest"
+)
+
+// fixture is a drive with a file at the top, a folder "docs" with a file
+// and a subfolder "old" with one more, and the shares table.
+func fixture(t *testing.T) (*metatest.Server, *meta.Client) {
+	s := metatest.New(t)
+	s.Table("files", "id")
+	s.Table("folders", "id")
+	s.Table("shares", "id")
+	s.Add("folders",
+		metatest.Row{"id": "docs", "name": "docs", "parent_id": nil},
+		metatest.Row{"id": "old", "name": "old", "parent_id": "docs"},
+	)
+	s.Add("files",
+		metatest.Row{"id": "top", "name": "top.txt", "size": 3, "folder_id": nil},
+		metatest.Row{"id": "a", "name": "a.txt", "size": 1, "folder_id": "docs"},
+		metatest.Row{"id": "b", "name": "b.txt", "size": 2, "folder_id": "old"},
+	)
+	// use_share as in supabase/migrations/003_shares.sql.
+	s.Func("use_share", func(args map[string]interface{}) (interface{}, error) {
+		return s.Update("shares", func(r metatest.Row) bool {
+			if r["id"] != args["p_id"] || r["revoked_at"] != nil {
+				return false
+			}
+			count, _ := r["download_count"].(float64)
+			if max, ok := r["max_downloads"].(float64); ok && count >= max {
+				return false
+			}
+			r["download_count"] = count + 1
+			return true
+		}), nil
+	})
+	return s, s.Client()
+}
+
+func ptr[T any](v T) *T { return &v }
+
+func TestCheck(t *testing.T) {
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	h, err := auth.HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := &h
+
+	tests := []struct {
+		name     string
+		share    Share
+		password string
+		want     error
+	}{
+		{name: "open", share: Share{}},
+		{name: "revoked", share: Share{RevokedAt: &past}, want: ErrGone},
+		{name: "expired", share: Share{ExpiresAt: &past}, want: ErrGone},
+		{name: "not expired yet", share: Share{ExpiresAt: &future}},
+		{name: "downloads left", share: Share{MaxDownloads: ptr(2), DownloadCount: 1}},
+		{name: "used up", share: Share{MaxDownloads: ptr(2), DownloadCount: 2}, want: ErrGone},
+		{name: "right password", share: Share{PasswordHash: hash}, password: "hunter2"},
+		{name: "wrong password", share: Share{PasswordHash: hash}, password: "hunter3", want: ErrPassword},
+		{name: "no password", share: Share{PasswordHash: hash}, want: ErrPassword},
+		{name: "gone before password", share: Share{PasswordHash: hash, RevokedAt: &past}, want: ErrGone},
+		{name: "legacy", share: Share{Legacy: true, RevokedAt: &past, PasswordHash: hash}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Check(&tt.share, tt.password); err != tt.want {
+				t.Errorf("Check = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDownloadsLeft(t *testing.T) {
+	tests := []struct {
+		max, count int
+		want       int
+	}{
+		{3, 0, 3},
+		{3, 2, 1},
+		{3, 3, 0},
+		{3, 5, 0},
+	}
+	for _, tt := range tests {
+		s := Share{MaxDownloads: ptr(tt.max), DownloadCount: tt.count}
+		if got := s.DownloadsLeft(); got == nil || *got != tt.want {
+			t.Errorf("DownloadsLeft(%d of %d) = %v, want %d", tt.count, tt.max, got, tt.want)
+		}
+	}
+	if got := (&Share{}).DownloadsLeft(); got != nil {
+		t.Errorf("DownloadsLeft without a limit = %d, want nil", *got)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	_, c := fixture(t)
+	wrapped := base64.StdEncoding.EncodeToString(make([]byte, wrappedKeySize))
+	s, err := Create(c, "top", Options{WrappedKey: wrapped, MaxDownloads: ptr(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(s.ID, "s_") || s.FileID != "top" || !s.KeyInLink() {
+		t.Errorf("Create = %+v", s)
+	}
+	got, err := Get(c, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FileID != "top" || got.MaxDownloads == nil || *got.MaxDownloads != 1 || got.Legacy {
+		t.Errorf("Get = %+v", got)
+	}
+
+	bad := []string{"not base64!", base64.StdEncoding.EncodeToString(make([]byte, wrappedKeySize-1))}
+	for _, key := range bad {
+		if _, err := Create(c, "top", Options{WrappedKey: key}); err != ErrWrappedKey {
+			t.Errorf("Create with wrapped key %q = %v, want ErrWrappedKey", key, err)
+		}
+	}
+	if _, err := CreateFolder(c, "docs", Options{WrappedKey: wrapped}); err != ErrFolderKey {
+		t.Errorf("CreateFolder with a wrapped key = %v, want ErrFolderKey", err)
+	}
+	if _, err := Create(c, "nope", Options{}); !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("Create for a missing file = %v, want ErrNotFound", err)
+	}
+	if _, err := Get(c, "s_nope"); !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("Get of a missing link = %v, want ErrNotFound", err)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	srv, c := fixture(t)
+	srv.Update("files", func(r metatest.Row) bool {
+		if r["id"] != "a" {
+			return false
+		}
+		r["share_id"], r["is_public"] = "old-link", true
+		return true
+	})
+	s, err := Get(c, "old-link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Legacy || s.FileID != "a" {
+		t.Fatalf("Get = %+v, want the legacy link to a", s)
+	}
+	if err := Revoke(c, s); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(c, "old-link"); !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("Get after Revoke = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	_, c := fixture(t)
+	s, err := Create(c, "top", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Revoke(c, s); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Get(c, s.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(s, ""); err != ErrGone {
+		t.Errorf("Check after Revoke = %v, want ErrGone", err)
+	}
+	if _, err := Open(c, s, ""); err != ErrGone {
+		t.Errorf("Open after Revoke = %v, want ErrGone", err)
+	}
+}
+
+func TestOpenCountsDownloads(t *testing.T) {
+	srv, c := fixture(t)
+	s, err := Create(c, "top", Options{MaxDownloads: ptr(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		f, err := Open(c, s, "")
+		if err != nil {
+			t.Fatalf("download %d: %v", i, err)
+		}
+		if f.ID != "top" || s.DownloadCount != i {
+			t.Errorf("download %d: file %s, count %d", i, f.ID, s.DownloadCount)
+		}
+	}
+	if _, err := Open(c, s, ""); err != ErrGone {
+		t.Errorf("third download = %v, want ErrGone", err)
+	}
+
+	// Another request holding the link from before the last download is
+	// stopped by the database, not by its stale copy.
+	stale, err := Create(c, "top", Options{MaxDownloads: ptr(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := *stale
+	if _, err := Open(c, stale, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(c, &copied, ""); err != ErrGone {
+		t.Errorf("download over the limit = %v, want ErrGone", err)
+	}
+	for _, r := range srv.Rows("shares") {
+		if r["id"] == stale.ID && r["download_count"] != float64(1) {
+			t.Errorf("download_count = %v, want 1", r["download_count"])
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	_, c := fixture(t)
+	folder, err := CreateFolder(c, "docs", Options{MaxDownloads: ptr(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := Create(c, "top", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		share  *Share
+		fileID string
+		want   error
+	}{
+		{name: "shared file", share: file, fileID: "top"},
+		{name: "other file", share: file, fileID: "a", want: meta.ErrNotFound},
+		{name: "in folder", share: folder, fileID: "a"},
+		{name: "in subfolder", share: folder, fileID: "b"},
+		{name: "outside folder", share: folder, fileID: "top", want: meta.ErrNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := File(c, tt.share, "", tt.fileID)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("File = %v, want %v", err, tt.want)
+			}
+			if err == nil && f.ID != tt.fileID {
+				t.Errorf("File returned %s", f.ID)
+			}
+		})
+	}
+
+	// The download that used the last one still fetches its chunks.
+	if err := Use(c, folder, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := File(c, folder, "", "b"); err != nil {
+		t.Errorf("File after the last download = %v", err)
+	}
+	if err := Revoke(c, folder); err != nil {
+		t.Fatal(err)
+	}
+	folder, _ = Get(c, folder.ID)
+	if _, err := File(c, folder, "", "b"); err != ErrGone {
+		t.Errorf("File after Revoke = %v, want ErrGone", err)
+	}
+}
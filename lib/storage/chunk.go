@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ProviderOf works out which provider stored a meta_links entry. Links are
+// not always on the file's meta_provider: the browser falls back to the other
+// provider when an upload fails.
+func ProviderOf(link string) string {
+	switch {
+	case strings.HasPrefix(link, `{"cdc"`):
+		return DedupProvider
+	case strings.HasPrefix(link, "{"):
+		return ErasureProvider
+	case strings.HasPrefix(link, "http://"), strings.HasPrefix(link, "https://"):
+		return "discord"
+	default:
+		return "telegram"
+	}
+}
+
+// ChunkSize returns the plaintext size of every chunk but the last for files
+// uploaded with provider, matching the web app's upload sizes. Dedup and
+// erasure files use the same 8MB windows as Discord.
+func ChunkSize(provider string) int {
+	if provider == "telegram" {
+		return 50 << 20
+	}
+	return 8 << 20
+}
+
+// StoredSize returns the bytes the providers end up holding for an
+// encrypted chunk of n bytes uploaded with provider: n, or every shard of
+// an erasure stripe.
+func StoredSize(provider string, n int) int64 {
+	if provider == ErasureProvider {
+		k, m := ErasureConfig()
+		return int64(k+m) * int64((n+k-1)/k)
+	}
+	return int64(n)
+}
+
+// BackendFor returns the backend for provider, posting to target or to the
+// default channel/chat from the environment when target is empty.
+func BackendFor(provider, target string) (Backend, error) {
+	switch provider {
+	case "discord":
+		token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+		if target == "" {
+			target = strings.TrimSpace(os.Getenv("DISCORD_CHANNEL_ID"))
+		}
+		if token == "" || target == "" {
+			return nil, fmt.Errorf("Discord not configured - missing environment variables")
+		}
+		return NewDiscord(token, target), nil
+	case "telegram":
+		token := strings.TrimSpace(os.Getenv("TELEGRAM_BOT_TOKEN"))
+		if target == "" {
+			target = strings.TrimSpace(os.Getenv("TELEGRAM_CHAT_ID"))
+		}
+		if token == "" || target == "" {
+			return nil, fmt.Errorf("Telegram not configured - missing environment variables")
+		}
+		return NewTelegram(token, target), nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", provider)
+}
+
+// PutChunk stores one encrypted chunk and returns its meta_links entry.
+// For the erasure provider target is ignored and the shards are spread over
+// every configured backend.
+func PutChunk(provider, target, fileName string, data []byte, index int) (string, error) {
+	link, _, err := Put(provider, target, fileName, data, index)
+	return link, err
+}
+
+// Put is PutChunk that also returns the messages the chunk was posted in:
+// one, or one per shard for erasure stripes.
+func Put(provider, target, fileName string, data []byte, index int) (string, []Locator, error) {
+	if provider == ErasureProvider {
+		return PutStripe(Backends(), fileName, data, index)
+	}
+
+	backend, err := BackendFor(provider, target)
+	if err != nil {
+		return "", nil, err
+	}
+	loc, err := backend.Upload(fileName, data)
+	if err != nil {
+		return "", nil, err
+	}
+	return loc.Ref, []Locator{loc}, nil
+}
+
+// PutStripe stores one encrypted chunk erasure-coded across backends and
+// returns its meta_links entry.
+func PutStripe(backends []Backend, fileName string, data []byte, index int) (string, []Locator, error) {
+	k, m := ErasureConfig()
+	stripe, err := UploadStripe(backends, fileName, data, k, m, index)
+	if err != nil {
+		return "", nil, err
+	}
+	return stripe.String(), stripe.Shards, nil
+}
+
+// GetChunk downloads one encrypted chunk given its meta_links entry. Dedup
+// groups are not chunks of their own; read them with lib/dedup.
+func GetChunk(link string) ([]byte, error) {
+	switch ProviderOf(link) {
+	case DedupProvider:
+		return nil, fmt.Errorf("dedup chunk groups must be read through the chunk index")
+	case ErasureProvider:
+		stripe, err := ParseStripe(link)
+		if err != nil {
+			return nil, err
+		}
+		return ReadStripe(stripe)
+	}
+	return Fetch(ProviderOf(link), link)
+}
+
+// OnTarget reports whether a meta_links entry has data on the given
+// provider/target. Telegram file_ids do not record their chat, so only the
+// provider can be matched for them.
+func OnTarget(link, provider, target string) bool {
+	switch ProviderOf(link) {
+	case DedupProvider:
+		return false
+	case ErasureProvider:
+		stripe, err := ParseStripe(link)
+		if err != nil {
+			return false
+		}
+		for _, loc := range stripe.Shards {
+			if loc.Provider == provider && (target == "" || loc.Target == target) {
+				return true
+			}
+		}
+		return false
+	case "discord":
+		// https://cdn.discordapp.com/attachments/<channel>/<attachment>/<name>
+		return provider == "discord" && (target == "" || strings.Contains(link, "/attachments/"+target+"/"))
+	default:
+		return provider == "telegram"
+	}
+}
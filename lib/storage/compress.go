@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunks are at most 50MB; refuse to inflate past a safe margin of that.
+const maxDecompressed = 64 << 20
+
+var (
+	encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	sampler, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	decoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressed), zstd.WithDecoderConcurrency(0))
+)
+
+// Extensions of formats that are already compressed. Chunks of these files
+// are stored as-is without trying.
+var compressedExts = map[string]bool{
+	".7z": true, ".aac": true, ".avi": true, ".br": true, ".bz2": true,
+	".docx": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true,
+	".jar": true, ".jpeg": true, ".jpg": true, ".m4a": true, ".m4v": true,
+	".mkv": true, ".mov": true, ".mp3": true, ".mp4": true, ".ogg": true,
+	".opus": true, ".png": true, ".pptx": true, ".rar": true, ".tgz": true,
+	".webm": true, ".webp": true, ".xlsx": true, ".xz": true, ".zip": true,
+	".zst": true,
+}
+
+const (
+	sampleSize = 64 << 10
+	// Give up if a sample shrinks by less than this much...
+	sampleRatio = 0.90
+	// ...or if the whole chunk does.
+	minSavings = 0.05
+)
+
+// compress returns the zstd form of data when it is worth storing instead.
+func compress(data []byte, fileName string) ([]byte, bool) {
+	if compressedExts[strings.ToLower(path.Ext(fileName))] {
+		return nil, false
+	}
+
+	if len(data) > sampleSize {
+		sample := sampler.EncodeAll(data[:sampleSize], nil)
+		if float64(len(sample)) > sampleRatio*sampleSize {
+			return nil, false
+		}
+	}
+
+	out := encoder.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if float64(len(out)) > (1-minSavings)*float64(len(data)) {
+		return nil, false
+	}
+	return out, true
+}
+
+func decompress(data []byte) ([]byte, error) {
+	return decoder.DecodeAll(data, nil)
+}
@@ -0,0 +1,101 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+)
+
+// Compressed chunks start with a 4-byte header, "TDC" plus a flags byte,
+// before the usual nonce+ciphertext. The header is authenticated as GCM
+// additional data so the flags can't be altered. Uncompressed chunks keep the
+// original header-less layout, so older readers still handle them.
+var chunkMagic = []byte("TDC")
+
+const (
+	chunkHeaderSize = 4
+	flagZstd        = 1 << 0
+)
+
+// SealOverhead is what SealChunk adds to every chunk: the 12-byte nonce and
+// the 16-byte GCM tag.
+const SealOverhead = 12 + 16
+
+// SealChunk encrypts a chunk with AES-256-GCM and returns nonce+ciphertext,
+// the layout the browser expects when it decrypts downloads.
+func SealChunk(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// SealCompressed zstd-compresses a chunk before encrypting it, unless the
+// file name or a sample of the data says it won't shrink, in which case it
+// falls back to SealChunk.
+func SealCompressed(key, plaintext []byte, fileName string) ([]byte, error) {
+	compressed, ok := compress(plaintext, fileName)
+	if !ok {
+		return SealChunk(key, plaintext)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := append(append([]byte(nil), chunkMagic...), flagZstd)
+	out := make([]byte, chunkHeaderSize+gcm.NonceSize(), chunkHeaderSize+gcm.NonceSize()+len(compressed)+gcm.Overhead())
+	copy(out, header)
+	nonce := out[chunkHeaderSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	fmt.Printf("[COMPRESS] %d -> %d bytes\n", len(plaintext), len(compressed))
+	return gcm.Seal(out, nonce, compressed, header), nil
+}
+
+// OpenChunk reverses SealChunk and SealCompressed.
+func OpenChunk(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) >= chunkHeaderSize+gcm.NonceSize() && bytes.HasPrefix(data, chunkMagic) {
+		header := data[:chunkHeaderSize]
+		nonce := data[chunkHeaderSize : chunkHeaderSize+gcm.NonceSize()]
+		plain, err := gcm.Open(nil, nonce, data[chunkHeaderSize+gcm.NonceSize():], header)
+		if err == nil {
+			if header[3]&flagZstd != 0 {
+				return decompress(plain)
+			}
+			return plain, nil
+		}
+		// A legacy chunk whose random nonce happens to start with the
+		// magic; fall through.
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("chunk is too small (%d bytes), expected at least %d (nonce)", len(data), gcm.NonceSize())
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid key length %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
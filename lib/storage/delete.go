@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUndeletable is returned when the provider refuses to ever delete a
+// message, such as a Telegram message older than 48 hours in a chat where
+// the bot may not delete other messages.
+var ErrUndeletable = errors.New("the provider does not allow deleting this message")
+
+// ErrNoMessage is returned by FindDiscordMessage when no message it can see
+// holds the attachment.
+var ErrNoMessage = errors.New("no Discord message found for this attachment")
+
+// DeleteMessage deletes the message that holds a stored object. A message
+// that is already gone counts as deleted.
+func DeleteMessage(loc Locator) error {
+	if loc.MessageID == "" || loc.Target == "" {
+		return fmt.Errorf("no message recorded for %s object %s", loc.Provider, loc.Ref)
+	}
+	switch loc.Provider {
+	case "discord":
+		token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+		if token == "" {
+			return fmt.Errorf("DISCORD_BOT_TOKEN missing in Env")
+		}
+		u := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages/%s", loc.Target, loc.MessageID)
+		status, body, err := discordCall(token, "DELETE", u)
+		if err != nil {
+			return err
+		}
+		if status == http.StatusNotFound || status == http.StatusNoContent || status == http.StatusOK {
+			return nil
+		}
+		return fmt.Errorf("Discord API error %d: %s", status, body)
+
+	case "telegram":
+		token := strings.TrimSpace(os.Getenv("TELEGRAM_BOT_TOKEN"))
+		if token == "" {
+			return fmt.Errorf("TELEGRAM_BOT_TOKEN missing in Env")
+		}
+		resp, err := http.PostForm(fmt.Sprintf("https://api.telegram.org/bot%s/deleteMessage", token), url.Values{
+			"chat_id":    {loc.Target},
+			"message_id": {loc.MessageID},
+		})
+		if err != nil {
+			return fmt.Errorf("HTTP request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var result struct {
+			OK          bool   `json:"ok"`
+			Description string `json:"description"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		switch {
+		case result.OK, strings.Contains(result.Description, "message to delete not found"):
+			return nil
+		case strings.Contains(result.Description, "message can't be deleted"):
+			return ErrUndeletable
+		}
+		return fmt.Errorf("Telegram API error %d: %s", resp.StatusCode, result.Description)
+	}
+	return fmt.Errorf("unknown provider %q", loc.Provider)
+}
+
+// FindDiscordMessage finds the message a Discord attachment URL belongs
+// to, for uploads made before their message was recorded. The URL only
+// names the channel and the attachment, but an attachment's ID is taken
+// within moments of its message's, so the message is usually among the
+// ones around it. When it is not, or the channel cannot be read, the
+// message may well still exist, so that is an error rather than a
+// locator without a message.
+func FindDiscordMessage(link string) (Locator, error) {
+	// https://cdn.discordapp.com/attachments/<channel>/<attachment>/<name>
+	u, err := url.Parse(link)
+	if err != nil {
+		return Locator{}, err
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 3 || parts[0] != "attachments" {
+		return Locator{}, fmt.Errorf("not a Discord attachment URL: %s", link)
+	}
+	channelID, attachmentID := parts[1], parts[2]
+
+	token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN"))
+	if token == "" {
+		return Locator{}, fmt.Errorf("DISCORD_BOT_TOKEN missing in Env")
+	}
+	api := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages?around=%s&limit=100", channelID, attachmentID)
+	status, body, err := discordCall(token, "GET", api)
+	if err != nil {
+		return Locator{}, err
+	}
+	if status != http.StatusOK {
+		return Locator{}, fmt.Errorf("Discord API error %d: %s", status, body)
+	}
+	var messages []struct {
+		ID          string `json:"id"`
+		Attachments []struct {
+			ID string `json:"id"`
+		} `json:"attachments"`
+	}
+	if err := json.Unmarshal(body, &messages); err != nil {
+		return Locator{}, fmt.Errorf("Failed to parse Discord response: %v", err)
+	}
+	for _, m := range messages {
+		for _, a := range m.Attachments {
+			if a.ID == attachmentID {
+				return Locator{Provider: "discord", Target: channelID, MessageID: m.ID, Ref: link}, nil
+			}
+		}
+	}
+	return Locator{}, fmt.Errorf("%w: %s", ErrNoMessage, link)
+}
+
+// discordCall makes a bot API request, waiting out rate limits a few times.
+func discordCall(token, method, u string) (int, []byte, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		req.Header.Set("Authorization", "Bot "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, nil, fmt.Errorf("HTTP request failed: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || attempt == 3 {
+			return resp.StatusCode, body, nil
+		}
+		wait, _ := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64)
+		if wait <= 0 || wait > 10 {
+			wait = 1
+		}
+		time.Sleep(time.Duration(wait * float64(time.Second)))
+	}
+}
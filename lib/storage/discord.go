@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+)
+
+type discordBackend struct {
+	token     string
+	channelID string
+}
+
+// NewDiscord returns a backend that posts attachments to a Discord channel.
+func NewDiscord(token, channelID string) Backend {
+	return &discordBackend{token: token, channelID: channelID}
+}
+
+func (d *discordBackend) Provider() string { return "discord" }
+func (d *discordBackend) Target() string   { return d.channelID }
+
+func (d *discordBackend) Upload(fileName string, data []byte) (Locator, error) {
+	fmt.Printf("[DISCORD] Starting upload: %d bytes\n", len(data))
+
+	url := fmt.Sprintf("https://discord.com/api/v10/channels/%s/messages", d.channelID)
+
+	// Create multipart
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("files[0]", CleanName(fileName)+".bin")
+	if err != nil {
+		return Locator{}, err
+	}
+
+	part.Write(data)
+	writer.Close()
+
+	// Create request
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return Locator{}, err
+	}
+
+	req.Header.Set("Authorization", "Bot "+d.token)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	// Make request with longer timeout for large files
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Locator{}, fmt.Errorf("HTTP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	fmt.Printf("[DISCORD] Response Status: %d\n", resp.StatusCode)
+	fmt.Printf("[DISCORD] Response Body: %s\n", string(respBody))
+
+	if resp.StatusCode == 401 {
+		return Locator{}, fmt.Errorf("Discord bot token invalid or expired. Please check DISCORD_BOT_TOKEN")
+	}
+
+	if resp.StatusCode == 403 {
+		return Locator{}, fmt.Errorf("Discord bot lacks permissions. Check bot permissions in channel %s", d.channelID)
+	}
+
+	if resp.StatusCode == 429 {
+		return Locator{}, fmt.Errorf("Discord rate limit exceeded. Please wait and try again")
+	}
+
+	if resp.StatusCode != 200 {
+		return Locator{}, fmt.Errorf("Discord API error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	// Parse response
+	var result struct {
+		ID          string `json:"id"`
+		Attachments []struct {
+			URL string `json:"url"`
+		} `json:"attachments"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return Locator{}, fmt.Errorf("Failed to parse Discord response: %v", err)
+	}
+
+	// Get attachment URL
+	if len(result.Attachments) == 0 || result.Attachments[0].URL == "" {
+		return Locator{}, fmt.Errorf("No attachment URL in Discord response")
+	}
+
+	return Locator{
+		Provider:  "discord",
+		Target:    d.channelID,
+		MessageID: result.ID,
+		Ref:       result.Attachments[0].URL,
+	}, nil
+}
@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// ErasureProvider is the meta_provider value for erasure-coded files.
+const ErasureProvider = "erasure"
+
+// DedupProvider is the meta_provider value for files stored as shared
+// content-defined chunks (see lib/dedup).
+const DedupProvider = "dedup"
+
+// Stripe describes one erasure-coded chunk: k data shards plus m parity
+// shards, each stored on a different target where possible. Any k shards
+// are enough to rebuild the chunk. It is stored JSON-encoded as the chunk's
+// entry in meta_links.
+type Stripe struct {
+	Version int       `json:"v"`
+	Data    int       `json:"k"`
+	Parity  int       `json:"m"`
+	Size    int       `json:"size"`
+	Shards  []Locator `json:"shards"`
+	Sums    []string  `json:"sums"` // hex SHA-256 per shard
+}
+
+// ErasureConfig reads ERASURE_DATA_SHARDS and ERASURE_PARITY_SHARDS,
+// defaulting to 4+2.
+func ErasureConfig() (k, m int) {
+	k, m = 4, 2
+	if v, err := strconv.Atoi(strings.TrimSpace(os.Getenv("ERASURE_DATA_SHARDS"))); err == nil && v > 0 {
+		k = v
+	}
+	if v, err := strconv.Atoi(strings.TrimSpace(os.Getenv("ERASURE_PARITY_SHARDS"))); err == nil && v > 0 {
+		m = v
+	}
+	return k, m
+}
+
+// ParseStripe decodes a meta_links entry written by UploadStripe.
+func ParseStripe(link string) (*Stripe, error) {
+	var s Stripe
+	if err := json.Unmarshal([]byte(link), &s); err != nil {
+		return nil, fmt.Errorf("invalid stripe: %v", err)
+	}
+	if s.Data <= 0 || s.Parity < 0 || len(s.Shards) != s.Data+s.Parity || len(s.Sums) != len(s.Shards) {
+		return nil, fmt.Errorf("invalid stripe: %d shards for %d+%d", len(s.Shards), s.Data, s.Parity)
+	}
+	return &s, nil
+}
+
+// StoredSize returns the bytes the shards take up together.
+func (s *Stripe) StoredSize() int64 {
+	return int64(len(s.Shards)) * int64((s.Size+s.Data-1)/s.Data)
+}
+
+// String returns the JSON form stored in meta_links.
+func (s *Stripe) String() string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// UploadStripe splits data into k+m shards and uploads them across
+// backends, starting at backends[offset%len(backends)] so consecutive chunks
+// rotate their placement. No target receives more than m shards, so losing
+// any single channel or chat leaves the chunk recoverable. When a shard
+// cannot be stored on any target, the shards already uploaded are deleted
+// again.
+func UploadStripe(backends []Backend, fileName string, data []byte, k, m, offset int) (*Stripe, error) {
+	if len(backends) == 0 {
+		return nil, ErrNotConfigured
+	}
+	perTarget := (k + m + len(backends) - 1) / len(backends)
+	if perTarget > m {
+		return nil, fmt.Errorf("erasure coding %d+%d needs at least %d targets, have %d", k, m, (k+m+m-1)/m, len(backends))
+	}
+
+	enc, err := reedsolomon.New(k, m)
+	if err != nil {
+		return nil, err
+	}
+	// Split may reuse the input's spare capacity, so hand it a copy.
+	shards, err := enc.Split(append([]byte(nil), data...))
+	if err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+
+	stripe := &Stripe{
+		Version: 1,
+		Data:    k,
+		Parity:  m,
+		Size:    len(data),
+		Shards:  make([]Locator, len(shards)),
+		Sums:    make([]string, len(shards)),
+	}
+
+	var (
+		mu      sync.Mutex
+		used    = make([]int, len(backends))
+		wg      sync.WaitGroup
+		errs    = make([]error, len(shards))
+		pending = make([]int, len(shards))
+	)
+	for i := range shards {
+		sum := sha256.Sum256(shards[i])
+		stripe.Sums[i] = hex.EncodeToString(sum[:])
+		pending[i] = (offset + i) % len(backends)
+		used[pending[i]]++
+	}
+
+	// pick returns another target with room left, or -1.
+	pick := func(failed map[int]bool) int {
+		mu.Lock()
+		defer mu.Unlock()
+		for j := range backends {
+			if !failed[j] && used[j] < perTarget {
+				used[j]++
+				return j
+			}
+		}
+		return -1
+	}
+
+	for i := range shards {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			failed := make(map[int]bool)
+			b := pending[i]
+			name := fmt.Sprintf("%s.s%d", fileName, i)
+			for b >= 0 {
+				loc, err := backends[b].Upload(name, shards[i])
+				if err == nil {
+					stripe.Shards[i] = loc
+					errs[i] = nil
+					return
+				}
+				fmt.Printf("[ERASURE] Shard %d on %s/%s failed: %v\n", i, backends[b].Provider(), backends[b].Target(), err)
+				errs[i] = err
+				failed[b] = true
+				b = pick(failed)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			discardShards(stripe.Shards)
+			return nil, fmt.Errorf("shard %d: %v", i, err)
+		}
+	}
+	return stripe, nil
+}
+
+// deleteShard is DeleteMessage, replaced in tests.
+var deleteShard = DeleteMessage
+
+// discardShards deletes the shards of a stripe that could not be stored
+// whole; nothing will ever point at them. Failures are only logged.
+func discardShards(shards []Locator) {
+	for i, loc := range shards {
+		if loc.Ref == "" {
+			continue
+		}
+		if err := deleteShard(loc); err != nil {
+			fmt.Printf("[ERASURE] Shard %d left on %s/%s: %v\n", i, loc.Provider, loc.Target, err)
+		}
+	}
+}
+
+// ReadStripe downloads the shards of a stripe and rebuilds the original
+// data. Shards that fail to download or whose checksum does not match are
+// treated as lost.
+func ReadStripe(s *Stripe) ([]byte, error) {
+	enc, err := reedsolomon.New(s.Data, s.Parity)
+	if err != nil {
+		return nil, err
+	}
+
+	shards := make([][]byte, len(s.Shards))
+	var wg sync.WaitGroup
+	for i, loc := range s.Shards {
+		wg.Add(1)
+		go func(i int, loc Locator) {
+			defer wg.Done()
+			data, err := Fetch(loc.Provider, loc.Ref)
+			if err != nil {
+				fmt.Printf("[ERASURE] Shard %d unavailable: %v\n", i, err)
+				return
+			}
+			sum := sha256.Sum256(data)
+			if hex.EncodeToString(sum[:]) != s.Sums[i] {
+				fmt.Printf("[ERASURE] Shard %d checksum mismatch\n", i)
+				return
+			}
+			shards[i] = data
+		}(i, loc)
+	}
+	wg.Wait()
+
+	present := 0
+	for _, shard := range shards {
+		if shard != nil {
+			present++
+		}
+	}
+	if present < s.Data {
+		return nil, fmt.Errorf("only %d of %d shards available, need %d", present, len(shards), s.Data)
+	}
+
+	if err := enc.ReconstructData(shards); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, s.Size)
+	for _, shard := range shards[:s.Data] {
+		out = append(out, shard...)
+	}
+	if len(out) < s.Size {
+		return nil, fmt.Errorf("reconstructed %d bytes, expected %d", len(out), s.Size)
+	}
+	return out[:s.Size], nil
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The test servers stand in for Discord's attachment hosts.
+func init() {
+	discordHosts = append(discordHosts, "127.0.0.1")
+}
+
+// memBackend keeps shards in memory and serves them over HTTP like Discord
+// attachment URLs, so ReadStripe fetches them as it would in production.
+type memBackend struct {
+	srv    *httptest.Server
+	target string
+
+	mu    sync.Mutex
+	blobs map[string][]byte
+	down  bool // uploads fail
+}
+
+func newMemBackend(t *testing.T, target string) *memBackend {
+	b := &memBackend{target: target, blobs: make(map[string][]byte)}
+	b.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.Lock()
+		data, ok := b.blobs[r.URL.Path]
+		b.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(b.srv.Close)
+	return b
+}
+
+func (b *memBackend) Provider() string { return "discord" }
+func (b *memBackend) Target() string   { return b.target }
+
+func (b *memBackend) Upload(fileName string, data []byte) (Locator, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.down {
+		return Locator{}, errors.New("target down")
+	}
+	p := fmt.Sprintf("/%s/%s", b.target, fileName)
+	b.blobs[p] = append([]byte(nil), data...)
+	return Locator{Provider: "discord", Target: b.target, Ref: b.srv.URL + p}, nil
+}
+
+// alter changes the stored copy of the shard at ref.
+func alter(backends []*memBackend, ref string, f func(map[string][]byte, string)) {
+	for _, b := range backends {
+		if p := strings.TrimPrefix(ref, b.srv.URL); p != ref {
+			b.mu.Lock()
+			f(b.blobs, p)
+			b.mu.Unlock()
+		}
+	}
+}
+
+func TestStripeRebuild(t *testing.T) {
+	lose := func(blobs map[string][]byte, p string) { delete(blobs, p) }
+	corrupt := func(blobs map[string][]byte, p string) {
+		b := append([]byte(nil), blobs[p]...)
+		b[0] ^= 0xff
+		blobs[p] = b
+	}
+	tests := []struct {
+		name    string
+		k, m    int
+		targets int
+		size    int
+		lost    []int // shards deleted
+		bad     []int // shards changed
+		fail    bool
+	}{
+		{name: "all shards", k: 4, m: 2, targets: 3, size: 100000},
+		{name: "one data shard lost", k: 4, m: 2, targets: 3, size: 100000, lost: []int{1}},
+		{name: "one parity shard lost", k: 4, m: 2, targets: 3, size: 100000, lost: []int{5}},
+		{name: "data and parity lost", k: 4, m: 2, targets: 3, size: 100000, lost: []int{0, 4}},
+		{name: "two data shards lost", k: 4, m: 2, targets: 3, size: 100000, lost: []int{2, 3}},
+		{name: "corrupt shard", k: 4, m: 2, targets: 3, size: 100000, bad: []int{0}},
+		{name: "lost and corrupt", k: 4, m: 2, targets: 3, size: 100000, lost: []int{3}, bad: []int{1}},
+		{name: "uneven size", k: 4, m: 2, targets: 3, size: 100003, lost: []int{3}},
+		{name: "smaller than k", k: 4, m: 2, targets: 3, size: 3, lost: []int{0, 1}},
+		{name: "wide stripe", k: 6, m: 3, targets: 3, size: 65536, lost: []int{0, 2, 7}},
+		{name: "too many lost", k: 4, m: 2, targets: 3, size: 100000, lost: []int{0, 1, 2}, fail: true},
+		{name: "too many corrupt", k: 4, m: 2, targets: 3, size: 100000, lost: []int{0}, bad: []int{4, 5}, fail: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mems := make([]*memBackend, tt.targets)
+			backends := make([]Backend, tt.targets)
+			for i := range mems {
+				mems[i] = newMemBackend(t, fmt.Sprint("t", i))
+				backends[i] = mems[i]
+			}
+			data := make([]byte, tt.size)
+			rand.New(rand.NewSource(int64(tt.size))).Read(data)
+
+			s, err := UploadStripe(backends, "chunk", data, tt.k, tt.m, 1)
+			if err != nil {
+				t.Fatalf("UploadStripe: %v", err)
+			}
+			// Round trip through meta_links, as downloads do.
+			s, err = ParseStripe(s.String())
+			if err != nil {
+				t.Fatalf("ParseStripe: %v", err)
+			}
+			for _, i := range tt.lost {
+				alter(mems, s.Shards[i].Ref, lose)
+			}
+			for _, i := range tt.bad {
+				alter(mems, s.Shards[i].Ref, corrupt)
+			}
+
+			got, err := ReadStripe(s)
+			if tt.fail {
+				if err == nil {
+					t.Fatal("ReadStripe succeeded with too few shards")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ReadStripe: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("rebuilt %d bytes that differ from the %d stored", len(got), len(data))
+			}
+		})
+	}
+}
+
+// No target holds more than m shards, so losing any one of them leaves
+// the chunk readable.
+func TestStripeLoseTarget(t *testing.T) {
+	for targets := 3; targets <= 6; targets++ {
+		mems := make([]*memBackend, targets)
+		backends := make([]Backend, targets)
+		for i := range mems {
+			mems[i] = newMemBackend(t, fmt.Sprint("t", i))
+			backends[i] = mems[i]
+		}
+		data := bytes.Repeat([]byte("teddrive"), 4096)
+		for offset := 0; offset < targets; offset++ {
+			s, err := UploadStripe(backends, fmt.Sprint("chunk", offset), data, 4, 2, offset)
+			if err != nil {
+				t.Fatalf("%d targets: UploadStripe: %v", targets, err)
+			}
+			for down := range mems {
+				stash := make(map[string][]byte)
+				for _, loc := range s.Shards {
+					if loc.Target == mems[down].target {
+						alter(mems, loc.Ref, func(blobs map[string][]byte, p string) {
+							stash[p] = blobs[p]
+							delete(blobs, p)
+						})
+					}
+				}
+				got, err := ReadStripe(s)
+				if err != nil || !bytes.Equal(got, data) {
+					t.Errorf("%d targets, offset %d, %s down: %v", targets, offset, mems[down].target, err)
+				}
+				mems[down].mu.Lock()
+				for p, b := range stash {
+					mems[down].blobs[p] = b
+				}
+				mems[down].mu.Unlock()
+			}
+		}
+	}
+}
+
+func TestUploadStripeTooFewTargets(t *testing.T) {
+	backends := []Backend{newMemBackend(t, "t0"), newMemBackend(t, "t1")}
+	if _, err := UploadStripe(backends, "chunk", []byte("data"), 4, 2, 0); err == nil {
+		t.Fatal("4+2 over two targets puts three shards on one, want an error")
+	}
+}
+
+func TestUploadStripeFailure(t *testing.T) {
+	mems := []*memBackend{newMemBackend(t, "t0"), newMemBackend(t, "t1"), newMemBackend(t, "t2")}
+	mems[1].down = true
+	mems[2].down = true
+	backends := []Backend{mems[0], mems[1], mems[2]}
+
+	deleted := 0
+	deleteShard = func(loc Locator) error {
+		alter(mems, loc.Ref, func(blobs map[string][]byte, p string) { delete(blobs, p) })
+		deleted++
+		return nil
+	}
+	defer func() { deleteShard = DeleteMessage }()
+
+	if _, err := UploadStripe(backends, "chunk", bytes.Repeat([]byte("teddrive"), 1024), 4, 2, 0); err == nil {
+		t.Fatal("UploadStripe succeeded with two of three targets down")
+	}
+	// t0 takes at most m shards, and every one of them is deleted again.
+	if deleted != 2 {
+		t.Errorf("deleted %d shards, want 2", deleted)
+	}
+	for _, b := range mems {
+		if len(b.blobs) != 0 {
+			t.Errorf("%s still holds %d shards", b.target, len(b.blobs))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+// Package storage holds the provider backends (Discord and Telegram) that
+// chunk data is written to, and the helpers shared by the API handlers that
+// read it back.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ErrNotConfigured is returned when no backend has credentials in the
+// environment.
+var ErrNotConfigured = errors.New("no storage backend configured")
+
+// ErrForeignURL is returned for a Discord ref that is not on Discord's
+// attachment hosts, so stored links cannot make the server fetch anything
+// else.
+var ErrForeignURL = errors.New("not a Discord attachment URL")
+
+// discordHosts serve Discord attachments.
+var discordHosts = []string{"cdn.discordapp.com", "media.discordapp.net"}
+
+// Locator identifies one object stored on a provider.
+type Locator struct {
+	Provider  string `json:"p"`
+	Target    string `json:"t,omitempty"` // channel ID or chat ID
+	MessageID string `json:"m,omitempty"`
+	Ref       string `json:"r"` // Discord attachment URL or Telegram file_id
+}
+
+// Backend uploads blobs to a single Discord channel or Telegram chat.
+type Backend interface {
+	Provider() string
+	Target() string
+	Upload(fileName string, data []byte) (Locator, error)
+}
+
+var cleanNameRe = regexp.MustCompile(`[^\w\.\-]+`)
+
+// CleanName makes a file name safe to use as an attachment name.
+func CleanName(fileName string) string {
+	return cleanNameRe.ReplaceAllString(fileName, "_")
+}
+
+// Backends returns one backend per configured Discord channel and Telegram
+// chat. DISCORD_CHANNEL_IDS and TELEGRAM_CHAT_IDS may list extra targets,
+// comma separated, in addition to DISCORD_CHANNEL_ID and TELEGRAM_CHAT_ID.
+func Backends() []Backend {
+	return BackendsFor(nil)
+}
+
+// BackendsFor is Backends for a workspace with its own targets by
+// provider: a workspace's channel or chat replaces the deployment's ones
+// for that provider.
+func BackendsFor(targets map[string]string) []Backend {
+	var backends []Backend
+
+	if token := strings.TrimSpace(os.Getenv("DISCORD_BOT_TOKEN")); token != "" {
+		ids := envList("DISCORD_CHANNEL_ID", "DISCORD_CHANNEL_IDS")
+		if id := targets["discord"]; id != "" {
+			ids = []string{id}
+		}
+		for _, id := range ids {
+			backends = append(backends, NewDiscord(token, id))
+		}
+	}
+	if token := strings.TrimSpace(os.Getenv("TELEGRAM_BOT_TOKEN")); token != "" {
+		ids := envList("TELEGRAM_CHAT_ID", "TELEGRAM_CHAT_IDS")
+		if id := targets["telegram"]; id != "" {
+			ids = []string{id}
+		}
+		for _, id := range ids {
+			backends = append(backends, NewTelegram(token, id))
+		}
+	}
+
+	return backends
+}
+
+func envList(single, multi string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	values := append([]string{os.Getenv(single)}, strings.Split(os.Getenv(multi), ",")...)
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		out = append(out, v)
+	}
+	return out
+}
+
+// Open starts a GET for a stored object. ref is a Discord attachment URL or
+// a Telegram file_id; rangeHeader is passed through when not empty. The
+// caller must close the response body.
+func Open(provider, ref, rangeHeader string) (*http.Response, error) {
+	targetURL := ref
+	if provider == "telegram" {
+		token := strings.TrimSpace(os.Getenv("TELEGRAM_BOT_TOKEN"))
+		if token == "" {
+			return nil, fmt.Errorf("TELEGRAM_BOT_TOKEN missing in Env")
+		}
+		filePath, err := telegramFilePath(token, ref)
+		if err != nil {
+			return nil, err
+		}
+		targetURL = fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", token, filePath)
+	} else if !onDiscord(ref) {
+		return nil, ErrForeignURL
+	}
+
+	req, err := http.NewRequest("GET", targetURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
+	req.Header.Set("Accept", "*/*")
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("connection failed: %v", err)
+	}
+	if resp.StatusCode != 200 && resp.StatusCode != 206 {
+		resp.Body.Close()
+		return nil, &RemoteError{StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+func onDiscord(ref string) bool {
+	u, err := url.Parse(ref)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return false
+	}
+	for _, host := range discordHosts {
+		if u.Hostname() == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch downloads a whole stored object into memory.
+func Fetch(provider, ref string) ([]byte, error) {
+	resp, err := Open(provider, ref, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// RemoteError reports a non-success status from the provider's file host.
+type RemoteError struct {
+	StatusCode int
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("Remote server error: %d", e.StatusCode)
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type telegramBackend struct {
+	token  string
+	chatID string
+}
+
+// NewTelegram returns a backend that sends documents to a Telegram chat.
+func NewTelegram(token, chatID string) Backend {
+	return &telegramBackend{token: token, chatID: chatID}
+}
+
+func (t *telegramBackend) Provider() string { return "telegram" }
+func (t *telegramBackend) Target() string   { return t.chatID }
+
+func (t *telegramBackend) Upload(fileName string, data []byte) (Locator, error) {
+	fmt.Printf("[TELEGRAM] Starting upload: %d bytes\n", len(data))
+
+	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendDocument", t.token)
+
+	// Create multipart
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	// Add chat_id field
+	writer.WriteField("chat_id", t.chatID)
+
+	part, err := writer.CreateFormFile("document", CleanName(fileName)+".bin")
+	if err != nil {
+		return Locator{}, err
+	}
+
+	part.Write(data)
+	writer.Close()
+
+	// Create request
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return Locator{}, err
+	}
+
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	// Make request with longer timeout for Telegram (supports larger files)
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return Locator{}, fmt.Errorf("HTTP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, _ := io.ReadAll(resp.Body)
+	fmt.Printf("[TELEGRAM] Response Status: %d\n", resp.StatusCode)
+	fmt.Printf("[TELEGRAM] Response Body: %s\n", string(respBody))
+
+	if resp.StatusCode == 401 {
+		return Locator{}, fmt.Errorf("Telegram bot token invalid or expired. Please check TELEGRAM_BOT_TOKEN")
+	}
+
+	if resp.StatusCode == 403 {
+		return Locator{}, fmt.Errorf("Telegram bot lacks permissions or chat not found. Check TELEGRAM_CHAT_ID")
+	}
+
+	if resp.StatusCode == 429 {
+		return Locator{}, fmt.Errorf("Telegram rate limit exceeded. Please wait and try again")
+	}
+
+	if resp.StatusCode != 200 {
+		return Locator{}, fmt.Errorf("Telegram API error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	// Parse response
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
+			MessageID int64 `json:"message_id"`
+			Document  struct {
+				FileID string `json:"file_id"`
+			} `json:"document"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return Locator{}, fmt.Errorf("Failed to parse Telegram response: %v", err)
+	}
+
+	// Check if ok
+	if !result.OK {
+		errorMsg := "Unknown error"
+		if result.Description != "" {
+			errorMsg = result.Description
+		}
+		return Locator{}, fmt.Errorf("Telegram API error: %s", errorMsg)
+	}
+
+	if result.Result.Document.FileID == "" {
+		return Locator{}, fmt.Errorf("No file_id in Telegram response")
+	}
+
+	return Locator{
+		Provider:  "telegram",
+		Target:    t.chatID,
+		MessageID: strconv.FormatInt(result.Result.MessageID, 10),
+		Ref:       result.Result.Document.FileID,
+	}, nil
+}
+
+// telegramFilePath resolves a file_id to the path used by the file host.
+func telegramFilePath(token, fileID string) (string, error) {
+	apiURL := fmt.Sprintf("https://api.telegram.org/bot%s/getFile?file_id=%s", token, url.QueryEscape(fileID))
+	resp, err := http.Get(apiURL)
+	if err != nil {
+		fmt.Println("[DOWNLOAD TG] GetFile Error:", err)
+		return "", fmt.Errorf("Telegram GetFile Error")
+	}
+	defer resp.Body.Close()
+
+	var tgResp struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
+			FilePath string `json:"file_path"`
+		} `json:"result"`
+	}
+	json.NewDecoder(resp.Body).Decode(&tgResp)
+
+	if !tgResp.OK || tgResp.Result.FilePath == "" {
+		fmt.Println("[DOWNLOAD TG] API Error:", tgResp.Description)
+		return "", fmt.Errorf("Telegram API Error")
+	}
+	return tgResp.Result.FilePath, nil
+}
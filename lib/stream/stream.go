@@ -0,0 +1,228 @@
+// Package stream plays files in the browser: it serves the decrypted bytes
+// of a file with Range support, so a <video> or <audio> element can start
+// at once and seek, fetching only the chunks around the playhead.
+//
+// Media elements cannot send the Authorization and X-Workspace headers
+// the API reads, so a stream URL carries a signed token instead, made for
+// a caller who may read the file. The token stands in for their headers:
+// each request still checks the access list.
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+)
+
+// TTL is how long a stream URL works, enough for a long film with pauses.
+const TTL = 6 * time.Hour
+
+// MaxResponse is the most one response carries. Vercel cuts responses off
+// at 4.5 MB, so larger ranges are shortened and the player asks for the
+// rest, as it does anyway while it plays.
+const MaxResponse = 4 << 20
+
+var (
+	// ErrDisabled is returned while there is no secret to sign tokens with.
+	ErrDisabled = errors.New("streaming needs SUPABASE_SERVICE_ROLE_KEY")
+	// ErrToken is returned for tokens that are forged, expired or for
+	// another file.
+	ErrToken = errors.New("invalid or expired stream token")
+)
+
+// Token is what a stream URL carries: who asked, in which workspace, for
+// which file, and until when.
+type Token struct {
+	FileID    string `json:"f"`
+	Workspace string `json:"w"`
+	UserID    string `json:"u,omitempty"`
+	Admin     bool   `json:"a,omitempty"`
+	Expires   int64  `json:"e"`
+}
+
+// secret signs tokens. The service role key never leaves the server; the
+// anon key is public, so it will not do.
+func secret() []byte {
+	key := strings.TrimSpace(os.Getenv("SUPABASE_SERVICE_ROLE_KEY"))
+	if key == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte("stream"))
+	return mac.Sum(nil)
+}
+
+// Sign returns t as a URL-safe string.
+func Sign(t Token) (string, error) {
+	key := secret()
+	if key == nil {
+		return "", ErrDisabled
+	}
+	payload, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + sign(key, body), nil
+}
+
+// Verify checks a token made by Sign for file id and returns it.
+func Verify(s, id string) (*Token, error) {
+	key := secret()
+	if key == nil {
+		return nil, ErrDisabled
+	}
+	body, sig, ok := strings.Cut(s, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(key, body))) {
+		return nil, ErrToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return nil, ErrToken
+	}
+	var t Token
+	if err := json.Unmarshal(payload, &t); err != nil {
+		return nil, ErrToken
+	}
+	if t.FileID != id || time.Now().Unix() > t.Expires {
+		return nil, ErrToken
+	}
+	return &t, nil
+}
+
+func sign(key []byte, body string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Serve answers a GET or HEAD for the content of f, honouring Range and
+// If-Range. Ranges are cut to MaxResponse bytes. A response without a range
+// is the whole file, which is cut off after MaxResponse bytes: players ask
+// for ranges, and Vercel would cut a longer response off anyway.
+func Serve(w http.ResponseWriter, r *http.Request, c *meta.Client, f *meta.File) error {
+	rd, err := content.NewReader(c, f)
+	if err != nil {
+		return err
+	}
+	mod := f.Modified()
+	etag := fmt.Sprintf(`"%x-%x"`, mod.UnixNano(), f.Size)
+
+	// If-Range is settled here, so ServeContent never falls back to the
+	// whole file for a range that was cut short.
+	header := r.Header.Get("Range")
+	if header != "" && !ifRange(r.Header.Get("If-Range"), etag, mod) {
+		header = ""
+		r.Header.Del("Range")
+	}
+	r.Header.Del("If-Range")
+	start, end := clamp(header, f.Size)
+	if end > start {
+		r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	} else {
+		end = min(f.Size, MaxResponse)
+	}
+	rd.ReadAhead(end)
+
+	// Setting the type keeps ServeContent from reading a chunk to sniff it.
+	mime := f.Mime
+	if mime == "" {
+		mime = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", mime)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(&capped{ResponseWriter: w, left: MaxResponse}, r, f.Name, mod, rd)
+	return nil
+}
+
+// ifRange reports whether a range request with this If-Range header is to
+// be served as a range, for a file with the given ETag and modification
+// time. It compares as net/http does: ETags strongly, dates to the second.
+func ifRange(header, etag string, mod time.Time) bool {
+	if header == "" {
+		return true
+	}
+	if strings.HasPrefix(header, `"`) || strings.HasPrefix(header, "W/") {
+		return header == etag
+	}
+	t, err := http.ParseTime(header)
+	return err == nil && !mod.IsZero() && t.Unix() == mod.Unix()
+}
+
+// errCapped ends a response that reached MaxResponse bytes.
+var errCapped = errors.New("stream: response cut at MaxResponse bytes")
+
+// capped passes at most left bytes of body on to the ResponseWriter.
+type capped struct {
+	http.ResponseWriter
+	left int64
+}
+
+func (c *capped) Write(p []byte) (int, error) {
+	if int64(len(p)) <= c.left {
+		n, err := c.ResponseWriter.Write(p)
+		c.left -= int64(n)
+		return n, err
+	}
+	n, err := c.ResponseWriter.Write(p[:c.left])
+	c.left -= int64(n)
+	if err == nil {
+		err = errCapped
+	}
+	return n, err
+}
+
+// clamp works out the bytes [start, end) to send for a Range header on a
+// file of size bytes. Only the first range of a multi-range request is
+// served. end is 0 when there is no range to serve and the header is to be
+// left as it is: when it is empty, or malformed, or unsatisfiable, which
+// ServeContent answers with the whole file or 416.
+func clamp(header string, size int64) (start, end int64) {
+	if size <= 0 || header == "" {
+		return 0, 0
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return 0, 0
+	}
+	spec, _, _ = strings.Cut(spec, ",")
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return 0, 0
+	}
+	if first == "" {
+		// The last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0
+		}
+		start = max(0, size-n)
+		end = size
+	} else {
+		var err error
+		if start, err = strconv.ParseInt(first, 10, 64); err != nil || start >= size {
+			return 0, 0 // ServeContent answers 416
+		}
+		end = size
+		if last != "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < start {
+				return 0, 0
+			}
+			end = min(n+1, size)
+		}
+	}
+	return start, min(end, start+MaxResponse)
+}
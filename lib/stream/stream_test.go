@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClamp(t *testing.T) {
+	const big = 3 * MaxResponse
+	tests := []struct {
+		name       string
+		header     string
+		size       int64
+		start, end int64
+	}{
+		{name: "no range", header: "", size: big},
+		{name: "no range, small file", header: "", size: 100},
+		{name: "empty file", header: "bytes=0-", size: 0},
+		{name: "open range", header: "bytes=0-", size: 100, start: 0, end: 100},
+		{name: "open range, big file", header: "bytes=0-", size: big, start: 0, end: MaxResponse},
+		{name: "open range from middle", header: "bytes=1000-", size: big, start: 1000, end: 1000 + MaxResponse},
+		{name: "closed range", header: "bytes=10-19", size: 100, start: 10, end: 20},
+		{name: "closed range past end", header: "bytes=90-199", size: 100, start: 90, end: 100},
+		{name: "closed range too long", header: "bytes=0-" + strconv.Itoa(big-1), size: big, start: 0, end: MaxResponse},
+		{name: "suffix", header: "bytes=-10", size: 100, start: 90, end: 100},
+		{name: "suffix longer than file", header: "bytes=-500", size: 100, start: 0, end: 100},
+		{name: "suffix of big file", header: "bytes=-" + strconv.Itoa(big), size: big, start: 0, end: MaxResponse},
+		{name: "first of several", header: "bytes=10-19, 50-59", size: 100, start: 10, end: 20},
+		{name: "spaces", header: "bytes= 10-19", size: 100, start: 10, end: 20},
+		{name: "start past end", header: "bytes=100-", size: 100},
+		{name: "end before start", header: "bytes=20-10", size: 100},
+		{name: "zero suffix", header: "bytes=-0", size: 100},
+		{name: "other unit", header: "items=0-1", size: 100},
+		{name: "no dash", header: "bytes=10", size: 100},
+		{name: "not a number", header: "bytes=a-b", size: 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := clamp(tt.header, tt.size)
+			if start != tt.start || end != tt.end {
+				t.Errorf("clamp(%q, %d) = [%d, %d), want [%d, %d)", tt.header, tt.size, start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	mod := time.Date(2024, 4, 5, 6, 7, 8, 900, time.UTC)
+	const etag = `"17c3-64"`
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{name: "absent", header: "", want: true},
+		{name: "same etag", header: etag, want: true},
+		{name: "other etag", header: `"17c3-65"`},
+		{name: "weak etag", header: "W/" + etag},
+		{name: "same date", header: "Fri, 05 Apr 2024 06:07:08 GMT", want: true},
+		{name: "earlier date", header: "Fri, 05 Apr 2024 06:07:07 GMT"},
+		{name: "garbage", header: "yesterday"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ifRange(tt.header, etag, mod); got != tt.want {
+				t.Errorf("ifRange(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapped(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &capped{ResponseWriter: rec, left: 10}
+	if n, err := w.Write([]byte("123456")); n != 6 || err != nil {
+		t.Fatalf("first write = %d, %v", n, err)
+	}
+	if n, err := w.Write([]byte("7890abc")); n != 4 || !errors.Is(err, errCapped) {
+		t.Fatalf("second write = %d, %v, want 4, errCapped", n, err)
+	}
+	if n, err := w.Write([]byte("d")); n != 0 || !errors.Is(err, errCapped) {
+		t.Fatalf("third write = %d, %v, want 0, errCapped", n, err)
+	}
+	if got := rec.Body.String(); got != "1234567890" {
+		t.Errorf("body = %q", got)
+	}
+}
@@ -0,0 +1,81 @@
+package syncer
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// stateName is the file in the local folder that remembers the last sync.
+// It is never synced itself.
+const stateName = ".teddrive-sync.json"
+
+// tempPrefix marks downloads in progress, which are never uploaded.
+const tempPrefix = ".teddrive-sync-"
+
+// state is what both sides looked like after the last sync, so that a
+// difference can be told apart as a local or a remote change.
+type state struct {
+	RootID  string                `json:"root_id"`
+	Files   map[string]*fileState `json:"files"`
+	Folders map[string]string     `json:"folders"` // path -> folder ID
+}
+
+// fileState records one synced file. MetaKey identifies the remote
+// content, since every upload picks a new key; MTime and Size tell whether
+// the local file needs hashing again.
+type fileState struct {
+	FileID  string `json:"file_id"`
+	MetaKey string `json:"meta_key"`
+	Size    int64  `json:"size"`
+	MTime   int64  `json:"mtime"` // UnixNano
+	SHA256  string `json:"sha256"`
+}
+
+func loadState(dir, rootID string) (*state, error) {
+	st := &state{RootID: rootID, Files: map[string]*fileState{}, Folders: map[string]string{}}
+	data, err := os.ReadFile(filepath.Join(dir, stateName))
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, err
+	}
+	if st.RootID != rootID {
+		return nil, errors.New(stateName + " belongs to a different remote folder; delete it to start over")
+	}
+	if st.Files == nil {
+		st.Files = map[string]*fileState{}
+	}
+	if st.Folders == nil {
+		st.Folders = map[string]string{}
+	}
+	return st, nil
+}
+
+// save writes the state through a temporary file so a crash never leaves
+// it half written.
+func (st *state) save(dir string) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, tempPrefix+"state-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, stateName))
+}
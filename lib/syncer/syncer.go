@@ -0,0 +1,426 @@
+// Package syncer keeps a local directory and a TEDDRIVE folder in step in
+// both directions. Each pass compares both sides with the state saved by
+// the previous pass: a file that changed on one side only is copied to the
+// other, and a file that changed on both is kept twice, the local copy
+// under a conflict name.
+package syncer
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/trash"
+)
+
+// Syncer syncs one local directory with one remote folder.
+type Syncer struct {
+	client   *meta.Client
+	provider string
+	dir      string
+	root     *meta.Folder
+	st       *state
+
+	// Set up by each pass.
+	remoteFiles   map[string]*meta.File
+	remoteFolders map[string]string // path -> folder ID, "" is the root
+}
+
+// New prepares to sync dir with the folder at remotePath, a "/"-separated
+// path from the top of the drive. Missing folders on the way are created.
+// New files are uploaded with provider.
+func New(c *meta.Client, provider, dir, remotePath string) (*Syncer, error) {
+	if _, err := content.NewWriter(c, provider, ""); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	root, err := resolveRoot(c, remotePath)
+	if err != nil {
+		return nil, err
+	}
+	st, err := loadState(dir, root.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &Syncer{client: c, provider: provider, dir: dir, root: root, st: st}, nil
+}
+
+// resolveRoot finds the folder at p, creating whatever is missing. The top
+// of the drive itself cannot be synced, as it is not a folder row.
+func resolveRoot(c *meta.Client, p string) (*meta.Folder, error) {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil, fmt.Errorf("choose a folder to sync, not the top of the drive")
+	}
+	var folder *meta.Folder
+	for _, name := range strings.Split(p, "/") {
+		parent := "is.null"
+		var parentID *string
+		if folder != nil {
+			parent, parentID = meta.Eq(folder.ID), &folder.ID
+		}
+		rows, err := c.ListFolders(url.Values{
+			"parent_id": {parent},
+			"name":      {meta.Eq(name)},
+			"order":     {"id.asc"},
+			"limit":     {"1"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) > 0 {
+			folder = &rows[0]
+			continue
+		}
+		folder = &meta.Folder{Name: name, ParentID: parentID}
+		if err := c.InsertFolder(folder); err != nil {
+			return nil, err
+		}
+	}
+	return folder, nil
+}
+
+// localFile is a regular file found by scan.
+type localFile struct {
+	size  int64
+	mtime int64
+}
+
+// scan lists the regular files and directories below s.dir by slash
+// path. Symlinks, the state file and downloads in progress are skipped.
+func (s *Syncer) scan() (map[string]localFile, map[string]bool, error) {
+	files := make(map[string]localFile)
+	dirs := make(map[string]bool)
+	err := filepath.WalkDir(s.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.Name() == stateName || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		switch {
+		case d.IsDir():
+			dirs[rel] = true
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			files[rel] = localFile{size: info.Size(), mtime: info.ModTime().UnixNano()}
+		}
+		return nil
+	})
+	return files, dirs, err
+}
+
+// Sync runs one pass. Errors on single files are logged and retried on the
+// next pass; only failing to list either side is returned.
+func (s *Syncer) Sync() error {
+	tree, err := s.client.GetTree(s.root.ID)
+	if err != nil {
+		return err
+	}
+	s.remoteFiles = make(map[string]*meta.File, len(tree.Files))
+	for i := range tree.Files {
+		s.remoteFiles[tree.Files[i].Path] = &tree.Files[i].File
+	}
+	s.remoteFolders = map[string]string{"": s.root.ID}
+	for _, f := range tree.Folders {
+		s.remoteFolders[f.Path] = f.Folder.ID
+	}
+	localFiles, localDirs, err := s.scan()
+	if err != nil {
+		return err
+	}
+
+	paths := make(map[string]bool)
+	for p := range localFiles {
+		paths[p] = true
+	}
+	for p := range s.remoteFiles {
+		paths[p] = true
+	}
+	for p := range s.st.Files {
+		paths[p] = true
+	}
+	for _, p := range sorted(paths) {
+		var l *localFile
+		if lf, ok := localFiles[p]; ok {
+			l = &lf
+		}
+		if err := s.syncFile(p, l, s.remoteFiles[p]); err != nil {
+			fmt.Printf("[SYNC] %s: %v\n", p, err)
+		}
+	}
+	s.syncFolders(localDirs)
+	return s.st.save(s.dir)
+}
+
+// syncFile brings one path up to date. l and r are the local and remote
+// file, nil when missing.
+func (s *Syncer) syncFile(p string, l *localFile, r *meta.File) error {
+	old := s.st.Files[p]
+
+	localChanged := false
+	var hash string
+	switch {
+	case l == nil:
+		localChanged = old != nil
+	case old == nil:
+		localChanged = true
+	case l.size != old.Size || l.mtime != old.MTime:
+		h, err := hashFile(s.local(p))
+		if err != nil {
+			return err
+		}
+		if h == old.SHA256 {
+			old.MTime = l.mtime // touched, not changed
+		} else {
+			localChanged, hash = true, h
+		}
+	}
+	remoteChanged := false
+	if r == nil {
+		remoteChanged = old != nil
+	} else {
+		remoteChanged = old == nil || r.ID != old.FileID || r.MetaKey != old.MetaKey
+	}
+
+	switch {
+	case !localChanged && !remoteChanged:
+		return nil
+	case l == nil && r == nil:
+		delete(s.st.Files, p)
+		return nil
+	case localChanged && !remoteChanged && l == nil:
+		return s.deleteRemote(p, r)
+	case remoteChanged && !localChanged && r == nil:
+		return s.deleteLocal(p, l)
+	case !remoteChanged || r == nil:
+		// Changed locally, or deleted remotely while changed locally: the
+		// local edit wins over the delete and comes back as a new file.
+		return s.upload(p, l, r)
+	case !localChanged || l == nil:
+		return s.download(p, l, r)
+	}
+
+	// Both sides have a file and both changed. The same content on both,
+	// as on a first sync of copies, is no conflict.
+	if l.size == r.Size {
+		if hash == "" {
+			h, err := hashFile(s.local(p))
+			if err != nil {
+				return err
+			}
+			hash = h
+		}
+		rh, err := s.hashRemote(r)
+		if err != nil {
+			return err
+		}
+		if rh == hash {
+			s.st.Files[p] = &fileState{FileID: r.ID, MetaKey: r.MetaKey, Size: l.size, MTime: l.mtime, SHA256: hash}
+			return nil
+		}
+	}
+	return s.conflict(p, l, r)
+}
+
+// conflict keeps the local file under a new name, uploads it as a new file
+// and downloads the remote one in its place.
+func (s *Syncer) conflict(p string, l *localFile, r *meta.File) error {
+	cp := conflictName(p, func(c string) bool {
+		_, err := os.Lstat(s.local(c))
+		return err == nil || s.remoteFiles[c] != nil
+	})
+	if err := os.Rename(s.local(p), s.local(cp)); err != nil {
+		return err
+	}
+	fmt.Printf("[SYNC] conflict: %s changed on both sides; local copy kept as %s\n", p, cp)
+	if err := s.upload(cp, l, nil); err != nil {
+		return err
+	}
+	return s.download(p, nil, r)
+}
+
+// conflictName picks "name (conflict N).ext" next to p.
+func conflictName(p string, taken func(string) bool) string {
+	dir, name := path.Split(p)
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		suffix := " (conflict)"
+		if i > 1 {
+			suffix = fmt.Sprintf(" (conflict %d)", i)
+		}
+		c := dir + base + suffix + ext
+		if !taken(c) {
+			return c
+		}
+	}
+}
+
+func (s *Syncer) deleteRemote(p string, r *meta.File) error {
+	// Only delete the version we know, not one uploaded meanwhile.
+	err := trash.Files(s.client, url.Values{"id": {meta.Eq(r.ID)}, "meta_key": {meta.Eq(r.MetaKey)}})
+	if err != nil {
+		return err
+	}
+	delete(s.st.Files, p)
+	fmt.Printf("[SYNC] deleted remote %s\n", p)
+	return s.st.save(s.dir)
+}
+
+func (s *Syncer) deleteLocal(p string, l *localFile) error {
+	if !s.unchanged(p, l) {
+		return nil // edited since the scan; next pass uploads it
+	}
+	if err := os.Remove(s.local(p)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	delete(s.st.Files, p)
+	fmt.Printf("[SYNC] deleted local %s\n", p)
+	return s.st.save(s.dir)
+}
+
+// syncFolders creates and deletes folders on either side, including empty
+// ones that no file pass would touch. A folder is only deleted once it is
+// empty, so anything added to it meanwhile keeps it alive.
+func (s *Syncer) syncFolders(localDirs map[string]bool) {
+	paths := make(map[string]bool)
+	for p := range localDirs {
+		paths[p] = true
+	}
+	for p := range s.remoteFolders {
+		if p != "" {
+			paths[p] = true
+		}
+	}
+	for p := range s.st.Folders {
+		paths[p] = true
+	}
+
+	// Parents are created before their children and deleted after them.
+	create := sorted(paths)
+	for _, p := range create {
+		_, local := localDirs[p]
+		_, remote := s.remoteFolders[p]
+		_, known := s.st.Folders[p]
+		switch {
+		case local && !remote && !known:
+			if _, err := s.ensureFolder(p); err != nil {
+				fmt.Printf("[SYNC] %s: %v\n", p, err)
+			}
+		case remote && !local && !known:
+			if err := os.MkdirAll(s.local(p), 0755); err != nil {
+				fmt.Printf("[SYNC] %s: %v\n", p, err)
+				continue
+			}
+			localDirs[p] = true
+			s.st.Folders[p] = s.remoteFolders[p]
+		case local && remote:
+			s.st.Folders[p] = s.remoteFolders[p]
+		}
+	}
+	for i := len(create) - 1; i >= 0; i-- {
+		p := create[i]
+		_, local := localDirs[p]
+		id, remote := s.remoteFolders[p]
+		_, known := s.st.Folders[p]
+		switch {
+		case !known:
+		case !local && !remote:
+			delete(s.st.Folders, p)
+		case !local:
+			empty, err := s.remoteEmpty(id)
+			if err == nil && empty {
+				err = trash.Folder(s.client, id)
+			}
+			if err != nil {
+				fmt.Printf("[SYNC] %s: %v\n", p, err)
+			} else if empty {
+				delete(s.st.Folders, p)
+				fmt.Printf("[SYNC] deleted remote folder %s\n", p)
+			}
+		case !remote:
+			if err := os.Remove(s.local(p)); err == nil || os.IsNotExist(err) {
+				delete(s.st.Folders, p)
+				fmt.Printf("[SYNC] deleted local folder %s\n", p)
+			}
+		}
+	}
+}
+
+func (s *Syncer) remoteEmpty(id string) (bool, error) {
+	q := url.Values{"select": {"id"}, "limit": {"1"}}
+	q.Set("folder_id", meta.Eq(id))
+	files, err := s.client.ListFiles(q)
+	if err != nil || len(files) > 0 {
+		return false, err
+	}
+	q.Del("folder_id")
+	q.Set("parent_id", meta.Eq(id))
+	folders, err := s.client.ListFolders(q)
+	return len(folders) == 0, err
+}
+
+// ensureFolder returns the ID of the remote folder at p, creating it and
+// its parents as needed.
+func (s *Syncer) ensureFolder(p string) (string, error) {
+	if id, ok := s.remoteFolders[p]; ok {
+		return id, nil
+	}
+	dir, name := path.Split(p)
+	parentID, err := s.ensureFolder(strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		return "", err
+	}
+	f := &meta.Folder{Name: name, ParentID: &parentID}
+	if err := s.client.InsertFolder(f); err != nil {
+		return "", err
+	}
+	s.remoteFolders[p] = f.ID
+	s.st.Folders[p] = f.ID
+	return f.ID, nil
+}
+
+// local returns the local path for a slash path.
+func (s *Syncer) local(p string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(p))
+}
+
+// unchanged reports whether the local file still matches what the scan saw.
+func (s *Syncer) unchanged(p string, l *localFile) bool {
+	info, err := os.Lstat(s.local(p))
+	if l == nil {
+		return os.IsNotExist(err)
+	}
+	return err == nil && info.Size() == l.size && info.ModTime().UnixNano() == l.mtime
+}
+
+func sorted(set map[string]bool) []string {
+	out := make([]string, 0, len(set))
+	for p := range set {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
@@ -0,0 +1,152 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/versions"
+)
+
+// upload stores the local file at p as new chunks. With r it replaces the
+// content of that row, keeping the old content as a version; otherwise it
+// adds a file. Nothing is saved if the local file changes during the
+// upload or r changes remotely meanwhile; the next pass sees why.
+func (s *Syncer) upload(p string, l *localFile, r *meta.File) error {
+	in, err := os.Open(s.local(p))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	_, name := path.Split(p)
+	w, err := content.NewWriter(s.client, s.provider, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		w.Release()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		w.Release()
+		return err
+	}
+	if !s.unchanged(p, l) {
+		w.Release()
+		return nil
+	}
+
+	f := meta.File{Name: name, Mime: meta.MimeOf(name)}
+	if r != nil {
+		f = *r
+	} else {
+		dir, _ := path.Split(p)
+		folderID, err := s.ensureFolder(strings.TrimSuffix(dir, "/"))
+		if err != nil {
+			w.Release()
+			return err
+		}
+		f.FolderID = &folderID
+	}
+	if err := versions.Save(s.client, &f, w); err != nil {
+		if errors.Is(err, versions.ErrChanged) {
+			return nil
+		}
+		return err
+	}
+	s.remoteFiles[p] = &f
+
+	s.st.Files[p] = &fileState{
+		FileID:  f.ID,
+		MetaKey: f.MetaKey,
+		Size:    l.size,
+		MTime:   l.mtime,
+		SHA256:  w.SHA256(),
+	}
+	fmt.Printf("[SYNC] uploaded %s (%d bytes)\n", p, f.Size)
+	return s.st.save(s.dir)
+}
+
+// download replaces the local file at p, which the scan saw as l, with
+// the content of r. The new content is written next to it and renamed
+// into place, unless the local file changed since the scan.
+func (s *Syncer) download(p string, l *localFile, r *meta.File) error {
+	dst := s.local(p)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	rd, err := content.NewReader(s.client, r)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, h), rd); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	mod := r.Modified()
+	os.Chtimes(tmp.Name(), mod, mod)
+
+	if !s.unchanged(p, l) {
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return err
+	}
+	s.st.Files[p] = &fileState{
+		FileID:  r.ID,
+		MetaKey: r.MetaKey,
+		Size:    info.Size(),
+		MTime:   info.ModTime().UnixNano(),
+		SHA256:  hex.EncodeToString(h.Sum(nil)),
+	}
+	fmt.Printf("[SYNC] downloaded %s (%d bytes)\n", p, info.Size())
+	return s.st.save(s.dir)
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashRemote downloads r to hash it, without keeping the content.
+func (s *Syncer) hashRemote(r *meta.File) (string, error) {
+	rd, err := content.NewReader(s.client, r)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, rd); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,97 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// settle is how long the local directory has to stay quiet after a change
+// before a pass starts, so files still being written are not uploaded.
+const settle = 2 * time.Second
+
+// Watch syncs once, then again whenever the local directory changes and at
+// least every interval to pick up remote changes, until ctx is done.
+// Local changes come from inotify (or the platform's equivalent), so they
+// are uploaded within seconds.
+func (s *Syncer) Watch(ctx context.Context, interval time.Duration) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err := s.watchTree(w, s.dir); err != nil {
+		return err
+	}
+
+	poll := time.NewTicker(interval)
+	defer poll.Stop()
+	quiet := time.NewTimer(0) // first pass right away
+	settling := false
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-w.Events:
+			name := filepath.Base(ev.Name)
+			if name == stateName || strings.HasPrefix(name, tempPrefix) {
+				continue
+			}
+			if ev.Has(fsnotify.Create) {
+				if fi, err := os.Lstat(ev.Name); err == nil && fi.IsDir() {
+					if err := s.watchTree(w, ev.Name); err != nil {
+						fmt.Printf("[SYNC] watch %s: %v\n", ev.Name, err)
+					}
+				}
+			}
+			restart(quiet, settle)
+			settling = true
+		case err := <-w.Errors:
+			// Events may have been dropped; a pass finds what they said.
+			fmt.Printf("[SYNC] watch: %v\n", err)
+			restart(quiet, settle)
+			settling = true
+		case <-poll.C:
+			if !settling {
+				restart(quiet, 0)
+			}
+		case <-quiet.C:
+			settling = false
+			if err := s.Sync(); err != nil {
+				fmt.Printf("[SYNC] pass failed: %v\n", err)
+			}
+			poll.Reset(interval)
+		}
+	}
+}
+
+// watchTree watches dir and every directory below it. inotify watches are
+// not recursive.
+func (s *Syncer) watchTree(w *fsnotify.Watcher, dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return w.Add(p)
+		}
+		return nil
+	})
+}
+
+// restart resets t, dropping a tick it may already have delivered.
+func restart(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
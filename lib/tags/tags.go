@@ -0,0 +1,242 @@
+// Package tags labels files and folders with tags and key/value metadata
+// (supabase/migrations/015_tags.sql), such as the tag "final" and the
+// metadata {"project": "apollo", "client": "acme", "release": "2.4"}.
+// Tags are kept lowercase so "Final" and "final" are one tag; metadata
+// keys and values are kept as given.
+package tags
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"teddrive-web/lib/meta"
+)
+
+// Limits per file or folder.
+const (
+	MaxTags     = 50
+	MaxTagLen   = 64
+	MaxKeys     = 50
+	MaxKeyLen   = 64
+	MaxValueLen = 1024
+)
+
+var (
+	// ErrDisabled is returned for changes while the migration is not
+	// applied.
+	ErrDisabled = errors.New("tags need supabase/migrations/015_tags.sql")
+	// ErrInvalid is returned for tags or metadata over the limits, or
+	// empty ones.
+	ErrInvalid = errors.New("invalid tags or metadata")
+)
+
+// Labels are the tags and metadata of one file or folder.
+type Labels struct {
+	Tags     []string          `json:"tags"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Change edits Labels. Tags, when not nil, replaces the tags; Add and
+// Remove then adjust them. Metadata is merged in, and a nil value removes
+// its key.
+type Change struct {
+	Tags     []string
+	Add      []string
+	Remove   []string
+	Metadata map[string]*string
+}
+
+var (
+	installedMu sync.Mutex
+	installed   = make(map[string]bool)
+)
+
+// Installed reports whether the files table has the tags column. A yes is
+// remembered; a no is checked again next time.
+func Installed(c *meta.Client) (bool, error) {
+	installedMu.Lock()
+	ok := installed[c.URL]
+	installedMu.Unlock()
+	if ok {
+		return true, nil
+	}
+	var rows []Labels
+	err := c.Select("files", url.Values{"select": {"tags"}, "limit": {"1"}}, &rows)
+	if pg := meta.AsPostgres(err); pg != nil && pg.Code == "42703" {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	installedMu.Lock()
+	installed[c.URL] = true
+	installedMu.Unlock()
+	return true, nil
+}
+
+// Get returns the labels of row id of table, "files" or "folders". Items
+// in the trash are not found.
+func Get(c *meta.Client, table, id string) (*Labels, error) {
+	if err := checkTable(table); err != nil {
+		return nil, err
+	}
+	ok, err := Installed(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if err := exists(c, table, id); err != nil {
+			return nil, err
+		}
+		return &Labels{Tags: []string{}, Metadata: map[string]string{}}, nil
+	}
+	var rows []Labels
+	err = c.Select(table, url.Values{
+		"select":     {"tags,metadata"},
+		"id":         {meta.Eq(id)},
+		"deleted_at": {"is.null"},
+	}, &rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	l := &rows[0]
+	if l.Tags == nil {
+		l.Tags = []string{}
+	}
+	if l.Metadata == nil {
+		l.Metadata = map[string]string{}
+	}
+	return l, nil
+}
+
+// Apply makes ch to row id of table and returns the labels it ends up
+// with.
+func Apply(c *meta.Client, table, id string, ch Change) (*Labels, error) {
+	ok, err := Installed(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDisabled
+	}
+	l, err := Get(c, table, id)
+	if err != nil {
+		return nil, err
+	}
+
+	list := l.Tags
+	if ch.Tags != nil {
+		list = ch.Tags
+	}
+	list = append(append([]string(nil), list...), ch.Add...)
+	drop, err := Normalize(ch.Remove)
+	if err != nil {
+		return nil, err
+	}
+	list, err = Normalize(list)
+	if err != nil {
+		return nil, err
+	}
+	kept := list[:0]
+	for _, t := range list {
+		if !contains(drop, t) {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) > MaxTags {
+		return nil, fmt.Errorf("%w: at most %d tags", ErrInvalid, MaxTags)
+	}
+
+	for k, v := range ch.Metadata {
+		if v == nil {
+			delete(l.Metadata, strings.TrimSpace(k))
+			continue
+		}
+		l.Metadata[strings.TrimSpace(k)] = *v
+	}
+	if err := CheckMetadata(l.Metadata); err != nil {
+		return nil, err
+	}
+
+	l.Tags = kept
+	var rows []Labels
+	err = c.Update(table, url.Values{"id": {meta.Eq(id)}}, map[string]interface{}{
+		"tags":     l.Tags,
+		"metadata": l.Metadata,
+	}, &rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return l, nil
+}
+
+// Normalize trims and lowercases tags, drops duplicates and sorts them.
+// An empty tag or one longer than MaxTagLen is ErrInvalid.
+func Normalize(list []string) ([]string, error) {
+	out := make([]string, 0, len(list))
+	for _, t := range list {
+		t = strings.ToLower(strings.Join(strings.Fields(t), " "))
+		if t == "" || utf8.RuneCountInString(t) > MaxTagLen {
+			return nil, fmt.Errorf("%w: tags must be 1 to %d characters", ErrInvalid, MaxTagLen)
+		}
+		if !contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// CheckMetadata returns ErrInvalid for metadata over the limits or with an
+// empty key.
+func CheckMetadata(m map[string]string) error {
+	if len(m) > MaxKeys {
+		return fmt.Errorf("%w: at most %d metadata keys", ErrInvalid, MaxKeys)
+	}
+	for k, v := range m {
+		if k == "" || utf8.RuneCountInString(k) > MaxKeyLen {
+			return fmt.Errorf("%w: metadata keys must be 1 to %d characters", ErrInvalid, MaxKeyLen)
+		}
+		if utf8.RuneCountInString(v) > MaxValueLen {
+			return fmt.Errorf("%w: metadata values must be at most %d characters", ErrInvalid, MaxValueLen)
+		}
+	}
+	return nil
+}
+
+func exists(c *meta.Client, table, id string) error {
+	var err error
+	if table == "files" {
+		_, err = c.GetFile(id)
+	} else {
+		_, err = c.GetFolder(id)
+	}
+	return err
+}
+
+func checkTable(table string) error {
+	if table != "files" && table != "folders" {
+		return fmt.Errorf("no tags on %s", table)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,413 @@
+// Package trash implements soft delete. Deleting a file or folder sets its
+// deleted_at, which hides it everywhere (see meta.Client.ListFiles); the
+// trash lists what was deleted, can put it back, and purges it for good
+// after a retention period, together with the provider messages that hold
+// its chunks.
+//
+// An item deleted on its own is a trash root. Everything in a deleted
+// folder is trashed with it and points at the folder through trash_root,
+// so restoring the folder brings back exactly what was in it at the time,
+// and not what had been deleted from it before.
+//
+// Until supabase/migrations/009_trash.sql is applied, deleting removes the
+// rows at once as it always did.
+package trash
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/preview"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/versions"
+)
+
+// DefaultRetention is how long items stay in the trash when
+// TRASH_RETENTION_DAYS is not set.
+const DefaultRetention = 30 * 24 * time.Hour
+
+// Retention reads TRASH_RETENTION_DAYS.
+func Retention() time.Duration {
+	days, err := strconv.Atoi(strings.TrimSpace(os.Getenv("TRASH_RETENTION_DAYS")))
+	if err != nil || days <= 0 {
+		return DefaultRetention
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// ErrDisabled is returned by the functions that read the trash while
+// supabase/migrations/009_trash.sql is not applied.
+var ErrDisabled = errors.New("the trash needs supabase/migrations/009_trash.sql")
+
+// Item is one entry of the trash: a file or folder that was deleted on its
+// own. For folders, Size and Files count what was trashed with it.
+type Item struct {
+	ID        string  `json:"id"`
+	Name      string  `json:"name"`
+	Folder    bool    `json:"folder"`
+	Size      int64   `json:"size"`
+	Files     int     `json:"files,omitempty"`
+	Type      string  `json:"type,omitempty"`
+	Mime      string  `json:"mime,omitempty"`
+	ParentID  *string `json:"parentId"` // where it is restored to
+	DeletedAt string  `json:"deletedAt"`
+}
+
+// listColumns leaves out meta_links, which can be large.
+const listColumns = "id,name,size,type,mime,folder_id,meta_provider,deleted_at,trash_root"
+
+// Files moves the files matching query to the trash, each as a root of its
+// own.
+func Files(c *meta.Client, query url.Values) error {
+	ok, err := c.HasTrash()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.Delete("files", query)
+	}
+	q := url.Values{"deleted_at": {"is.null"}}
+	for k, v := range query {
+		q[k] = v
+	}
+	return c.Update("files", q, map[string]interface{}{"deleted_at": now(), "trash_root": nil}, nil)
+}
+
+// File moves one file to the trash.
+func File(c *meta.Client, id string) error {
+	return Files(c, url.Values{"id": {meta.Eq(id)}})
+}
+
+// Folder moves a folder to the trash with everything in it, in one
+// transaction once supabase/migrations/010_folder_ops.sql is applied.
+func Folder(c *meta.Client, id string) error {
+	ok, err := c.HasTrash()
+	if err != nil {
+		return err
+	}
+	if ok && c.Workspace != "" {
+		// The function only takes the ID.
+		if _, err := c.GetFolder(id); err != nil {
+			return err
+		}
+	}
+	if ok {
+		var done bool
+		err := c.RPC("trash_folder", map[string]string{"p_id": id}, &done)
+		if !meta.MissingFunction(err) {
+			if err == nil && !done {
+				return meta.ErrNotFound
+			}
+			return err
+		}
+	}
+	t, err := c.GetTree(id)
+	if err != nil {
+		return err
+	}
+	fileIDs := make([]string, 0, len(t.Files))
+	for _, tf := range t.Files {
+		fileIDs = append(fileIDs, tf.File.ID)
+	}
+	folderIDs := make([]string, 0, len(t.Folders))
+	for _, tf := range t.Folders {
+		folderIDs = append(folderIDs, tf.Folder.ID)
+	}
+
+	if !ok {
+		for _, ids := range batches(fileIDs) {
+			if err := c.Delete("files", url.Values{"id": {meta.In(ids)}}); err != nil {
+				return err
+			}
+		}
+		for _, ids := range batches(append(folderIDs, id)) {
+			if err := c.Delete("folders", url.Values{"id": {meta.In(ids)}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// The folder itself goes last: if this stops halfway, it is still in
+	// place and deleting it again trashes the rest.
+	with := map[string]interface{}{"deleted_at": now(), "trash_root": id}
+	for _, ids := range batches(fileIDs) {
+		if err := c.Update("files", url.Values{"id": {meta.In(ids)}}, with, nil); err != nil {
+			return err
+		}
+	}
+	for _, ids := range batches(folderIDs) {
+		if err := c.Update("folders", url.Values{"id": {meta.In(ids)}}, with, nil); err != nil {
+			return err
+		}
+	}
+	return c.Update("folders", url.Values{"id": {meta.Eq(id)}, "deleted_at": {"is.null"}},
+		map[string]interface{}{"deleted_at": now(), "trash_root": nil}, nil)
+}
+
+// List returns the trash, most recently deleted first.
+func List(c *meta.Client) ([]Item, error) {
+	roots := url.Values{"deleted_at": {"not.is.null"}, "trash_root": {"is.null"}}
+	return list(c, roots)
+}
+
+// Expired returns the trash roots deleted longer than retention ago.
+func Expired(c *meta.Client, retention time.Duration) ([]Item, error) {
+	cutoff := time.Now().UTC().Add(-retention).Format(time.RFC3339)
+	roots := url.Values{"deleted_at": {"lt." + cutoff}, "trash_root": {"is.null"}}
+	return list(c, roots)
+}
+
+func list(c *meta.Client, roots url.Values) ([]Item, error) {
+	if err := enabled(c); err != nil {
+		return nil, err
+	}
+	q := url.Values{"select": {listColumns}, "order": {"deleted_at.desc"}}
+	for k, v := range roots {
+		q[k] = v
+	}
+	files, err := c.ListFiles(q)
+	if err != nil {
+		return nil, err
+	}
+	folders, err := c.ListFolders(url.Values{
+		"select":     {"id,name,parent_id,deleted_at,trash_root"},
+		"deleted_at": roots["deleted_at"],
+		"trash_root": {"is.null"},
+		"order":      {"deleted_at.desc"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]Item, 0, len(files)+len(folders))
+	for _, f := range files {
+		items = append(items, Item{ID: f.ID, Name: f.Name, Size: f.Size, Type: f.Type, Mime: f.Mime, ParentID: f.FolderID, DeletedAt: *f.DeletedAt})
+	}
+	byID := make(map[string]*Item)
+	folderIDs := make([]string, 0, len(folders))
+	for _, f := range folders {
+		items = append(items, Item{ID: f.ID, Name: f.Name, Folder: true, ParentID: f.ParentID, DeletedAt: *f.DeletedAt})
+		folderIDs = append(folderIDs, f.ID)
+	}
+	for i := range items {
+		if items[i].Folder {
+			byID[items[i].ID] = &items[i]
+		}
+	}
+	for _, ids := range batches(folderIDs) {
+		inside, err := c.ListFiles(url.Values{
+			"select":     {"size,trash_root"},
+			"deleted_at": {"not.is.null"},
+			"trash_root": {meta.In(ids)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range inside {
+			if it := byID[*f.TrashRoot]; it != nil {
+				it.Size += f.Size
+				it.Files++
+			}
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return meta.ParseTime(items[i].DeletedAt).After(meta.ParseTime(items[j].DeletedAt))
+	})
+	return items, nil
+}
+
+// Restore takes a trash root out of the trash with everything deleted
+// along with it. If the folder it was in is gone or in the trash itself,
+// it is restored to the top level.
+func Restore(c *meta.Client, id string) error {
+	file, folder, err := root(c, id)
+	if err != nil {
+		return err
+	}
+	parent := func(p *string) (*string, error) {
+		if p == nil {
+			return nil, nil
+		}
+		if _, err := c.GetFolder(*p); errors.Is(err, meta.ErrNotFound) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	back := map[string]interface{}{"deleted_at": nil, "trash_root": nil}
+
+	if file != nil {
+		to, err := parent(file.FolderID)
+		if err != nil {
+			return err
+		}
+		back["folder_id"] = to
+		return c.Update("files", url.Values{"id": {meta.Eq(id)}}, back, nil)
+	}
+
+	inside := url.Values{"trash_root": {meta.Eq(id)}, "deleted_at": {"not.is.null"}}
+	if err := c.Update("files", inside, back, nil); err != nil {
+		return err
+	}
+	if err := c.Update("folders", inside, back, nil); err != nil {
+		return err
+	}
+	to, err := parent(folder.ParentID)
+	if err != nil {
+		return err
+	}
+	back["parent_id"] = to
+	return c.Update("folders", url.Values{"id": {meta.Eq(id)}}, back, nil)
+}
+
+// Purge deletes a trash root for good, with everything deleted along with
+// it: the messages holding the chunks of every file and of its old
+// versions, then the rows. Dedup chunks are shared, so they are only
+// released; `teddrive dedup -gc` collects them.
+//
+// Chunks the provider will not delete, and Telegram chunks uploaded before
+// their messages were recorded, are logged and left behind. Any other
+// failure stops the purge with the rest still in the trash, and purging
+// again carries on.
+func Purge(c *meta.Client, id string) error {
+	file, _, err := root(c, id)
+	if err != nil {
+		return err
+	}
+	var files []meta.File
+	if file != nil {
+		full, err := c.ListFiles(url.Values{"id": {meta.Eq(id)}, "deleted_at": {"not.is.null"}})
+		if err != nil {
+			return err
+		}
+		files = full
+	} else {
+		inside, err := c.ListFiles(url.Values{"trash_root": {meta.Eq(id)}, "deleted_at": {"not.is.null"}})
+		if err != nil {
+			return err
+		}
+		files = inside
+	}
+
+	for i := range files {
+		if err := purgeFile(c, &files[i]); err != nil {
+			return fmt.Errorf("%s: %v", files[i].Name, err)
+		}
+	}
+	if file != nil {
+		return nil
+	}
+	if err := c.Delete("folders", url.Values{"trash_root": {meta.Eq(id)}, "deleted_at": {"not.is.null"}}); err != nil {
+		return err
+	}
+	return c.Delete("folders", url.Values{"id": {meta.Eq(id)}, "deleted_at": {"not.is.null"}})
+}
+
+func purgeFile(c *meta.Client, f *meta.File) error {
+	hasVersions, err := versions.Installed(c)
+	if err != nil {
+		return err
+	}
+	contents := []versions.Content{versions.Of(f)}
+	var versionIDs []string
+	if hasVersions {
+		old, err := versions.List(c, f.ID)
+		if err != nil {
+			return err
+		}
+		for _, v := range old {
+			contents = append(contents, v.Content)
+			versionIDs = append(versionIDs, v.ID)
+		}
+	}
+	stored, err := preview.Stored(c, f.ID)
+	if err != nil {
+		return err
+	}
+	if p := stored.Content(f.ID); p != nil {
+		contents = append(contents, versions.Of(p))
+	}
+
+	// Copies of a file share its key and chunks; they go when the last
+	// one does.
+	links, sizes, err := versions.Unused(c, contents, []string{f.ID}, versionIDs)
+	if err != nil {
+		return err
+	}
+	freed, err := versions.DeleteChunks(c, f.Name, links, sizes)
+	if err != nil {
+		return err
+	}
+	// Versions go with the row, releasing their dedup references.
+	if err := c.Delete("files", url.Values{"id": {meta.Eq(f.ID)}}); err != nil {
+		return err
+	}
+	// Only now, so purging again after a failure does not give the bytes
+	// back twice.
+	tenant := quota.DefaultTenant
+	if f.WorkspaceID != "" {
+		tenant = f.WorkspaceID
+	}
+	versions.Release(c, tenant, f.Name, freed)
+	return nil
+}
+
+// root finds a trash root by ID; exactly one of file and folder is set.
+func root(c *meta.Client, id string) (*meta.File, *meta.Folder, error) {
+	if err := enabled(c); err != nil {
+		return nil, nil, err
+	}
+	q := url.Values{"id": {meta.Eq(id)}, "deleted_at": {"not.is.null"}, "trash_root": {"is.null"}}
+	q.Set("select", listColumns)
+	files, err := c.ListFiles(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(files) > 0 {
+		return &files[0], nil, nil
+	}
+	q.Set("select", "id,name,parent_id,deleted_at,trash_root")
+	folders, err := c.ListFolders(q)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(folders) > 0 {
+		return nil, &folders[0], nil
+	}
+	return nil, nil, meta.ErrNotFound
+}
+
+func enabled(c *meta.Client) error {
+	ok, err := c.HasTrash()
+	if err == nil && !ok {
+		err = ErrDisabled
+	}
+	return err
+}
+
+// batches keeps id=in.(...) filters to a safe URL length.
+func batches(ids []string) [][]string {
+	const size = 100
+	var out [][]string
+	for len(ids) > size {
+		out = append(out, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) > 0 {
+		out = append(out, ids)
+	}
+	return out
+}
+
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,96 @@
+package versions
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"teddrive-web/lib/messages"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+)
+
+// Shared reports whether a files row or a version other than the listed
+// ones holds content encrypted with key, which means it uses the same
+// chunks. Copies of a file share its key and chunks, and a restored
+// version shares them with the row it was restored to.
+func Shared(c *meta.Client, key string, fileIDs, versionIDs []string) (bool, error) {
+	var rows []struct {
+		ID string `json:"id"`
+	}
+	q := url.Values{"select": {"id"}, "meta_key": {meta.Eq(key)}, "limit": {"1"}}
+	if len(fileIDs) > 0 {
+		q.Set("id", "not."+meta.In(fileIDs))
+	}
+	if err := c.Select("files", q, &rows); err != nil || len(rows) > 0 {
+		return len(rows) > 0, err
+	}
+	ok, err := Installed(c)
+	if err != nil || !ok {
+		return false, err
+	}
+	q = url.Values{"select": {"id"}, "meta_key": {meta.Eq(key)}, "limit": {"1"}}
+	if len(versionIDs) > 0 {
+		q.Set("id", "not."+meta.In(versionIDs))
+	}
+	err = c.Select(table, q, &rows)
+	return len(rows) > 0, err
+}
+
+// Unused returns the links of contents that no files row or version
+// other than the listed ones uses, each once, with the bytes each takes up
+// on its provider.
+func Unused(c *meta.Client, contents []Content, fileIDs, versionIDs []string) ([]string, map[string]int64, error) {
+	var links []string
+	sizes := make(map[string]int64)
+	for i := range contents {
+		shared, err := Shared(c, contents[i].MetaKey, fileIDs, versionIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if shared {
+			continue
+		}
+		more, err := contents[i].Links()
+		if err != nil {
+			return nil, nil, err
+		}
+		for j, n := range quota.LinkSizes(contents[i].Size, contents[i].MetaProvider, more) {
+			if _, ok := sizes[more[j]]; !ok {
+				sizes[more[j]] = n
+				links = append(links, more[j])
+			}
+		}
+	}
+	return links, sizes, nil
+}
+
+// DeleteChunks deletes the messages behind links and returns the bytes
+// freed on each provider, to give back with Release once nothing points
+// at the chunks any more. Chunks a provider keeps are logged and skipped;
+// it stops at the first other error.
+func DeleteChunks(c *meta.Client, label string, links []string, sizes map[string]int64) (map[string]int64, error) {
+	freed := make(map[string]int64)
+	for _, link := range links {
+		err := messages.Delete(c, link)
+		switch {
+		case errors.Is(err, messages.ErrUntracked), errors.Is(err, storage.ErrUndeletable):
+			fmt.Printf("[VERSIONS] %s: chunk left on %s: %v\n", label, storage.ProviderOf(link), err)
+		case err != nil:
+			return freed, err
+		default:
+			freed[storage.ProviderOf(link)] += sizes[link]
+		}
+	}
+	return freed, nil
+}
+
+// Release gives the bytes DeleteChunks freed back to tenant.
+func Release(c *meta.Client, tenant, label string, freed map[string]int64) {
+	for provider, n := range freed {
+		if err := quota.Release(c, tenant, provider, n); err != nil {
+			fmt.Printf("[VERSIONS] %s: releasing %d bytes on %s failed: %v\n", label, n, provider, err)
+		}
+	}
+}
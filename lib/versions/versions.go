@@ -0,0 +1,355 @@
+// Package versions keeps the history of a file's content. The files row
+// always holds the current revision; whenever the content is replaced, the
+// previous manifest, key, size and hash move to an immutable file_versions
+// row. Old revisions can be listed, downloaded and restored, and are pruned
+// by a retention policy.
+//
+// Everything here degrades to plain overwrites while
+// supabase/migrations/008_file_versions.sql is not applied.
+package versions
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"teddrive-web/lib/content"
+	"teddrive-web/lib/dedup"
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/quota"
+	"teddrive-web/lib/storage"
+)
+
+const table = "file_versions"
+
+// ErrChanged is returned when the file was rewritten after the caller read
+// it. Nothing is changed; the caller should read the file again.
+var ErrChanged = errors.New("file was changed by someone else")
+
+// Content is what one revision of a file consists of.
+type Content struct {
+	Size         int64   `json:"size"`
+	MetaKey      string  `json:"meta_key"`
+	MetaLinks    string  `json:"meta_links"`
+	MetaProvider string  `json:"meta_provider"`
+	SHA256       *string `json:"sha256"`
+}
+
+// Version mirrors a row of the file_versions table: a revision that was
+// current until CreatedAt.
+type Version struct {
+	ID     string `json:"id"`
+	FileID string `json:"file_id"`
+	Content
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// Of returns the current content of f.
+func Of(f *meta.File) Content {
+	return Content{
+		Size:         f.Size,
+		MetaKey:      f.MetaKey,
+		MetaLinks:    f.MetaLinks,
+		MetaProvider: f.MetaProvider,
+		SHA256:       f.SHA256,
+	}
+}
+
+// Links decodes meta_links.
+func (c *Content) Links() ([]string, error) {
+	f := meta.File{MetaLinks: c.MetaLinks}
+	return f.Links()
+}
+
+// File returns f as it looked while v was current, for reading v with
+// lib/content.
+func (v *Version) File(f *meta.File) *meta.File {
+	old := *f
+	old.Size = v.Size
+	old.MetaKey = v.MetaKey
+	old.MetaLinks = v.MetaLinks
+	old.MetaProvider = v.MetaProvider
+	old.SHA256 = v.SHA256
+	return &old
+}
+
+var (
+	installedMu sync.Mutex
+	installed   = make(map[string]bool)
+)
+
+// Installed reports whether the file_versions table exists. A yes is
+// remembered; a no is checked again next time, so applying the migration
+// takes effect without a restart.
+func Installed(c *meta.Client) (bool, error) {
+	installedMu.Lock()
+	ok := installed[c.URL]
+	installedMu.Unlock()
+	if ok {
+		return true, nil
+	}
+	var rows []Version
+	err := c.Select(table, url.Values{"select": {"id"}, "limit": {"1"}}, &rows)
+	var apiErr *meta.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	installedMu.Lock()
+	installed[c.URL] = true
+	installedMu.Unlock()
+	return true, nil
+}
+
+// Save stores what w wrote as the content of f, after w is closed. A file
+// without an ID is inserted as a new row; otherwise the content replaces
+// f's through Replace. On success f holds the saved row; on error the
+// dedup chunks w took are given back.
+func Save(c *meta.Client, f *meta.File, w *content.Writer) error {
+	err := save(c, f, w)
+	if err != nil {
+		releaseWriter(w)
+	}
+	return err
+}
+
+func save(c *meta.Client, f *meta.File, w *content.Writer) error {
+	next := *f
+	w.Apply(&next)
+	sum := w.SHA256()
+	if f.ID != "" {
+		return Replace(c, f, Content{
+			Size:         next.Size,
+			MetaKey:      next.MetaKey,
+			MetaLinks:    next.MetaLinks,
+			MetaProvider: next.MetaProvider,
+			SHA256:       &sum,
+		})
+	}
+	ok, err := Installed(c)
+	if err != nil {
+		return err
+	}
+	if ok {
+		next.SHA256 = &sum
+	}
+	if err := c.InsertFile(&next); err != nil {
+		return err
+	}
+	*f = next
+	return nil
+}
+
+// Overwrite is Save for writers that have the last word, like WebDAV and
+// the mount: if f was changed by someone else meanwhile, that content is
+// kept as a version and what w wrote replaces it anyway.
+func Overwrite(c *meta.Client, f *meta.File, w *content.Writer) error {
+	for i := 0; ; i++ {
+		err := save(c, f, w)
+		if !errors.Is(err, ErrChanged) || i == 2 {
+			if err != nil {
+				releaseWriter(w)
+			}
+			return err
+		}
+		cur, err := c.GetFile(f.ID)
+		if err != nil {
+			releaseWriter(w)
+			return err
+		}
+		*f = *cur
+	}
+}
+
+// releaseWriter gives back what w holds when its content is not saved.
+func releaseWriter(w *content.Writer) {
+	if err := w.Release(); err != nil {
+		fmt.Printf("[VERSIONS] Releasing unsaved chunks failed: %v\n", err)
+	}
+}
+
+// Replace makes next the current content of f and keeps the previous
+// content as a version. f must be the row as the caller read it: if its
+// content changed since, ErrChanged is returned and nothing happens. On
+// success f holds the updated row.
+func Replace(c *meta.Client, f *meta.File, next Content) error {
+	ok, err := Installed(c)
+	if err != nil {
+		return err
+	}
+	patch := map[string]interface{}{
+		"size":          next.Size,
+		"meta_key":      next.MetaKey,
+		"meta_links":    next.MetaLinks,
+		"meta_provider": next.MetaProvider,
+	}
+	if ok {
+		patch["sha256"] = next.SHA256
+	}
+	var rows []meta.File
+	err = c.Update("files", url.Values{
+		"id":       {meta.Eq(f.ID)},
+		"meta_key": {meta.Eq(f.MetaKey)},
+	}, patch, &rows)
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return ErrChanged
+	}
+
+	if ok {
+		prev := Version{ID: newID(), FileID: f.ID, Content: Of(f)}
+		if err := c.Insert(table, &prev, nil); err != nil {
+			// The new content is in place; only the history entry is lost.
+			return fmt.Errorf("file %s saved, but keeping the previous version failed: %v", f.ID, err)
+		}
+		if n, err := Prune(c, f.ID, PolicyFromEnv()); err != nil {
+			fmt.Printf("[VERSIONS] Pruning %s failed: %v\n", f.ID, err)
+		} else if n > 0 {
+			fmt.Printf("[VERSIONS] Pruned %d old versions of %s\n", n, f.ID)
+		}
+	}
+	*f = rows[0]
+	return nil
+}
+
+// Restore makes v the current content of f again. The content it replaces
+// becomes a version itself, so a restore can be undone; v stays in the
+// history as it was.
+func Restore(c *meta.Client, f *meta.File, v *Version) error {
+	if v.FileID != f.ID {
+		return meta.ErrNotFound
+	}
+	if v.MetaProvider == storage.DedupProvider {
+		// The files row and v now both hold the chunks.
+		links, err := v.Links()
+		if err != nil {
+			return err
+		}
+		if err := dedup.Claim(c, links); err != nil {
+			return err
+		}
+	}
+	return Replace(c, f, v.Content)
+}
+
+// List returns the old versions of a file, newest first.
+func List(c *meta.Client, fileID string) ([]Version, error) {
+	var rows []Version
+	err := c.Select(table, url.Values{
+		"file_id": {meta.Eq(fileID)},
+		"order":   {"created_at.desc"},
+	}, &rows)
+	return rows, err
+}
+
+// Get looks up a version by ID.
+func Get(c *meta.Client, id string) (*Version, error) {
+	var rows []Version
+	if err := c.Select(table, url.Values{"id": {meta.Eq(id)}}, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// Delete drops one old version, with its chunks unless the file or
+// another version still uses them.
+func Delete(c *meta.Client, v *Version) error {
+	return drop(c, v.FileID, []Version{*v})
+}
+
+// drop deletes versions of file fileID and the chunks only they use, and
+// gives those bytes back. Dedup chunks are released by the chunk index
+// when the rows go.
+func drop(c *meta.Client, fileID string, vs []Version) error {
+	contents := make([]Content, len(vs))
+	ids := make([]string, len(vs))
+	for i, v := range vs {
+		contents[i] = v.Content
+		ids[i] = v.ID
+	}
+	links, sizes, err := Unused(c, contents, nil, ids)
+	if err != nil {
+		return err
+	}
+	label := "versions of " + fileID
+	freed, err := DeleteChunks(c, label, links, sizes)
+	if err != nil {
+		return err
+	}
+	if err := c.Delete(table, url.Values{"id": {meta.In(ids)}}); err != nil {
+		return err
+	}
+	// Only now, so deleting again after a failure does not give the bytes
+	// back twice.
+	Release(c, quota.Tenant(c), label, freed)
+	return nil
+}
+
+// Policy is the retention policy for old versions. A version is kept while
+// it is one of the newest KeepLast or younger than KeepDays days; with both
+// zero, every version is kept.
+type Policy struct {
+	KeepLast int
+	KeepDays int
+}
+
+// PolicyFromEnv reads VERSIONS_KEEP_LAST and VERSIONS_KEEP_DAYS.
+func PolicyFromEnv() Policy {
+	return Policy{KeepLast: envInt("VERSIONS_KEEP_LAST"), KeepDays: envInt("VERSIONS_KEEP_DAYS")}
+}
+
+func envInt(name string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(os.Getenv(name)))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Prune deletes the versions of a file that p no longer keeps, with their
+// chunks, and returns how many it deleted.
+func Prune(c *meta.Client, fileID string, p Policy) (int, error) {
+	if p.KeepLast == 0 && p.KeepDays == 0 {
+		return 0, nil
+	}
+	rows, err := List(c, fileID)
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().AddDate(0, 0, -p.KeepDays)
+	var old []Version
+	for i, v := range rows {
+		if i < p.KeepLast || (p.KeepDays > 0 && meta.ParseTime(v.CreatedAt).After(cutoff)) {
+			continue
+		}
+		old = append(old, v)
+	}
+	if len(old) == 0 {
+		return 0, nil
+	}
+	if err := drop(c, fileID, old); err != nil {
+		return 0, err
+	}
+	return len(old), nil
+}
+
+func newID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "v_" + base64.RawURLEncoding.EncodeToString(b)
+}
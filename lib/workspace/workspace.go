@@ -0,0 +1,620 @@
+// Package workspace keeps several teams apart on one deployment. Each
+// workspace has its own files and folders, its own Discord channel and
+// Telegram chat, and members with a role: owners manage the workspace and
+// its members, editors change files, viewers only read.
+//
+// Members are Supabase Auth users; the browser sends its session as a
+// bearer token and picks a workspace with the X-Workspace header. Handlers
+// call Resolve and use the Access's client, which only sees that
+// workspace. Until supabase/migrations/012_workspaces.sql is applied there
+// is only the default workspace, open to everyone as before.
+package workspace
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"teddrive-web/lib/auth"
+	"teddrive-web/lib/meta"
+)
+
+// DefaultID is the workspace everything from before workspaces is in, and
+// the one used when a request names none.
+const DefaultID = "default"
+
+// Roles, from least to most allowed.
+const (
+	Viewer = "viewer"
+	Editor = "editor"
+	Owner  = "owner"
+)
+
+// Guest is the role of someone who is not a member but has been given
+// some files or folders of the workspace through its access list (see
+// lib/acl). It is never stored; handlers that let guests in check the
+// access list for each item.
+const Guest = "guest"
+
+var rank = map[string]int{Viewer: 1, Editor: 2, Owner: 3}
+
+var (
+	// ErrDisabled is returned for anything but the default workspace while
+	// the migration is not applied.
+	ErrDisabled = errors.New("workspaces need supabase/migrations/012_workspaces.sql")
+	// ErrUnauthorized is returned when a workspace needs a signed-in member.
+	ErrUnauthorized = errors.New("sign in to use this workspace")
+	// ErrForbidden is returned when the caller's role does not allow it.
+	ErrForbidden = errors.New("not allowed in this workspace")
+	// ErrRole is returned for a role that is not owner, editor or viewer.
+	ErrRole = errors.New("role must be owner, editor or viewer")
+	// ErrUser is returned for a member ID that is not a Supabase user ID.
+	ErrUser = errors.New("user ID must be a Supabase Auth user ID")
+	// ErrLastOwner is returned when a change would leave no owner.
+	ErrLastOwner = errors.New("a workspace needs at least one owner")
+	// ErrName is returned for an empty workspace name.
+	ErrName = errors.New("workspace name is required")
+)
+
+// Workspace mirrors a row of the workspaces table.
+type Workspace struct {
+	ID               string  `json:"id"`
+	Name             string  `json:"name"`
+	DiscordChannelID *string `json:"discord_channel_id"`
+	TelegramChatID   *string `json:"telegram_chat_id"`
+	Public           bool    `json:"public"`
+	CreatedAt        string  `json:"created_at,omitempty"`
+}
+
+// Targets returns the workspace's own upload targets by provider.
+func (w *Workspace) Targets() map[string]string {
+	t := make(map[string]string)
+	if w.DiscordChannelID != nil && *w.DiscordChannelID != "" {
+		t["discord"] = *w.DiscordChannelID
+	}
+	if w.TelegramChatID != nil && *w.TelegramChatID != "" {
+		t["telegram"] = *w.TelegramChatID
+	}
+	return t
+}
+
+// Member mirrors a row of the workspace_members table.
+type Member struct {
+	WorkspaceID string `json:"workspace_id"`
+	UserID      string `json:"user_id"`
+	Role        string `json:"role"`
+	CreatedAt   string `json:"created_at,omitempty"`
+}
+
+// Access is what a caller may do in a workspace.
+type Access struct {
+	Workspace *Workspace
+	Role      string
+	UserID    string // "" for anonymous callers and the admin token
+	// Client only sees the workspace's files and folders and uploads to
+	// its channel and chat.
+	Client *meta.Client
+}
+
+// Can reports whether the caller's role is at least role.
+func (a *Access) Can(role string) bool {
+	return rank[a.Role] >= rank[role]
+}
+
+var (
+	installedMu sync.Mutex
+	installed   = make(map[string]bool)
+)
+
+// Installed reports whether the workspaces table exists. A yes is
+// remembered; a no is checked again next time.
+func Installed(c *meta.Client) (bool, error) {
+	installedMu.Lock()
+	ok := installed[c.URL]
+	installedMu.Unlock()
+	if ok {
+		return true, nil
+	}
+	var rows []Workspace
+	err := c.Select("workspaces", url.Values{"select": {"id"}, "limit": {"1"}}, &rows)
+	var apiErr *meta.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	installedMu.Lock()
+	installed[c.URL] = true
+	installedMu.Unlock()
+	return true, nil
+}
+
+// Get looks up a workspace by ID.
+func Get(c *meta.Client, id string) (*Workspace, error) {
+	var rows []Workspace
+	if err := c.Select("workspaces", url.Values{"id": {meta.Eq(id)}}, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// legacy is the default workspace before the migration.
+var legacy = Workspace{ID: DefaultID, Name: "Default", Public: true}
+
+// Open works out what userID, or the admin when admin is set, may do in
+// workspace id. Anyone may edit a public workspace; others need to be
+// members. A workspace the caller cannot see is refused the same way
+// whether it exists or not.
+func Open(c *meta.Client, id, userID string, admin bool) (*Access, error) {
+	if id == "" {
+		id = DefaultID
+	}
+	ok, err := Installed(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if id != DefaultID {
+			return nil, ErrDisabled
+		}
+		role := Editor
+		if admin {
+			role = Owner
+		}
+		ws := legacy
+		return &Access{Workspace: &ws, Role: role, UserID: userID, Client: c}, nil
+	}
+
+	ws, err := Get(c, id)
+	if errors.Is(err, meta.ErrNotFound) && !admin {
+		return nil, denied(userID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	role := ""
+	switch {
+	case admin:
+		role = Owner
+	case userID != "":
+		if role, err = roleOf(c, id, userID); err != nil {
+			return nil, err
+		}
+	}
+	if role == "" && ws.Public {
+		role = Editor
+	}
+	if role == "" && userID != "" {
+		if role, err = guestOf(c, id, userID); err != nil {
+			return nil, err
+		}
+	}
+	if role == "" {
+		return nil, denied(userID)
+	}
+	return &Access{Workspace: ws, Role: role, UserID: userID, Client: c.In(ws.ID, ws.Targets())}, nil
+}
+
+func denied(userID string) error {
+	if userID == "" {
+		return ErrUnauthorized
+	}
+	return ErrForbidden
+}
+
+func roleOf(c *meta.Client, id, userID string) (string, error) {
+	var rows []Member
+	err := c.Select("workspace_members", url.Values{
+		"workspace_id": {meta.Eq(id)},
+		"user_id":      {meta.Eq(userID)},
+	}, &rows)
+	if err != nil || len(rows) == 0 {
+		return "", err
+	}
+	return rows[0].Role, nil
+}
+
+// guestOf returns Guest when the access list gives userID anything in
+// workspace id. Before supabase/migrations/013_acl.sql there is no list.
+func guestOf(c *meta.Client, id, userID string) (string, error) {
+	ids, err := granted(c, url.Values{"workspace_id": {meta.Eq(id)}}, userID)
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	return Guest, nil
+}
+
+// granted returns the workspaces whose access lists have entries for
+// userID that are not a deny.
+func granted(c *meta.Client, query url.Values, userID string) ([]string, error) {
+	q := url.Values{"select": {"workspace_id"}, "user_id": {meta.Eq(userID)}, "access": {"neq.deny"}}
+	for k, v := range query {
+		q[k] = v
+	}
+	var rows []struct {
+		WorkspaceID string `json:"workspace_id"`
+	}
+	err := c.Select("acl_entries", q, &rows)
+	var apiErr *meta.APIError
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(rows))
+	for _, row := range rows {
+		ids = append(ids, row.WorkspaceID)
+	}
+	return ids, nil
+}
+
+// Resolve opens the workspace a request names in its X-Workspace header,
+// or ?workspace=, for its caller, and checks their role is at least role.
+func Resolve(c *meta.Client, r *http.Request, role string) (*Access, error) {
+	id := strings.TrimSpace(r.Header.Get("X-Workspace"))
+	if id == "" {
+		id = strings.TrimSpace(r.URL.Query().Get("workspace"))
+	}
+	return Authorize(c, r, id, role)
+}
+
+// Authorize is Resolve for workspace id, whatever the request names.
+func Authorize(c *meta.Client, r *http.Request, id, role string) (*Access, error) {
+	userID, err := auth.UserID(r)
+	if errors.Is(err, auth.ErrSession) {
+		return nil, ErrUnauthorized
+	}
+	if err != nil {
+		return nil, err
+	}
+	a, err := Open(c, id, userID, auth.IsAdmin(r))
+	if err != nil {
+		return nil, err
+	}
+	if !a.Can(role) {
+		return nil, ErrForbidden
+	}
+	return a, nil
+}
+
+// For returns c confined to workspace id without asking who wants it, for
+// the command line and for links that carry their own permission. Before
+// the migration it returns c.
+func For(c *meta.Client, id string) (*meta.Client, error) {
+	if id == "" {
+		id = DefaultID
+	}
+	a, err := Open(c, id, "", true)
+	if err != nil {
+		return nil, err
+	}
+	return a.Client, nil
+}
+
+// Of returns c confined to the workspace that row id of table, "files" or
+// "folders", is in, for requests that reach it through a link rather than
+// a workspace. Before the migration it returns c.
+func Of(c *meta.Client, table, id string) (*meta.Client, error) {
+	ok, err := Installed(c)
+	if err != nil || !ok {
+		return c, err
+	}
+	var rows []struct {
+		WorkspaceID string `json:"workspace_id"`
+	}
+	err = c.Select(table, url.Values{"select": {"workspace_id"}, "id": {meta.Eq(id)}}, &rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return For(c, rows[0].WorkspaceID)
+}
+
+// Owns returns meta.ErrNotFound unless row id of table, "files" or
+// "folders", is in c's workspace, in the trash or not. It guards things
+// kept by file or folder ID, like share and drop links.
+func Owns(c *meta.Client, table, id string) error {
+	var rows []struct {
+		ID string `json:"id"`
+	}
+	if err := c.Select(table, url.Values{"select": {"id"}, "id": {meta.Eq(id)}}, &rows); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return meta.ErrNotFound
+	}
+	return nil
+}
+
+// FromEnv is meta.FromEnv confined to the workspace TEDDRIVE_WORKSPACE
+// names, or the default workspace.
+func FromEnv() (*meta.Client, error) {
+	c, err := meta.FromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return For(c, strings.TrimSpace(os.Getenv("TEDDRIVE_WORKSPACE")))
+}
+
+// Entry is a workspace with the caller's role in it.
+type Entry struct {
+	Workspace
+	Role string `json:"role"`
+}
+
+// List returns the workspaces userID is a member of or a guest in, and the
+// public ones. The admin sees all of them.
+func List(c *meta.Client, userID string, admin bool) ([]Entry, error) {
+	ok, err := Installed(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		role := Editor
+		if admin {
+			role = Owner
+		}
+		return []Entry{{Workspace: legacy, Role: role}}, nil
+	}
+
+	roles := make(map[string]string)
+	if userID != "" {
+		var members []Member
+		if err := c.Select("workspace_members", url.Values{"user_id": {meta.Eq(userID)}}, &members); err != nil {
+			return nil, err
+		}
+		for _, m := range members {
+			roles[m.WorkspaceID] = m.Role
+		}
+		guests, err := granted(c, nil, userID)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range guests {
+			if roles[id] == "" {
+				roles[id] = Guest
+			}
+		}
+	}
+	q := url.Values{"order": {"created_at.asc"}}
+	if !admin {
+		ids := make([]string, 0, len(roles))
+		for id := range roles {
+			ids = append(ids, id)
+		}
+		if len(ids) > 0 {
+			q.Set("or", "(public.eq.true,id."+meta.In(ids)+")")
+		} else {
+			q.Set("public", "eq.true")
+		}
+	}
+	var rows []Workspace
+	if err := c.Select("workspaces", q, &rows); err != nil {
+		return nil, err
+	}
+	out := make([]Entry, 0, len(rows))
+	for _, ws := range rows {
+		role := roles[ws.ID]
+		switch {
+		case admin:
+			role = Owner
+		case (role == "" || role == Guest) && ws.Public:
+			role = Editor
+		}
+		out = append(out, Entry{Workspace: ws, Role: role})
+	}
+	return out, nil
+}
+
+// Settings are the fields of a workspace its owners can change. Nil
+// fields stay as they are; an empty channel or chat goes back to the
+// default from the environment.
+type Settings struct {
+	Name             *string `json:"name,omitempty"`
+	DiscordChannelID *string `json:"discordChannelId,omitempty"`
+	TelegramChatID   *string `json:"telegramChatId,omitempty"`
+	Public           *bool   `json:"public,omitempty"`
+}
+
+func (s Settings) patch() (map[string]interface{}, error) {
+	p := make(map[string]interface{})
+	if s.Name != nil {
+		name := strings.TrimSpace(*s.Name)
+		if name == "" {
+			return nil, ErrName
+		}
+		p["name"] = name
+	}
+	target := func(v string) interface{} {
+		if v = strings.TrimSpace(v); v == "" {
+			return nil
+		}
+		return v
+	}
+	if s.DiscordChannelID != nil {
+		p["discord_channel_id"] = target(*s.DiscordChannelID)
+	}
+	if s.TelegramChatID != nil {
+		p["telegram_chat_id"] = target(*s.TelegramChatID)
+	}
+	if s.Public != nil {
+		p["public"] = *s.Public
+	}
+	return p, nil
+}
+
+// Create makes a workspace with ownerID as its first owner. Only the admin
+// may create one without an owner.
+func Create(c *meta.Client, ownerID string, s Settings) (*Workspace, error) {
+	ok, err := Installed(c)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrDisabled
+	}
+	if s.Name == nil {
+		return nil, ErrName
+	}
+	row, err := s.patch()
+	if err != nil {
+		return nil, err
+	}
+	row["id"] = newID()
+
+	var rows []Workspace
+	if err := c.Insert("workspaces", row, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("workspace insert returned no row")
+	}
+	ws := &rows[0]
+	if ownerID != "" {
+		err := c.Insert("workspace_members", Member{WorkspaceID: ws.ID, UserID: ownerID, Role: Owner}, nil)
+		if err != nil {
+			c.Delete("workspaces", url.Values{"id": {meta.Eq(ws.ID)}})
+			return nil, err
+		}
+	}
+	return ws, nil
+}
+
+// Update changes a workspace's settings.
+func Update(c *meta.Client, id string, s Settings) (*Workspace, error) {
+	p, err := s.patch()
+	if err != nil {
+		return nil, err
+	}
+	if len(p) == 0 {
+		return Get(c, id)
+	}
+	var rows []Workspace
+	if err := c.Update("workspaces", url.Values{"id": {meta.Eq(id)}}, p, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, meta.ErrNotFound
+	}
+	return &rows[0], nil
+}
+
+// Members lists a workspace's members, owners first.
+func Members(c *meta.Client, id string) ([]Member, error) {
+	var rows []Member
+	err := c.Select("workspace_members", url.Values{
+		"workspace_id": {meta.Eq(id)},
+		"order":        {"role.desc,created_at.asc"},
+	}, &rows)
+	return rows, err
+}
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ValidUser reports whether userID looks like a Supabase Auth user ID.
+func ValidUser(userID string) bool {
+	return uuidRe.MatchString(userID)
+}
+
+// SetMember adds userID to a workspace with role, or changes their role.
+func SetMember(c *meta.Client, id, userID, role string) error {
+	if rank[role] == 0 {
+		return ErrRole
+	}
+	if !ValidUser(userID) {
+		return ErrUser
+	}
+	current, err := roleOf(c, id, userID)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return c.Insert("workspace_members", Member{WorkspaceID: id, UserID: userID, Role: role}, nil)
+	}
+	if current == Owner && role != Owner {
+		if err := keepOwner(c, id); err != nil {
+			return err
+		}
+	}
+	return c.Update("workspace_members", member(id, userID), map[string]string{"role": role}, nil)
+}
+
+// RemoveMember takes userID out of a workspace. Their files stay.
+func RemoveMember(c *meta.Client, id, userID string) error {
+	current, err := roleOf(c, id, userID)
+	if err != nil {
+		return err
+	}
+	if current == "" {
+		return meta.ErrNotFound
+	}
+	if current == Owner {
+		if err := keepOwner(c, id); err != nil {
+			return err
+		}
+	}
+	return c.Delete("workspace_members", member(id, userID))
+}
+
+// keepOwner fails unless the workspace has an owner besides the one about
+// to go.
+func keepOwner(c *meta.Client, id string) error {
+	var owners []Member
+	err := c.Select("workspace_members", url.Values{
+		"select":       {"user_id"},
+		"workspace_id": {meta.Eq(id)},
+		"role":         {meta.Eq(Owner)},
+		"limit":        {"2"},
+	}, &owners)
+	if err != nil {
+		return err
+	}
+	if len(owners) < 2 {
+		return ErrLastOwner
+	}
+	return nil
+}
+
+func member(id, userID string) url.Values {
+	return url.Values{"workspace_id": {meta.Eq(id)}, "user_id": {meta.Eq(userID)}}
+}
+
+// WriteError answers a request Resolve or a change refused: 401, 403, 400
+// for bad input, 404, 503 before the migration, 502 for anything else.
+func WriteError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case errors.Is(err, ErrForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, ErrRole), errors.Is(err, ErrUser), errors.Is(err, ErrLastOwner), errors.Is(err, ErrName):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, meta.ErrNotFound):
+		http.Error(w, "Not found", http.StatusNotFound)
+	case errors.Is(err, ErrDisabled):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		fmt.Printf("[WORKSPACE] Error: %v\n", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	}
+}
+
+func newID() string {
+	b := make([]byte, 9)
+	rand.Read(b)
+	return "w_" + base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,187 @@
+package workspace
+
+import (
+	"errors"
+	"testing"
+
+	"teddrive-web/lib/meta"
+	"teddrive-web/lib/meta/metatest"
+)
+
+const (
+	ownerUser  = "0b5f3c1e-2a4d-4e6f-8a9b-0c1d2e3f4a5b"
+	viewerUser = "7e8f9a0b-1c2d-4e3f-9a4b-5c6d7e8f9a0b"
+	guestUser  = "3c4d5e6f-7a8b-4c9d-8e0f-1a2b3c4d5e6f"
+	deniedUser = "9a8b7c6d-5e4f-4a3b-9c2d-1e0f9a8b7c6d"
+	stranger   = "5f6e7d8c-9b0a-4f1e-8d2c-3b4a5f6e7d8c"
+)
+
+// fixture has a private workspace "team" and a public one "open" with its
+// own Discord channel. ownerUser owns team, viewerUser views both,
+// guestUser has a folder of team through its access list and deniedUser
+// only a deny there.
+func fixture(t *testing.T) *metatest.Server {
+	s := metatest.New(t)
+	s.Table("workspaces", "id")
+	s.Table("workspace_members")
+	s.Table("acl_entries", "id")
+	s.Table("files", "id")
+	s.Add("workspaces",
+		metatest.Row{"id": "team", "name": "Team", "public": false},
+		metatest.Row{"id": "open", "name": "Open", "public": true, "discord_channel_id": "123"},
+	)
+	s.Add("workspace_members",
+		metatest.Row{"workspace_id": "team", "user_id": ownerUser, "role": Owner},
+		metatest.Row{"workspace_id": "team", "user_id": viewerUser, "role": Viewer},
+		metatest.Row{"workspace_id": "open", "user_id": viewerUser, "role": Viewer},
+	)
+	s.Add("acl_entries",
+		metatest.Row{"id": "1", "workspace_id": "team", "user_id": guestUser, "folder_id": "f", "access": "read"},
+		metatest.Row{"id": "2", "workspace_id": "team", "user_id": deniedUser, "folder_id": "f", "access": "deny"},
+	)
+	s.Add("files",
+		metatest.Row{"id": "in-team", "name": "a", "workspace_id": "team"},
+		metatest.Row{"id": "in-open", "name": "b", "workspace_id": "open"},
+	)
+	return s
+}
+
+func TestOpen(t *testing.T) {
+	c := fixture(t).Client()
+	tests := []struct {
+		name   string
+		id     string
+		user   string
+		admin  bool
+		role   string
+		target string
+		err    error
+	}{
+		{name: "owner", id: "team", user: ownerUser, role: Owner},
+		{name: "member", id: "team", user: viewerUser, role: Viewer},
+		{name: "admin", id: "team", admin: true, role: Owner},
+		{name: "guest", id: "team", user: guestUser, role: Guest},
+		{name: "only a deny", id: "team", user: deniedUser, err: ErrForbidden},
+		{name: "stranger", id: "team", user: stranger, err: ErrForbidden},
+		{name: "anonymous", id: "team", err: ErrUnauthorized},
+		{name: "public, anonymous", id: "open", role: Editor, target: "123"},
+		{name: "public, stranger", id: "open", user: stranger, role: Editor, target: "123"},
+		{name: "public, member keeps role", id: "open", user: viewerUser, role: Viewer, target: "123"},
+		{name: "missing", id: "gone", user: ownerUser, err: ErrForbidden},
+		{name: "missing, anonymous", id: "gone", err: ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := Open(c, tt.id, tt.user, tt.admin)
+			if tt.err != nil {
+				if err != tt.err {
+					t.Fatalf("Open = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.Role != tt.role || a.UserID != tt.user || a.Workspace.ID != tt.id {
+				t.Errorf("Open = role %s, user %q, workspace %s", a.Role, a.UserID, a.Workspace.ID)
+			}
+			if a.Client.Workspace != tt.id || a.Client.Target("discord") != tt.target {
+				t.Errorf("client in %q uploading to %q", a.Client.Workspace, a.Client.Target("discord"))
+			}
+		})
+	}
+}
+
+func TestOpenBeforeMigration(t *testing.T) {
+	c := metatest.New(t).Client()
+	a, err := Open(c, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Role != Editor || a.Workspace.ID != DefaultID || a.Client != c {
+		t.Errorf("Open = role %s in %s", a.Role, a.Workspace.ID)
+	}
+	if a, err := Open(c, DefaultID, "", true); err != nil || a.Role != Owner {
+		t.Errorf("Open as admin = %v, %v, want owner", a, err)
+	}
+	if _, err := Open(c, "team", ownerUser, true); err != ErrDisabled {
+		t.Errorf("Open of another workspace = %v, want ErrDisabled", err)
+	}
+}
+
+func TestCan(t *testing.T) {
+	tests := []struct {
+		role, need string
+		want       bool
+	}{
+		{Owner, Owner, true},
+		{Owner, Viewer, true},
+		{Editor, Editor, true},
+		{Editor, Owner, false},
+		{Viewer, Viewer, true},
+		{Viewer, Editor, false},
+		{Guest, Viewer, false},
+		{"", Viewer, false},
+	}
+	for _, tt := range tests {
+		a := &Access{Role: tt.role}
+		if got := a.Can(tt.need); got != tt.want {
+			t.Errorf("%q.Can(%s) = %v, want %v", tt.role, tt.need, got, tt.want)
+		}
+	}
+}
+
+func TestOwnsAndOf(t *testing.T) {
+	c := fixture(t).Client()
+	team, err := For(c, "team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Owns(team, "files", "in-team"); err != nil {
+		t.Errorf("Owns(in-team) = %v", err)
+	}
+	if err := Owns(team, "files", "in-open"); !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("Owns(in-open) = %v, want ErrNotFound", err)
+	}
+	open, err := Of(c, "files", "in-open")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if open.Workspace != "open" || open.Target("discord") != "123" {
+		t.Errorf("Of = client in %q", open.Workspace)
+	}
+	if _, err := Of(c, "files", "nope"); !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("Of(nope) = %v, want ErrNotFound", err)
+	}
+}
+
+func TestMembers(t *testing.T) {
+	c := fixture(t).Client()
+	if err := SetMember(c, "team", ownerUser, Viewer); err != ErrLastOwner {
+		t.Errorf("demoting the last owner = %v, want ErrLastOwner", err)
+	}
+	if err := RemoveMember(c, "team", ownerUser); err != ErrLastOwner {
+		t.Errorf("removing the last owner = %v, want ErrLastOwner", err)
+	}
+	if err := SetMember(c, "team", viewerUser, "admin"); err != ErrRole {
+		t.Errorf("unknown role = %v, want ErrRole", err)
+	}
+	if err := SetMember(c, "team", "bob", Viewer); err != ErrUser {
+		t.Errorf("bad user = %v, want ErrUser", err)
+	}
+	if err := SetMember(c, "team", viewerUser, Owner); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveMember(c, "team", ownerUser); err != nil {
+		t.Errorf("removing one of two owners = %v", err)
+	}
+	if a, err := Open(c, "team", viewerUser, false); err != nil || a.Role != Owner {
+		t.Errorf("Open after promotion = %v, %v", a, err)
+	}
+	if _, err := Open(c, "team", ownerUser, false); err != ErrForbidden {
+		t.Errorf("Open after removal = %v, want ErrForbidden", err)
+	}
+	if err := RemoveMember(c, "team", ownerUser); !errors.Is(err, meta.ErrNotFound) {
+		t.Errorf("removing a non-member = %v, want ErrNotFound", err)
+	}
+}
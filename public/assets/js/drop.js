@@ -0,0 +1,176 @@
+// Drop link page for TEDDRIVE: upload-only, the sender never sees the folder
+const urlParams = new URLSearchParams(window.location.search);
+const dropId = urlParams.get('id');
+let dropInfo = null;
+
+if (!dropId) {
+    showError('Invalid drop link. Drop ID is missing.');
+} else {
+    loadDrop();
+}
+
+async function loadDrop() {
+    try {
+        const res = await fetch(`/api/drop/${encodeURIComponent(dropId)}`);
+        if (!res.ok) {
+            showError(dropErrorMessage(res.status));
+            return;
+        }
+        dropInfo = await res.json();
+        showUploadForm();
+    } catch (error) {
+        console.error('Error loading drop link:', error);
+        showError('Network error. Please check your connection and try again.');
+    }
+}
+
+function dropErrorMessage(status) {
+    if (status === 401) return 'Incorrect password.';
+    if (status === 410) return 'This link has expired or been closed.';
+    if (status === 404) return 'This link does not exist.';
+    if (status === 413) return 'This link has no space left for that file.';
+    return 'Something went wrong.';
+}
+
+function showUploadForm() {
+    const limits = [];
+    if (dropInfo.expiresAt) limits.push(`Open until ${new Date(dropInfo.expiresAt).toLocaleString()}`);
+    if (dropInfo.bytesLeft != null) limits.push(`${formatSize(dropInfo.bytesLeft)} left`);
+
+    const content = document.getElementById('content');
+    content.innerHTML = `
+        <p style="color: var(--text-muted);">Files you send here go straight to the owner. You won't be able to see anything else in their drive.</p>
+        ${limits.length ? `<p style="color: var(--text-muted); font-size: 0.9rem;">${limits.join(' &middot; ')}</p>` : ''}
+        <div class="drop-zone" id="dropZone" onclick="document.getElementById('dropFiles').click()">
+            <i class="fa-solid fa-cloud-arrow-up"></i>
+            <div id="dropSelection">Click or drag files here</div>
+        </div>
+        <input type="file" id="dropFiles" multiple style="display: none;" onchange="showSelection()">
+        ${dropInfo.passwordRequired ? `
+        <input type="password" id="dropPassword" class="drop-input" placeholder="Password" autocomplete="current-password">
+        ` : ''}
+        <button class="download-btn" onclick="sendFiles()">
+            <i class="fa-solid fa-paper-plane"></i>
+            Send Files
+        </button>
+        <div class="sent-list" id="sentList"></div>
+        <div class="footer-info">
+            <p>Files are encrypted before they are stored</p>
+        </div>
+    `;
+
+    const zone = document.getElementById('dropZone');
+    zone.addEventListener('dragover', e => { e.preventDefault(); zone.classList.add('dragover'); });
+    zone.addEventListener('dragleave', () => zone.classList.remove('dragover'));
+    zone.addEventListener('drop', e => {
+        e.preventDefault();
+        zone.classList.remove('dragover');
+        document.getElementById('dropFiles').files = e.dataTransfer.files;
+        showSelection();
+    });
+}
+
+function showSelection() {
+    const picked = document.getElementById('dropFiles').files;
+    const total = Array.from(picked).reduce((acc, f) => acc + f.size, 0);
+    document.getElementById('dropSelection').innerText = picked.length
+        ? `${picked.length} file${picked.length === 1 ? '' : 's'} (${formatSize(total)})`
+        : 'Click or drag files here';
+}
+
+function showError(message) {
+    document.getElementById('content').innerHTML = `
+        <div class="error-message">
+            <i class="fa-solid fa-exclamation-triangle" style="margin-right: 10px;"></i>
+            ${message}
+        </div>
+    `;
+}
+
+async function sendFiles() {
+    const picked = Array.from(document.getElementById('dropFiles').files);
+    if (picked.length === 0) {
+        alert('Choose at least one file.');
+        return;
+    }
+    const total = picked.reduce((acc, f) => acc + f.size, 0);
+    if (dropInfo.bytesLeft != null && total > dropInfo.bytesLeft) {
+        alert(`These files are ${formatSize(total)}, but only ${formatSize(dropInfo.bytesLeft)} can be sent to this link.`);
+        return;
+    }
+
+    const passwordInput = document.getElementById('dropPassword');
+    const password = passwordInput ? passwordInput.value : '';
+
+    document.getElementById('progressModal').style.display = 'flex';
+    try {
+        for (let n = 0; n < picked.length; n++) {
+            document.getElementById('progressTitle').innerText = `Uploading ${n + 1} of ${picked.length}...`;
+            await sendFile(picked[n], password);
+            document.getElementById('sentList').innerHTML +=
+                `<div><i class="fa-solid fa-check" style="color: #22c55e;"></i> ${escapeHTML(picked[n].name)}</div>`;
+        }
+        document.getElementById('progressModal').style.display = 'none';
+        document.getElementById('dropFiles').value = '';
+        showSelection();
+        alert('All files sent.');
+    } catch (e) {
+        document.getElementById('progressModal').style.display = 'none';
+        alert('Upload failed: ' + e.message);
+    }
+}
+
+// Same chunk pipeline as the main app: a fresh key per file, each chunk
+// encrypted and stored by the server. The server signs every stored chunk
+// and only accepts the file if all receipts check out.
+async function sendFile(file, password) {
+    const keyBytes = window.crypto.getRandomValues(new Uint8Array(32));
+    const keyBase64 = btoa(String.fromCharCode(...keyBytes));
+    const total = Math.max(1, Math.ceil(file.size / dropInfo.chunkSize));
+    const parts = [];
+
+    for (let i = 0; i < total; i++) {
+        const pct = Math.round(((i + 1) / total) * 100);
+        document.getElementById('progressBar').style.width = pct + '%';
+        document.getElementById('progressText').innerText = `${file.name}: ${pct}%`;
+
+        const form = new FormData();
+        form.append('chunkData', file.slice(i * dropInfo.chunkSize, (i + 1) * dropInfo.chunkSize));
+        form.append('chunkIndex', i);
+        form.append('keyBase64', keyBase64);
+        form.append('fileName', file.name);
+        form.append('password', password);
+
+        const res = await fetch(`/api/drop/${encodeURIComponent(dropId)}/chunk`, { method: 'POST', body: form });
+        if (!res.ok) {
+            throw new Error(res.status === 502 ? await res.text() : dropErrorMessage(res.status));
+        }
+        parts.push(await res.json());
+    }
+
+    const res = await fetch(`/api/drop/${encodeURIComponent(dropId)}`, {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({
+            password: password,
+            name: file.name,
+            mime: file.type || 'application/octet-stream',
+            key: keyBase64,
+            parts: parts
+        })
+    });
+    if (!res.ok) throw new Error(dropErrorMessage(res.status));
+}
+
+function escapeHTML(s) {
+    return s.replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c]));
+}
+
+function formatSize(bytes) {
+    if (bytes === 0) return '0 B';
+    const sizes = ['B', 'KB', 'MB', 'GB', 'TB'];
+    const i = Math.floor(Math.log(bytes) / Math.log(1024));
+    if (i === 0) return bytes + ' B';
+    const size = (bytes / Math.pow(1024, i)).toFixed(1);
+    return size + ' ' + sizes[i];
+}
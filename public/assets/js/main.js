@@ -6,16 +6,21 @@ let files = [];
 let folders = [];
 let currentFolder = null;
 let currentFilter = 'all';
+let trashInstalled = true; // false until migration 009 adds deleted_at
 let selectedFile = null;
 let cryptoKey = null;
 let useDatabase = true;
 let supabaseClient = null;
+let workspaces = [];
+let workspacesEnabled = false; // false until migration 012 adds workspaces
+let currentWorkspace = localStorage.getItem('ois_workspace') || 'default';
 
 // === INITIALIZATION ===
 document.addEventListener('DOMContentLoaded', function() {
     console.log('TEDDRIVE initializing...');
-    initSupabase().then(() => {
+    initSupabase().then(async () => {
         console.log('[INIT] Supabase initialization complete, loading data...');
+        await loadWorkspaces();
         loadData();
     });
 });
@@ -137,6 +142,572 @@ GRANT ALL ON public.folders TO anon, authenticated;`);
     }
 }
 
+// === WORKSPACES ===
+// Sends an API request in the current workspace, signed in as the Supabase
+// Auth user when there is one.
+async function apiFetch(url, options = {}) {
+    const headers = new Headers(options.headers || {});
+    headers.set('X-Workspace', currentWorkspace);
+    if (supabaseClient && !headers.has('Authorization')) {
+        const { data } = await supabaseClient.auth.getSession();
+        if (data && data.session) headers.set('Authorization', 'Bearer ' + data.session.access_token);
+    }
+    return fetch(url, { ...options, headers: headers });
+}
+
+async function loadWorkspaces() {
+    workspaces = [];
+    workspacesEnabled = false;
+    try {
+        const res = await apiFetch('/api/workspaces');
+        if (res.ok) {
+            const data = await res.json();
+            workspaces = data.workspaces;
+            workspacesEnabled = data.enabled;
+            document.getElementById('accountLabel').textContent = data.userId ? 'Account' : 'Sign in';
+        }
+    } catch (error) {
+        console.error('[WORKSPACE] Failed to load workspaces:', error);
+    }
+    if (!workspaces.some(ws => ws.id === currentWorkspace)) {
+        currentWorkspace = workspaces.length ? workspaces[0].id : 'default';
+        localStorage.setItem('ois_workspace', currentWorkspace);
+    }
+    
+    const select = document.getElementById('workspaceSelect');
+    select.innerHTML = '';
+    workspaces.forEach(ws => {
+        const option = document.createElement('option');
+        option.value = ws.id;
+        option.textContent = `${ws.name} (${ws.role})`;
+        option.selected = ws.id === currentWorkspace;
+        select.appendChild(option);
+    });
+    document.getElementById('workspaceSection').style.display = workspacesEnabled ? '' : 'none';
+}
+
+function switchWorkspace(id) {
+    currentWorkspace = id;
+    localStorage.setItem('ois_workspace', id);
+    currentFolder = null;
+    clearSelection();
+    loadData();
+}
+
+function currentWorkspaceInfo() {
+    return workspaces.find(ws => ws.id === currentWorkspace) || null;
+}
+
+function showAccountModal() {
+    let modal = document.getElementById('accountModal');
+    if (!modal) {
+        const inputStyle = 'width: 100%; padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem; margin-bottom: 10px;';
+        modal = document.createElement('div');
+        modal.id = 'accountModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3><i class="fa-solid fa-user"></i> Account</h3>
+                
+                <div id="accountSignedIn" style="display: none; margin-bottom: 20px; font-size: 0.9rem; color: var(--text-muted);">
+                    Signed in as <span id="accountEmail" style="color: var(--text-main);"></span><br>
+                    User ID (share it to be invited): <code id="accountUserId"></code>
+                </div>
+                
+                <div id="accountSignedOut" style="margin-bottom: 20px;">
+                    <input type="email" id="accountEmailInput" placeholder="Email" autocomplete="email" style="${inputStyle}">
+                    <input type="password" id="accountPassword" placeholder="Password" autocomplete="current-password" style="${inputStyle}">
+                </div>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button id="accountSignUp" onclick="signIn(true)" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Sign up</button>
+                    <button id="accountSignIn" onclick="signIn(false)" style="padding: 10px 20px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer;">Sign in</button>
+                    <button id="accountSignOut" onclick="signOut()" style="display: none; padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Sign out</button>
+                    <button onclick="closeModal('accountModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Close</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    modal.style.display = 'flex';
+    renderAccount();
+}
+
+async function renderAccount() {
+    if (!supabaseClient) return;
+    const { data } = await supabaseClient.auth.getSession();
+    const user = data && data.session ? data.session.user : null;
+    document.getElementById('accountSignedIn').style.display = user ? '' : 'none';
+    document.getElementById('accountSignedOut').style.display = user ? 'none' : '';
+    document.getElementById('accountSignIn').style.display = user ? 'none' : '';
+    document.getElementById('accountSignUp').style.display = user ? 'none' : '';
+    document.getElementById('accountSignOut').style.display = user ? '' : 'none';
+    if (user) {
+        document.getElementById('accountEmail').textContent = user.email || '';
+        document.getElementById('accountUserId').textContent = user.id;
+    }
+}
+
+async function signIn(signUp) {
+    if (!supabaseClient) {
+        alert('Sign-in needs Supabase.');
+        return;
+    }
+    const credentials = {
+        email: document.getElementById('accountEmailInput').value.trim(),
+        password: document.getElementById('accountPassword').value
+    };
+    const { data, error } = signUp
+        ? await supabaseClient.auth.signUp(credentials)
+        : await supabaseClient.auth.signInWithPassword(credentials);
+    if (error) {
+        alert('Error: ' + error.message);
+        return;
+    }
+    if (signUp && !data.session) {
+        alert('Check your email to confirm the account, then sign in.');
+        return;
+    }
+    await renderAccount();
+    await loadWorkspaces();
+    loadData();
+}
+
+async function signOut() {
+    await supabaseClient.auth.signOut();
+    await renderAccount();
+    await loadWorkspaces();
+    loadData();
+}
+
+function showWorkspaceModal() {
+    let modal = document.getElementById('workspaceModal');
+    if (!modal) {
+        const inputStyle = 'padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem;';
+        modal = document.createElement('div');
+        modal.id = 'workspaceModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3><i class="fa-solid fa-users"></i> <span id="workspaceTitle">Workspace</span></h3>
+                
+                <div id="workspaceMembers" style="margin-bottom: 15px; font-size: 0.85rem; color: var(--text-muted); max-height: 40vh; overflow-y: auto;"></div>
+                
+                <div id="workspaceInvite" style="display: flex; gap: 10px; margin-bottom: 20px;">
+                    <input type="text" id="workspaceMemberId" placeholder="User ID" style="flex: 1; ${inputStyle}">
+                    <select id="workspaceMemberRole" style="${inputStyle}">
+                        <option value="viewer">Viewer</option>
+                        <option value="editor">Editor</option>
+                        <option value="owner">Owner</option>
+                    </select>
+                    <button onclick="setWorkspaceMember()" style="padding: 10px 15px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer;">Add</button>
+                </div>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="createWorkspace()" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;"><i class="fa-solid fa-plus"></i> New Workspace</button>
+                    <button onclick="closeModal('workspaceModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Close</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    const ws = currentWorkspaceInfo();
+    document.getElementById('workspaceTitle').textContent = ws ? ws.name : 'Workspace';
+    document.getElementById('workspaceInvite').style.display = ws && ws.role === 'owner' ? 'flex' : 'none';
+    modal.style.display = 'flex';
+    loadWorkspaceMembers();
+}
+
+async function loadWorkspaceMembers() {
+    const list = document.getElementById('workspaceMembers');
+    const ws = currentWorkspaceInfo();
+    if (ws && ws.public) {
+        list.innerHTML = 'Anyone with the app can edit this workspace.';
+        return;
+    }
+    list.innerHTML = '<i class="fa-solid fa-spinner fa-spin"></i>';
+    try {
+        const res = await apiFetch(`/api/workspaces/${encodeURIComponent(currentWorkspace)}/members`);
+        if (!res.ok) throw new Error(await res.text());
+        const { members } = await res.json();
+        const owner = ws && ws.role === 'owner';
+        list.innerHTML = members.map(m => `
+            <div style="display: flex; align-items: center; gap: 8px; padding: 6px 0; border-bottom: 1px solid var(--border);">
+                <span style="flex: 1;"><code>${m.userId}</code> &middot; ${m.role}</span>
+                ${owner ? `<button onclick="removeWorkspaceMember('${m.userId}')" title="Remove" style="background: none; border: none; color: #ef4444; cursor: pointer;"><i class="fa-solid fa-user-minus"></i></button>` : ''}
+            </div>`).join('');
+    } catch (error) {
+        console.error('[WORKSPACE] Members load failed:', error);
+        list.innerHTML = 'Could not load members.';
+    }
+}
+
+async function setWorkspaceMember() {
+    const body = {
+        userId: document.getElementById('workspaceMemberId').value.trim(),
+        role: document.getElementById('workspaceMemberRole').value
+    };
+    try {
+        const res = await apiFetch(`/api/workspaces/${encodeURIComponent(currentWorkspace)}/members`, {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(body)
+        });
+        if (!res.ok) throw new Error(await res.text());
+        document.getElementById('workspaceMemberId').value = '';
+        loadWorkspaceMembers();
+    } catch (error) {
+        alert('Error: ' + error.message);
+    }
+}
+
+async function removeWorkspaceMember(userId) {
+    if (!confirm('Remove this member from the workspace?')) return;
+    try {
+        const res = await apiFetch(`/api/workspaces/${encodeURIComponent(currentWorkspace)}/members/${encodeURIComponent(userId)}`, { method: 'DELETE' });
+        if (!res.ok) throw new Error(await res.text());
+        loadWorkspaceMembers();
+    } catch (error) {
+        alert('Error: ' + error.message);
+    }
+}
+
+async function createWorkspace() {
+    const name = prompt('Workspace name:');
+    if (!name || !name.trim()) return;
+    try {
+        const res = await apiFetch('/api/workspaces', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({ name: name.trim() })
+        });
+        if (!res.ok) throw new Error(await res.text());
+        const ws = await res.json();
+        currentWorkspace = ws.id;
+        localStorage.setItem('ois_workspace', ws.id);
+        closeModal('workspaceModal');
+        await loadWorkspaces();
+        currentFolder = null;
+        loadData();
+    } catch (error) {
+        alert('Error: ' + error.message);
+    }
+}
+
+// === SEARCH ===
+// Searches run on the server, across every folder, or below the folder
+// that was open when the search started.
+let searchScope = null;
+let searchOffset = 0;
+
+async function runSearch(more = false) {
+    const text = document.getElementById('searchInput').value.trim();
+    if (!text) {
+        if (currentFilter === 'search') switchView('all');
+        return;
+    }
+    
+    const grid = document.getElementById('fileGrid');
+    if (!more) {
+        if (currentFilter !== 'search') searchScope = currentFilter === 'all' ? currentFolder : null;
+        currentFilter = 'search';
+        searchOffset = 0;
+        document.querySelectorAll('.nav-item').forEach(el => el.classList.remove('active'));
+        const scope = searchScope ? folders.find(f => f.id === searchScope) : null;
+        document.getElementById('pageTitle').innerText = scope ? `Search in ${scope.name}` : 'Search';
+        updateBreadcrumb();
+        grid.innerHTML = '<div style="grid-column:1/-1; text-align:center; color:var(--text-muted); padding:40px;"><i class="fa-solid fa-spinner fa-spin"></i> Searching...</div>';
+    }
+    
+    // tag:name words filter by tag; the rest is matched against names
+    const words = text.split(/\s+/);
+    const params = new URLSearchParams({
+        q: words.filter(w => !w.startsWith('tag:')).join(' '),
+        fuzzy: '1',
+        offset: searchOffset
+    });
+    words.filter(w => w.startsWith('tag:') && w.length > 4).forEach(w => params.append('tag', w.slice(4)));
+    if (searchScope) params.set('folderId', searchScope);
+    try {
+        const res = await apiFetch(`/api/search?${params}`);
+        if (!res.ok) throw new Error(await res.text());
+        const { results, total } = await res.json();
+        if (currentFilter !== 'search') return;
+        
+        if (!more) grid.innerHTML = '';
+        document.getElementById('searchMore')?.remove();
+        if (total === 0) {
+            grid.innerHTML = '<div style="grid-column:1/-1; text-align:center; color:var(--text-muted);">Nothing matches.</div>';
+            return;
+        }
+        
+        results.forEach(item => {
+            const isFolder = item.kind === 'folder';
+            const target = isFolder ? item.id : item.parentId;
+            const div = document.createElement('div');
+            div.className = 'file-card';
+            div.innerHTML = `
+                ${selectBox(isFolder ? 'folder' : 'file', item.id)}
+                <div class="preview"${isFolder || !hasPreview(item) ? '' : ` data-preview="${item.id}" data-size="${item.size}"`} onclick="showInDrive(${target ? `'${target}'` : 'null'})" style="cursor: pointer;">${isFolder ? '<i class="fa-solid fa-folder" style="color: #fbbf24; font-size: 3rem;"></i>' : getIconHTML(item.type)}</div>
+                <div class="info">
+                    <div class="name" title="${item.name}">${item.name}</div>
+                    <div class="meta">
+                        <div style="display:flex; justify-content:space-between; font-size:0.75rem; color:var(--text-muted);">
+                            <span>${isFolder ? 'Folder' : formatSize(item.size)}</span>
+                            <span>${item.updatedAt ? new Date(item.updatedAt).toLocaleDateString() : ''}</span>
+                        </div>
+                        <div class="meta-detail">
+                            <span class="file-type" title="${item.path}">${item.path}</span>
+                        </div>
+                        ${tagChips(item.tags)}
+                    </div>
+                </div>
+                <div class="actions">
+                    <button class="btn-card btn-share" onclick="showInDrive(${target ? `'${target}'` : 'null'})" title="Show in folder"><i class="fa-solid fa-folder-open"></i></button>
+                </div>`;
+            grid.appendChild(div);
+        });
+        loadPreviews(grid);
+        
+        searchOffset += results.length;
+        if (searchOffset < total) {
+            const next = document.createElement('div');
+            next.id = 'searchMore';
+            next.style.cssText = 'grid-column:1/-1; text-align:center;';
+            next.innerHTML = `<button class="btn-action btn-upload" onclick="runSearch(true)">Show more (${total - searchOffset} left)</button>`;
+            grid.appendChild(next);
+        }
+    } catch (error) {
+        console.error('[SEARCH] Failed:', error);
+        if (!more) grid.innerHTML = '<div style="grid-column:1/-1; text-align:center; color:var(--text-muted);">Search failed.</div>';
+    }
+}
+
+function showInDrive(folderId) {
+    document.getElementById('searchInput').value = '';
+    currentFilter = 'all';
+    if (folderId) {
+        openFolder(folderId);
+    } else {
+        navigateToRoot();
+    }
+}
+
+// === TAGS AND METADATA ===
+function tagChips(tags) {
+    if (!tags || tags.length === 0) return '';
+    const chips = tags.map(t => `<span class="file-type" onclick="event.stopPropagation(); searchTag(this.dataset.tag)" data-tag="${t}" style="cursor: pointer; color: var(--accent);">#${t}</span>`).join(' ');
+    return `<div class="meta-detail" style="flex-wrap: wrap; gap: 4px;">${chips}</div>`;
+}
+
+function searchTag(tag) {
+    document.getElementById('searchInput').value = `tag:${tag}`;
+    runSearch();
+}
+
+function showTags(kind, id) {
+    const item = kind === 'folder' ? folders.find(f => f.id === id) : getFileById(id);
+    if (!item) return;
+    
+    let modal = document.getElementById('tagsModal');
+    if (!modal) {
+        const inputStyle = 'width: 100%; padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem; box-sizing: border-box;';
+        modal = document.createElement('div');
+        modal.id = 'tagsModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3><i class="fa-solid fa-tags"></i> Tags</h3>
+                
+                <div style="margin-bottom: 15px; background: var(--bg-dark); padding: 10px; border-radius: 6px; border: 1px solid var(--border);">
+                    <span id="tagsItemName" style="color: var(--text-main);"></span>
+                </div>
+                
+                <label style="font-size: 0.8rem; color: var(--text-muted);">Tags, separated by commas</label>
+                <input type="text" id="tagsInput" placeholder="final, reviewed" style="${inputStyle} margin-bottom: 15px;">
+                
+                <label style="font-size: 0.8rem; color: var(--text-muted);">Metadata, one key=value per line</label>
+                <textarea id="metadataInput" rows="5" placeholder="project=apollo&#10;release=2.4" style="${inputStyle} margin-bottom: 20px; font-family: monospace; resize: vertical;"></textarea>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="closeModal('tagsModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Cancel</button>
+                    <button id="tagsSaveButton" onclick="saveTags()" style="padding: 10px 20px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer;">Save</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    
+    modal.dataset.kind = kind;
+    modal.dataset.id = id;
+    document.getElementById('tagsItemName').textContent = item.name;
+    document.getElementById('tagsInput').value = (item.tags || []).join(', ');
+    document.getElementById('metadataInput').value = Object.entries(item.metadata || {}).map(([k, v]) => `${k}=${v}`).join('\n');
+    modal.dataset.keys = JSON.stringify(Object.keys(item.metadata || {}));
+    modal.style.display = 'flex';
+}
+
+async function saveTags() {
+    const modal = document.getElementById('tagsModal');
+    const body = {
+        tags: document.getElementById('tagsInput').value.split(',').map(t => t.trim()).filter(t => t),
+        metadata: {}
+    };
+    body[modal.dataset.kind === 'folder' ? 'folderId' : 'fileId'] = modal.dataset.id;
+    // Keys that were removed from the text are sent as null to delete them
+    JSON.parse(modal.dataset.keys).forEach(k => body.metadata[k] = null);
+    document.getElementById('metadataInput').value.split('\n').forEach(line => {
+        const at = line.indexOf('=');
+        if (at > 0) body.metadata[line.slice(0, at).trim()] = line.slice(at + 1).trim();
+    });
+    
+    const button = document.getElementById('tagsSaveButton');
+    button.disabled = true;
+    try {
+        const res = await apiFetch('/api/tags', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(body)
+        });
+        if (!res.ok) throw new Error(await res.text());
+        const { tags, metadata } = await res.json();
+        const item = modal.dataset.kind === 'folder' ? folders.find(f => f.id === modal.dataset.id) : getFileById(modal.dataset.id);
+        if (item) {
+            item.tags = tags;
+            item.metadata = metadata;
+        }
+        closeModal('tagsModal');
+        renderGrid();
+    } catch (error) {
+        alert('Error: ' + error.message);
+    } finally {
+        button.disabled = false;
+    }
+}
+
+// === ACCESS LISTS ===
+// Owners give single users deny, read or write access to a file or a
+// folder tree, on top of their workspace role.
+function canManageAccess() {
+    const ws = currentWorkspaceInfo();
+    return workspacesEnabled && ws !== null && ws.role === 'owner' && !ws.public;
+}
+
+function accessButton(kind, id) {
+    if (!canManageAccess()) return '';
+    return `<button class="btn-card btn-share" onclick="showAccess('${kind}', '${id}')" title="Access"><i class="fa-solid fa-user-lock"></i></button>`;
+}
+
+function showAccess(kind, id) {
+    const item = kind === 'folder' ? folders.find(f => f.id === id) : getFileById(id);
+    if (!item) return;
+    
+    let modal = document.getElementById('accessModal');
+    if (!modal) {
+        const inputStyle = 'padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem;';
+        modal = document.createElement('div');
+        modal.id = 'accessModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3><i class="fa-solid fa-user-lock"></i> Access</h3>
+                
+                <div style="margin-bottom: 15px; background: var(--bg-dark); padding: 10px; border-radius: 6px; border: 1px solid var(--border);">
+                    <span id="accessItemName" style="color: var(--text-main);"></span>
+                </div>
+                
+                <div id="accessList" style="margin-bottom: 15px; font-size: 0.85rem; color: var(--text-muted); max-height: 40vh; overflow-y: auto;"></div>
+                
+                <div style="display: flex; gap: 10px; margin-bottom: 20px;">
+                    <input type="text" id="accessUserId" placeholder="User ID" style="flex: 1; ${inputStyle}">
+                    <select id="accessLevel" style="${inputStyle} width: auto;">
+                        <option value="read">Read</option>
+                        <option value="write">Write</option>
+                        <option value="deny">Deny</option>
+                    </select>
+                    <button onclick="setAccess()" style="padding: 10px 15px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer;">Set</button>
+                </div>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="closeModal('accessModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Close</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    
+    modal.dataset.kind = kind;
+    modal.dataset.id = id;
+    document.getElementById('accessItemName').textContent = item.name;
+    modal.style.display = 'flex';
+    loadAccess();
+}
+
+function accessQuery(userId) {
+    const modal = document.getElementById('accessModal');
+    const param = modal.dataset.kind === 'folder' ? 'folderId' : 'fileId';
+    let query = `${param}=${encodeURIComponent(modal.dataset.id)}`;
+    if (userId) query += `&userId=${encodeURIComponent(userId)}`;
+    return query;
+}
+
+async function loadAccess() {
+    const list = document.getElementById('accessList');
+    list.innerHTML = '<i class="fa-solid fa-spinner fa-spin"></i>';
+    try {
+        const res = await apiFetch(`/api/acl?${accessQuery()}`);
+        if (!res.ok) throw new Error(await res.text());
+        const { entries, enabled } = await res.json();
+        if (!enabled) {
+            list.innerHTML = 'Access lists are off until migration 013 is applied.';
+            return;
+        }
+        if (entries.length === 0) {
+            list.innerHTML = 'No entries. Workspace roles apply, and anything set on the folders above.';
+            return;
+        }
+        list.innerHTML = entries.map(e => `
+            <div style="display: flex; align-items: center; gap: 8px; padding: 6px 0; border-bottom: 1px solid var(--border);">
+                <span style="flex: 1;"><code>${e.userId}</code> &middot; ${e.access}</span>
+                <button onclick="removeAccess('${e.userId}')" title="Remove" style="background: none; border: none; color: #ef4444; cursor: pointer;"><i class="fa-solid fa-xmark"></i></button>
+            </div>`).join('');
+    } catch (error) {
+        console.error('[ACL] Load failed:', error);
+        list.innerHTML = 'Could not load the access list.';
+    }
+}
+
+async function setAccess() {
+    const modal = document.getElementById('accessModal');
+    const body = {
+        userId: document.getElementById('accessUserId').value.trim(),
+        access: document.getElementById('accessLevel').value
+    };
+    body[modal.dataset.kind === 'folder' ? 'folderId' : 'fileId'] = modal.dataset.id;
+    try {
+        const res = await apiFetch('/api/acl', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(body)
+        });
+        if (!res.ok) throw new Error(await res.text());
+        document.getElementById('accessUserId').value = '';
+        loadAccess();
+    } catch (error) {
+        alert('Error: ' + error.message);
+    }
+}
+
+async function removeAccess(userId) {
+    try {
+        const res = await apiFetch(`/api/acl?${accessQuery(userId)}`, { method: 'DELETE' });
+        if (!res.ok) throw new Error(await res.text());
+        loadAccess();
+    } catch (error) {
+        alert('Error: ' + error.message);
+    }
+}
+
 // === DATA LOADING ===
 async function loadData() {
     const grid = document.getElementById('fileGrid');
@@ -186,6 +757,10 @@ function loadFromLocalStorage() {
     folders = JSON.parse(localStorage.getItem('ois_folders')) || [];
 }
 
+// Every column of files but meta_key, which the browser cannot read
+// (022_file_keys.sql); fileKey asks for one file's key at a time.
+const FILE_COLUMNS = 'id, name, size, type, mime, date, folder_id, meta_links, meta_provider, is_public, share_id, tags, metadata';
+
 async function loadFilesFromDB() {
     if (!supabaseClient) {
         console.warn('[DB] Supabase client not available, using localStorage');
@@ -194,7 +769,7 @@ async function loadFilesFromDB() {
     
     console.log('[DB] Loading files from database...');
     
-    let query = supabaseClient.from('files').select('*');
+    let query = inWorkspace(supabaseClient.from('files').select(FILE_COLUMNS));
     
     if (currentFolder) {
         query = query.eq('folder_id', currentFolder);
@@ -203,7 +778,8 @@ async function loadFilesFromDB() {
             currentFilter === 'video' || currentFilter === 'image' || 
             currentFilter === 'audio' || currentFilter === 'other') {
             // Load ALL files for these views
-        } else {
+        } else if (!currentWorkspaceInfo() || currentWorkspaceInfo().role !== 'guest') {
+            // Guests get files out of folders they cannot see; inCurrentFolder sorts them out
             query = query.is('folder_id', null);
         }
     }
@@ -216,7 +792,7 @@ async function loadFilesFromDB() {
         query = query.limit(20);
     }
     
-    const { data, error } = await query;
+    const { data, error } = await withoutTrash(query);
     
     if (error) {
         console.error('[DB] Query error:', error);
@@ -237,12 +813,14 @@ async function loadFilesFromDB() {
                 date: f.date,
                 folderId: f.folder_id,
                 meta: {
-                    key: f.meta_key,
+                    key: null, // fetched by fileKey when needed
                     links: JSON.parse(f.meta_links || '[]'),
                     provider: f.meta_provider
                 },
                 isPublic: f.is_public || false,
-                shareId: f.share_id || null
+                shareId: f.share_id || null,
+                tags: f.tags || [],
+                metadata: f.metadata || {}
             };
         } catch (parseError) {
             console.warn('Failed to parse file:', f.id, parseError);
@@ -253,6 +831,24 @@ async function loadFilesFromDB() {
     console.log('[DB] Loaded', files.length, 'files');
 }
 
+// Keeps a files or folders query to the current workspace. Before
+// migration 012 every row is in the one shared drive.
+function inWorkspace(query) {
+    return workspacesEnabled ? query.eq('workspace_id', currentWorkspace) : query;
+}
+
+// Leaves out rows in the trash. Before migration 009 there is no deleted_at
+// column (error 42703), and nothing is in the trash.
+async function withoutTrash(query) {
+    if (!trashInstalled) return await query;
+    const result = await query.is('deleted_at', null);
+    if (result.error && result.error.code === '42703') {
+        trashInstalled = false;
+        return await query;
+    }
+    return result;
+}
+
 async function loadFoldersFromDB() {
     if (!supabaseClient) {
         console.warn('[DB] Supabase client not available, using localStorage');
@@ -262,9 +858,9 @@ async function loadFoldersFromDB() {
     console.log('[DB] Loading folders from database...');
     
     // Load ALL folders for breadcrumb functionality
-    let query = supabaseClient.from('folders').select('*').order('created_at', { ascending: false });
+    let query = inWorkspace(supabaseClient.from('folders').select('*')).order('created_at', { ascending: false });
     
-    const { data, error } = await query;
+    const { data, error } = await withoutTrash(query);
     
     if (error) {
         console.error('[DB] Folders query error:', error);
@@ -281,7 +877,9 @@ async function loadFoldersFromDB() {
         parentId: f.parent_id,
         created: f.created,
         shareId: f.share_id || null,
-        isPublic: f.is_public || false
+        isPublic: f.is_public || false,
+        tags: f.tags || [],
+        metadata: f.metadata || {}
     }));
     
     // Set global folders array to all folders
@@ -294,6 +892,7 @@ async function loadFoldersFromDB() {
 
 // === RENDERING ===
 function renderGrid() {
+    if (currentFilter === 'search') return;
     const grid = document.getElementById('fileGrid');
     grid.innerHTML = '';
     if (currentFilter === 'dashboard' || currentFilter === 'recent') return;
@@ -311,7 +910,8 @@ function renderGrid() {
             const div = document.createElement('div');
             div.className = 'file-card';
             div.innerHTML = `
-                <div class="preview">${getIconHTML(f.type)}</div>
+                ${selectBox('file', f.id)}
+                ${previewBox(f)}
                 <div class="info">
                     <div class="name" title="${f.name}">${f.name}</div>
                     <div class="meta">
@@ -323,22 +923,28 @@ function renderGrid() {
                             <span class="file-type">${f.mime}</span>
                             ${getProviderIcon(f.meta.provider)}
                         </div>
+                        ${tagChips(f.tags)}
                     </div>
                 </div>
                 <div class="actions">
                     <button class="btn-card btn-download" onclick="downloadFile('${f.id}')" title="Download"><i class="fa-solid fa-download"></i></button>
+                    ${playButton(f)}
                     <button class="btn-card btn-share" onclick="shareFile('${f.id}')" title="Share"><i class="fa-solid fa-share"></i></button>
+                    <button class="btn-card btn-share" onclick="showVersions('${f.id}')" title="Version history"><i class="fa-solid fa-clock-rotate-left"></i></button>
+                    <button class="btn-card btn-share" onclick="showTags('file', '${f.id}')" title="Tags"><i class="fa-solid fa-tags"></i></button>
+                    ${accessButton('file', f.id)}
                     <button class="btn-card btn-delete" onclick="deleteFile('${f.id}')" title="Delete"><i class="fa-solid fa-trash"></i></button>
                 </div>`;
             grid.appendChild(div);
         });
+        loadPreviews(grid);
         return;
     }
 
     // For "My Files" view, show files and folders based on current folder
-    const currentFiles = files.filter(f => f.folderId === currentFolder);
+    const currentFiles = files.filter(f => inCurrentFolder(f.folderId));
     // Filter folders to show only children of current folder
-    const currentFolders = folders.filter(f => f.parentId === currentFolder);
+    const currentFolders = folders.filter(f => inCurrentFolder(f.parentId));
     
     const filtered = currentFilter === 'all' ? currentFiles : currentFiles.filter(f => f.type === currentFilter);
     
@@ -348,6 +954,7 @@ function renderGrid() {
             const div = document.createElement('div');
             div.className = 'file-card folder-card';
             div.innerHTML = `
+                ${selectBox('folder', folder.id)}
                 <div class="preview"><i class="fa-solid fa-folder" style="color: #fbbf24; font-size: 3rem;"></i></div>
                 <div class="info">
                     <div class="name" title="${folder.name}">${folder.name}</div>
@@ -360,6 +967,13 @@ function renderGrid() {
                 </div>
                 <div class="actions">
                     <button class="btn-card btn-open" onclick="openFolder('${folder.id}')" title="Open"><i class="fa-solid fa-folder-open"></i></button>
+                    <button class="btn-card btn-share" onclick="shareFolder('${folder.id}')" title="Share"><i class="fa-solid fa-share"></i></button>
+                    <button class="btn-card btn-share" onclick="requestFiles('${folder.id}')" title="Request files"><i class="fa-solid fa-inbox"></i></button>
+                    <button class="btn-card btn-share" onclick="renameFolder('${folder.id}')" title="Rename"><i class="fa-solid fa-pen"></i></button>
+                    <button class="btn-card btn-share" onclick="showFolderTarget('${folder.id}', 'move')" title="Move"><i class="fa-solid fa-arrow-right-to-bracket"></i></button>
+                    <button class="btn-card btn-share" onclick="showFolderTarget('${folder.id}', 'copy')" title="Copy"><i class="fa-solid fa-copy"></i></button>
+                    <button class="btn-card btn-share" onclick="showTags('folder', '${folder.id}')" title="Tags"><i class="fa-solid fa-tags"></i></button>
+                    ${accessButton('folder', folder.id)}
                     <button class="btn-card btn-delete" onclick="deleteFolder('${folder.id}')" title="Delete"><i class="fa-solid fa-trash"></i></button>
                 </div>`;
             div.ondblclick = () => openFolder(folder.id);
@@ -377,7 +991,8 @@ function renderGrid() {
         const div = document.createElement('div');
         div.className = 'file-card';
         div.innerHTML = `
-            <div class="preview">${getIconHTML(f.type)}</div>
+            ${selectBox('file', f.id)}
+            ${previewBox(f)}
             <div class="info">
                 <div class="name" title="${f.name}">${f.name}</div>
                 <div class="meta">
@@ -389,15 +1004,28 @@ function renderGrid() {
                         <span class="file-type">${f.mime}</span>
                         ${getProviderIcon(f.meta.provider)}
                     </div>
+                    ${tagChips(f.tags)}
                 </div>
             </div>
             <div class="actions">
                 <button class="btn-card btn-download" onclick="downloadFile('${f.id}')" title="Download"><i class="fa-solid fa-download"></i></button>
+                ${playButton(f)}
                 <button class="btn-card btn-share" onclick="shareFile('${f.id}')" title="Share"><i class="fa-solid fa-share"></i></button>
+                <button class="btn-card btn-share" onclick="showVersions('${f.id}')" title="Version history"><i class="fa-solid fa-clock-rotate-left"></i></button>
+                <button class="btn-card btn-share" onclick="showTags('file', '${f.id}')" title="Tags"><i class="fa-solid fa-tags"></i></button>
+                ${accessButton('file', f.id)}
                 <button class="btn-card btn-delete" onclick="deleteFile('${f.id}')" title="Delete"><i class="fa-solid fa-trash"></i></button>
             </div>`;
         grid.appendChild(div);
     });
+    loadPreviews(grid);
+}
+
+// At the top level this also shows what the access list gives out of
+// folders the user cannot see.
+function inCurrentFolder(parentId) {
+    if (currentFolder) return parentId === currentFolder;
+    return !parentId || !folders.some(p => p.id === parentId);
 }
 
 function renderDashboard() {
@@ -449,7 +1077,8 @@ function renderDashboard() {
             const div = document.createElement('div');
             div.className = 'file-card';
             div.innerHTML = `
-                <div class="preview">${getIconHTML(f.type)}</div>
+                ${selectBox('file', f.id)}
+                ${previewBox(f)}
                 <div class="info">
                     <div class="name" title="${f.name}">${f.name}</div>
                     <div class="meta">
@@ -461,15 +1090,21 @@ function renderDashboard() {
                             <span class="file-type">${f.mime}</span>
                             ${getProviderIcon(f.meta.provider)}
                         </div>
+                        ${tagChips(f.tags)}
                     </div>
                 </div>
                 <div class="actions">
                     <button class="btn-card btn-download" onclick="downloadFile('${f.id}')" title="Download"><i class="fa-solid fa-download"></i></button>
+                    ${playButton(f)}
                     <button class="btn-card btn-share" onclick="shareFile('${f.id}')" title="Share"><i class="fa-solid fa-share"></i></button>
+                    <button class="btn-card btn-share" onclick="showVersions('${f.id}')" title="Version history"><i class="fa-solid fa-clock-rotate-left"></i></button>
+                    <button class="btn-card btn-share" onclick="showTags('file', '${f.id}')" title="Tags"><i class="fa-solid fa-tags"></i></button>
+                    ${accessButton('file', f.id)}
                     <button class="btn-card btn-delete" onclick="deleteFile('${f.id}')" title="Delete"><i class="fa-solid fa-trash"></i></button>
                 </div>`;
             grid.appendChild(div);
         });
+        loadPreviews(grid);
     }
 }
 
@@ -487,7 +1122,8 @@ function renderRecentFiles() {
         const div = document.createElement('div');
         div.className = 'file-card';
         div.innerHTML = `
-            <div class="preview">${getIconHTML(f.type)}</div>
+            ${selectBox('file', f.id)}
+            ${previewBox(f)}
             <div class="info">
                 <div class="name" title="${f.name}">${f.name}</div>
                 <div class="meta">
@@ -499,15 +1135,92 @@ function renderRecentFiles() {
                         <span class="file-type">${f.mime}</span>
                         ${getProviderIcon(f.meta.provider)}
                     </div>
+                    ${tagChips(f.tags)}
                 </div>
             </div>
             <div class="actions">
                 <button class="btn-card btn-download" onclick="downloadFile('${f.id}')" title="Download"><i class="fa-solid fa-download"></i></button>
+                ${playButton(f)}
                 <button class="btn-card btn-share" onclick="shareFile('${f.id}')" title="Share"><i class="fa-solid fa-share"></i></button>
+                <button class="btn-card btn-share" onclick="showVersions('${f.id}')" title="Version history"><i class="fa-solid fa-clock-rotate-left"></i></button>
+                <button class="btn-card btn-share" onclick="showTags('file', '${f.id}')" title="Tags"><i class="fa-solid fa-tags"></i></button>
+                ${accessButton('file', f.id)}
                 <button class="btn-card btn-delete" onclick="deleteFile('${f.id}')" title="Delete"><i class="fa-solid fa-trash"></i></button>
             </div>`;
         grid.appendChild(div);
     });
+    loadPreviews(grid);
+}
+
+// === PREVIEWS ===
+// Thumbnails and waveforms come from /api/files/{id}/thumbnail, which
+// makes them the first time. Cards load theirs once scrolled into view
+// and keep the type icon when there is none.
+const PREVIEW_MAX_SIZE = 32 * 1024 * 1024; // lib/preview.MaxSource
+const previewCache = {};
+let previewObserver = null;
+
+function hasPreview(f) {
+    if (!f.size || f.size > PREVIEW_MAX_SIZE) return false;
+    const mime = f.mime || '';
+    return ['image/jpeg', 'image/png', 'image/gif', 'application/pdf'].includes(mime) ||
+        mime.startsWith('audio/') || /\.pdf$/i.test(f.name || '');
+}
+
+function previewBox(f) {
+    const attrs = hasPreview(f) ? ` data-preview="${f.id}" data-size="${f.size}"` : '';
+    return `<div class="preview"${attrs}>${getIconHTML(f.type)}</div>`;
+}
+
+function loadPreviews(root) {
+    const boxes = root.querySelectorAll('.preview[data-preview]');
+    if (!('IntersectionObserver' in window)) {
+        boxes.forEach(showPreview);
+        return;
+    }
+    if (!previewObserver) {
+        previewObserver = new IntersectionObserver(entries => {
+            entries.forEach(entry => {
+                if (!entry.isIntersecting) return;
+                previewObserver.unobserve(entry.target);
+                showPreview(entry.target);
+            });
+        }, { rootMargin: '200px' });
+    }
+    boxes.forEach(box => previewObserver.observe(box));
+}
+
+async function showPreview(box) {
+    // A new size means new content, which gets a new preview.
+    const key = `${box.dataset.preview}:${box.dataset.size}`;
+    if (!(key in previewCache)) previewCache[key] = fetchPreview(box.dataset.preview);
+    const html = await previewCache[key];
+    if (html && box.isConnected) box.innerHTML = html;
+}
+
+async function fetchPreview(id) {
+    try {
+        const res = await apiFetch(`/api/files/${encodeURIComponent(id)}/thumbnail`);
+        if (!res.ok) return null;
+        if ((res.headers.get('Content-Type') || '').startsWith('application/json')) {
+            const { peaks } = await res.json();
+            return waveformHTML(peaks);
+        }
+        const url = URL.createObjectURL(await res.blob());
+        return `<img src="${url}" alt="" class="preview-image">`;
+    } catch (error) {
+        console.warn('[PREVIEW] Failed to load preview of', id, error);
+        return null;
+    }
+}
+
+function waveformHTML(peaks) {
+    if (!peaks || peaks.length === 0) return null;
+    const bars = peaks.map((p, i) => {
+        const h = Math.max(p, 2);
+        return `<rect x="${i}" y="${(100 - h) / 2}" width="0.6" height="${h}"></rect>`;
+    }).join('');
+    return `<svg class="preview-waveform" viewBox="0 0 ${peaks.length} 100" preserveAspectRatio="none">${bars}</svg>`;
 }
 
 // === FOLDER MANAGEMENT ===
@@ -548,6 +1261,7 @@ async function saveFolderToDB(folderObj) {
         parent_id: folderObj.parentId,
         created: folderObj.created
     };
+    if (workspacesEnabled) dbRecord.workspace_id = currentWorkspace;
     
     const { data, error } = await supabaseClient.from('folders').insert(dbRecord);
     
@@ -566,12 +1280,32 @@ function openFolder(folderId) {
     updatePageTitle();
 }
 
-function deleteFolder(folderId) {
-    if (!confirm("Delete this folder and all its contents?")) return;
+async function moveToTrash(body) {
+    const res = await apiFetch('/api/trash', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+    });
+    if (!res.ok) throw new Error(await res.text());
+}
+
+async function deleteFolder(folderId) {
+    if (!confirm("Move this folder and all its contents to the trash?")) return;
     
-    const deleteRecursive = (id) => {
-        files = files.filter(f => f.folderId !== id);
-        const subfolders = folders.filter(f => f.parentId === id);
+    if (useDatabase && supabaseClient) {
+        try {
+            const res = await apiFetch(`/api/folders/${encodeURIComponent(folderId)}`, { method: 'DELETE' });
+            if (!res.ok) throw new Error(await res.text());
+        } catch (error) {
+            console.error('[TRASH] Delete failed:', error);
+            alert('Failed to delete folder: ' + error.message);
+            return;
+        }
+    }
+    
+    const deleteRecursive = (id) => {
+        files = files.filter(f => f.folderId !== id);
+        const subfolders = folders.filter(f => f.parentId === id);
         subfolders.forEach(sf => deleteRecursive(sf.id));
         folders = folders.filter(f => f.id !== id);
     };
@@ -584,12 +1318,120 @@ function deleteFolder(folderId) {
     updateUsedSpace();
 }
 
+async function changeFolder(folderId, body) {
+    const res = await apiFetch(`/api/folders/${encodeURIComponent(folderId)}`, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body)
+    });
+    if (!res.ok) throw new Error(await res.text());
+    return res.json();
+}
+
+async function renameFolder(folderId) {
+    const folder = folders.find(f => f.id === folderId);
+    if (!folder) return;
+    const name = prompt("New folder name:", folder.name);
+    if (!name || name.trim() === '' || name.trim() === folder.name) return;
+    
+    try {
+        await changeFolder(folderId, { action: 'rename', name: name.trim() });
+        await loadData();
+    } catch (error) {
+        console.error('[FOLDERS] Rename failed:', error);
+        alert('Failed to rename folder: ' + error.message);
+    }
+}
+
+// Full path of a folder for the move/copy picker, e.g. "Photos / 2024".
+function folderPath(folder) {
+    const parts = [];
+    const seen = new Set();
+    for (let f = folder; f && !seen.has(f.id); f = folders.find(p => p.id === f.parentId)) {
+        seen.add(f.id);
+        parts.unshift(f.name);
+    }
+    return parts.join(' / ');
+}
+
+function showFolderTarget(folderId, action) {
+    const folder = folders.find(f => f.id === folderId);
+    if (!folder) return;
+    
+    let modal = document.getElementById('folderTargetModal');
+    if (!modal) {
+        modal = document.createElement('div');
+        modal.id = 'folderTargetModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3 id="folderTargetTitle"></h3>
+                
+                <div style="margin-bottom: 15px;">
+                    <label style="display: block; margin-bottom: 5px; color: var(--text-muted); font-size: 0.9rem;">Destination</label>
+                    <select id="folderTargetSelect" style="width: 100%; padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); border-radius: 6px; color: var(--text-main);"></select>
+                </div>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="closeModal('folderTargetModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Cancel</button>
+                    <button id="folderTargetButton" onclick="submitFolderTarget()" style="padding: 10px 20px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer;"></button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    
+    // A folder cannot go into itself or anything below it.
+    const below = new Set([folderId]);
+    let grew = true;
+    while (grew) {
+        grew = false;
+        folders.forEach(f => {
+            if (!below.has(f.id) && below.has(f.parentId)) {
+                below.add(f.id);
+                grew = true;
+            }
+        });
+    }
+    const options = folders
+        .filter(f => !below.has(f.id))
+        .map(f => ({ id: f.id, path: folderPath(f) }))
+        .sort((a, b) => a.path.localeCompare(b.path));
+    
+    const select = document.getElementById('folderTargetSelect');
+    select.innerHTML = '<option value="">My Files</option>' +
+        options.map(o => `<option value="${o.id}">${o.path}</option>`).join('');
+    select.value = folder.parentId || '';
+    
+    const verb = action === 'move' ? 'Move' : 'Copy';
+    document.getElementById('folderTargetTitle').innerHTML =
+        `<i class="fa-solid ${action === 'move' ? 'fa-arrow-right-to-bracket' : 'fa-copy'}"></i> ${verb} "${folder.name}"`;
+    document.getElementById('folderTargetButton').textContent = `${verb} here`;
+    modal.dataset.id = folderId;
+    modal.dataset.action = action;
+    modal.style.display = 'flex';
+}
+
+async function submitFolderTarget() {
+    const modal = document.getElementById('folderTargetModal');
+    const parentId = document.getElementById('folderTargetSelect').value || null;
+    
+    try {
+        await changeFolder(modal.dataset.id, { action: modal.dataset.action, parentId });
+        closeModal('folderTargetModal');
+        await loadData();
+    } catch (error) {
+        console.error('[FOLDERS] ' + modal.dataset.action + ' failed:', error);
+        alert(`Failed to ${modal.dataset.action} folder: ` + error.message);
+    }
+}
+
 function updatePageTitle() {
     if (currentFolder) {
         const folder = folders.find(f => f.id === currentFolder);
         document.getElementById('pageTitle').innerText = folder ? folder.name : 'My Files';
     } else {
-        const titles = { 'all': 'My Files', 'video': 'Videos', 'image': 'Images', 'audio': 'Audio', 'other': 'Other', 'recent': 'Recent Files', 'dashboard': 'Dashboard' };
+        const titles = { 'all': 'My Files', 'video': 'Videos', 'image': 'Images', 'audio': 'Audio', 'other': 'Other', 'recent': 'Recent Files', 'dashboard': 'Dashboard', 'trash': 'Trash' };
         document.getElementById('pageTitle').innerText = titles[currentFilter] || 'My Files';
     }
 }
@@ -612,6 +1454,7 @@ async function saveFileToDB(fileObj) {
         is_public: true,
         share_id: fileObj.shareId || null
     };
+    if (workspacesEnabled) dbRecord.workspace_id = currentWorkspace;
     
     const { data, error } = await supabaseClient.from('files').insert(dbRecord);
     
@@ -627,12 +1470,11 @@ async function saveFileToDB(fileObj) {
 async function deleteFileFromDB(fileId) {
     if (!supabaseClient) throw new Error('Supabase not initialized');
     
-    const { error } = await supabaseClient.from('files').delete().eq('id', fileId);
-    if (error) throw error;
+    await moveToTrash({ fileId });
 }
 
 function deleteFile(id) {
-    if(!confirm("Delete this file?")) return;
+    if(!confirm("Move this file to the trash?")) return;
     
     if (useDatabase && supabaseClient) {
         deleteFileFromDB(id).then(() => {
@@ -657,6 +1499,7 @@ function deleteFile(id) {
 // === UPLOAD ===
 async function startRealUpload() {
     const provider = document.getElementById('provider').value;
+    const compress = document.getElementById('compressUpload').checked;
     if(!selectedFile) return alert("Pilih file!");
 
     // Check file size limits
@@ -675,7 +1518,9 @@ async function startRealUpload() {
     
     const CHUNK_SIZES = {
         'discord': 8 * 1024 * 1024,
-        'telegram': 50 * 1024 * 1024
+        'telegram': 50 * 1024 * 1024,
+        'erasure': 8 * 1024 * 1024,
+        'dedup': 8 * 1024 * 1024
     };
     const CHUNK = CHUNK_SIZES[provider] || 5 * 1024 * 1024;
     const total = Math.ceil(selectedFile.size / CHUNK);
@@ -701,14 +1546,17 @@ async function startRealUpload() {
             formData.append('chunkIndex', i);
             formData.append('keyBase64', keyBase64);
             formData.append('fileName', selectedFile.name);
+            if (compress) formData.append('compress', '1');
+            if (currentFolder) formData.append('folderId', currentFolder);
 
-            let endpoint = provider === 'telegram' ? '/api/telegram' : '/api/discord';
+            let endpoint = '/api/' + provider;
             let success = false;
             let lastError = null;
+            let overQuota = false;
 
             // Try primary provider first
             try {
-                const res = await fetch(endpoint, {
+                const res = await apiFetch(endpoint, {
                     method: 'POST',
                     body: formData
                 });
@@ -718,6 +1566,11 @@ async function startRealUpload() {
                     links.push(data.link);
                     success = true;
                     console.log(`[UPLOAD] Chunk ${i+1} uploaded successfully via ${provider}`);
+                } else if (res.status === 413) {
+                    // Over the storage quota: the other provider counts against it too
+                    const q = await res.json();
+                    lastError = `Storage quota exceeded: ${formatSize(q.remaining)} left of ${formatSize(q.limit)}`;
+                    overQuota = true;
                 } else {
                     const errText = await res.text();
                     lastError = errText;
@@ -729,14 +1582,15 @@ async function startRealUpload() {
             }
 
             // If primary provider fails, try the other one
-            if (!success) {
+            // (erasure stripes and dedup groups can't fall back: their links are manifests)
+            if (!success && !overQuota && provider !== 'erasure' && provider !== 'dedup') {
                 const fallbackProvider = provider === 'discord' ? 'telegram' : 'discord';
                 const fallbackEndpoint = fallbackProvider === 'telegram' ? '/api/telegram' : '/api/discord';
                 
                 console.log(`[UPLOAD] Trying fallback provider: ${fallbackProvider}`);
                 
                 try {
-                    const res = await fetch(fallbackEndpoint, {
+                    const res = await apiFetch(fallbackEndpoint, {
                         method: 'POST',
                         body: formData
                     });
@@ -755,6 +1609,9 @@ async function startRealUpload() {
                 }
             }
 
+            if (overQuota) {
+                throw new Error(lastError);
+            }
             if (!success) {
                 throw new Error(`Chunk ${i+1} failed on both providers. Last error: ${lastError}`);
             }
@@ -777,7 +1634,19 @@ async function startRealUpload() {
             meta: { key: keyBase64, links: links, provider: provider }
         };
         
-        if (useDatabase && supabaseClient) {
+        // A file with the same name in this folder gets a new revision
+        // instead of a second row, so older ones can be restored.
+        const existing = files.find(f => f.folderId === currentFolder && f.name === fileObj.name);
+        
+        if (useDatabase && supabaseClient && existing) {
+            try {
+                await saveRevision(existing, fileObj);
+            } catch (error) {
+                console.error('[UPLOAD] Saving new version failed:', error);
+                alert('Upload gagal: ' + error.message);
+                return;
+            }
+        } else if (useDatabase && supabaseClient) {
             try {
                 await saveFileToDB(fileObj);
             } catch (dbError) {
@@ -812,12 +1681,59 @@ async function startRealUpload() {
     }
 }
 
+// Replace the content of existing with the chunks just uploaded for
+// fileObj. The server keeps the old content as a version.
+async function saveRevision(existing, fileObj) {
+    const res = await apiFetch(`/api/versions?fileId=${encodeURIComponent(existing.id)}`, {
+        method: 'POST',
+        headers: {'Content-Type': 'application/json'},
+        body: JSON.stringify({
+            size: fileObj.size,
+            key: fileObj.meta.key,
+            links: fileObj.meta.links,
+            provider: fileObj.meta.provider,
+            baseKey: await fileKey(existing)
+        })
+    });
+    if (res.status === 409) throw new Error('the file was changed elsewhere, reload and try again');
+    if (!res.ok) throw new Error(await res.text());
+    applyManifest(existing, await res.json());
+    existing.date = fileObj.date;
+}
+
+// The decryption key of fileObj. Keys of listed files are not loaded with
+// the list; the database hands them out only to users who may read the file.
+async function fileKey(fileObj) {
+    if (!fileObj.meta.key && fileObj.id) {
+        const { data, error } = await supabaseClient.rpc('file_key', { p_id: fileObj.id.toString() });
+        if (error) throw error;
+        fileObj.meta.key = data;
+    }
+    return fileObj.meta.key;
+}
+
+function applyManifest(fileObj, m) {
+    fileObj.size = m.size;
+    fileObj.meta = { key: m.key, links: m.links, provider: m.provider };
+}
+
 // === DOWNLOAD ===
 async function downloadFile(id) {
     const fileObj = getFileById(id);
     if(!fileObj) return;
+    await downloadFileObj(fileObj);
+}
 
-    const theKey = fileObj.meta.key;
+// fileObj only needs name and meta, so this also downloads old versions.
+// Files with an id are checked against the access list.
+async function downloadFileObj(fileObj) {
+    let theKey;
+    try {
+        theKey = await fileKey(fileObj);
+    } catch (e) {
+        alert("Gagal mengambil key: " + e.message);
+        return;
+    }
     if(!theKey) {
         alert("File ini RUSAK (Key kosong). Hapus dan Upload ulang.");
         return;
@@ -838,12 +1754,13 @@ async function downloadFile(id) {
             document.getElementById('progressText').innerText = `Downloading: ${pct}%`;
             
             // First, check if file needs chunked download
-            const checkRes = await fetch('/api/download', {
+            const checkRes = await apiFetch('/api/download', {
                 method: 'POST', 
                 headers: {'Content-Type': 'application/json'},
                 body: JSON.stringify({ 
                     url: fileObj.meta.links[i], 
-                    provider: fileObj.meta.provider 
+                    provider: fileObj.meta.provider,
+                    fileId: fileObj.id
                 })
             });
             
@@ -871,13 +1788,14 @@ async function downloadFile(id) {
                     const endByte = Math.min(startByte + metadata.maxChunkSize - 1, metadata.fileSize - 1);
                     const rangeHeader = `bytes=${startByte}-${endByte}`;
                     
-                    const subChunkRes = await fetch('/api/download', {
+                    const subChunkRes = await apiFetch('/api/download', {
                         method: 'POST',
                         headers: {'Content-Type': 'application/json'},
                         body: JSON.stringify({
                             url: fileObj.meta.links[i],
                             provider: fileObj.meta.provider,
-                            range: rangeHeader
+                            range: rangeHeader,
+                            fileId: fileObj.id
                         })
                     });
                     
@@ -900,41 +1818,13 @@ async function downloadFile(id) {
                 }
                 
                 // Decrypt the combined chunk
-                if (combinedChunk.length < 12) {
-                    throw new Error(`Chunk ${i} is too small (${combinedChunk.length} bytes), expected at least 12 (nonce)`);
-                }
-                
-                const nonce = combinedChunk.slice(0, 12);
-                const ciphertext = combinedChunk.slice(12);
-                
-                const decryptedData = await window.crypto.subtle.decrypt(
-                    { name: "AES-GCM", iv: nonce },
-                    key,
-                    ciphertext
-                );
-                
-                decryptedChunks.push(decryptedData);
+                decryptedChunks.push(await openChunk(key, combinedChunk, fileObj.meta.provider, i));
                 
             } else {
                 // Small file - direct download
                 console.log(`[DOWNLOAD] Chunk ${i+1} is small, direct download`);
                 const encryptedData = await checkRes.arrayBuffer();
-                const encryptedArray = new Uint8Array(encryptedData);
-                
-                if (encryptedArray.length < 12) {
-                    throw new Error(`Chunk ${i} is too small (${encryptedArray.length} bytes), expected at least 12 (nonce)`);
-                }
-                
-                const nonce = encryptedArray.slice(0, 12);
-                const ciphertext = encryptedArray.slice(12);
-                
-                const decryptedData = await window.crypto.subtle.decrypt(
-                    { name: "AES-GCM", iv: nonce },
-                    key,
-                    ciphertext
-                );
-                
-                decryptedChunks.push(decryptedData);
+                decryptedChunks.push(await openChunk(key, new Uint8Array(encryptedData), fileObj.meta.provider, i));
             }
         }
         
@@ -953,6 +1843,238 @@ async function downloadFile(id) {
     }
 }
 
+// Decrypt one downloaded chunk (nonce + ciphertext). Dedup chunks are
+// reassembled and decrypted by the server, so they arrive as plaintext.
+async function openChunk(key, data, provider, index) {
+    if (provider === 'dedup') return data;
+
+    // Compressed chunks: "TDC" + flags, then nonce + ciphertext. The header
+    // is authenticated as additional data. If it doesn't decrypt, it was a
+    // plain chunk whose nonce happened to start with the same bytes.
+    if (data.length >= 16 && data[0] === 0x54 && data[1] === 0x44 && data[2] === 0x43) {
+        try {
+            const plain = await window.crypto.subtle.decrypt(
+                { name: "AES-GCM", iv: data.slice(4, 16), additionalData: data.slice(0, 4) },
+                key,
+                data.slice(16)
+            );
+            return (data[3] & 1) ? fzstd.decompress(new Uint8Array(plain)) : plain;
+        } catch (e) {
+            // fall through to the plain layout
+        }
+    }
+
+    if (data.length < 12) {
+        throw new Error(`Chunk ${index} is too small (${data.length} bytes), expected at least 12 (nonce)`);
+    }
+
+    const nonce = data.slice(0, 12);
+    const ciphertext = data.slice(12);
+
+    return await window.crypto.subtle.decrypt(
+        { name: "AES-GCM", iv: nonce },
+        key,
+        ciphertext
+    );
+}
+
+// === STREAMING ===
+// Video and audio play from /api/files/{id}/stream, which serves byte
+// ranges, so playback starts at once and seeking only fetches the chunks
+// around the playhead. The player gets a signed URL, as media elements
+// cannot send the API's headers.
+function isPlayable(f) {
+    return /^(video|audio)\//.test(f.mime || '') || f.type === 'video' || f.type === 'audio';
+}
+
+function playButton(f) {
+    if (!isPlayable(f)) return '';
+    return `<button class="btn-card btn-share" onclick="playFile('${f.id}')" title="Play"><i class="fa-solid fa-play"></i></button>`;
+}
+
+async function playFile(id) {
+    const fileObj = getFileById(id);
+    if (!fileObj) return;
+    
+    let modal = document.getElementById('playerModal');
+    if (!modal) {
+        modal = document.createElement('div');
+        modal.id = 'playerModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal" style="max-width: 900px; width: 95%;">
+                <h3 id="playerTitle" style="overflow: hidden; text-overflow: ellipsis; white-space: nowrap;"></h3>
+                <div id="playerBody" style="margin-bottom: 20px;"></div>
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="downloadFile(document.getElementById('playerModal').dataset.fileId)" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;"><i class="fa-solid fa-download"></i> Download</button>
+                    <button onclick="closePlayer()" style="padding: 10px 20px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer;">Close</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    modal.dataset.fileId = id;
+    document.getElementById('playerTitle').textContent = fileObj.name;
+    const body = document.getElementById('playerBody');
+    body.innerHTML = '<div style="text-align:center; color:var(--text-muted);"><i class="fa-solid fa-spinner fa-spin"></i> Loading...</div>';
+    modal.style.display = 'flex';
+    
+    try {
+        const res = await apiFetch(`/api/files/${encodeURIComponent(id)}/stream`, { method: 'POST' });
+        if (!res.ok) throw new Error(await res.text());
+        const { url } = await res.json();
+        if (modal.style.display === 'none' || modal.dataset.fileId !== id) return;
+        
+        const video = (fileObj.mime || '').startsWith('video/') || fileObj.type === 'video';
+        const player = document.createElement(video ? 'video' : 'audio');
+        player.controls = true;
+        player.autoplay = true;
+        player.preload = 'metadata';
+        player.style.width = '100%';
+        if (video) player.style.maxHeight = '70vh';
+        player.onerror = () => {
+            body.insertAdjacentHTML('beforeend', '<div style="margin-top:10px; color:var(--text-muted); font-size:0.85rem;">This format may not play in your browser. Download it instead.</div>');
+        };
+        player.src = url;
+        body.innerHTML = '';
+        body.appendChild(player);
+        console.log('[STREAM] Playing', fileObj.name);
+    } catch (error) {
+        console.error('[STREAM] Failed to start playback:', error);
+        body.innerHTML = `<div style="color:var(--text-muted);">Playback failed: ${error.message}</div>`;
+    }
+}
+
+// Closing stops playback, so the player stops fetching ranges.
+function closePlayer() {
+    const player = document.querySelector('#playerBody video, #playerBody audio');
+    if (player) {
+        player.pause();
+        player.removeAttribute('src');
+        player.load();
+    }
+    document.getElementById('playerBody').innerHTML = '';
+    closeModal('playerModal');
+}
+
+// === ARCHIVE DOWNLOADS ===
+// Cards have a checkbox; what is ticked, in any folder, downloads as one
+// ZIP or tar.gz from /api/archive, which streams it as it decrypts.
+const selection = { file: new Set(), folder: new Set() };
+
+function selectBox(kind, id) {
+    const checked = selection[kind].has(id) ? ' checked' : '';
+    return `<input type="checkbox" class="select-box"${checked} onclick="toggleSelect('${kind}', '${id}', this.checked)" title="Select">`;
+}
+
+function toggleSelect(kind, id, on) {
+    if (on) selection[kind].add(id);
+    else selection[kind].delete(id);
+    updateSelectionBar();
+}
+
+function clearSelection() {
+    selection.file.clear();
+    selection.folder.clear();
+    document.querySelectorAll('.select-box:checked').forEach(box => { box.checked = false; });
+    updateSelectionBar();
+}
+
+function updateSelectionBar() {
+    const files = selection.file.size, dirs = selection.folder.size;
+    const parts = [];
+    if (files) parts.push(`${files} file${files === 1 ? '' : 's'}`);
+    if (dirs) parts.push(`${dirs} folder${dirs === 1 ? '' : 's'}`);
+    document.getElementById('selectionCount').textContent = parts.join(', ') + ' selected';
+    document.getElementById('selectionBar').style.display = parts.length ? 'flex' : 'none';
+}
+
+// Names the archive the way the server would, so the save dialog can open
+// before the download starts.
+function archiveName() {
+    if (selection.file.size + selection.folder.size === 1) {
+        const [id] = [...selection.file, ...selection.folder];
+        const item = selection.file.size ? getFileById(id) : folders.find(f => f.id === id);
+        if (item) return item.name;
+    }
+    const here = currentFolder && folders.find(f => f.id === currentFolder);
+    return here ? here.name : 'TEDDRIVE';
+}
+
+async function downloadArchive(format) {
+    if (selection.file.size + selection.folder.size === 0) return;
+    const name = archiveName();
+    const fileName = name + (format === 'zip' ? '.zip' : '.tar.gz');
+    
+    // Where the browser can write to disk, the archive goes straight
+    // there; otherwise it is collected in memory first.
+    let writable = null;
+    if (window.showSaveFilePicker) {
+        try {
+            const handle = await window.showSaveFilePicker({ suggestedName: fileName });
+            writable = await handle.createWritable();
+        } catch (error) {
+            if (error.name === 'AbortError') return;
+            console.warn('[ARCHIVE] Save dialog failed, downloading in memory:', error);
+        }
+    }
+    
+    document.getElementById('progressModal').style.display = 'flex';
+    document.getElementById('progressTitle').innerText = "Downloading archive...";
+    document.getElementById('progressBar').style.width = '0%';
+    document.getElementById('progressText').innerText = 'Starting...';
+    
+    try {
+        const res = await apiFetch('/api/archive', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({
+                fileIds: [...selection.file],
+                folderIds: [...selection.folder],
+                format: format,
+                name: name
+            })
+        });
+        if (!res.ok) throw new Error(await res.text());
+        
+        // Only the files' sizes are known here, not the archive's.
+        const total = [...selection.file].reduce((n, id) => n + ((getFileById(id) || {}).size || 0), 0);
+        let received = 0;
+        const counter = new TransformStream({
+            transform(chunk, controller) {
+                received += chunk.byteLength;
+                document.getElementById('progressText').innerText = `Downloaded ${formatSize(received)}`;
+                if (total && !selection.folder.size) {
+                    document.getElementById('progressBar').style.width = Math.min(100, Math.round(received / total * 100)) + '%';
+                }
+                controller.enqueue(chunk);
+            }
+        });
+        const body = res.body.pipeThrough(counter);
+        
+        if (writable) {
+            await body.pipeTo(writable);
+        } else {
+            const blob = await new Response(body).blob();
+            const url = URL.createObjectURL(blob);
+            const a = document.createElement('a');
+            a.href = url;
+            a.download = fileName;
+            document.body.appendChild(a);
+            a.click();
+            a.remove();
+            setTimeout(() => URL.revokeObjectURL(url), 1000);
+        }
+        console.log('[ARCHIVE] Downloaded', fileName, received, 'bytes');
+    } catch (error) {
+        console.error('[ARCHIVE] Download failed:', error);
+        if (writable) writable.abort().catch(() => {});
+        alert('Archive download failed: ' + error.message);
+    } finally {
+        document.getElementById('progressModal').style.display = 'none';
+    }
+}
+
 // === SHARE FUNCTIONS ===
 async function shareFile(fileId) {
     const file = getFileById(fileId);
@@ -961,55 +2083,72 @@ async function shareFile(fileId) {
         return;
     }
     
-    if (!file.shareId) {
-        file.shareId = generateShareId();
-        
-        if (useDatabase && supabaseClient) {
-            try {
-                await supabaseClient
-                    .from('files')
-                    .update({ 
-                        share_id: file.shareId,
-                        is_public: true 
-                    })
-                    .eq('id', fileId);
-            } catch (error) {
-                console.error('[SHARE] Failed to update database:', error);
-            }
-        }
-        
-        const fileIndex = files.findIndex(f => f.id == fileId);
-        if (fileIndex !== -1) {
-            files[fileIndex].shareId = file.shareId;
-            files[fileIndex].isPublic = true;
-            localStorage.setItem('ois_files', JSON.stringify(files));
-        }
+    showShareModal('file', file.id, file.name);
+    loadShareLinks();
+}
+
+async function shareFolder(folderId) {
+    const folder = folders.find(f => f.id === folderId);
+    if (!folder) {
+        alert('Folder not found!');
+        return;
     }
     
-    const shareUrl = `${window.location.origin}/share.html?id=${file.shareId}`;
-    showShareModal(file.name, shareUrl);
+    showShareModal('folder', folder.id, folder.name);
+    loadShareLinks();
 }
 
-function showShareModal(fileName, shareUrl) {
+// kind is 'file' or 'folder'; the modal remembers which one it is sharing.
+function showShareModal(kind, id, name) {
     let modal = document.getElementById('shareModal');
     if (!modal) {
+        const inputStyle = 'width: 100%; padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem;';
+        const labelStyle = 'font-size: 0.9rem; color: var(--text-muted); display: block; margin-bottom: 5px;';
         modal = document.createElement('div');
         modal.id = 'shareModal';
         modal.className = 'modal-overlay';
         modal.innerHTML = `
             <div class="modal">
-                <h3><i class="fa-solid fa-share"></i> Share File</h3>
-                <p style="color: var(--text-muted); margin-bottom: 15px;">Share this file with others using the link below:</p>
+                <h3><i class="fa-solid fa-share"></i> <span id="shareTitle">Share File</span></h3>
                 
                 <div style="margin-bottom: 15px;">
-                    <label style="font-size: 0.9rem; color: var(--text-muted); display: block; margin-bottom: 5px;">File Name:</label>
+                    <label id="shareNameLabel" style="${labelStyle}">File Name:</label>
                     <div style="background: var(--bg-dark); padding: 10px; border-radius: 6px; border: 1px solid var(--border);">
                         <span id="shareFileName" style="color: var(--text-main);"></span>
                     </div>
                 </div>
                 
-                <div style="margin-bottom: 20px;">
-                    <label style="font-size: 0.9rem; color: var(--text-muted); display: block; margin-bottom: 5px;">Share Link:</label>
+                <div style="display: grid; grid-template-columns: 1fr 1fr; gap: 10px; margin-bottom: 15px;">
+                    <div style="grid-column: 1 / -1;">
+                        <label style="${labelStyle}">Password (optional):</label>
+                        <input type="password" id="sharePassword" autocomplete="new-password" style="${inputStyle}">
+                    </div>
+                    <div>
+                        <label style="${labelStyle}">Expires:</label>
+                        <select id="shareExpiry" style="${inputStyle}">
+                            <option value="">Never</option>
+                            <option value="1">1 hour</option>
+                            <option value="24">1 day</option>
+                            <option value="168">7 days</option>
+                            <option value="720">30 days</option>
+                        </select>
+                    </div>
+                    <div>
+                        <label style="${labelStyle}">Max downloads:</label>
+                        <input type="number" id="shareMaxDownloads" min="1" placeholder="Unlimited" style="${inputStyle}">
+                    </div>
+                    <label id="shareKeyInLinkRow" style="grid-column: 1 / -1; font-size: 0.9rem; color: var(--text-muted); display: flex; align-items: center; gap: 8px; cursor: pointer;">
+                        <input type="checkbox" id="shareKeyInLink" checked>
+                        Keep the decryption key in the link only (it is shown once)
+                    </label>
+                </div>
+                
+                <button onclick="createShareLink()" style="width: 100%; padding: 10px 15px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer; margin-bottom: 15px;">
+                    <i class="fa-solid fa-link"></i> Create Link
+                </button>
+                
+                <div id="shareUrlBox" style="margin-bottom: 20px; display: none;">
+                    <label style="${labelStyle}">Share Link:</label>
                     <div style="display: flex; gap: 10px;">
                         <input type="text" id="shareUrl" readonly style="flex: 1; padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem;">
                         <button onclick="copyShareUrl()" style="padding: 10px 15px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer; white-space: nowrap;">
@@ -1018,11 +2157,9 @@ function showShareModal(fileName, shareUrl) {
                     </div>
                 </div>
                 
-                <div style="background: rgba(139, 92, 246, 0.1); padding: 15px; border-radius: 8px; border: 1px solid rgba(139, 92, 246, 0.3); margin-bottom: 20px;">
-                    <p style="color: var(--primary); font-size: 0.85rem; margin: 0;">
-                        <i class="fa-solid fa-info-circle"></i> 
-                        This link allows anyone to download the file. The file is encrypted and stored securely.
-                    </p>
+                <div style="margin-bottom: 20px;">
+                    <label style="${labelStyle}">Existing Links:</label>
+                    <div id="shareLinks" style="font-size: 0.85rem; color: var(--text-muted);"></div>
                 </div>
                 
                 <div style="display: flex; justify-content: flex-end; gap: 10px;">
@@ -1033,11 +2170,687 @@ function showShareModal(fileName, shareUrl) {
         document.body.appendChild(modal);
     }
     
-    document.getElementById('shareFileName').textContent = fileName;
-    document.getElementById('shareUrl').value = shareUrl;
+    modal.dataset.kind = kind;
+    modal.dataset.id = id;
+    document.getElementById('shareTitle').textContent = kind === 'folder' ? 'Share Folder' : 'Share File';
+    document.getElementById('shareNameLabel').textContent = kind === 'folder' ? 'Folder Name:' : 'File Name:';
+    document.getElementById('shareFileName').textContent = name;
+    document.getElementById('sharePassword').value = '';
+    document.getElementById('shareExpiry').value = '';
+    document.getElementById('shareMaxDownloads').value = '';
+    // Folder links are decrypted by the server, so they can't keep the key in the link.
+    document.getElementById('shareKeyInLink').checked = kind === 'file';
+    document.getElementById('shareKeyInLinkRow').style.display = kind === 'file' ? 'flex' : 'none';
+    document.getElementById('shareUrlBox').style.display = 'none';
     modal.style.display = 'flex';
 }
 
+function shareUrlFor(shareId, fragmentKey) {
+    const url = `${window.location.origin}/share.html?id=${shareId}`;
+    return fragmentKey ? `${url}#k=${fragmentKey}` : url;
+}
+
+// Wrap the file key under a fresh share key. Only the wrapped key goes to the
+// server; the share key goes in the URL fragment, which is never sent to it.
+async function wrapKeyForShare(fileKeyBase64) {
+    const shareKey = window.crypto.getRandomValues(new Uint8Array(32));
+    const iv = window.crypto.getRandomValues(new Uint8Array(12));
+    const wrappingKey = await window.crypto.subtle.importKey("raw", shareKey, { name: "AES-GCM" }, false, ["encrypt"]);
+    const fileKey = Uint8Array.from(atob(fileKeyBase64), c => c.charCodeAt(0));
+    const sealed = new Uint8Array(await window.crypto.subtle.encrypt({ name: "AES-GCM", iv: iv }, wrappingKey, fileKey));
+    
+    const wrapped = new Uint8Array(iv.length + sealed.length);
+    wrapped.set(iv);
+    wrapped.set(sealed, iv.length);
+    
+    const fragmentKey = btoa(String.fromCharCode(...shareKey))
+        .replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    return { wrappedKey: btoa(String.fromCharCode(...wrapped)), fragmentKey: fragmentKey };
+}
+
+async function createShareLink() {
+    const modal = document.getElementById('shareModal');
+    const fileId = modal.dataset.id;
+    const body = modal.dataset.kind === 'folder' ? { folderId: fileId } : { fileId: fileId };
+    
+    const password = document.getElementById('sharePassword').value;
+    if (password) body.password = password;
+    
+    const hours = document.getElementById('shareExpiry').value;
+    if (hours) body.expiresAt = new Date(Date.now() + hours * 3600 * 1000).toISOString();
+    
+    const maxDownloads = parseInt(document.getElementById('shareMaxDownloads').value, 10);
+    if (maxDownloads > 0) body.maxDownloads = maxDownloads;
+    
+    try {
+        let fragmentKey = null;
+        if (modal.dataset.kind === 'file' && document.getElementById('shareKeyInLink').checked) {
+            const file = getFileById(fileId);
+            const fileKeyBase64 = file && await fileKey(file);
+            if (!fileKeyBase64) throw new Error('missing encryption key');
+            const wrapped = await wrapKeyForShare(fileKeyBase64);
+            body.wrappedKey = wrapped.wrappedKey;
+            fragmentKey = wrapped.fragmentKey;
+        }
+        
+        const res = await apiFetch('/api/share', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(body)
+        });
+        if (!res.ok) throw new Error(await res.text());
+        
+        const link = await res.json();
+        document.getElementById('shareUrl').value = shareUrlFor(link.id, fragmentKey);
+        document.getElementById('shareUrlBox').style.display = 'block';
+        loadShareLinks();
+    } catch (error) {
+        console.error('[SHARE] Create failed:', error);
+        alert('Failed to create share link: ' + error.message);
+    }
+}
+
+async function loadShareLinks() {
+    const modal = document.getElementById('shareModal');
+    const list = document.getElementById('shareLinks');
+    list.innerHTML = '<i class="fa-solid fa-spinner fa-spin"></i>';
+    
+    try {
+        const param = modal.dataset.kind === 'folder' ? 'folderId' : 'fileId';
+        const res = await apiFetch(`/api/share?${param}=${encodeURIComponent(modal.dataset.id)}`);
+        if (!res.ok) throw new Error(await res.text());
+        const { shares } = await res.json();
+        
+        if (!shares.length) {
+            list.innerHTML = 'No links yet.';
+            return;
+        }
+        
+        list.innerHTML = shares.map(s => {
+            const details = [];
+            if (s.hasPassword) details.push('<i class="fa-solid fa-lock"></i>');
+            if (s.keyInLink) details.push('<i class="fa-solid fa-key" title="Key in link"></i>');
+            if (s.expiresAt) details.push('expires ' + new Date(s.expiresAt).toLocaleString());
+            details.push(s.maxDownloads ? `${s.downloadCount}/${s.maxDownloads} downloads` : `${s.downloadCount} downloads`);
+            const status = s.revoked ? 'revoked' : (s.active ? '' : 'expired');
+            return `
+                <div style="display: flex; align-items: center; gap: 8px; padding: 6px 0; border-bottom: 1px solid var(--border);">
+                    <span style="flex: 1; ${s.active ? '' : 'text-decoration: line-through;'}">${s.id} &middot; ${details.join(' &middot; ')} ${status}</span>
+                    ${s.active && !s.keyInLink ? `<button onclick="copyText('${shareUrlFor(s.id)}')" title="Copy" style="background: none; border: none; color: var(--primary); cursor: pointer;"><i class="fa-solid fa-copy"></i></button>` : ''}
+                    ${s.active ? `<button onclick="revokeShareLink('${s.id}')" title="Revoke" style="background: none; border: none; color: #ef4444; cursor: pointer;"><i class="fa-solid fa-ban"></i></button>` : ''}
+                </div>`;
+        }).join('');
+    } catch (error) {
+        console.error('[SHARE] Load links failed:', error);
+        list.innerHTML = 'Could not load links.';
+    }
+}
+
+async function revokeShareLink(shareId) {
+    if (!confirm('Revoke this link? Anyone holding it will lose access.')) return;
+    
+    try {
+        const res = await apiFetch(`/api/share/${encodeURIComponent(shareId)}`, { method: 'DELETE' });
+        if (!res.ok) throw new Error(await res.text());
+        loadShareLinks();
+    } catch (error) {
+        console.error('[SHARE] Revoke failed:', error);
+        alert('Failed to revoke link: ' + error.message);
+    }
+}
+
+// === DROP LINKS (FILE REQUESTS) ===
+async function requestFiles(folderId) {
+    const folder = folders.find(f => f.id === folderId);
+    if (!folder) {
+        alert('Folder not found!');
+        return;
+    }
+    
+    let modal = document.getElementById('dropModal');
+    if (!modal) {
+        const inputStyle = 'width: 100%; padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem;';
+        const labelStyle = 'font-size: 0.9rem; color: var(--text-muted); display: block; margin-bottom: 5px;';
+        modal = document.createElement('div');
+        modal.id = 'dropModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3><i class="fa-solid fa-inbox"></i> Request Files</h3>
+                
+                <p style="font-size: 0.9rem; color: var(--text-muted); margin-bottom: 15px;">
+                    Anyone with the link can upload into <strong id="dropFolderName" style="color: var(--text-main);"></strong>, but can't see what's in it.
+                </p>
+                
+                <div style="display: grid; grid-template-columns: 1fr 1fr; gap: 10px; margin-bottom: 15px;">
+                    <div style="grid-column: 1 / -1;">
+                        <label style="${labelStyle}">Password (optional):</label>
+                        <input type="password" id="dropPassword" autocomplete="new-password" style="${inputStyle}">
+                    </div>
+                    <div>
+                        <label style="${labelStyle}">Expires:</label>
+                        <select id="dropExpiry" style="${inputStyle}">
+                            <option value="24">1 day</option>
+                            <option value="168" selected>7 days</option>
+                            <option value="720">30 days</option>
+                            <option value="">Never</option>
+                        </select>
+                    </div>
+                    <div>
+                        <label style="${labelStyle}">Max size (MB):</label>
+                        <input type="number" id="dropMaxMB" min="1" value="2048" placeholder="Unlimited" style="${inputStyle}">
+                    </div>
+                    <div style="grid-column: 1 / -1;">
+                        <label style="${labelStyle}">Store on:</label>
+                        <select id="dropProvider" style="${inputStyle}">
+                            <option value="discord">Discord</option>
+                            <option value="telegram">Telegram</option>
+                            <option value="erasure">Erasure coded (Discord + Telegram)</option>
+                        </select>
+                    </div>
+                </div>
+                
+                <button onclick="createDropLink()" style="width: 100%; padding: 10px 15px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer; margin-bottom: 15px;">
+                    <i class="fa-solid fa-link"></i> Create Link
+                </button>
+                
+                <div style="margin-bottom: 20px;">
+                    <label style="${labelStyle}">Existing Links:</label>
+                    <div id="dropLinks" style="font-size: 0.85rem; color: var(--text-muted);"></div>
+                </div>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="closeModal('dropModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Close</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    
+    modal.dataset.folderId = folder.id;
+    document.getElementById('dropFolderName').textContent = folder.name;
+    document.getElementById('dropPassword').value = '';
+    modal.style.display = 'flex';
+    loadDropLinks();
+}
+
+function dropUrlFor(dropId) {
+    return `${window.location.origin}/drop.html?id=${dropId}`;
+}
+
+async function createDropLink() {
+    const body = {
+        folderId: document.getElementById('dropModal').dataset.folderId,
+        provider: document.getElementById('dropProvider').value
+    };
+    
+    const password = document.getElementById('dropPassword').value;
+    if (password) body.password = password;
+    
+    const hours = document.getElementById('dropExpiry').value;
+    if (hours) body.expiresAt = new Date(Date.now() + hours * 3600 * 1000).toISOString();
+    
+    const maxMB = parseInt(document.getElementById('dropMaxMB').value, 10);
+    if (maxMB > 0) body.maxBytes = maxMB * 1024 * 1024;
+    
+    try {
+        const res = await apiFetch('/api/drop', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(body)
+        });
+        if (!res.ok) throw new Error(await res.text());
+        
+        const link = await res.json();
+        const url = dropUrlFor(link.id);
+        navigator.clipboard.writeText(url)
+            .then(() => alert('Drop link copied to clipboard:\n' + url))
+            .catch(() => prompt('Copy this link:', url));
+        loadDropLinks();
+    } catch (error) {
+        console.error('[DROP] Create failed:', error);
+        alert('Failed to create drop link: ' + error.message);
+    }
+}
+
+async function loadDropLinks() {
+    const list = document.getElementById('dropLinks');
+    list.innerHTML = '<i class="fa-solid fa-spinner fa-spin"></i>';
+    
+    try {
+        const folderId = document.getElementById('dropModal').dataset.folderId;
+        const res = await apiFetch(`/api/drop?folderId=${encodeURIComponent(folderId)}`);
+        if (!res.ok) throw new Error(await res.text());
+        const { drops } = await res.json();
+        
+        if (!drops.length) {
+            list.innerHTML = 'No links yet.';
+            return;
+        }
+        
+        list.innerHTML = drops.map(d => {
+            const details = [];
+            if (d.hasPassword) details.push('<i class="fa-solid fa-lock"></i>');
+            if (d.expiresAt) details.push('until ' + new Date(d.expiresAt).toLocaleString());
+            details.push(`${d.fileCount} file${d.fileCount === 1 ? '' : 's'}`);
+            details.push(d.maxBytes ? `${formatSize(d.bytesUsed)} / ${formatSize(d.maxBytes)}` : formatSize(d.bytesUsed));
+            const status = d.revoked ? 'closed' : (d.active ? '' : 'expired');
+            return `
+                <div style="display: flex; align-items: center; gap: 8px; padding: 6px 0; border-bottom: 1px solid var(--border);">
+                    <span style="flex: 1; ${d.active ? '' : 'text-decoration: line-through;'}">${d.id} &middot; ${details.join(' &middot; ')} ${status}</span>
+                    ${d.active ? `<button onclick="copyText('${dropUrlFor(d.id)}')" title="Copy" style="background: none; border: none; color: var(--primary); cursor: pointer;"><i class="fa-solid fa-copy"></i></button>
+                    <button onclick="revokeDropLink('${d.id}')" title="Close link" style="background: none; border: none; color: #ef4444; cursor: pointer;"><i class="fa-solid fa-ban"></i></button>` : ''}
+                </div>`;
+        }).join('');
+    } catch (error) {
+        console.error('[DROP] Load links failed:', error);
+        list.innerHTML = 'Could not load links.';
+    }
+}
+
+async function revokeDropLink(dropId) {
+    if (!confirm('Close this link? Files already received are kept.')) return;
+    
+    try {
+        const res = await apiFetch(`/api/drop/${encodeURIComponent(dropId)}`, { method: 'DELETE' });
+        if (!res.ok) throw new Error(await res.text());
+        loadDropLinks();
+    } catch (error) {
+        console.error('[DROP] Revoke failed:', error);
+        alert('Failed to close link: ' + error.message);
+    }
+}
+
+// === IMPORT FROM URL ===
+// The server fetches the file and stores it like an upload; the browser
+// only keeps asking it to carry on, a few chunks per call, and shows how
+// far it got. Closing the tab pauses an import; Resume picks it up again.
+const importsRunning = new Set();
+
+function showImportModal() {
+    let modal = document.getElementById('importModal');
+    if (!modal) {
+        const inputStyle = 'width: 100%; padding: 10px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 6px; font-size: 0.9rem;';
+        const labelStyle = 'font-size: 0.9rem; color: var(--text-muted); display: block; margin-bottom: 5px;';
+        modal = document.createElement('div');
+        modal.id = 'importModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3><i class="fa-solid fa-link"></i> Import from URL</h3>
+                
+                <p style="font-size: 0.9rem; color: var(--text-muted); margin-bottom: 15px;">
+                    The server downloads the file into <strong id="importFolderName" style="color: var(--text-main);"></strong>; nothing goes through this browser.
+                </p>
+                
+                <div style="display: grid; grid-template-columns: 1fr 1fr; gap: 10px; margin-bottom: 15px;">
+                    <div style="grid-column: 1 / -1;">
+                        <label style="${labelStyle}">URL:</label>
+                        <input type="url" id="importUrl" placeholder="https://" style="${inputStyle}">
+                    </div>
+                    <div>
+                        <label style="${labelStyle}">Name (optional):</label>
+                        <input type="text" id="importName" style="${inputStyle}">
+                    </div>
+                    <div>
+                        <label style="${labelStyle}">Store on:</label>
+                        <select id="importProvider" style="${inputStyle}">
+                            <option value="discord">Discord</option>
+                            <option value="telegram">Telegram</option>
+                            <option value="erasure">Erasure coded (Discord + Telegram)</option>
+                        </select>
+                    </div>
+                </div>
+                
+                <button onclick="startImport()" style="width: 100%; padding: 10px 15px; background: var(--primary); color: white; border: none; border-radius: 6px; cursor: pointer; margin-bottom: 15px;">
+                    <i class="fa-solid fa-cloud-arrow-down"></i> Import
+                </button>
+                
+                <div style="margin-bottom: 20px;">
+                    <label style="${labelStyle}">Imports:</label>
+                    <div id="importList" style="font-size: 0.85rem; color: var(--text-muted);"></div>
+                </div>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="closeModal('importModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Close</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    
+    const folder = folders.find(f => f.id === currentFolder);
+    modal.dataset.folderId = folder ? folder.id : '';
+    document.getElementById('importFolderName').textContent = folder ? folder.name : 'Home';
+    document.getElementById('importUrl').value = '';
+    document.getElementById('importName').value = '';
+    modal.style.display = 'flex';
+    loadImports();
+}
+
+async function startImport() {
+    const modal = document.getElementById('importModal');
+    const body = {
+        url: document.getElementById('importUrl').value.trim(),
+        provider: document.getElementById('importProvider').value
+    };
+    if (!body.url) return;
+    const name = document.getElementById('importName').value.trim();
+    if (name) body.name = name;
+    if (modal.dataset.folderId) body.folderId = modal.dataset.folderId;
+    
+    try {
+        const res = await apiFetch('/api/imports', {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(body)
+        });
+        if (!res.ok) throw new Error(await res.text());
+        const job = await res.json();
+        document.getElementById('importUrl').value = '';
+        document.getElementById('importName').value = '';
+        await loadImports();
+        if (job.status === 'done') loadData();
+        else if (job.status !== 'failed') continueImport(job.id);
+    } catch (error) {
+        console.error('[IMPORT] Start failed:', error);
+        alert('Failed to start import: ' + error.message);
+    }
+}
+
+// Asks the server for more until the import is done or failed.
+async function continueImport(id) {
+    if (importsRunning.has(id)) return;
+    importsRunning.add(id);
+    try {
+        for (;;) {
+            const res = await apiFetch(`/api/imports/${encodeURIComponent(id)}`, { method: 'POST' });
+            if (res.status === 409) {
+                // Another tab or `teddrive import` is on it; look again later.
+                await new Promise(resolve => setTimeout(resolve, 5000));
+                continue;
+            }
+            if (!res.ok) throw new Error(await res.text());
+            const job = await res.json();
+            showImport(job);
+            if (job.status === 'done') {
+                loadData();
+                return;
+            }
+            if (job.status === 'failed') return;
+        }
+    } catch (error) {
+        console.error('[IMPORT] Import failed:', error);
+        alert('Import stopped: ' + error.message);
+    } finally {
+        importsRunning.delete(id);
+        if (document.getElementById('importList')) loadImports();
+    }
+}
+
+async function loadImports() {
+    const list = document.getElementById('importList');
+    list.innerHTML = '<i class="fa-solid fa-spinner fa-spin"></i>';
+    
+    try {
+        const res = await apiFetch('/api/imports');
+        if (!res.ok) throw new Error(await res.text());
+        const { imports } = await res.json();
+        
+        if (!imports.length) {
+            list.innerHTML = 'No imports yet.';
+            return;
+        }
+        list.innerHTML = '';
+        imports.forEach(showImport);
+    } catch (error) {
+        console.error('[IMPORT] Load failed:', error);
+        list.innerHTML = 'Could not load imports.';
+    }
+}
+
+// Adds or updates the row of one import in the list.
+function showImport(job) {
+    const list = document.getElementById('importList');
+    if (!list) return;
+    let row = document.getElementById('import-' + job.id);
+    if (!row) {
+        row = document.createElement('div');
+        row.id = 'import-' + job.id;
+        row.style.cssText = 'display: flex; align-items: center; gap: 8px; padding: 6px 0; border-bottom: 1px solid var(--border);';
+        list.appendChild(row);
+    }
+    
+    const running = importsRunning.has(job.id);
+    let status = job.status;
+    if (job.status !== 'done') {
+        status = job.size ? `${formatSize(job.doneBytes)} / ${formatSize(job.size)}` : formatSize(job.doneBytes);
+        if (job.status === 'failed') status += ' &middot; failed: <span class="import-error"></span>';
+        else if (!running) status += ' &middot; paused';
+    }
+    row.innerHTML = `
+        <span style="flex: 1; min-width: 0; overflow: hidden; text-overflow: ellipsis; white-space: nowrap;"><span class="import-name"></span> &middot; ${status}</span>
+        ${job.status !== 'done' && !running ? `<button onclick="continueImport('${job.id}')" title="Resume" style="background: none; border: none; color: var(--primary); cursor: pointer;"><i class="fa-solid fa-play"></i></button>` : ''}
+        ${running ? '<i class="fa-solid fa-spinner fa-spin"></i>' : `<button onclick="cancelImport('${job.id}', '${job.status}')" title="${job.status === 'done' ? 'Remove from list' : 'Cancel'}" style="background: none; border: none; color: #ef4444; cursor: pointer;"><i class="fa-solid fa-xmark"></i></button>`}`;
+    // Names come from other servers; keep them out of the markup.
+    const name = row.querySelector('.import-name');
+    name.textContent = job.name || job.url;
+    const error = row.querySelector('.import-error');
+    if (error) error.textContent = job.error;
+    row.title = job.url;
+}
+
+async function cancelImport(id, status) {
+    if (status !== 'done' && !confirm('Cancel this import? What it stored so far is deleted.')) return;
+    
+    try {
+        const res = await apiFetch(`/api/imports/${encodeURIComponent(id)}`, { method: 'DELETE' });
+        if (!res.ok) throw new Error(await res.text());
+        loadImports();
+    } catch (error) {
+        console.error('[IMPORT] Cancel failed:', error);
+        alert('Failed to cancel import: ' + error.message);
+    }
+}
+
+// === VERSION HISTORY ===
+function showVersions(fileId) {
+    const file = getFileById(fileId);
+    if (!file) {
+        alert('File not found!');
+        return;
+    }
+    
+    let modal = document.getElementById('versionsModal');
+    if (!modal) {
+        modal = document.createElement('div');
+        modal.id = 'versionsModal';
+        modal.className = 'modal-overlay';
+        modal.innerHTML = `
+            <div class="modal">
+                <h3><i class="fa-solid fa-clock-rotate-left"></i> Version History</h3>
+                
+                <div style="margin-bottom: 15px; background: var(--bg-dark); padding: 10px; border-radius: 6px; border: 1px solid var(--border);">
+                    <span id="versionsFileName" style="color: var(--text-main);"></span>
+                </div>
+                
+                <div id="versionsList" style="margin-bottom: 20px; font-size: 0.85rem; color: var(--text-muted); max-height: 50vh; overflow-y: auto;"></div>
+                
+                <div style="display: flex; justify-content: flex-end; gap: 10px;">
+                    <button onclick="closeModal('versionsModal')" style="padding: 10px 20px; background: #333; color: white; border: none; border-radius: 6px; cursor: pointer;">Close</button>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+    }
+    
+    modal.dataset.id = file.id;
+    document.getElementById('versionsFileName').textContent = file.name;
+    modal.style.display = 'flex';
+    loadVersions();
+}
+
+async function loadVersions() {
+    const fileId = document.getElementById('versionsModal').dataset.id;
+    const list = document.getElementById('versionsList');
+    list.innerHTML = '<i class="fa-solid fa-spinner fa-spin"></i>';
+    
+    try {
+        const res = await apiFetch(`/api/versions?fileId=${encodeURIComponent(fileId)}`);
+        if (!res.ok) throw new Error(await res.text());
+        const { versions, enabled } = await res.json();
+        
+        const rows = versions.map(v => {
+            const when = v.createdAt ? new Date(v.createdAt).toLocaleString() : '';
+            const label = v.current ? '<strong>Current</strong>' : 'Replaced';
+            return `
+                <div style="display: flex; align-items: center; gap: 8px; padding: 6px 0; border-bottom: 1px solid var(--border);">
+                    <span style="flex: 1;">${label} &middot; ${when} &middot; ${formatSize(v.size)}</span>
+                    ${v.current ? '' : `
+                    <button onclick="downloadVersion('${v.id}')" title="Download" style="background: none; border: none; color: var(--primary); cursor: pointer;"><i class="fa-solid fa-download"></i></button>
+                    <button onclick="restoreVersion('${v.id}')" title="Restore" style="background: none; border: none; color: var(--primary); cursor: pointer;"><i class="fa-solid fa-rotate-left"></i></button>
+                    <button onclick="deleteVersion('${v.id}')" title="Delete" style="background: none; border: none; color: #ef4444; cursor: pointer;"><i class="fa-solid fa-trash"></i></button>`}
+                </div>`;
+        });
+        if (!enabled) {
+            rows.push('<div style="padding: 6px 0;">Version history is off until migration 008 is applied.</div>');
+        } else if (versions.length === 1) {
+            rows.push('<div style="padding: 6px 0;">No older versions yet. Upload a file with the same name to this folder to add one.</div>');
+        }
+        list.innerHTML = rows.join('');
+    } catch (error) {
+        console.error('[VERSIONS] Load failed:', error);
+        list.innerHTML = 'Could not load versions.';
+    }
+}
+
+async function downloadVersion(versionId) {
+    const fileId = document.getElementById('versionsModal').dataset.id;
+    try {
+        const res = await apiFetch(`/api/versions?fileId=${encodeURIComponent(fileId)}&id=${encodeURIComponent(versionId)}`);
+        if (!res.ok) throw new Error(await res.text());
+        const m = await res.json();
+        const fileObj = { name: m.name, size: m.size };
+        applyManifest(fileObj, m);
+        await downloadFileObj(fileObj);
+    } catch (error) {
+        console.error('[VERSIONS] Download failed:', error);
+        alert('Failed to download version: ' + error.message);
+    }
+}
+
+async function restoreVersion(versionId) {
+    if (!confirm('Restore this version? The current content is kept as a version.')) return;
+    
+    const fileId = document.getElementById('versionsModal').dataset.id;
+    try {
+        const res = await apiFetch(`/api/versions?fileId=${encodeURIComponent(fileId)}&id=${encodeURIComponent(versionId)}`, { method: 'POST' });
+        if (!res.ok) throw new Error(await res.text());
+        const file = getFileById(fileId);
+        if (file) applyManifest(file, await res.json());
+        renderGrid();
+        updateUsedSpace();
+        loadVersions();
+    } catch (error) {
+        console.error('[VERSIONS] Restore failed:', error);
+        alert('Failed to restore version: ' + error.message);
+    }
+}
+
+async function deleteVersion(versionId) {
+    if (!confirm('Delete this version? It cannot be restored afterwards.')) return;
+    
+    const fileId = document.getElementById('versionsModal').dataset.id;
+    try {
+        const res = await apiFetch(`/api/versions?fileId=${encodeURIComponent(fileId)}&id=${encodeURIComponent(versionId)}`, { method: 'DELETE' });
+        if (!res.ok) throw new Error(await res.text());
+        loadVersions();
+    } catch (error) {
+        console.error('[VERSIONS] Delete failed:', error);
+        alert('Failed to delete version: ' + error.message);
+    }
+}
+
+// === TRASH ===
+async function renderTrash() {
+    const grid = document.getElementById('fileGrid');
+    grid.innerHTML = '<div style="grid-column:1/-1; text-align:center; color:var(--text-muted); padding:40px;"><i class="fa-solid fa-spinner fa-spin"></i> Loading...</div>';
+    
+    try {
+        const res = await apiFetch('/api/trash');
+        if (!res.ok) throw new Error(await res.text());
+        const { items, enabled, retentionDays } = await res.json();
+        if (currentFilter !== 'trash') return;
+        
+        if (!enabled) {
+            grid.innerHTML = '<div style="grid-column:1/-1; text-align:center; color:var(--text-muted);">The trash is off until migration 009 is applied. Deleted files are removed at once.</div>';
+            return;
+        }
+        if (items.length === 0) {
+            grid.innerHTML = `<div style="grid-column:1/-1; text-align:center; color:var(--text-muted);">The trash is empty. Deleted items are kept for ${retentionDays} days.</div>`;
+            return;
+        }
+        
+        grid.innerHTML = '';
+        items.forEach(item => {
+            const left = Math.max(0, retentionDays - Math.floor((Date.now() - new Date(item.deletedAt)) / 86400000));
+            const detail = item.folder ? `${item.files || 0} file(s), ${formatSize(item.size)}` : formatSize(item.size);
+            const div = document.createElement('div');
+            div.className = 'file-card';
+            div.innerHTML = `
+                <div class="preview">${item.folder ? '<i class="fa-solid fa-folder" style="color: #fbbf24; font-size: 3rem;"></i>' : getIconHTML(item.type)}</div>
+                <div class="info">
+                    <div class="name" title="${item.name}">${item.name}</div>
+                    <div class="meta">
+                        <div style="display:flex; justify-content:space-between; font-size:0.75rem; color:var(--text-muted);">
+                            <span>${detail}</span>
+                            <span>${new Date(item.deletedAt).toLocaleDateString()}</span>
+                        </div>
+                        <div class="meta-detail">
+                            <span class="file-type">Deleted for good in ${left} day(s)</span>
+                        </div>
+                    </div>
+                </div>
+                <div class="actions">
+                    <button class="btn-card btn-share" onclick="restoreFromTrash('${item.id}')" title="Restore"><i class="fa-solid fa-rotate-left"></i></button>
+                    <button class="btn-card btn-delete" onclick="purgeFromTrash('${item.id}')" title="Delete forever"><i class="fa-solid fa-trash"></i></button>
+                </div>`;
+            grid.appendChild(div);
+        });
+    } catch (error) {
+        console.error('[TRASH] Load failed:', error);
+        grid.innerHTML = '<div style="grid-column:1/-1; text-align:center; color:var(--text-muted);">Could not load the trash.</div>';
+    }
+}
+
+async function restoreFromTrash(id) {
+    try {
+        const res = await apiFetch(`/api/trash?id=${encodeURIComponent(id)}`, { method: 'POST' });
+        if (!res.ok) throw new Error(await res.text());
+        renderTrash();
+    } catch (error) {
+        console.error('[TRASH] Restore failed:', error);
+        alert('Failed to restore: ' + error.message);
+    }
+}
+
+async function purgeFromTrash(id) {
+    if (!confirm('Delete this forever? Its chunks are removed from the provider and it cannot be restored.')) return;
+    
+    try {
+        const res = await apiFetch(`/api/trash?id=${encodeURIComponent(id)}`, { method: 'DELETE' });
+        if (!res.ok) throw new Error(await res.text());
+        renderTrash();
+    } catch (error) {
+        console.error('[TRASH] Purge failed:', error);
+        alert('Failed to delete: ' + error.message);
+    }
+}
+
+function copyText(text) {
+    navigator.clipboard.writeText(text).catch(() => prompt('Copy this link:', text));
+}
+
 function copyShareUrl() {
     const shareUrlInput = document.getElementById('shareUrl');
     shareUrlInput.select();
@@ -1072,6 +2885,8 @@ function getIconHTML(t) {
 function getProviderIcon(p) {
     if(p==='discord') return '<i class="fa-brands fa-discord provider-icon discord"></i>';
     if(p==='telegram') return '<i class="fa-brands fa-telegram provider-icon telegram"></i>';
+    if(p==='erasure') return '<i class="fa-solid fa-shield-halved provider-icon"></i>';
+    if(p==='dedup') return '<i class="fa-solid fa-layer-group provider-icon"></i>';
     return '';
 }
 
@@ -1102,11 +2917,29 @@ function getType(mime) {
     return 'other';
 }
 
-function updateUsedSpace() {
-    const total = files.reduce((acc, f) => acc + f.size, 0);
-    document.getElementById('usedSpaceText').innerText = formatSize(total);
-    const limitGB = 10 * 1024 * 1024 * 1024;
-    const percentage = Math.min((total / limitGB) * 100, 100);
+// Shows what the providers hold according to /api/usage, or the sum of
+// the file sizes until usage accounting is set up.
+async function updateUsedSpace() {
+    let used = files.reduce((acc, f) => acc + f.size, 0);
+    let limit = 10 * 1024 * 1024 * 1024;
+    let counted = false;
+    try {
+        const res = await apiFetch('/api/usage');
+        if (res.ok) {
+            const usage = await res.json();
+            if (usage.enabled) {
+                used = usage.used;
+                limit = usage.limit;
+                counted = true;
+            }
+        }
+    } catch (error) {
+        console.error('[USAGE] Failed to load usage:', error);
+    }
+    document.getElementById('usedSpaceText').innerText = counted && limit
+        ? `${formatSize(used)} of ${formatSize(limit)}`
+        : formatSize(used);
+    const percentage = limit ? Math.min((used / limit) * 100, 100) : 0;
     document.getElementById('usedSpaceBar').style.width = percentage + "%";
 }
 
@@ -1229,7 +3062,7 @@ function switchView(filterType, element) {
 
     currentFilter = filterType;
     
-    if (filterType === 'dashboard' || filterType === 'recent' || filterType === 'video' || filterType === 'image' || filterType === 'audio' || filterType === 'other') {
+    if (filterType === 'dashboard' || filterType === 'recent' || filterType === 'video' || filterType === 'image' || filterType === 'audio' || filterType === 'other' || filterType === 'trash') {
         currentFolder = null;
     } else if (filterType !== currentFilter) {
         currentFolder = null;
@@ -1241,6 +3074,10 @@ function switchView(filterType, element) {
     } else if (filterType === 'recent') {
         document.getElementById('pageTitle').innerText = 'Recent Files';
         loadData().then(() => renderRecentFiles());
+    } else if (filterType === 'trash') {
+        document.getElementById('pageTitle').innerText = 'Trash';
+        updateBreadcrumb();
+        renderTrash();
     } else {
         const titles = { 'all': 'My Files', 'video': 'Videos', 'image': 'Images', 'audio': 'Audio', 'other': 'Other' };
         document.getElementById('pageTitle').innerText = titles[filterType] || 'My Files';
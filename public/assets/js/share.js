@@ -1,86 +1,47 @@
 // Share page JavaScript for TEDDRIVE
 let sharedFile = null;
-let supabaseClient = null;
-
-// Initialize Supabase
-async function initSupabase() {
-    try {
-        let supabaseUrl = window.SUPABASE_URL;
-        let supabaseKey = window.SUPABASE_ANON_KEY;
-
-        if (!supabaseUrl || supabaseUrl === 'https://your-project.supabase.co') {
-            try {
-                const configResponse = await fetch('/api/config');
-                if (configResponse.ok) {
-                    const config = await configResponse.json();
-                    supabaseUrl = config.supabaseUrl;
-                    supabaseKey = config.supabaseAnonKey;
-                }
-            } catch (configError) {
-                console.warn('Failed to fetch config from API:', configError);
-            }
-        }
-
-        if (!supabaseUrl || supabaseUrl === 'https://your-project.supabase.co') {
-            supabaseUrl = 'https://your-project.supabase.co';
-            supabaseKey = 'your-anon-key';
-        }
-
-        supabaseClient = window.supabase.createClient(supabaseUrl, supabaseKey);
-        return true;
-    } catch (error) {
-        console.error('Supabase initialization failed:', error);
-        return false;
-    }
-}
 
 // Get share ID from URL and initialize
 const urlParams = new URLSearchParams(window.location.search);
 const shareId = urlParams.get('id');
+// Links created with the key in the fragment carry it as #k=...; the browser
+// never sends the fragment to the server.
+const fragmentKey = new URLSearchParams(window.location.hash.slice(1)).get('k');
 
 if (!shareId) {
     showError('Invalid share link. Share ID is missing.');
 } else {
-    initSupabase().then(success => {
-        if (success) {
-            loadSharedFile(shareId);
-        } else {
-            showError('Failed to initialize database connection.');
-        }
-    });
+    loadSharedFile(shareId);
 }
 
 async function loadSharedFile(shareId) {
     try {
-        const { data, error } = await supabaseClient
-            .from('files')
-            .select('*')
-            .eq('share_id', shareId)
-            .eq('is_public', true)
-            .single();
-
-        if (error || !data) {
-            showError('File not found or share link has expired.');
+        const res = await fetch(`/api/share/${encodeURIComponent(shareId)}`);
+        if (!res.ok) {
+            showError(shareErrorMessage(res.status));
             return;
         }
 
+        const data = await res.json();
         sharedFile = {
-            id: data.id,
             name: data.name,
             size: data.size,
             type: data.type,
             mime: data.mime,
-            date: data.date,
-            folderId: data.folder_id,
-            meta: {
-                key: data.meta_key,
-                links: JSON.parse(data.meta_links),
-                provider: data.meta_provider
-            },
-            isPublic: data.is_public,
-            shareId: data.share_id
+            provider: data.provider,
+            passwordRequired: data.passwordRequired,
+            keyInLink: data.keyInLink,
+            expiresAt: data.expiresAt,
+            downloadsLeft: data.downloadsLeft,
+            folder: data.folder,
+            files: data.files
         };
 
+        if (sharedFile.keyInLink && !fragmentKey) {
+            showError('This share link is incomplete. Ask the sender for the full link, including the part after "#".');
+            return;
+        }
+
         showFileInfo(sharedFile);
     } catch (error) {
         console.error('Error loading shared file:', error);
@@ -88,7 +49,38 @@ async function loadSharedFile(shareId) {
     }
 }
 
+function shareErrorMessage(status) {
+    if (status === 401) return 'Incorrect password.';
+    if (status === 410) return 'This share link has expired or been revoked.';
+    if (status === 404) return 'File not found or share link has expired.';
+    return 'Failed to load shared file.';
+}
+
 function showFileInfo(file) {
+    const limits = [];
+    if (file.expiresAt) limits.push(`Expires ${new Date(file.expiresAt).toLocaleString()}`);
+    if (file.downloadsLeft != null) limits.push(`${file.downloadsLeft} download${file.downloadsLeft === 1 ? '' : 's'} left`);
+
+    const details = file.folder
+        ? `<span>${file.files} file${file.files === 1 ? '' : 's'}</span>`
+        : `<span>${file.mime}</span>
+                    ${getProviderIcon(file.provider)}`;
+
+    const buttons = file.folder
+        ? `<button class="download-btn" onclick="downloadFolderZip()">
+            <i class="fa-solid fa-file-zipper"></i>
+            Download as ZIP
+        </button>
+        <button class="download-btn" onclick="browseFolder()" style="background: #333;">
+            <i class="fa-solid fa-list"></i>
+            Browse Files
+        </button>
+        <div id="folderListing"></div>`
+        : `<button class="download-btn" onclick="downloadSharedFile()">
+            <i class="fa-solid fa-download"></i>
+            Download File
+        </button>`;
+
     const content = document.getElementById('content');
     content.innerHTML = `
         <div class="file-preview">
@@ -97,15 +89,16 @@ function showFileInfo(file) {
             <div class="file-meta">
                 <div style="margin-bottom: 5px;">${formatSize(file.size)}</div>
                 <div style="display: flex; justify-content: center; align-items: center; gap: 10px;">
-                    <span>${file.mime}</span>
-                    ${getProviderIcon(file.meta.provider)}
+                    ${details}
                 </div>
+                ${limits.length ? `<div style="margin-top: 5px;">${limits.join(' &middot; ')}</div>` : ''}
             </div>
         </div>
-        <button class="download-btn" onclick="downloadSharedFile()">
-            <i class="fa-solid fa-download"></i>
-            Download File
-        </button>
+        ${file.passwordRequired ? `
+        <input type="password" id="sharePassword" placeholder="Password" autocomplete="current-password"
+            style="width: 100%; padding: 12px; margin-bottom: 15px; background: var(--bg-dark); border: 1px solid var(--border); color: var(--text-main); border-radius: 8px; font-size: 1rem;">
+        ` : ''}
+        ${buttons}
         <div class="footer-info">
             <p>This file is shared via TEDDRIVE</p>
             <p>Encrypted and stored securely on Discord/Telegram</p>
@@ -128,23 +121,94 @@ function showError(message) {
     `;
 }
 
-async function downloadSharedFile() {
-    if (!sharedFile) return;
+// POST to the share link with the password. Returns the parsed answer, or
+// null after telling the user what went wrong.
+async function openShare(extra) {
+    const passwordInput = document.getElementById('sharePassword');
+    try {
+        const res = await fetch(`/api/share/${encodeURIComponent(shareId)}`, {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify({ password: passwordInput ? passwordInput.value : '', ...extra })
+        });
+        if (!res.ok) {
+            if (res.status === 401) {
+                alert(shareErrorMessage(res.status));
+                passwordInput && passwordInput.focus();
+            } else {
+                showError(shareErrorMessage(res.status));
+            }
+            return null;
+        }
+        return await res.json();
+    } catch (error) {
+        alert('Network error. Please check your connection and try again.');
+        return null;
+    }
+}
+
+async function browseFolder() {
+    const listing = await openShare({});
+    if (!listing) return;
 
-    const theKey = sharedFile.meta.key;
-    if (!theKey) {
-        alert("File is corrupted (missing encryption key).");
+    const box = document.getElementById('folderListing');
+    if (listing.files.length === 0) {
+        box.innerHTML = '<p style="margin-top: 20px; color: var(--text-muted);">This folder is empty.</p>';
         return;
     }
+    box.innerHTML = `
+        <div class="folder-listing">
+            ${listing.files.map(f => `
+                <div class="folder-entry">
+                    ${getIconHTML(f.type)}
+                    <span class="path">${escapeHTML(f.path)}</span>
+                    <span style="color: var(--text-muted); white-space: nowrap;">${formatSize(f.size)}</span>
+                    <button onclick="downloadSharedFile('${f.id}')" title="Download"><i class="fa-solid fa-download"></i></button>
+                </div>`).join('')}
+        </div>
+    `;
+}
 
-    const keyData = Uint8Array.from(atob(theKey), c => c.charCodeAt(0));
-    const key = await window.crypto.subtle.importKey("raw", keyData, { name: "AES-GCM" }, false, ["decrypt"]);
+// The ZIP is built by the server while it streams, so hand it to the browser
+// as a normal form download instead of buffering it here. Check the password
+// first so a typo doesn't navigate away to an error page.
+async function downloadFolderZip() {
+    if (!(await openShare({}))) return;
+
+    const passwordInput = document.getElementById('sharePassword');
+    const form = document.createElement('form');
+    form.method = 'POST';
+    form.action = `/api/share/${encodeURIComponent(shareId)}/zip`;
+    const field = document.createElement('input');
+    field.type = 'hidden';
+    field.name = 'password';
+    field.value = passwordInput ? passwordInput.value : '';
+    form.appendChild(field);
+    document.body.appendChild(form);
+    form.submit();
+    form.remove();
+}
+
+async function downloadSharedFile(fileId) {
+    if (!sharedFile) return;
+
+    const manifest = await openShare(fileId ? { fileId: fileId } : {});
+    if (!manifest) return;
+    const passwordInput = document.getElementById('sharePassword');
+
+    let key;
+    try {
+        key = await shareFileKey(manifest);
+    } catch (error) {
+        alert(error.message);
+        return;
+    }
 
     document.getElementById('progressModal').style.display = 'flex';
     document.getElementById('progressTitle').innerText = "Downloading...";
 
     const decryptedChunks = [];
-    const totalChunks = sharedFile.meta.links.length;
+    const totalChunks = manifest.links.length;
 
     try {
         for (let i = 0; i < totalChunks; i++) {
@@ -155,7 +219,13 @@ async function downloadSharedFile() {
             const proxyRes = await fetch('/api/download', {
                 method: 'POST',
                 headers: {'Content-Type': 'application/json'},
-                body: JSON.stringify({ url: sharedFile.meta.links[i], provider: sharedFile.meta.provider })
+                body: JSON.stringify({
+                    url: manifest.links[i],
+                    provider: manifest.provider,
+                    fileId: manifest.id,
+                    shareId: shareId,
+                    password: passwordInput ? passwordInput.value : ''
+                })
             });
 
             if (!proxyRes.ok) {
@@ -164,23 +234,13 @@ async function downloadSharedFile() {
             }
 
             const encryptedData = await proxyRes.arrayBuffer();
-            const encryptedArray = new Uint8Array(encryptedData);
-            const nonce = encryptedArray.slice(0, 12);
-            const ciphertext = encryptedArray.slice(12);
-
-            const decryptedData = await window.crypto.subtle.decrypt(
-                { name: "AES-GCM", iv: nonce },
-                key,
-                ciphertext
-            );
-
-            decryptedChunks.push(decryptedData);
+            decryptedChunks.push(await openChunk(key, new Uint8Array(encryptedData), manifest.provider, i));
         }
 
         const finalBlob = new Blob(decryptedChunks, { type: "application/octet-stream" });
         const a = document.createElement('a');
         a.href = URL.createObjectURL(finalBlob);
-        a.download = sharedFile.name;
+        a.download = manifest.name;
         a.click();
 
         document.getElementById('progressModal').style.display = 'none';
@@ -190,8 +250,62 @@ async function downloadSharedFile() {
     }
 }
 
+// Import the file key, unwrapping it with the fragment key when the link
+// keeps the key out of the server's hands.
+async function shareFileKey(manifest) {
+    let keyData;
+    if (manifest.wrappedKey) {
+        if (!fragmentKey) throw new Error("This share link is incomplete (missing key).");
+        const shareKey = Uint8Array.from(atob(fragmentKey.replace(/-/g, '+').replace(/_/g, '/')), c => c.charCodeAt(0));
+        const wrapped = Uint8Array.from(atob(manifest.wrappedKey), c => c.charCodeAt(0));
+        const unwrapKey = await window.crypto.subtle.importKey("raw", shareKey, { name: "AES-GCM" }, false, ["decrypt"]);
+        try {
+            keyData = await window.crypto.subtle.decrypt({ name: "AES-GCM", iv: wrapped.slice(0, 12) }, unwrapKey, wrapped.slice(12));
+        } catch (e) {
+            throw new Error("The key in this share link is wrong. Ask the sender for the full link.");
+        }
+    } else if (manifest.key) {
+        keyData = Uint8Array.from(atob(manifest.key), c => c.charCodeAt(0));
+    } else {
+        throw new Error("File is corrupted (missing encryption key).");
+    }
+    return await window.crypto.subtle.importKey("raw", keyData, { name: "AES-GCM" }, false, ["decrypt"]);
+}
+
+// Decrypt one downloaded chunk (same layouts as main.js)
+async function openChunk(key, data, provider, index) {
+    if (provider === 'dedup') return data;
+
+    // Compressed chunks: "TDC" + flags, then nonce + ciphertext. The header
+    // is authenticated as additional data. If it doesn't decrypt, it was a
+    // plain chunk whose nonce happened to start with the same bytes.
+    if (data.length >= 16 && data[0] === 0x54 && data[1] === 0x44 && data[2] === 0x43) {
+        try {
+            const plain = await window.crypto.subtle.decrypt(
+                { name: "AES-GCM", iv: data.slice(4, 16), additionalData: data.slice(0, 4) },
+                key,
+                data.slice(16)
+            );
+            return (data[3] & 1) ? fzstd.decompress(new Uint8Array(plain)) : plain;
+        } catch (e) {
+            // fall through to the plain layout
+        }
+    }
+
+    if (data.length < 12) {
+        throw new Error(`Chunk ${index} is too small (${data.length} bytes), expected at least 12 (nonce)`);
+    }
+
+    return await window.crypto.subtle.decrypt(
+        { name: "AES-GCM", iv: data.slice(0, 12) },
+        key,
+        data.slice(12)
+    );
+}
+
 // Helper functions
 function getIconHTML(t) {
+    if(t==='folder') return '<i class="fa-solid fa-folder" style="color: #fbbf24;"></i>';
     if(t==='video') return '<i class="fa-solid fa-video"></i>';
     if(t==='audio') return '<i class="fa-solid fa-music"></i>';
     if(t==='image') return '<i class="fa-solid fa-image"></i>';
@@ -201,9 +315,15 @@ function getIconHTML(t) {
 function getProviderIcon(p) {
     if(p==='discord') return '<i class="fa-brands fa-discord" style="color: #5865F2;"></i>';
     if(p==='telegram') return '<i class="fa-brands fa-telegram" style="color: #0088cc;"></i>';
+    if(p==='erasure') return '<i class="fa-solid fa-shield-halved" style="color: #8b5cf6;"></i>';
+    if(p==='dedup') return '<i class="fa-solid fa-layer-group" style="color: #8b5cf6;"></i>';
     return '';
 }
 
+function escapeHTML(s) {
+    return s.replace(/[&<>"']/g, c => ({ '&': '&amp;', '<': '&lt;', '>': '&gt;', '"': '&quot;', "'": '&#39;' }[c]));
+}
+
 function formatSize(bytes) {
     if (bytes === 0) return '0 B';
     const sizes = ['B', 'KB', 'MB', 'GB', 'TB'];
@@ -0,0 +1,41 @@
+-- Provider migration jobs (see lib/migrate)
+CREATE TABLE IF NOT EXISTS migrations (
+    id VARCHAR(50) PRIMARY KEY,
+    file_id VARCHAR(50) NOT NULL,
+    to_provider VARCHAR(20) NOT NULL,
+    to_target VARCHAR(50),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    done_chunks INT NOT NULL DEFAULT 0,
+    total_chunks INT NOT NULL DEFAULT 0,
+    source_links TEXT NOT NULL,
+    new_links TEXT NOT NULL DEFAULT '[]',
+    error TEXT,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS migrations_status_idx ON migrations (status, created_at);
+
+-- Swap a file's manifest only if it still matches what was copied, so a
+-- concurrent edit is never overwritten.
+CREATE OR REPLACE FUNCTION swap_file_manifest(
+    p_file_id TEXT,
+    p_old_links TEXT,
+    p_new_links TEXT,
+    p_new_provider TEXT
+) RETURNS BOOLEAN
+LANGUAGE plpgsql AS $$
+BEGIN
+    UPDATE files
+       SET meta_links = p_new_links,
+           meta_provider = p_new_provider
+     WHERE id = p_file_id
+       AND meta_links = p_old_links;
+    RETURN FOUND;
+END;
+$$;
+
+-- Jobs hold manifests, so keep them away from the browser's anon key.
+ALTER TABLE public.migrations ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.migrations FROM anon, authenticated;
+REVOKE EXECUTE ON FUNCTION swap_file_manifest(TEXT, TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
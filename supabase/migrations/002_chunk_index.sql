@@ -0,0 +1,72 @@
+-- Shared content-defined chunks for dedup uploads (see lib/dedup)
+CREATE TABLE IF NOT EXISTS chunks (
+    id VARCHAR(64) PRIMARY KEY,      -- HMAC-SHA256 of the plaintext, hex
+    size INT NOT NULL,               -- plaintext bytes
+    link TEXT NOT NULL,              -- meta_links entry of the encrypted chunk
+    ref_count INT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW(),
+    released_at TIMESTAMP            -- set when ref_count drops to zero
+);
+
+CREATE INDEX IF NOT EXISTS chunks_unreferenced_idx ON chunks (released_at) WHERE ref_count <= 0;
+
+-- Take one reference on each chunk that already exists and return them.
+CREATE OR REPLACE FUNCTION claim_chunks(p_ids TEXT[])
+RETURNS SETOF chunks
+LANGUAGE sql AS $$
+    UPDATE chunks
+       SET ref_count = ref_count + 1,
+           released_at = NULL
+     WHERE id = ANY(p_ids)
+    RETURNING *;
+$$;
+
+-- Record a newly uploaded chunk with one reference. If another upload won
+-- the race, take a reference on its copy instead and return that link.
+CREATE OR REPLACE FUNCTION register_chunk(p_id TEXT, p_size INT, p_link TEXT)
+RETURNS TEXT
+LANGUAGE sql AS $$
+    INSERT INTO chunks (id, size, link, ref_count)
+    VALUES (p_id, p_size, p_link, 1)
+    ON CONFLICT (id) DO UPDATE
+       SET ref_count = chunks.ref_count + 1,
+           released_at = NULL
+    RETURNING link;
+$$;
+
+-- Dropping a dedup file releases one reference per window that used a chunk.
+-- Runs as the owner because the browser deletes files with the anon key.
+CREATE OR REPLACE FUNCTION release_file_chunks()
+RETURNS TRIGGER
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public AS $$
+BEGIN
+    IF OLD.meta_provider = 'dedup' THEN
+        UPDATE chunks c
+           SET ref_count = c.ref_count - r.n,
+               released_at = CASE WHEN c.ref_count - r.n <= 0 THEN NOW() ELSE c.released_at END
+          FROM (
+              SELECT chunk_id, COUNT(*) AS n
+                FROM (
+                    SELECT DISTINCT w.ord, x.chunk_id
+                      FROM jsonb_array_elements_text(OLD.meta_links::jsonb) WITH ORDINALITY AS w(link, ord),
+                           jsonb_array_elements_text(w.link::jsonb -> 'cdc') AS x(chunk_id)
+                ) refs
+               GROUP BY chunk_id
+          ) r
+         WHERE c.id = r.chunk_id;
+    END IF;
+    RETURN OLD;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_release_chunks ON files;
+CREATE TRIGGER files_release_chunks
+    AFTER DELETE ON files
+    FOR EACH ROW EXECUTE FUNCTION release_file_chunks();
+
+ALTER TABLE public.chunks ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.chunks FROM anon, authenticated;
+REVOKE EXECUTE ON FUNCTION claim_chunks(TEXT[]) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION register_chunk(TEXT, INT, TEXT) FROM anon, authenticated, PUBLIC;
@@ -0,0 +1,32 @@
+-- Share links with optional password, expiry and download limit (see lib/share)
+CREATE TABLE IF NOT EXISTS shares (
+    id VARCHAR(50) PRIMARY KEY,
+    file_id VARCHAR(50) NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    password_hash TEXT,              -- pbkdf2-sha256$iterations$salt$hash
+    expires_at TIMESTAMPTZ,
+    max_downloads INT,
+    download_count INT NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS shares_file_idx ON shares (file_id);
+
+-- Count one download if the link is still usable and return it. Returns no
+-- row when the link is revoked, expired or out of downloads, so concurrent
+-- downloads can never exceed max_downloads.
+CREATE OR REPLACE FUNCTION use_share(p_id TEXT)
+RETURNS SETOF shares
+LANGUAGE sql AS $$
+    UPDATE shares
+       SET download_count = download_count + 1
+     WHERE id = p_id
+       AND revoked_at IS NULL
+       AND (expires_at IS NULL OR expires_at > NOW())
+       AND (max_downloads IS NULL OR download_count < max_downloads)
+    RETURNING *;
+$$;
+
+ALTER TABLE public.shares ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.shares FROM anon, authenticated;
+REVOKE EXECUTE ON FUNCTION use_share(TEXT) FROM anon, authenticated, PUBLIC;
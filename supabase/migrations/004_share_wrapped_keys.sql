@@ -0,0 +1,3 @@
+-- Share links that carry the decryption key in the URL fragment store only
+-- the file key wrapped under that fragment key (see lib/share).
+ALTER TABLE shares ADD COLUMN IF NOT EXISTS wrapped_key TEXT;
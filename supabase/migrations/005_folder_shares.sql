@@ -0,0 +1,10 @@
+-- Share links for whole folders (see lib/share). A link points at exactly
+-- one file or one folder.
+ALTER TABLE shares ALTER COLUMN file_id DROP NOT NULL;
+ALTER TABLE shares ADD COLUMN IF NOT EXISTS folder_id VARCHAR(50) REFERENCES folders(id) ON DELETE CASCADE;
+
+ALTER TABLE shares DROP CONSTRAINT IF EXISTS shares_target_check;
+ALTER TABLE shares ADD CONSTRAINT shares_target_check
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL));
+
+CREATE INDEX IF NOT EXISTS shares_folder_idx ON shares (folder_id);
@@ -0,0 +1,42 @@
+-- Upload-only drop links into a folder (see lib/drop)
+CREATE TABLE IF NOT EXISTS drops (
+    id VARCHAR(50) PRIMARY KEY,
+    folder_id VARCHAR(50) NOT NULL REFERENCES folders(id) ON DELETE CASCADE,
+    provider VARCHAR(20) NOT NULL DEFAULT 'discord',
+    password_hash TEXT,              -- pbkdf2-sha256$iterations$salt$hash
+    expires_at TIMESTAMPTZ,
+    max_bytes BIGINT,                -- NULL for no limit
+    bytes_used BIGINT NOT NULL DEFAULT 0,
+    file_count INT NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMPTZ,
+    secret TEXT NOT NULL,            -- signs chunk receipts
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS drops_folder_idx ON drops (folder_id);
+
+-- Book p_bytes against the limit of a usable link and return it. Returns no
+-- row when the link is revoked, expired or would go over max_bytes. A
+-- negative p_bytes gives bytes back after a failed upload.
+CREATE OR REPLACE FUNCTION reserve_drop_bytes(p_id TEXT, p_bytes BIGINT)
+RETURNS SETOF drops
+LANGUAGE sql AS $$
+    UPDATE drops
+       SET bytes_used = GREATEST(bytes_used + p_bytes, 0)
+     WHERE id = p_id
+       AND revoked_at IS NULL
+       AND (expires_at IS NULL OR expires_at > NOW())
+       AND (max_bytes IS NULL OR p_bytes <= 0 OR bytes_used + p_bytes <= max_bytes)
+    RETURNING *;
+$$;
+
+CREATE OR REPLACE FUNCTION count_drop_file(p_id TEXT)
+RETURNS VOID
+LANGUAGE sql AS $$
+    UPDATE drops SET file_count = file_count + 1 WHERE id = p_id;
+$$;
+
+ALTER TABLE public.drops ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.drops FROM anon, authenticated;
+REVOKE EXECUTE ON FUNCTION reserve_drop_bytes(TEXT, BIGINT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION count_drop_file(TEXT) FROM anon, authenticated, PUBLIC;
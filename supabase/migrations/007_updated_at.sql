@@ -0,0 +1,32 @@
+-- Modification times for files and folders (see lib/syncer). A trigger
+-- bumps updated_at on every change to a row, so no client can forget to.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+
+UPDATE files SET updated_at = COALESCE(created_at, NOW()) WHERE updated_at IS NULL;
+UPDATE folders SET updated_at = COALESCE(created_at, NOW()) WHERE updated_at IS NULL;
+
+ALTER TABLE files ALTER COLUMN updated_at SET DEFAULT NOW();
+ALTER TABLE files ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE folders ALTER COLUMN updated_at SET DEFAULT NOW();
+ALTER TABLE folders ALTER COLUMN updated_at SET NOT NULL;
+
+CREATE OR REPLACE FUNCTION touch_updated_at()
+RETURNS TRIGGER
+LANGUAGE plpgsql AS $$
+BEGIN
+    NEW.updated_at = NOW();
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_touch_updated_at ON files;
+CREATE TRIGGER files_touch_updated_at BEFORE UPDATE ON files
+    FOR EACH ROW EXECUTE FUNCTION touch_updated_at();
+
+DROP TRIGGER IF EXISTS folders_touch_updated_at ON folders;
+CREATE TRIGGER folders_touch_updated_at BEFORE UPDATE ON folders
+    FOR EACH ROW EXECUTE FUNCTION touch_updated_at();
+
+CREATE INDEX IF NOT EXISTS files_updated_at_idx ON files (updated_at);
+CREATE INDEX IF NOT EXISTS folders_updated_at_idx ON folders (updated_at);
@@ -0,0 +1,27 @@
+-- Version history (see lib/versions). The files row always holds the
+-- current content; every earlier revision is kept here, immutable, with
+-- its own chunk manifest, key, size and plaintext hash.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS sha256 VARCHAR(64);
+
+CREATE TABLE IF NOT EXISTS file_versions (
+    id VARCHAR(50) PRIMARY KEY,
+    file_id VARCHAR(50) NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    size BIGINT NOT NULL,
+    meta_key TEXT NOT NULL,
+    meta_links TEXT NOT NULL,
+    meta_provider VARCHAR(20) NOT NULL,
+    sha256 VARCHAR(64),              -- hex; NULL for content uploaded by the browser
+    created_at TIMESTAMPTZ DEFAULT NOW()  -- when this revision was replaced
+);
+
+CREATE INDEX IF NOT EXISTS file_versions_file_idx ON file_versions (file_id, created_at DESC);
+
+-- A pruned or cascaded version gives back its dedup chunk references,
+-- exactly like a deleted file (see 002_chunk_index.sql).
+DROP TRIGGER IF EXISTS file_versions_release_chunks ON file_versions;
+CREATE TRIGGER file_versions_release_chunks
+    AFTER DELETE ON file_versions
+    FOR EACH ROW EXECUTE FUNCTION release_file_chunks();
+
+ALTER TABLE public.file_versions ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.file_versions FROM anon, authenticated;
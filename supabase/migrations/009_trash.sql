@@ -0,0 +1,25 @@
+-- Trash (see lib/trash). Deleting a file or folder only sets deleted_at;
+-- everything trashed along with a folder points at it through trash_root,
+-- so restoring the folder brings back exactly what went with it. Rows are
+-- removed for good when the trash is purged.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS trash_root VARCHAR(50);
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS trash_root VARCHAR(50);
+
+CREATE INDEX IF NOT EXISTS files_trash_idx ON files (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS folders_trash_idx ON folders (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS files_trash_root_idx ON files (trash_root) WHERE trash_root IS NOT NULL;
+CREATE INDEX IF NOT EXISTS folders_trash_root_idx ON folders (trash_root) WHERE trash_root IS NOT NULL;
+
+-- The message behind every Telegram upload. A file_id cannot be traced back
+-- to its message, which is needed to delete the chunk when it is purged.
+CREATE TABLE IF NOT EXISTS telegram_messages (
+    file_id TEXT PRIMARY KEY,
+    chat_id TEXT NOT NULL,
+    message_id BIGINT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+ALTER TABLE public.telegram_messages ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.telegram_messages FROM anon, authenticated;
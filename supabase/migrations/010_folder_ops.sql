@@ -0,0 +1,164 @@
+-- Folder operations (see lib/folders). Each runs as one transaction, so a
+-- move, copy or delete of a deep tree is never left half done. Needs
+-- 009_trash.sql.
+--
+-- Moves, copies and deletes take the same advisory lock, so two moves can
+-- never pass each other's cycle check.
+
+-- Every live folder below p_id, not including p_id. UNION stops at a cycle
+-- left behind by older clients.
+CREATE OR REPLACE FUNCTION folder_subtree(p_id TEXT)
+RETURNS SETOF VARCHAR
+LANGUAGE sql STABLE AS $$
+    WITH RECURSIVE tree(id) AS (
+        SELECT id FROM folders WHERE parent_id = p_id AND deleted_at IS NULL
+        UNION
+        SELECT f.id FROM folders f JOIN tree t ON f.parent_id = t.id
+         WHERE f.deleted_at IS NULL
+    )
+    SELECT id FROM tree WHERE id <> p_id;
+$$;
+
+-- Checks shared by move and copy. Errors carry SQLSTATEs lib/folders
+-- understands: no_data_found for a missing folder, check_violation for a
+-- folder put inside itself, unique_violation with the hint name_taken for
+-- a name already used in p_parent by a folder other than p_except.
+CREATE OR REPLACE FUNCTION check_folder_target(p_id TEXT, p_parent TEXT, p_name TEXT, p_except TEXT)
+RETURNS VOID
+LANGUAGE plpgsql AS $$
+BEGIN
+    PERFORM 1 FROM folders WHERE id = p_id AND deleted_at IS NULL FOR UPDATE;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'folder % not found', p_id USING ERRCODE = 'no_data_found';
+    END IF;
+    IF p_parent IS NOT NULL THEN
+        PERFORM 1 FROM folders WHERE id = p_parent AND deleted_at IS NULL;
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'folder % not found', p_parent USING ERRCODE = 'no_data_found';
+        END IF;
+        IF p_parent = p_id OR p_parent IN (SELECT folder_subtree(p_id)) THEN
+            RAISE EXCEPTION 'a folder cannot go inside itself' USING ERRCODE = 'check_violation';
+        END IF;
+    END IF;
+    IF EXISTS (
+        SELECT 1 FROM folders
+         WHERE parent_id IS NOT DISTINCT FROM p_parent
+           AND name = p_name
+           AND id IS DISTINCT FROM p_except
+           AND deleted_at IS NULL
+    ) THEN
+        RAISE EXCEPTION 'a folder named % already exists there', p_name
+            USING ERRCODE = 'unique_violation', HINT = 'name_taken';
+    END IF;
+END;
+$$;
+
+-- Rename and/or move a folder. p_parent NULL is the top level.
+CREATE OR REPLACE FUNCTION move_folder(p_id TEXT, p_parent TEXT, p_name TEXT)
+RETURNS VOID
+LANGUAGE plpgsql AS $$
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('teddrive_folder_tree'));
+    PERFORM check_folder_target(p_id, p_parent, p_name, p_id);
+    UPDATE folders SET name = p_name, parent_id = p_parent WHERE id = p_id;
+END;
+$$;
+
+-- Copy a folder with everything in it and return the new folder's ID.
+-- Copied files point at the same chunks, so nothing is uploaded again;
+-- dedup chunks get a reference per copy (see 002_chunk_index.sql). Version
+-- history, shares and drop links are not copied. New IDs are p_base
+-- followed by a suffix; a clash with another copy fails the whole copy
+-- with unique_violation on the primary key, to retry with another base.
+CREATE OR REPLACE FUNCTION copy_folder(p_id TEXT, p_parent TEXT, p_name TEXT, p_base TEXT)
+RETURNS TEXT
+LANGUAGE plpgsql AS $$
+DECLARE
+    new_root TEXT;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('teddrive_folder_tree'));
+    PERFORM check_folder_target(p_id, p_parent, p_name, NULL);
+
+    CREATE TEMP TABLE folder_copy ON COMMIT DROP AS
+    SELECT id AS old_id, p_base || '-' || row_number() OVER (ORDER BY id) AS new_id
+      FROM (SELECT p_id::VARCHAR AS id UNION SELECT folder_subtree(p_id)) s;
+
+    SELECT new_id INTO new_root FROM folder_copy WHERE old_id = p_id;
+
+    INSERT INTO folders (id, name, parent_id, created, is_public)
+    SELECT m.new_id,
+           CASE WHEN f.id = p_id THEN p_name ELSE f.name END,
+           CASE WHEN f.id = p_id THEN p_parent ELSE pm.new_id END,
+           to_char(NOW(), 'FMMM/FMDD/YYYY'),
+           f.is_public
+      FROM folders f
+      JOIN folder_copy m ON m.old_id = f.id
+      LEFT JOIN folder_copy pm ON pm.old_id = f.parent_id;
+
+    WITH copied AS (
+        INSERT INTO files (id, name, size, type, mime, date, folder_id,
+                           meta_key, meta_links, meta_provider, sha256, is_public)
+        SELECT p_base || '-f' || row_number() OVER (ORDER BY f.id),
+               f.name, f.size, f.type, f.mime, f.date, m.new_id,
+               f.meta_key, f.meta_links, f.meta_provider, f.sha256, f.is_public
+          FROM files f
+          JOIN folder_copy m ON m.old_id = f.folder_id
+         WHERE f.deleted_at IS NULL
+        RETURNING id, meta_links, meta_provider
+    )
+    UPDATE chunks c
+       SET ref_count = c.ref_count + r.n,
+           released_at = NULL
+      FROM (
+          SELECT chunk_id, COUNT(*) AS n
+            FROM (
+                SELECT DISTINCT cp.id, w.ord, x.chunk_id
+                  FROM copied cp,
+                       jsonb_array_elements_text(cp.meta_links::jsonb) WITH ORDINALITY AS w(link, ord),
+                       jsonb_array_elements_text(w.link::jsonb -> 'cdc') AS x(chunk_id)
+                 WHERE cp.meta_provider = 'dedup'
+            ) refs
+           GROUP BY chunk_id
+      ) r
+     WHERE c.id = r.chunk_id;
+
+    RETURN new_root;
+END;
+$$;
+
+-- Move a folder to the trash with everything in it, as lib/trash does
+-- step by step without this migration. Returns false if it is not there.
+CREATE OR REPLACE FUNCTION trash_folder(p_id TEXT)
+RETURNS BOOLEAN
+LANGUAGE plpgsql AS $$
+DECLARE
+    t TIMESTAMPTZ := NOW();
+    inside VARCHAR[];
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('teddrive_folder_tree'));
+    PERFORM 1 FROM folders WHERE id = p_id AND deleted_at IS NULL FOR UPDATE;
+    IF NOT FOUND THEN
+        RETURN FALSE;
+    END IF;
+    inside := ARRAY(SELECT folder_subtree(p_id));
+
+    UPDATE files SET deleted_at = t, trash_root = p_id
+     WHERE (folder_id = p_id OR folder_id = ANY(inside)) AND deleted_at IS NULL;
+    UPDATE folders SET deleted_at = t, trash_root = p_id
+     WHERE id = ANY(inside);
+    UPDATE folders SET deleted_at = t, trash_root = NULL
+     WHERE id = p_id;
+    RETURN TRUE;
+END;
+$$;
+
+-- Purging a file leaves chunks alone while a copy still uses them; copies
+-- share meta_key with their original.
+CREATE INDEX IF NOT EXISTS files_meta_key_idx ON files (meta_key);
+CREATE INDEX IF NOT EXISTS file_versions_meta_key_idx ON file_versions (meta_key);
+
+REVOKE EXECUTE ON FUNCTION folder_subtree(TEXT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION check_folder_target(TEXT, TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION move_folder(TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION copy_folder(TEXT, TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION trash_folder(TEXT) FROM anon, authenticated, PUBLIC;
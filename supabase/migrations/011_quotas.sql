@@ -0,0 +1,57 @@
+-- Storage quotas (see lib/quota). storage_usage counts the bytes held on
+-- each provider per tenant: what was actually uploaded, encrypted, with
+-- every erasure shard. Uploads book their bytes before they start; purging
+-- the trash gives them back. `teddrive usage -recount` rebuilds the
+-- counters from the metadata.
+CREATE TABLE IF NOT EXISTS storage_usage (
+    tenant VARCHAR(50) NOT NULL,
+    provider VARCHAR(20) NOT NULL,
+    bytes BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (tenant, provider)
+);
+
+-- Limits that differ from STORAGE_QUOTA_GB. NULL max_bytes is no limit.
+CREATE TABLE IF NOT EXISTS quotas (
+    tenant VARCHAR(50) PRIMARY KEY,
+    max_bytes BIGINT
+);
+
+-- Book p_bytes on p_provider for p_tenant, unless that takes the tenant's
+-- total over its limit: the quotas row, or p_default_limit (NULL for none).
+-- A negative p_bytes gives bytes back and always succeeds. Returns whether
+-- it was booked, with the total and limit it was checked against.
+CREATE OR REPLACE FUNCTION reserve_storage(p_tenant TEXT, p_provider TEXT, p_bytes BIGINT, p_default_limit BIGINT)
+RETURNS TABLE (ok BOOLEAN, used BIGINT, max_bytes BIGINT)
+LANGUAGE plpgsql AS $$
+DECLARE
+    v_used BIGINT;
+    v_limit BIGINT;
+BEGIN
+    -- Parallel chunk uploads must not pass the check together.
+    PERFORM pg_advisory_xact_lock(hashtext('teddrive_quota:' || p_tenant));
+    SELECT COALESCE(SUM(bytes), 0) INTO v_used FROM storage_usage WHERE tenant = p_tenant;
+    SELECT q.max_bytes INTO v_limit FROM quotas q WHERE q.tenant = p_tenant;
+    IF NOT FOUND THEN
+        v_limit := p_default_limit;
+    END IF;
+
+    IF p_bytes > 0 AND v_limit IS NOT NULL AND v_used + p_bytes > v_limit THEN
+        RETURN QUERY SELECT FALSE, v_used, v_limit;
+        RETURN;
+    END IF;
+
+    INSERT INTO storage_usage AS u (tenant, provider, bytes)
+    VALUES (p_tenant, p_provider, GREATEST(p_bytes, 0))
+    ON CONFLICT (tenant, provider) DO UPDATE
+       SET bytes = GREATEST(u.bytes + p_bytes, 0),
+           updated_at = NOW();
+    RETURN QUERY SELECT TRUE, GREATEST(v_used + p_bytes, 0), v_limit;
+END;
+$$;
+
+ALTER TABLE public.storage_usage ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.quotas ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.storage_usage FROM anon, authenticated;
+REVOKE ALL ON public.quotas FROM anon, authenticated;
+REVOKE EXECUTE ON FUNCTION reserve_storage(TEXT, TEXT, BIGINT, BIGINT) FROM anon, authenticated, PUBLIC;
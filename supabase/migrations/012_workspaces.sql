@@ -0,0 +1,254 @@
+-- Workspaces (see lib/workspace). Every file and folder belongs to one
+-- workspace, and people see and change only the workspaces they are members
+-- of: owners manage the workspace and its members, editors change files,
+-- viewers only read. Everything that existed before goes into the
+-- "default" workspace, which starts out public so the app keeps working
+-- with the anon key until it is closed.
+CREATE TABLE IF NOT EXISTS workspaces (
+    id VARCHAR(50) PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    discord_channel_id VARCHAR(50),  -- NULL uses DISCORD_CHANNEL_ID
+    telegram_chat_id VARCHAR(50),    -- NULL uses TELEGRAM_CHAT_ID
+    public BOOLEAN NOT NULL DEFAULT FALSE, -- anyone may edit, signed in or not
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+INSERT INTO workspaces (id, name, public) VALUES ('default', 'Default', TRUE)
+ON CONFLICT (id) DO NOTHING;
+
+-- Members are Supabase Auth users.
+CREATE TABLE IF NOT EXISTS workspace_members (
+    workspace_id VARCHAR(50) NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL,
+    role VARCHAR(10) NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    PRIMARY KEY (workspace_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS workspace_members_user_idx ON workspace_members (user_id);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS workspace_id VARCHAR(50) DEFAULT 'default' REFERENCES workspaces(id);
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS workspace_id VARCHAR(50) DEFAULT 'default' REFERENCES workspaces(id);
+UPDATE files SET workspace_id = 'default' WHERE workspace_id IS NULL;
+UPDATE folders SET workspace_id = 'default' WHERE workspace_id IS NULL;
+ALTER TABLE files ALTER COLUMN workspace_id DROP DEFAULT;
+ALTER TABLE files ALTER COLUMN workspace_id SET NOT NULL;
+ALTER TABLE folders ALTER COLUMN workspace_id DROP DEFAULT;
+ALTER TABLE folders ALTER COLUMN workspace_id SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS files_workspace_idx ON files (workspace_id, folder_id);
+CREATE INDEX IF NOT EXISTS folders_workspace_idx ON folders (workspace_id, parent_id);
+
+-- Rows inserted without a workspace go where their folder is, or into the
+-- default workspace at the top level. Drop links and older clients rely
+-- on this.
+CREATE OR REPLACE FUNCTION inherit_workspace()
+RETURNS TRIGGER
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public AS $$
+DECLARE
+    parent VARCHAR;
+BEGIN
+    IF NEW.workspace_id IS NULL THEN
+        IF TG_TABLE_NAME = 'files' THEN
+            parent := NEW.folder_id;
+        ELSE
+            parent := NEW.parent_id;
+        END IF;
+        SELECT workspace_id INTO NEW.workspace_id FROM folders WHERE id = parent;
+        NEW.workspace_id := COALESCE(NEW.workspace_id, 'default');
+    END IF;
+    RETURN NEW;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS files_inherit_workspace ON files;
+CREATE TRIGGER files_inherit_workspace BEFORE INSERT ON files
+    FOR EACH ROW EXECUTE FUNCTION inherit_workspace();
+
+DROP TRIGGER IF EXISTS folders_inherit_workspace ON folders;
+CREATE TRIGGER folders_inherit_workspace BEFORE INSERT ON folders
+    FOR EACH ROW EXECUTE FUNCTION inherit_workspace();
+
+-- The caller's role in a workspace: their membership, or editor in a
+-- public workspace. NULL means no access. Policies call it for every row,
+-- so it runs as the owner to read the membership tables.
+CREATE OR REPLACE FUNCTION workspace_role(p_workspace TEXT)
+RETURNS TEXT
+LANGUAGE sql STABLE
+SECURITY DEFINER
+SET search_path = public AS $$
+    SELECT COALESCE(
+        (SELECT role FROM workspace_members WHERE workspace_id = p_workspace AND user_id = auth.uid()),
+        (SELECT 'editor' FROM workspaces WHERE id = p_workspace AND public)
+    );
+$$;
+
+-- Whether p_folder, if any, is in p_workspace: a file or folder cannot be
+-- put into another workspace's folder.
+CREATE OR REPLACE FUNCTION folder_in_workspace(p_folder TEXT, p_workspace TEXT)
+RETURNS BOOLEAN
+LANGUAGE sql STABLE
+SECURITY DEFINER
+SET search_path = public AS $$
+    SELECT p_folder IS NULL
+        OR EXISTS (SELECT 1 FROM folders WHERE id = p_folder AND workspace_id = p_workspace);
+$$;
+
+-- The browser reads and writes files and folders directly, as the signed-in
+-- user or anon. The Go API uses the service role, which skips these and
+-- scopes its own queries.
+ALTER TABLE files ENABLE ROW LEVEL SECURITY;
+ALTER TABLE folders ENABLE ROW LEVEL SECURITY;
+
+DROP POLICY IF EXISTS files_select ON files;
+CREATE POLICY files_select ON files FOR SELECT
+    USING (workspace_role(workspace_id) IS NOT NULL);
+DROP POLICY IF EXISTS files_insert ON files;
+CREATE POLICY files_insert ON files FOR INSERT
+    WITH CHECK (workspace_role(workspace_id) IN ('owner', 'editor')
+                AND folder_in_workspace(folder_id, workspace_id));
+DROP POLICY IF EXISTS files_update ON files;
+CREATE POLICY files_update ON files FOR UPDATE
+    USING (workspace_role(workspace_id) IN ('owner', 'editor'))
+    WITH CHECK (workspace_role(workspace_id) IN ('owner', 'editor')
+                AND folder_in_workspace(folder_id, workspace_id));
+DROP POLICY IF EXISTS files_delete ON files;
+CREATE POLICY files_delete ON files FOR DELETE
+    USING (workspace_role(workspace_id) IN ('owner', 'editor'));
+
+DROP POLICY IF EXISTS folders_select ON folders;
+CREATE POLICY folders_select ON folders FOR SELECT
+    USING (workspace_role(workspace_id) IS NOT NULL);
+DROP POLICY IF EXISTS folders_insert ON folders;
+CREATE POLICY folders_insert ON folders FOR INSERT
+    WITH CHECK (workspace_role(workspace_id) IN ('owner', 'editor')
+                AND folder_in_workspace(parent_id, workspace_id));
+DROP POLICY IF EXISTS folders_update ON folders;
+CREATE POLICY folders_update ON folders FOR UPDATE
+    USING (workspace_role(workspace_id) IN ('owner', 'editor'))
+    WITH CHECK (workspace_role(workspace_id) IN ('owner', 'editor')
+                AND folder_in_workspace(parent_id, workspace_id));
+DROP POLICY IF EXISTS folders_delete ON folders;
+CREATE POLICY folders_delete ON folders FOR DELETE
+    USING (workspace_role(workspace_id) IN ('owner', 'editor'));
+
+-- 010_folder_ops.sql again, with folder names unique per workspace, the
+-- target parent in the folder's own workspace, and copies staying there.
+CREATE OR REPLACE FUNCTION check_folder_target(p_id TEXT, p_parent TEXT, p_name TEXT, p_except TEXT)
+RETURNS VOID
+LANGUAGE plpgsql AS $$
+DECLARE
+    v_workspace VARCHAR;
+BEGIN
+    SELECT workspace_id INTO v_workspace FROM folders WHERE id = p_id AND deleted_at IS NULL FOR UPDATE;
+    IF NOT FOUND THEN
+        RAISE EXCEPTION 'folder % not found', p_id USING ERRCODE = 'no_data_found';
+    END IF;
+    IF p_parent IS NOT NULL THEN
+        PERFORM 1 FROM folders WHERE id = p_parent AND workspace_id = v_workspace AND deleted_at IS NULL;
+        IF NOT FOUND THEN
+            RAISE EXCEPTION 'folder % not found', p_parent USING ERRCODE = 'no_data_found';
+        END IF;
+        IF p_parent = p_id OR p_parent IN (SELECT folder_subtree(p_id)) THEN
+            RAISE EXCEPTION 'a folder cannot go inside itself' USING ERRCODE = 'check_violation';
+        END IF;
+    END IF;
+    IF EXISTS (
+        SELECT 1 FROM folders
+         WHERE parent_id IS NOT DISTINCT FROM p_parent
+           AND workspace_id = v_workspace
+           AND name = p_name
+           AND id IS DISTINCT FROM p_except
+           AND deleted_at IS NULL
+    ) THEN
+        RAISE EXCEPTION 'a folder named % already exists there', p_name
+            USING ERRCODE = 'unique_violation', HINT = 'name_taken';
+    END IF;
+END;
+$$;
+
+CREATE OR REPLACE FUNCTION copy_folder(p_id TEXT, p_parent TEXT, p_name TEXT, p_base TEXT)
+RETURNS TEXT
+LANGUAGE plpgsql AS $$
+DECLARE
+    new_root TEXT;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('teddrive_folder_tree'));
+    PERFORM check_folder_target(p_id, p_parent, p_name, NULL);
+
+    CREATE TEMP TABLE folder_copy ON COMMIT DROP AS
+    SELECT id AS old_id, p_base || '-' || row_number() OVER (ORDER BY id) AS new_id
+      FROM (SELECT p_id::VARCHAR AS id UNION SELECT folder_subtree(p_id)) s;
+
+    SELECT new_id INTO new_root FROM folder_copy WHERE old_id = p_id;
+
+    INSERT INTO folders (id, name, parent_id, created, is_public, workspace_id)
+    SELECT m.new_id,
+           CASE WHEN f.id = p_id THEN p_name ELSE f.name END,
+           CASE WHEN f.id = p_id THEN p_parent ELSE pm.new_id END,
+           to_char(NOW(), 'FMMM/FMDD/YYYY'),
+           f.is_public,
+           f.workspace_id
+      FROM folders f
+      JOIN folder_copy m ON m.old_id = f.id
+      LEFT JOIN folder_copy pm ON pm.old_id = f.parent_id;
+
+    WITH copied AS (
+        INSERT INTO files (id, name, size, type, mime, date, folder_id,
+                           meta_key, meta_links, meta_provider, sha256, is_public, workspace_id)
+        SELECT p_base || '-f' || row_number() OVER (ORDER BY f.id),
+               f.name, f.size, f.type, f.mime, f.date, m.new_id,
+               f.meta_key, f.meta_links, f.meta_provider, f.sha256, f.is_public, f.workspace_id
+          FROM files f
+          JOIN folder_copy m ON m.old_id = f.folder_id
+         WHERE f.deleted_at IS NULL
+        RETURNING id, meta_links, meta_provider
+    )
+    UPDATE chunks c
+       SET ref_count = c.ref_count + r.n,
+           released_at = NULL
+      FROM (
+          SELECT chunk_id, COUNT(*) AS n
+            FROM (
+                SELECT DISTINCT cp.id, w.ord, x.chunk_id
+                  FROM copied cp,
+                       jsonb_array_elements_text(cp.meta_links::jsonb) WITH ORDINALITY AS w(link, ord),
+                       jsonb_array_elements_text(w.link::jsonb -> 'cdc') AS x(chunk_id)
+                 WHERE cp.meta_provider = 'dedup'
+            ) refs
+           GROUP BY chunk_id
+      ) r
+     WHERE c.id = r.chunk_id;
+
+    RETURN new_root;
+END;
+$$;
+
+-- Dedup chunk IDs are keyed per workspace (see lib/dedup), so workspaces
+-- never share chunks; the chunk's workspace is recorded for the storage
+-- quota. NULL is the default workspace.
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS workspace_id VARCHAR(50);
+
+DROP FUNCTION IF EXISTS register_chunk(TEXT, INT, TEXT);
+CREATE OR REPLACE FUNCTION register_chunk(p_id TEXT, p_size INT, p_link TEXT, p_workspace TEXT DEFAULT NULL)
+RETURNS TEXT
+LANGUAGE sql AS $$
+    INSERT INTO chunks (id, size, link, ref_count, workspace_id)
+    VALUES (p_id, p_size, p_link, 1, p_workspace)
+    ON CONFLICT (id) DO UPDATE
+       SET ref_count = chunks.ref_count + 1,
+           released_at = NULL
+    RETURNING link;
+$$;
+
+ALTER TABLE public.workspaces ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.workspace_members ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.workspaces FROM anon, authenticated;
+REVOKE ALL ON public.workspace_members FROM anon, authenticated;
+GRANT EXECUTE ON FUNCTION workspace_role(TEXT) TO anon, authenticated;
+GRANT EXECUTE ON FUNCTION folder_in_workspace(TEXT, TEXT) TO anon, authenticated;
+REVOKE EXECUTE ON FUNCTION check_folder_target(TEXT, TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION copy_folder(TEXT, TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION register_chunk(TEXT, INT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
@@ -0,0 +1,109 @@
+-- Access lists (see lib/acl). An entry gives one user deny, read or write
+-- access to a file, or to a folder and everything under it, whatever their
+-- workspace role. The nearest entry up the parent_id chain wins, so a
+-- write grant on a subfolder works inside a read-only folder, and a deny
+-- hides a folder from an editor. Without an entry the workspace role
+-- applies; owners are never restricted. Someone with entries but no
+-- membership is a guest of the workspace and sees only what they were
+-- given.
+CREATE TABLE IF NOT EXISTS acl_entries (
+    id VARCHAR(50) PRIMARY KEY,
+    workspace_id VARCHAR(50) NOT NULL REFERENCES workspaces(id) ON DELETE CASCADE,
+    file_id VARCHAR(50) REFERENCES files(id) ON DELETE CASCADE,
+    folder_id VARCHAR(50) REFERENCES folders(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL,
+    access VARCHAR(10) NOT NULL CHECK (access IN ('deny', 'read', 'write')),
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    CHECK ((file_id IS NULL) <> (folder_id IS NULL)),
+    UNIQUE (file_id, user_id),
+    UNIQUE (folder_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS acl_entries_user_idx ON acl_entries (user_id, workspace_id);
+
+-- What p_user may do with file p_file, or folder p_folder when p_file is
+-- NULL, given their workspace role p_role: 'write', 'read', 'deny' or NULL
+-- for nothing. A file's folder is looked up unless p_folder gives it.
+CREATE OR REPLACE FUNCTION acl_access(p_user UUID, p_file TEXT, p_folder TEXT, p_role TEXT)
+RETURNS TEXT
+LANGUAGE plpgsql STABLE
+SECURITY DEFINER
+SET search_path = public AS $$
+DECLARE
+    v_access TEXT;
+    v_folder TEXT := p_folder;
+BEGIN
+    IF p_role = 'owner' THEN
+        RETURN 'write';
+    END IF;
+    IF p_user IS NOT NULL AND EXISTS (SELECT 1 FROM acl_entries WHERE user_id = p_user) THEN
+        IF p_file IS NOT NULL THEN
+            SELECT access INTO v_access FROM acl_entries WHERE file_id = p_file AND user_id = p_user;
+            IF FOUND THEN
+                RETURN v_access;
+            END IF;
+            IF v_folder IS NULL THEN
+                SELECT folder_id INTO v_folder FROM files WHERE id = p_file;
+            END IF;
+        END IF;
+        WITH RECURSIVE chain AS (
+            SELECT id, parent_id, 0 AS depth FROM folders WHERE id = v_folder
+            UNION ALL
+            SELECT f.id, f.parent_id, c.depth + 1
+              FROM folders f
+              JOIN chain c ON f.id = c.parent_id
+             WHERE c.depth < 100
+        )
+        SELECT a.access INTO v_access
+          FROM chain c
+          JOIN acl_entries a ON a.folder_id = c.id AND a.user_id = p_user
+         ORDER BY c.depth
+         LIMIT 1;
+        IF FOUND THEN
+            RETURN v_access;
+        END IF;
+    END IF;
+    RETURN CASE p_role WHEN 'editor' THEN 'write' WHEN 'viewer' THEN 'read' END;
+END;
+$$;
+
+-- 012_workspaces.sql's policies again, with the access list on top: the
+-- browser only gets rows the user may read, and only changes rows the
+-- user may write, in folders the user may write.
+DROP POLICY IF EXISTS files_select ON files;
+CREATE POLICY files_select ON files FOR SELECT
+    USING (acl_access(auth.uid(), id, folder_id, workspace_role(workspace_id)) IN ('read', 'write'));
+DROP POLICY IF EXISTS files_insert ON files;
+CREATE POLICY files_insert ON files FOR INSERT
+    WITH CHECK (acl_access(auth.uid(), NULL, folder_id, workspace_role(workspace_id)) = 'write'
+                AND folder_in_workspace(folder_id, workspace_id));
+DROP POLICY IF EXISTS files_update ON files;
+CREATE POLICY files_update ON files FOR UPDATE
+    USING (acl_access(auth.uid(), id, folder_id, workspace_role(workspace_id)) = 'write')
+    WITH CHECK (acl_access(auth.uid(), id, folder_id, workspace_role(workspace_id)) = 'write'
+                AND acl_access(auth.uid(), NULL, folder_id, workspace_role(workspace_id)) = 'write'
+                AND folder_in_workspace(folder_id, workspace_id));
+DROP POLICY IF EXISTS files_delete ON files;
+CREATE POLICY files_delete ON files FOR DELETE
+    USING (acl_access(auth.uid(), id, folder_id, workspace_role(workspace_id)) = 'write');
+
+DROP POLICY IF EXISTS folders_select ON folders;
+CREATE POLICY folders_select ON folders FOR SELECT
+    USING (acl_access(auth.uid(), NULL, id, workspace_role(workspace_id)) IN ('read', 'write'));
+DROP POLICY IF EXISTS folders_insert ON folders;
+CREATE POLICY folders_insert ON folders FOR INSERT
+    WITH CHECK (acl_access(auth.uid(), NULL, parent_id, workspace_role(workspace_id)) = 'write'
+                AND folder_in_workspace(parent_id, workspace_id));
+DROP POLICY IF EXISTS folders_update ON folders;
+CREATE POLICY folders_update ON folders FOR UPDATE
+    USING (acl_access(auth.uid(), NULL, id, workspace_role(workspace_id)) = 'write')
+    WITH CHECK (acl_access(auth.uid(), NULL, id, workspace_role(workspace_id)) = 'write'
+                AND acl_access(auth.uid(), NULL, parent_id, workspace_role(workspace_id)) = 'write'
+                AND folder_in_workspace(parent_id, workspace_id));
+DROP POLICY IF EXISTS folders_delete ON folders;
+CREATE POLICY folders_delete ON folders FOR DELETE
+    USING (acl_access(auth.uid(), NULL, id, workspace_role(workspace_id)) = 'write');
+
+ALTER TABLE public.acl_entries ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.acl_entries FROM anon, authenticated;
+GRANT EXECUTE ON FUNCTION acl_access(UUID, TEXT, TEXT, TEXT) TO anon, authenticated;
@@ -0,0 +1,93 @@
+-- Search over file and folder names (see lib/search). Needs 013_acl.sql.
+--
+-- Names are split into words at spaces, dots, dashes and underscores for
+-- full-text matching, so "q3-report_final.pdf" matches "report". Trigram
+-- indexes make substring matches and, on request, misspelled words fast
+-- enough for large drives.
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS name_words TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('simple', translate(name, '._-', '   '))) STORED;
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS name_words TSVECTOR
+    GENERATED ALWAYS AS (to_tsvector('simple', translate(name, '._-', '   '))) STORED;
+
+CREATE INDEX IF NOT EXISTS files_name_words_idx ON files USING GIN (name_words);
+CREATE INDEX IF NOT EXISTS folders_name_words_idx ON folders USING GIN (name_words);
+CREATE INDEX IF NOT EXISTS files_name_trgm_idx ON files USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS folders_name_trgm_idx ON folders USING GIN (name gin_trgm_ops);
+
+-- One page of files and folders in p_workspace (NULL for all) that p_user,
+-- with role p_role, may read, best matches first. Every filter is optional:
+--
+--   p_query         words or part of a name; NULL matches everything
+--   p_fuzzy         also match names within a typo or two of p_query
+--   p_folder        only below this folder
+--   p_mime, p_type  MIME type prefix and files.type
+--   p_min_size, p_max_size, p_after, p_before
+--                   size in bytes and modification time, both inclusive
+--
+-- Folders are only returned when no file-only filter (MIME type, type or
+-- size) is set. total is the number of matches on all pages.
+CREATE OR REPLACE FUNCTION search_drive(
+    p_workspace TEXT, p_user UUID, p_role TEXT,
+    p_query TEXT, p_fuzzy BOOLEAN, p_folder TEXT,
+    p_mime TEXT, p_type TEXT, p_min_size BIGINT, p_max_size BIGINT,
+    p_after TIMESTAMPTZ, p_before TIMESTAMPTZ,
+    p_limit INT, p_offset INT)
+RETURNS TABLE (
+    kind TEXT, id VARCHAR, name VARCHAR, parent_id VARCHAR, size BIGINT,
+    mime VARCHAR, type VARCHAR, updated_at TIMESTAMPTZ, rank REAL, total BIGINT)
+LANGUAGE sql STABLE AS $$
+    WITH q AS (
+        SELECT t AS text,
+               websearch_to_tsquery('simple', translate(t, '._-', '   ')) AS words,
+               '%' || replace(replace(replace(t, '\', '\\'), '%', '\%'), '_', '\_') || '%' AS pattern
+          FROM (SELECT NULLIF(btrim(p_query), '') AS t) s
+    ),
+    below AS (
+        SELECT p_folder AS id WHERE p_folder IS NOT NULL
+        UNION ALL
+        SELECT folder_subtree(p_folder) WHERE p_folder IS NOT NULL
+    ),
+    hits AS (
+        SELECT 'file'::TEXT AS kind, f.id, f.name, f.folder_id AS parent_id, f.size, f.mime, f.type, f.updated_at,
+               CASE WHEN q.text IS NULL THEN 0
+                    ELSE ts_rank(f.name_words, q.words) + similarity(f.name, q.text) END::REAL AS rank
+          FROM files f, q
+         WHERE f.deleted_at IS NULL
+           AND (p_workspace IS NULL OR f.workspace_id = p_workspace)
+           AND (q.text IS NULL OR f.name_words @@ q.words OR f.name ILIKE q.pattern
+                OR (p_fuzzy AND word_similarity(q.text, f.name) >= 0.4))
+           AND (p_folder IS NULL OR f.folder_id IN (SELECT id FROM below))
+           AND (p_mime IS NULL OR f.mime LIKE replace(replace(p_mime, '%', '\%'), '_', '\_') || '%')
+           AND (p_type IS NULL OR f.type = p_type)
+           AND (p_min_size IS NULL OR f.size >= p_min_size)
+           AND (p_max_size IS NULL OR f.size <= p_max_size)
+           AND (p_after IS NULL OR f.updated_at >= p_after)
+           AND (p_before IS NULL OR f.updated_at <= p_before)
+           AND acl_access(p_user, f.id, f.folder_id, p_role) IN ('read', 'write')
+        UNION ALL
+        SELECT 'folder'::TEXT, d.id, d.name, d.parent_id, NULL, NULL, NULL, d.updated_at,
+               CASE WHEN q.text IS NULL THEN 0
+                    ELSE ts_rank(d.name_words, q.words) + similarity(d.name, q.text) END::REAL
+          FROM folders d, q
+         WHERE p_mime IS NULL AND p_type IS NULL AND p_min_size IS NULL AND p_max_size IS NULL
+           AND d.deleted_at IS NULL
+           AND (p_workspace IS NULL OR d.workspace_id = p_workspace)
+           AND (q.text IS NULL OR d.name_words @@ q.words OR d.name ILIKE q.pattern
+                OR (p_fuzzy AND word_similarity(q.text, d.name) >= 0.4))
+           AND (p_folder IS NULL OR d.id IN (SELECT folder_subtree(p_folder)))
+           AND (p_after IS NULL OR d.updated_at >= p_after)
+           AND (p_before IS NULL OR d.updated_at <= p_before)
+           AND acl_access(p_user, NULL, d.id, p_role) IN ('read', 'write')
+    )
+    SELECT h.kind, h.id, h.name, h.parent_id, h.size, h.mime, h.type, h.updated_at, h.rank,
+           count(*) OVER () AS total
+      FROM hits h
+     ORDER BY h.rank DESC, h.kind DESC, lower(h.name), h.id
+     LIMIT p_limit OFFSET p_offset;
+$$;
+
+-- Called by the server only; the browser goes through /api/search.
+REVOKE EXECUTE ON FUNCTION search_drive(TEXT, UUID, TEXT, TEXT, BOOLEAN, TEXT, TEXT, TEXT, BIGINT, BIGINT, TIMESTAMPTZ, TIMESTAMPTZ, INT, INT)
+    FROM anon, authenticated, PUBLIC;
@@ -0,0 +1,171 @@
+-- Tags and metadata on files and folders (see lib/tags). Needs
+-- 014_search.sql.
+--
+-- Tags are lowercase labels; metadata is a flat object of string keys and
+-- values, such as {"project": "apollo", "release": "2.4"}. /api/tags
+-- changes both and keeps them in that shape.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'
+    CHECK (jsonb_typeof(metadata) = 'object');
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE folders ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}'
+    CHECK (jsonb_typeof(metadata) = 'object');
+
+CREATE INDEX IF NOT EXISTS files_tags_idx ON files USING GIN (tags);
+CREATE INDEX IF NOT EXISTS files_metadata_idx ON files USING GIN (metadata jsonb_path_ops);
+CREATE INDEX IF NOT EXISTS folders_tags_idx ON folders USING GIN (tags);
+CREATE INDEX IF NOT EXISTS folders_metadata_idx ON folders USING GIN (metadata jsonb_path_ops);
+
+-- 012_workspaces.sql's copy_folder again; copies keep their tags and
+-- metadata.
+CREATE OR REPLACE FUNCTION copy_folder(p_id TEXT, p_parent TEXT, p_name TEXT, p_base TEXT)
+RETURNS TEXT
+LANGUAGE plpgsql AS $$
+DECLARE
+    new_root TEXT;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('teddrive_folder_tree'));
+    PERFORM check_folder_target(p_id, p_parent, p_name, NULL);
+
+    CREATE TEMP TABLE folder_copy ON COMMIT DROP AS
+    SELECT id AS old_id, p_base || '-' || row_number() OVER (ORDER BY id) AS new_id
+      FROM (SELECT p_id::VARCHAR AS id UNION SELECT folder_subtree(p_id)) s;
+
+    SELECT new_id INTO new_root FROM folder_copy WHERE old_id = p_id;
+
+    INSERT INTO folders (id, name, parent_id, created, is_public, workspace_id, tags, metadata)
+    SELECT m.new_id,
+           CASE WHEN f.id = p_id THEN p_name ELSE f.name END,
+           CASE WHEN f.id = p_id THEN p_parent ELSE pm.new_id END,
+           to_char(NOW(), 'FMMM/FMDD/YYYY'),
+           f.is_public,
+           f.workspace_id,
+           f.tags,
+           f.metadata
+      FROM folders f
+      JOIN folder_copy m ON m.old_id = f.id
+      LEFT JOIN folder_copy pm ON pm.old_id = f.parent_id;
+
+    WITH copied AS (
+        INSERT INTO files (id, name, size, type, mime, date, folder_id,
+                           meta_key, meta_links, meta_provider, sha256, is_public, workspace_id,
+                           tags, metadata)
+        SELECT p_base || '-f' || row_number() OVER (ORDER BY f.id),
+               f.name, f.size, f.type, f.mime, f.date, m.new_id,
+               f.meta_key, f.meta_links, f.meta_provider, f.sha256, f.is_public, f.workspace_id,
+               f.tags, f.metadata
+          FROM files f
+          JOIN folder_copy m ON m.old_id = f.folder_id
+         WHERE f.deleted_at IS NULL
+        RETURNING id, meta_links, meta_provider
+    )
+    UPDATE chunks c
+       SET ref_count = c.ref_count + r.n,
+           released_at = NULL
+      FROM (
+          SELECT chunk_id, COUNT(*) AS n
+            FROM (
+                SELECT DISTINCT cp.id, w.ord, x.chunk_id
+                  FROM copied cp,
+                       jsonb_array_elements_text(cp.meta_links::jsonb) WITH ORDINALITY AS w(link, ord),
+                       jsonb_array_elements_text(w.link::jsonb -> 'cdc') AS x(chunk_id)
+                 WHERE cp.meta_provider = 'dedup'
+            ) refs
+           GROUP BY chunk_id
+      ) r
+     WHERE c.id = r.chunk_id;
+
+    RETURN new_root;
+END;
+$$;
+
+-- 014_search.sql's search_drive again, with tag and metadata filters, and
+-- both in the results. The filters come last and may be left out, so the
+-- server calls it the same way with or without this migration.
+DROP FUNCTION IF EXISTS search_drive(TEXT, UUID, TEXT, TEXT, BOOLEAN, TEXT, TEXT, TEXT, BIGINT, BIGINT, TIMESTAMPTZ, TIMESTAMPTZ, INT, INT);
+
+-- One page of files and folders in p_workspace (NULL for all) that p_user,
+-- with role p_role, may read, best matches first. Every filter is optional:
+--
+--   p_query         words or part of a name; NULL matches everything
+--   p_fuzzy         also match names within a typo or two of p_query
+--   p_folder        only below this folder
+--   p_mime, p_type  MIME type prefix and files.type
+--   p_min_size, p_max_size, p_after, p_before
+--                   size in bytes and modification time, both inclusive
+--   p_tags          every one of these tags
+--   p_metadata      every one of these metadata keys with its value
+--
+-- Folders are only returned when no file-only filter (MIME type, type or
+-- size) is set. total is the number of matches on all pages.
+CREATE OR REPLACE FUNCTION search_drive(
+    p_workspace TEXT, p_user UUID, p_role TEXT,
+    p_query TEXT, p_fuzzy BOOLEAN, p_folder TEXT,
+    p_mime TEXT, p_type TEXT, p_min_size BIGINT, p_max_size BIGINT,
+    p_after TIMESTAMPTZ, p_before TIMESTAMPTZ,
+    p_limit INT, p_offset INT,
+    p_tags TEXT[] DEFAULT NULL, p_metadata JSONB DEFAULT NULL)
+RETURNS TABLE (
+    kind TEXT, id VARCHAR, name VARCHAR, parent_id VARCHAR, size BIGINT,
+    mime VARCHAR, type VARCHAR, updated_at TIMESTAMPTZ, tags TEXT[], metadata JSONB,
+    rank REAL, total BIGINT)
+LANGUAGE sql STABLE AS $$
+    WITH q AS (
+        SELECT t AS text,
+               websearch_to_tsquery('simple', translate(t, '._-', '   ')) AS words,
+               '%' || replace(replace(replace(t, '\', '\\'), '%', '\%'), '_', '\_') || '%' AS pattern
+          FROM (SELECT NULLIF(btrim(p_query), '') AS t) s
+    ),
+    below AS (
+        SELECT p_folder AS id WHERE p_folder IS NOT NULL
+        UNION ALL
+        SELECT folder_subtree(p_folder) WHERE p_folder IS NOT NULL
+    ),
+    hits AS (
+        SELECT 'file'::TEXT AS kind, f.id, f.name, f.folder_id AS parent_id, f.size, f.mime, f.type, f.updated_at,
+               f.tags, f.metadata,
+               CASE WHEN q.text IS NULL THEN 0
+                    ELSE ts_rank(f.name_words, q.words) + similarity(f.name, q.text) END::REAL AS rank
+          FROM files f, q
+         WHERE f.deleted_at IS NULL
+           AND (p_workspace IS NULL OR f.workspace_id = p_workspace)
+           AND (q.text IS NULL OR f.name_words @@ q.words OR f.name ILIKE q.pattern
+                OR (p_fuzzy AND word_similarity(q.text, f.name) >= 0.4))
+           AND (p_folder IS NULL OR f.folder_id IN (SELECT id FROM below))
+           AND (p_mime IS NULL OR f.mime LIKE replace(replace(p_mime, '%', '\%'), '_', '\_') || '%')
+           AND (p_type IS NULL OR f.type = p_type)
+           AND (p_min_size IS NULL OR f.size >= p_min_size)
+           AND (p_max_size IS NULL OR f.size <= p_max_size)
+           AND (p_after IS NULL OR f.updated_at >= p_after)
+           AND (p_before IS NULL OR f.updated_at <= p_before)
+           AND (p_tags IS NULL OR f.tags @> p_tags)
+           AND (p_metadata IS NULL OR f.metadata @> p_metadata)
+           AND acl_access(p_user, f.id, f.folder_id, p_role) IN ('read', 'write')
+        UNION ALL
+        SELECT 'folder'::TEXT, d.id, d.name, d.parent_id, NULL, NULL, NULL, d.updated_at,
+               d.tags, d.metadata,
+               CASE WHEN q.text IS NULL THEN 0
+                    ELSE ts_rank(d.name_words, q.words) + similarity(d.name, q.text) END::REAL
+          FROM folders d, q
+         WHERE p_mime IS NULL AND p_type IS NULL AND p_min_size IS NULL AND p_max_size IS NULL
+           AND d.deleted_at IS NULL
+           AND (p_workspace IS NULL OR d.workspace_id = p_workspace)
+           AND (q.text IS NULL OR d.name_words @@ q.words OR d.name ILIKE q.pattern
+                OR (p_fuzzy AND word_similarity(q.text, d.name) >= 0.4))
+           AND (p_folder IS NULL OR d.id IN (SELECT folder_subtree(p_folder)))
+           AND (p_after IS NULL OR d.updated_at >= p_after)
+           AND (p_before IS NULL OR d.updated_at <= p_before)
+           AND (p_tags IS NULL OR d.tags @> p_tags)
+           AND (p_metadata IS NULL OR d.metadata @> p_metadata)
+           AND acl_access(p_user, NULL, d.id, p_role) IN ('read', 'write')
+    )
+    SELECT h.kind, h.id, h.name, h.parent_id, h.size, h.mime, h.type, h.updated_at, h.tags, h.metadata, h.rank,
+           count(*) OVER () AS total
+      FROM hits h
+     ORDER BY h.rank DESC, h.kind DESC, lower(h.name), h.id
+     LIMIT p_limit OFFSET p_offset;
+$$;
+
+REVOKE EXECUTE ON FUNCTION copy_folder(TEXT, TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
+REVOKE EXECUTE ON FUNCTION search_drive(TEXT, UUID, TEXT, TEXT, BOOLEAN, TEXT, TEXT, TEXT, BIGINT, BIGINT, TIMESTAMPTZ, TIMESTAMPTZ, INT, INT, TEXT[], JSONB)
+    FROM anon, authenticated, PUBLIC;
@@ -0,0 +1,27 @@
+-- Previews of files (see lib/preview): thumbnails of images and PDFs and
+-- waveforms of audio, stored encrypted like small files of their own. The
+-- column holds their key and chunk links, and the meta_key of the content
+-- they were made from, so a changed file gets a new one:
+--
+--   {"source": "...", "mime": "image/jpeg", "size": 14210,
+--    "key": "...", "links": "[...]", "provider": "discord"}
+--
+-- A file without a preview has only "source".
+ALTER TABLE files ADD COLUMN IF NOT EXISTS preview JSONB;
+
+-- Storing a preview is not a change to the file: keep updated_at (from
+-- 007_updated_at.sql) as it was, so sync and WebDAV clients do not see a
+-- new version.
+CREATE OR REPLACE FUNCTION touch_updated_at()
+RETURNS TRIGGER
+LANGUAGE plpgsql AS $$
+BEGIN
+    IF TG_TABLE_NAME = 'files'
+       AND to_jsonb(NEW) - 'preview' - 'updated_at' = to_jsonb(OLD) - 'preview' - 'updated_at' THEN
+        NEW.updated_at = OLD.updated_at;
+    ELSE
+        NEW.updated_at = NOW();
+    END IF;
+    RETURN NEW;
+END;
+$$;
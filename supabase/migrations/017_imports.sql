@@ -0,0 +1,35 @@
+-- Imports from URLs (see lib/imports): the server downloads a file and
+-- stores it like an upload. The job keeps the state of the file being
+-- written after every chunk, so an import that stopped carries on from
+-- there:
+--
+--   {"key": "...", "links": ["..."], "size": 16777216, "sum": "..."}
+--
+-- state holds the file's key until the file row exists.
+CREATE TABLE IF NOT EXISTS imports (
+    id VARCHAR(50) PRIMARY KEY,
+    workspace_id VARCHAR(50) NOT NULL DEFAULT 'default' REFERENCES workspaces(id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL DEFAULT '',
+    url TEXT NOT NULL,
+    name TEXT NOT NULL DEFAULT '',
+    mime TEXT NOT NULL DEFAULT '',
+    folder_id VARCHAR(50) REFERENCES folders(id) ON DELETE SET NULL,
+    provider VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    size BIGINT,
+    done_bytes BIGINT NOT NULL DEFAULT 0,
+    etag TEXT NOT NULL DEFAULT '',
+    state JSONB,
+    file_id VARCHAR(50),
+    error TEXT NOT NULL DEFAULT '',
+    claimed_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ DEFAULT NOW(),
+    updated_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS imports_user_idx ON imports (workspace_id, user_id, created_at);
+CREATE INDEX IF NOT EXISTS imports_status_idx ON imports (status, created_at);
+
+-- Jobs hold file keys, so keep them away from the browser's anon key.
+ALTER TABLE public.imports ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.imports FROM anon, authenticated;
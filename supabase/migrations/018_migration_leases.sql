@@ -0,0 +1,4 @@
+-- A worker holds a provider migration job (see lib/migrate) until
+-- claimed_until, so two workers never copy the same file's chunks at once.
+-- A worker that is cut off lets go when the time runs out.
+ALTER TABLE migrations ADD COLUMN IF NOT EXISTS claimed_until TIMESTAMPTZ;
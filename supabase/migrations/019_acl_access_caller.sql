@@ -0,0 +1,54 @@
+-- acl_access (013_acl.sql) takes the user and role as arguments, so the
+-- browser must not call it: anyone could ask about another user, or claim
+-- to be an owner, and learn what the access list holds. The server, which
+-- checks both first, keeps it; the policies use caller_access, which takes
+-- them from the signed-in user.
+
+-- What the signed-in user may do with file p_file, or folder p_folder when
+-- p_file is NULL, in workspace p_workspace: acl_access with auth.uid() and
+-- their workspace role.
+CREATE OR REPLACE FUNCTION caller_access(p_file TEXT, p_folder TEXT, p_workspace TEXT)
+RETURNS TEXT
+LANGUAGE sql STABLE
+SECURITY DEFINER
+SET search_path = public AS $$
+    SELECT acl_access(auth.uid(), p_file, p_folder, workspace_role(p_workspace));
+$$;
+
+DROP POLICY IF EXISTS files_select ON files;
+CREATE POLICY files_select ON files FOR SELECT
+    USING (caller_access(id, folder_id, workspace_id) IN ('read', 'write'));
+DROP POLICY IF EXISTS files_insert ON files;
+CREATE POLICY files_insert ON files FOR INSERT
+    WITH CHECK (caller_access(NULL, folder_id, workspace_id) = 'write'
+                AND folder_in_workspace(folder_id, workspace_id));
+DROP POLICY IF EXISTS files_update ON files;
+CREATE POLICY files_update ON files FOR UPDATE
+    USING (caller_access(id, folder_id, workspace_id) = 'write')
+    WITH CHECK (caller_access(id, folder_id, workspace_id) = 'write'
+                AND caller_access(NULL, folder_id, workspace_id) = 'write'
+                AND folder_in_workspace(folder_id, workspace_id));
+DROP POLICY IF EXISTS files_delete ON files;
+CREATE POLICY files_delete ON files FOR DELETE
+    USING (caller_access(id, folder_id, workspace_id) = 'write');
+
+DROP POLICY IF EXISTS folders_select ON folders;
+CREATE POLICY folders_select ON folders FOR SELECT
+    USING (caller_access(NULL, id, workspace_id) IN ('read', 'write'));
+DROP POLICY IF EXISTS folders_insert ON folders;
+CREATE POLICY folders_insert ON folders FOR INSERT
+    WITH CHECK (caller_access(NULL, parent_id, workspace_id) = 'write'
+                AND folder_in_workspace(parent_id, workspace_id));
+DROP POLICY IF EXISTS folders_update ON folders;
+CREATE POLICY folders_update ON folders FOR UPDATE
+    USING (caller_access(NULL, id, workspace_id) = 'write')
+    WITH CHECK (caller_access(NULL, id, workspace_id) = 'write'
+                AND caller_access(NULL, parent_id, workspace_id) = 'write'
+                AND folder_in_workspace(parent_id, workspace_id));
+DROP POLICY IF EXISTS folders_delete ON folders;
+CREATE POLICY folders_delete ON folders FOR DELETE
+    USING (caller_access(NULL, id, workspace_id) = 'write');
+
+-- Called by the server, and by the functions above, only.
+REVOKE EXECUTE ON FUNCTION acl_access(UUID, TEXT, TEXT, TEXT) FROM anon, authenticated, PUBLIC;
+GRANT EXECUTE ON FUNCTION caller_access(TEXT, TEXT, TEXT) TO anon, authenticated;
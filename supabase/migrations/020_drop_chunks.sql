@@ -0,0 +1,13 @@
+-- The chunks each drop link has put into a file (see lib/drop). A chunk
+-- receipt is good for one file only: finishing a file claims its chunks
+-- here first, so sending the same receipts again cannot add more files.
+CREATE TABLE IF NOT EXISTS drop_chunks (
+    link TEXT PRIMARY KEY,
+    drop_id VARCHAR(50) NOT NULL REFERENCES drops(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS drop_chunks_drop_idx ON drop_chunks (drop_id);
+
+ALTER TABLE public.drop_chunks ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.drop_chunks FROM anon, authenticated;
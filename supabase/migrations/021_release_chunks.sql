@@ -0,0 +1,14 @@
+-- Give back one reference on each chunk, for uploads that took references
+-- with claim_chunks or register_chunk but never made it into a files row
+-- (see lib/dedup). Chunks left with none can be collected after the grace
+-- period, as if their file had been deleted.
+CREATE OR REPLACE FUNCTION release_chunks(p_ids TEXT[])
+RETURNS VOID
+LANGUAGE sql AS $$
+    UPDATE chunks
+       SET ref_count = ref_count - 1,
+           released_at = CASE WHEN ref_count - 1 <= 0 THEN NOW() ELSE released_at END
+     WHERE id = ANY(p_ids);
+$$;
+
+REVOKE EXECUTE ON FUNCTION release_chunks(TEXT[]) FROM anon, authenticated, PUBLIC;
@@ -0,0 +1,36 @@
+-- files.meta_key decrypts the file, and until now anyone who could list a
+-- file with the anon key could read it. Take the column away from the
+-- browser's roles and hand keys out one file at a time through file_key,
+-- which checks the caller's access first. The server uses the service role
+-- and keeps reading the column directly.
+--
+-- Column grants do not cover columns added later: a migration that adds a
+-- column the browser should see must grant SELECT on it as well.
+
+REVOKE SELECT ON files FROM anon, authenticated;
+
+DO $$
+DECLARE
+    col TEXT;
+BEGIN
+    FOR col IN
+        SELECT column_name FROM information_schema.columns
+         WHERE table_schema = 'public' AND table_name = 'files' AND column_name <> 'meta_key'
+    LOOP
+        EXECUTE format('GRANT SELECT (%I) ON files TO anon, authenticated', col);
+    END LOOP;
+END $$;
+
+-- The key of file p_id, or NULL when the signed-in user may not read it.
+CREATE OR REPLACE FUNCTION file_key(p_id TEXT)
+RETURNS TEXT
+LANGUAGE sql STABLE
+SECURITY DEFINER
+SET search_path = public AS $$
+    SELECT meta_key FROM files
+     WHERE id = p_id
+       AND caller_access(id, folder_id, workspace_id) IN ('read', 'write');
+$$;
+
+REVOKE EXECUTE ON FUNCTION file_key(TEXT) FROM PUBLIC;
+GRANT EXECUTE ON FUNCTION file_key(TEXT) TO anon, authenticated;
@@ -0,0 +1,13 @@
+-- The message behind every Discord upload, like telegram_messages
+-- (009_trash.sql). An attachment URL names its channel but not its message,
+-- and searching the channel for it can miss, which used to leave the
+-- message on Discord while its file was purged.
+CREATE TABLE IF NOT EXISTS discord_messages (
+    url TEXT PRIMARY KEY,
+    channel_id TEXT NOT NULL,
+    message_id TEXT NOT NULL,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+ALTER TABLE public.discord_messages ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.discord_messages FROM anon, authenticated;
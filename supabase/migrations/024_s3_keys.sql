@@ -0,0 +1,17 @@
+-- Access keys for the S3 gateway (teddrive s3). Each key is an API token
+-- for one user in one workspace: requests signed with it get that user's
+-- role and access list there, as their browser session would. SigV4 signs
+-- with the secret itself, so it is stored as it is and only the service
+-- role can read the table.
+CREATE TABLE IF NOT EXISTS s3_keys (
+    access_key TEXT PRIMARY KEY,
+    secret TEXT NOT NULL,
+    user_id UUID NOT NULL,
+    workspace_id VARCHAR(50) NOT NULL DEFAULT 'default' REFERENCES workspaces(id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS s3_keys_user_idx ON s3_keys (user_id);
+
+ALTER TABLE public.s3_keys ENABLE ROW LEVEL SECURITY;
+REVOKE ALL ON public.s3_keys FROM anon, authenticated;